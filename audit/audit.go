@@ -34,6 +34,8 @@ type AuditLog struct {
 	RequestBody       string
 	RequestHeader     map[string][]string
 	Description       string
+	Decision          string // Authorization decision such as Allowed, Unauthenticated or Forbidden. Empty if not recorded.
+	RealUserName      string // The user acting as UserName during impersonation. Empty otherwise.
 }
 
 var descriptionMap map[string]string = make(map[string]string)
@@ -67,6 +69,8 @@ func CreateAuditLog(component string, path string, userName string, remoteAddres
 		requestBody,
 		requestHeader,
 		getDescriptionFromMethodAndPath(requestMethod, path),
+		"",
+		"",
 	}
 }
 
@@ -0,0 +1,371 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBadCredentials = errors.New("User name or password is incorrect")
+	ErrDisabled       = errors.New("User is disabled")
+	ErrExpired        = errors.New("User is expired")
+	ErrLocked         = errors.New("Too many failed logins, try again later")
+	// The password is verified but older than the maximum age of the password policy. The password should be changed with User.ChangePassword.
+	ErrPasswordExpired = errors.New("Password is expired")
+	// The password is verified but the user must pass the second factor with AuthenticateWithSecondFactor
+	ErrSecondFactorRequired    = errors.New("Second factor is required")
+	ErrSecondFactorNotEnrolled = errors.New("Second factor is required but not enrolled")
+	ErrBadSecondFactor         = errors.New("Second factor code is incorrect")
+)
+
+type AuthenticatorConfiguration struct {
+	MaxFailure         int           // Consecutive failures before locking. 0 disables the lockout.
+	LockoutDuration    time.Duration // Doubled for every further lockout
+	MaxLockoutDuration time.Duration // 0 for no maximum. The lockout is never shorter than LockoutDuration.
+	TokenTTL           time.Duration
+}
+
+// Find the user by name. Return nil without error if the user doesn't exist.
+type UserFinder func(name string) (*User, error)
+
+// Failure records are checked for removal in this interval
+const failureRecordPruneInterval = time.Minute
+
+// Minimum time a failure record is kept after the last failure and the end of the lock
+const failureRecordRetention = time.Hour
+
+type failureRecord struct {
+	consecutiveFailure int
+	lockoutCount       int
+	lockedUntil        time.Time
+	lastFailureTime    time.Time
+	pendingAttempt     int // Attempts in progress. They count as failures until finished so the concurrent attempts couldn't exceed MaxFailure.
+}
+
+// Authenticator checks the password, the disabled flag and the expiry, then issues a token into the token cache.
+// Consecutive failures are tracked per user name and per source address separately, and either one could be locked.
+// A success clears the failures of the user but not the ones of the address.
+type Authenticator struct {
+	configuration AuthenticatorConfiguration
+	userFinder    UserFinder
+	tokenCache    TokenCache
+	// Optional. Called with a rehashed copy of the user on login so the user could be persisted. The user found is left unchanged.
+	PasswordUpgradeHandler func(user *User)
+	// Optional. Called after the second factor is verified so the used time step or the consumed recovery code could be persisted.
+	SecondFactorUpdateHandler func(user *User)
+	// Optional. Issue the tokens as the sessions so they could be listed and revoked. The token cache of the session manager is used instead.
+	SessionManager *SessionManager
+	failureMap     map[string]*failureRecord
+	lastPruneTime  time.Time
+	mutex          sync.Mutex
+	now            func() time.Time
+}
+
+// The token cache is the default one if nil
+func CreateAuthenticator(userFinder UserFinder, tokenCache TokenCache, configuration AuthenticatorConfiguration) *Authenticator {
+	return &Authenticator{
+		configuration: configuration,
+		userFinder:    userFinder,
+		tokenCache:    tokenCache,
+		failureMap:    make(map[string]*failureRecord),
+		now:           time.Now,
+	}
+}
+
+func (authenticator *Authenticator) getTokenCache() TokenCache {
+	if authenticator.tokenCache != nil {
+		return authenticator.tokenCache
+	}
+	return GetDefaultTokenCache()
+}
+
+func getUserFailureKey(name string) string {
+	return "user " + name
+}
+
+// The key of the user is the first
+func getFailureKeySlice(name string, remoteAddress string) []string {
+	host, _, err := net.SplitHostPort(remoteAddress)
+	if err != nil {
+		host = remoteAddress
+	}
+	keySlice := []string{getUserFailureKey(name)}
+	if host != "" {
+		keySlice = append(keySlice, "address "+host)
+	}
+	return keySlice
+}
+
+// Verify the credentials and issue a token with the configured TTL.
+// The disabled flag and the expiry are only disclosed after the password is verified.
+// ErrSecondFactorRequired is returned without a token if the user requires the second factor.
+func (authenticator *Authenticator) Authenticate(name string, password string, remoteAddress string) (string, *User, error) {
+	return authenticator.authenticate(name, password, nil, remoteAddress)
+}
+
+// Same as Authenticate with the TOTP code or a recovery code. A wrong code counts as a failed login.
+func (authenticator *Authenticator) AuthenticateWithSecondFactor(name string, password string, code string, remoteAddress string) (string, *User, error) {
+	return authenticator.authenticate(name, password, &code, remoteAddress)
+}
+
+func (authenticator *Authenticator) authenticate(name string, password string, code *string, remoteAddress string) (string, *User, error) {
+	keySlice := getFailureKeySlice(name, remoteAddress)
+	if authenticator.reserveAttempt(keySlice) == false {
+		return "", nil, ErrLocked
+	}
+	defer authenticator.releaseAttempt(keySlice)
+
+	user, err := authenticator.userFinder(name)
+	if err != nil {
+		log.Error(err)
+		return "", nil, err
+	}
+
+	if user == nil {
+		// Spend the same effort as a real verification so the existence of the user isn't revealed by timing
+		VerifyPassword(getDummyEncodedPassword(), password)
+		authenticator.recordFailure(keySlice)
+		return "", nil, ErrBadCredentials
+	}
+
+	matched, rehash := user.CheckPasswordWithRehash(password)
+	if matched == false {
+		authenticator.recordFailure(keySlice)
+		return "", nil, ErrBadCredentials
+	}
+
+	if user.RequiresSecondFactor() {
+		if user.HasSecondFactor() == false {
+			return "", nil, ErrSecondFactorNotEnrolled
+		}
+		if code == nil {
+			return "", nil, ErrSecondFactorRequired
+		}
+		if user.VerifySecondFactor(*code, authenticator.now()) == false {
+			authenticator.recordFailure(keySlice)
+			return "", nil, ErrBadSecondFactor
+		}
+		if authenticator.SecondFactorUpdateHandler != nil {
+			authenticator.SecondFactorUpdateHandler(user)
+		}
+	}
+	// Failures from the address are kept since they could be guesses for the other users
+	authenticator.resetFailure(getUserFailureKey(name))
+
+	if user.Disabled {
+		return "", nil, ErrDisabled
+	}
+	if user.ExpiredTime != nil && authenticator.now().After(*user.ExpiredTime) {
+		return "", nil, ErrExpired
+	}
+	if GetPasswordPolicy().IsPasswordExpired(user, authenticator.now()) {
+		return "", nil, ErrPasswordExpired
+	}
+
+	// The user could be shared such as by the token cache so the copy is rehashed
+	if rehash && authenticator.PasswordUpgradeHandler != nil {
+		upgradedUser := *user
+		if err := upgradedUser.SetPassword(password); err == nil {
+			// The password itself is unchanged so it doesn't restart the maximum age
+			upgradedUser.PasswordChangedTime = user.PasswordChangedTime
+			authenticator.PasswordUpgradeHandler(&upgradedUser)
+		}
+	}
+
+	if authenticator.SessionManager != nil {
+		token, _, err := authenticator.SessionManager.CreateSession(user, authenticator.configuration.TokenTTL, remoteAddress, "")
+		if err != nil {
+			return "", nil, err
+		}
+		return token, user, nil
+	}
+
+	token, err := GenerateToken()
+	if err != nil {
+		log.Error(err)
+		return "", nil, err
+	}
+	authenticator.getTokenCache().Set(token, user, authenticator.configuration.TokenTTL)
+
+	return token, user, nil
+}
+
+// Random opaque token for the token cache
+func GenerateToken() (string, error) {
+	return generateRandomHex(32)
+}
+
+func generateRandomHex(length int) (string, error) {
+	byteSlice := make([]byte, length)
+	if _, err := rand.Read(byteSlice); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(byteSlice), nil
+}
+
+var dummyEncodedPassword string
+var dummyEncodedPasswordOnce sync.Once
+
+func getDummyEncodedPassword() string {
+	dummyEncodedPasswordOnce.Do(func() {
+		dummyEncodedPassword, _ = EncodePassword("dummy password")
+	})
+	return dummyEncodedPassword
+}
+
+// Check the lock and reserve the attempt at once. Return false if any key is locked or has as many failures and attempts in progress as MaxFailure.
+// The reserved attempt must be released with releaseAttempt.
+func (authenticator *Authenticator) reserveAttempt(keySlice []string) bool {
+	if authenticator.configuration.MaxFailure <= 0 {
+		return true
+	}
+
+	authenticator.mutex.Lock()
+	defer authenticator.mutex.Unlock()
+
+	now := authenticator.now()
+	if now.Sub(authenticator.lastPruneTime) >= failureRecordPruneInterval {
+		authenticator.prune(now)
+	}
+
+	for _, key := range keySlice {
+		if record, ok := authenticator.failureMap[key]; ok {
+			if now.Before(record.lockedUntil) || record.consecutiveFailure+record.pendingAttempt >= authenticator.configuration.MaxFailure {
+				return false
+			}
+		}
+	}
+	for _, key := range keySlice {
+		record, ok := authenticator.failureMap[key]
+		if ok == false {
+			record = &failureRecord{}
+			authenticator.failureMap[key] = record
+		}
+		record.pendingAttempt++
+	}
+	return true
+}
+
+// The record is removed if nothing is left in it
+func (authenticator *Authenticator) releaseAttempt(keySlice []string) {
+	if authenticator.configuration.MaxFailure <= 0 {
+		return
+	}
+
+	authenticator.mutex.Lock()
+	defer authenticator.mutex.Unlock()
+
+	for _, key := range keySlice {
+		record, ok := authenticator.failureMap[key]
+		if ok == false {
+			continue
+		}
+		if record.pendingAttempt > 0 {
+			record.pendingAttempt--
+		}
+		if record.pendingAttempt == 0 && record.consecutiveFailure == 0 && record.lockoutCount == 0 && record.lastFailureTime.IsZero() {
+			delete(authenticator.failureMap, key)
+		}
+	}
+}
+
+func (authenticator *Authenticator) recordFailure(keySlice []string) {
+	if authenticator.configuration.MaxFailure <= 0 {
+		return
+	}
+
+	authenticator.mutex.Lock()
+	defer authenticator.mutex.Unlock()
+
+	now := authenticator.now()
+	for _, key := range keySlice {
+		record, ok := authenticator.failureMap[key]
+		if ok == false {
+			record = &failureRecord{}
+			authenticator.failureMap[key] = record
+		}
+		record.lastFailureTime = now
+		record.consecutiveFailure++
+		if record.consecutiveFailure >= authenticator.configuration.MaxFailure {
+			record.lockedUntil = now.Add(authenticator.configuration.getLockoutDuration(record.lockoutCount))
+			record.lockoutCount++
+			record.consecutiveFailure = 0
+		}
+	}
+}
+
+// Remove the records without lock and failure for a while so the failures of random names and addresses don't pile up.
+// The record is kept as long as its next lockout would last so a pause doesn't reset the back-off.
+func (authenticator *Authenticator) prune(now time.Time) {
+	for key, record := range authenticator.failureMap {
+		if record.pendingAttempt > 0 {
+			continue
+		}
+		retention := authenticator.configuration.getLockoutDuration(record.lockoutCount)
+		if retention < failureRecordRetention {
+			retention = failureRecordRetention
+		}
+		if now.Before(record.lockedUntil.Add(retention)) == false && now.Before(record.lastFailureTime.Add(retention)) == false {
+			delete(authenticator.failureMap, key)
+		}
+	}
+	authenticator.lastPruneTime = now
+}
+
+// Exponential back-off for every further lockout until a success. It stops doubling at the maximum or before overflowing.
+func (configuration *AuthenticatorConfiguration) getLockoutDuration(lockoutCount int) time.Duration {
+	lockoutDuration := configuration.LockoutDuration
+	for i := 0; i < lockoutCount; i++ {
+		if lockoutDuration <= 0 || lockoutDuration > math.MaxInt64/2 {
+			break
+		}
+		if configuration.MaxLockoutDuration > 0 && lockoutDuration >= configuration.MaxLockoutDuration {
+			break
+		}
+		lockoutDuration *= 2
+	}
+	if configuration.MaxLockoutDuration > configuration.LockoutDuration && lockoutDuration > configuration.MaxLockoutDuration {
+		lockoutDuration = configuration.MaxLockoutDuration
+	}
+	return lockoutDuration
+}
+
+// The attempts in progress are kept
+func (authenticator *Authenticator) resetFailure(key string) {
+	authenticator.mutex.Lock()
+	defer authenticator.mutex.Unlock()
+
+	record, ok := authenticator.failureMap[key]
+	if ok == false {
+		return
+	}
+	if record.pendingAttempt == 0 {
+		delete(authenticator.failureMap, key)
+		return
+	}
+	authenticator.failureMap[key] = &failureRecord{pendingAttempt: record.pendingAttempt}
+}
+
+// Clear the failures and the lockout of the user, such as by an administrator
+func (authenticator *Authenticator) Unlock(name string) {
+	authenticator.resetFailure(getUserFailureKey(name))
+}
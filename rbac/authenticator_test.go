@@ -0,0 +1,265 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func createTestAuthenticator(userSlice ...*User) (*Authenticator, *MemoryTokenCache, *time.Time) {
+	userMap := make(map[string]*User)
+	for _, user := range userSlice {
+		userMap[user.Name] = user
+	}
+	tokenCache := CreateMemoryTokenCache(0)
+	authenticator := CreateAuthenticator(func(name string) (*User, error) {
+		return userMap[name], nil
+	}, tokenCache, AuthenticatorConfiguration{
+		MaxFailure:         3,
+		LockoutDuration:    time.Minute,
+		MaxLockoutDuration: 3 * time.Minute,
+		TokenTTL:           time.Hour,
+	})
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	authenticator.now = func() time.Time {
+		return now
+	}
+	return authenticator, tokenCache, &now
+}
+
+func TestAuthenticate(t *testing.T) {
+	past := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	alice := createTestUser(t, "alice", testPassword, nil, nil, "", nil, nil, false)
+	disabled := createTestUser(t, "disabled", testPassword, nil, nil, "", nil, nil, true)
+	expired := createTestUser(t, "expired", testPassword, nil, nil, "", nil, &past, false)
+	authenticator, tokenCache, _ := createTestAuthenticator(alice, disabled, expired)
+
+	token, user, err := authenticator.Authenticate("alice", testPassword, "10.0.0.1:1234")
+	if err != nil || user != alice {
+		t.Fatalf("Authentication should succeed but get %v", err)
+	}
+	if tokenCache.Get(token) != alice {
+		t.Errorf("Token should be issued into the token cache")
+	}
+
+	checkSlice := []struct {
+		name     string
+		password string
+		expected error
+	}{
+		{"alice", "wrong", ErrBadCredentials},
+		{"nobody", testPassword, ErrBadCredentials},
+		{"disabled", testPassword, ErrDisabled},
+		{"expired", testPassword, ErrExpired},
+		// Status is not disclosed without the correct password
+		{"disabled", "wrong", ErrBadCredentials},
+	}
+	for _, check := range checkSlice {
+		if _, _, err := authenticator.Authenticate(check.name, check.password, "10.0.0.2:1234"); err != check.expected {
+			t.Errorf("%s should get %v but get %v", check.name, check.expected, err)
+		}
+	}
+}
+
+func TestAuthenticateLockout(t *testing.T) {
+	alice := createTestUser(t, "alice", testPassword, nil, nil, "", nil, nil, false)
+	authenticator, _, now := createTestAuthenticator(alice)
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := authenticator.Authenticate("alice", "wrong", "10.0.0.1:1234"); err != ErrBadCredentials {
+			t.Fatalf("Expect bad credentials but get %v", err)
+		}
+	}
+	// Locked even with the correct password and from another address because the user is locked
+	if _, _, err := authenticator.Authenticate("alice", testPassword, "10.0.0.9:1234"); err != ErrLocked {
+		t.Errorf("User should be locked but get %v", err)
+	}
+
+	// First lockout is one minute
+	*now = now.Add(61 * time.Second)
+	for i := 0; i < 3; i++ {
+		authenticator.Authenticate("alice", "wrong", "10.0.0.1:1234")
+	}
+	// Second lockout is two minutes
+	*now = now.Add(61 * time.Second)
+	if _, _, err := authenticator.Authenticate("alice", testPassword, "10.0.0.1:1234"); err != ErrLocked {
+		t.Errorf("Lockout should be backed off exponentially but get %v", err)
+	}
+	*now = now.Add(60 * time.Second)
+	if _, _, err := authenticator.Authenticate("alice", testPassword, "10.0.0.1:1234"); err != nil {
+		t.Errorf("Lockout should expire but get %v", err)
+	}
+
+	// Failures from one address lock the address for the other users as well
+	bob := createTestUser(t, "bob", testPassword, nil, nil, "", nil, nil, false)
+	authenticator, _, _ = createTestAuthenticator(alice, bob)
+	for _, name := range []string{"a", "b", "c"} {
+		authenticator.Authenticate(name, "guess", "203.0.113.5:1000")
+	}
+	if _, _, err := authenticator.Authenticate("bob", testPassword, "203.0.113.5:2000"); err != ErrLocked {
+		t.Errorf("Address should be locked but get %v", err)
+	}
+	if _, _, err := authenticator.Authenticate("bob", testPassword, "10.0.0.1:2000"); err != nil {
+		t.Errorf("Other address should not be locked but get %v", err)
+	}
+}
+
+func TestAuthenticateUpgradesLegacyPassword(t *testing.T) {
+	legacyEncodedPassword, _ := (&LegacySha3PasswordHasher{}).Hash("secret")
+	alice := &User{Name: "alice", EncodedPassword: legacyEncodedPassword}
+	authenticator, _, _ := createTestAuthenticator(alice)
+	upgradedUserSlice := make([]*User, 0)
+	authenticator.PasswordUpgradeHandler = func(user *User) {
+		upgradedUserSlice = append(upgradedUserSlice, user)
+	}
+
+	if _, _, err := authenticator.Authenticate("alice", "secret", ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(upgradedUserSlice) != 1 || upgradedUserSlice[0].EncodedPassword == legacyEncodedPassword || upgradedUserSlice[0].CheckPassword("secret") == false {
+		t.Fatalf("Legacy password should be upgraded on login")
+	}
+	if upgradedUserSlice[0] == alice || alice.EncodedPassword != legacyEncodedPassword {
+		t.Errorf("Shared user should not be modified by the upgrade")
+	}
+	if upgradedUserSlice[0].PasswordChangedTime != nil {
+		t.Errorf("Rehash should not restart the password age")
+	}
+}
+
+func TestLockoutDuration(t *testing.T) {
+	checkSlice := []struct {
+		configuration AuthenticatorConfiguration
+		lockoutCount  int
+		expected      time.Duration
+	}{
+		{AuthenticatorConfiguration{LockoutDuration: time.Minute, MaxLockoutDuration: 3 * time.Minute}, 0, time.Minute},
+		{AuthenticatorConfiguration{LockoutDuration: time.Minute, MaxLockoutDuration: 3 * time.Minute}, 1, 2 * time.Minute},
+		{AuthenticatorConfiguration{LockoutDuration: time.Minute, MaxLockoutDuration: 3 * time.Minute}, 100, 3 * time.Minute},
+		// No maximum stops doubling before overflow
+		{AuthenticatorConfiguration{LockoutDuration: time.Minute}, 10, 1024 * time.Minute},
+		{AuthenticatorConfiguration{LockoutDuration: time.Minute}, 1000, time.Minute << 27},
+		// Maximum shorter than the lockout never shortens the lockout
+		{AuthenticatorConfiguration{LockoutDuration: time.Hour, MaxLockoutDuration: time.Minute}, 5, time.Hour},
+	}
+	for i, check := range checkSlice {
+		if lockoutDuration := check.configuration.getLockoutDuration(check.lockoutCount); lockoutDuration != check.expected {
+			t.Errorf("Check %d expects %v but get %v", i, check.expected, lockoutDuration)
+		}
+	}
+}
+
+func TestFailureRecordPrune(t *testing.T) {
+	alice := createTestUser(t, "alice", testPassword, nil, nil, "", nil, nil, false)
+	authenticator, _, now := createTestAuthenticator(alice)
+
+	for i := 0; i < 10; i++ {
+		authenticator.Authenticate("guess"+strconv.Itoa(i), "guess", "")
+	}
+	for i := 0; i < 3; i++ {
+		authenticator.Authenticate("alice", "wrong", "")
+	}
+	if len(authenticator.failureMap) != 11 {
+		t.Fatalf("Failures should be recorded but get %d", len(authenticator.failureMap))
+	}
+
+	// The record of alice is kept longer since its lock ended later
+	*now = now.Add(failureRecordRetention + 30*time.Second)
+	authenticator.Authenticate("bob", "guess", "")
+	if len(authenticator.failureMap) != 2 {
+		t.Errorf("Stale failures should be pruned but get %d", len(authenticator.failureMap))
+	}
+	*now = now.Add(2 * failureRecordRetention)
+	authenticator.Authenticate("carol", "guess", "")
+	if _, ok := authenticator.failureMap["user alice"]; ok || len(authenticator.failureMap) != 1 {
+		t.Errorf("Expired lock should be pruned but get %d", len(authenticator.failureMap))
+	}
+}
+
+func TestAuthenticateKeepsAddressFailure(t *testing.T) {
+	alice := createTestUser(t, "alice", testPassword, nil, nil, "", nil, nil, false)
+	bob := createTestUser(t, "bob", testPassword, nil, nil, "", nil, nil, false)
+	authenticator, _, _ := createTestAuthenticator(alice, bob)
+
+	// The guesser couldn't reset the failures of the address by logging in as itself
+	authenticator.Authenticate("a", "guess", "203.0.113.5:1000")
+	authenticator.Authenticate("b", "guess", "203.0.113.5:1000")
+	if _, _, err := authenticator.Authenticate("alice", testPassword, "203.0.113.5:1000"); err != nil {
+		t.Fatal(err)
+	}
+	authenticator.Authenticate("c", "guess", "203.0.113.5:1000")
+	if _, _, err := authenticator.Authenticate("bob", testPassword, "203.0.113.5:2000"); err != ErrLocked {
+		t.Errorf("Address should be locked but get %v", err)
+	}
+}
+
+func TestAuthenticateConcurrentAttempt(t *testing.T) {
+	alice := createTestUser(t, "alice", testPassword, nil, nil, "", nil, nil, false)
+	authenticator, _, _ := createTestAuthenticator(alice)
+	// Hold the attempts after the lock is checked
+	foundChannel := make(chan bool)
+	releaseChannel := make(chan bool)
+	authenticator.userFinder = func(name string) (*User, error) {
+		foundChannel <- true
+		<-releaseChannel
+		return alice, nil
+	}
+
+	errorChannel := make(chan error)
+	for i := 0; i < 3; i++ {
+		go func() {
+			_, _, err := authenticator.Authenticate("alice", "wrong", "")
+			errorChannel <- err
+		}()
+		<-foundChannel
+	}
+	if _, _, err := authenticator.Authenticate("alice", "wrong", ""); err != ErrLocked {
+		t.Errorf("Attempts in progress should count toward the lockout but get %v", err)
+	}
+	close(releaseChannel)
+	for i := 0; i < 3; i++ {
+		if err := <-errorChannel; err != ErrBadCredentials {
+			t.Errorf("Expect bad credentials but get %v", err)
+		}
+	}
+	if _, _, err := authenticator.Authenticate("alice", testPassword, ""); err != ErrLocked {
+		t.Errorf("User should be locked but get %v", err)
+	}
+}
+
+func TestAuthenticateWithSessionManager(t *testing.T) {
+	alice := createTestUser(t, "alice", testPassword, nil, nil, "", nil, nil, false)
+	authenticator, tokenCache, _ := createTestAuthenticator(alice)
+	sessionManager, _ := createTestSessionManager(t)
+	authenticator.SessionManager = sessionManager
+
+	token, _, err := authenticator.Authenticate("alice", testPassword, "10.0.0.1:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokenCache.Get(token) != nil || sessionManager.GetUser(token) != alice {
+		t.Errorf("Token should be issued by the session manager")
+	}
+	sessionSlice := sessionManager.GetSessionSlice("alice")
+	if len(sessionSlice) != 1 || sessionSlice[0].RemoteAddress != "10.0.0.1:1234" {
+		t.Fatalf("Session should be recorded")
+	}
+	sessionManager.RevokeAllSession("alice")
+	if sessionManager.GetUser(token) != nil {
+		t.Errorf("Token should be revoked with the sessions")
+	}
+}
@@ -15,6 +15,7 @@
 package rbac
 
 import (
+	"sync"
 	"time"
 )
 
@@ -25,13 +26,74 @@ type Cache struct {
 	ExpiredTime time.Time
 }
 
-var cacheMap map[string]*Cache = make(map[string]*Cache)
+type CacheStatistics struct {
+	Hit      uint64
+	Miss     uint64
+	Eviction uint64
+}
 
-func SetCache(token string, user *User, ttl time.Duration) {
+type TokenCache interface {
+	Set(token string, user *User, ttl time.Duration)
+	Get(token string) *User
+	// Same as Get without counting in the statistics, used for the maintenance such as SynchronizeTokenCache
+	Peek(token string) *User
+	// Change the time to live of the cached token. Return false and never add the token if it isn't cached or is expired.
+	Extend(token string, ttl time.Duration) bool
+	Delete(token string)
+	CheckTimeout()
+	GetAllTokenExpiredTime() map[string]time.Time
+	GetStatistics() CacheStatistics
+	Stop()
+}
+
+// MemoryTokenCache is safe for concurrent use. Expired tokens are never returned by Get and
+// are removed either on read or by the sweeper goroutine when a sweep interval is configured.
+type MemoryTokenCache struct {
+	mutex         sync.Mutex
+	cacheMap      map[string]*Cache
+	statistics    CacheStatistics
+	sweepInterval time.Duration
+	stopChannel   chan struct{}
+	stopOnce      sync.Once
+}
+
+// Sweep interval less than or equal to 0 disables the sweeper goroutine
+func CreateMemoryTokenCache(sweepInterval time.Duration) *MemoryTokenCache {
+	memoryTokenCache := &MemoryTokenCache{
+		cacheMap:      make(map[string]*Cache),
+		sweepInterval: sweepInterval,
+		stopChannel:   make(chan struct{}),
+	}
+
+	if sweepInterval > 0 {
+		go memoryTokenCache.sweep()
+	}
+
+	return memoryTokenCache
+}
+
+func (memoryTokenCache *MemoryTokenCache) sweep() {
+	ticker := time.NewTicker(memoryTokenCache.sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			memoryTokenCache.CheckTimeout()
+		case <-memoryTokenCache.stopChannel:
+			return
+		}
+	}
+}
+
+func (memoryTokenCache *MemoryTokenCache) Set(token string, user *User, ttl time.Duration) {
 	createdTime := time.Now()
 	expiredTime := createdTime.Add(ttl)
 
-	cacheMap[token] = &Cache{
+	memoryTokenCache.mutex.Lock()
+	defer memoryTokenCache.mutex.Unlock()
+
+	memoryTokenCache.cacheMap[token] = &Cache{
 		token,
 		user,
 		createdTime,
@@ -39,30 +101,133 @@ func SetCache(token string, user *User, ttl time.Duration) {
 	}
 }
 
-func GetCache(token string) *User {
-	cache := cacheMap[token]
+func (memoryTokenCache *MemoryTokenCache) Get(token string) *User {
+	memoryTokenCache.mutex.Lock()
+	defer memoryTokenCache.mutex.Unlock()
+
+	cache := memoryTokenCache.cacheMap[token]
 	if cache == nil {
+		memoryTokenCache.statistics.Miss++
+		return nil
+	} else if time.Now().After(cache.ExpiredTime) {
+		delete(memoryTokenCache.cacheMap, token)
+		memoryTokenCache.statistics.Eviction++
+		memoryTokenCache.statistics.Miss++
 		return nil
 	} else {
+		memoryTokenCache.statistics.Hit++
 		return cache.User
 	}
 }
 
-func CheckCacheTimeout() {
+func (memoryTokenCache *MemoryTokenCache) Peek(token string) *User {
+	memoryTokenCache.mutex.Lock()
+	defer memoryTokenCache.mutex.Unlock()
+
+	cache := memoryTokenCache.cacheMap[token]
+	if cache == nil || time.Now().After(cache.ExpiredTime) {
+		return nil
+	}
+	return cache.User
+}
+
+func (memoryTokenCache *MemoryTokenCache) Extend(token string, ttl time.Duration) bool {
 	now := time.Now()
-	for key, value := range cacheMap {
+
+	memoryTokenCache.mutex.Lock()
+	defer memoryTokenCache.mutex.Unlock()
+
+	cache := memoryTokenCache.cacheMap[token]
+	if cache == nil || now.After(cache.ExpiredTime) {
+		return false
+	}
+	cache.ExpiredTime = now.Add(ttl)
+	return true
+}
+
+func (memoryTokenCache *MemoryTokenCache) Delete(token string) {
+	memoryTokenCache.mutex.Lock()
+	defer memoryTokenCache.mutex.Unlock()
+
+	delete(memoryTokenCache.cacheMap, token)
+}
+
+func (memoryTokenCache *MemoryTokenCache) CheckTimeout() {
+	now := time.Now()
+
+	memoryTokenCache.mutex.Lock()
+	defer memoryTokenCache.mutex.Unlock()
+
+	for key, value := range memoryTokenCache.cacheMap {
 		if now.After(value.ExpiredTime) {
-			delete(cacheMap, key)
+			delete(memoryTokenCache.cacheMap, key)
+			memoryTokenCache.statistics.Eviction++
 		}
 	}
 }
 
-func GetAllTokenExpiredTime() map[string]time.Time {
-	expiredMap := make(map[string]time.Time)
+func (memoryTokenCache *MemoryTokenCache) GetAllTokenExpiredTime() map[string]time.Time {
+	memoryTokenCache.mutex.Lock()
+	defer memoryTokenCache.mutex.Unlock()
 
-	for key, value := range cacheMap {
+	expiredMap := make(map[string]time.Time)
+	for key, value := range memoryTokenCache.cacheMap {
 		expiredMap[key] = value.ExpiredTime
 	}
 
 	return expiredMap
 }
+
+func (memoryTokenCache *MemoryTokenCache) GetStatistics() CacheStatistics {
+	memoryTokenCache.mutex.Lock()
+	defer memoryTokenCache.mutex.Unlock()
+
+	return memoryTokenCache.statistics
+}
+
+// Stop terminates the sweeper goroutine. It is safe to call more than once.
+func (memoryTokenCache *MemoryTokenCache) Stop() {
+	memoryTokenCache.stopOnce.Do(func() {
+		close(memoryTokenCache.stopChannel)
+	})
+}
+
+// The default instance backs the package level functions. It has no sweeper so the expired tokens are removed on read or by CheckCacheTimeout.
+var defaultTokenCache TokenCache = CreateMemoryTokenCache(0)
+var defaultTokenCacheMutex sync.RWMutex
+
+func GetDefaultTokenCache() TokenCache {
+	defaultTokenCacheMutex.RLock()
+	defer defaultTokenCacheMutex.RUnlock()
+	return defaultTokenCache
+}
+
+// Replace the instance used by the package level functions. The previous instance is returned and not stopped.
+func SetDefaultTokenCache(tokenCache TokenCache) TokenCache {
+	defaultTokenCacheMutex.Lock()
+	defer defaultTokenCacheMutex.Unlock()
+	previousTokenCache := defaultTokenCache
+	defaultTokenCache = tokenCache
+	return previousTokenCache
+}
+
+func SetCache(token string, user *User, ttl time.Duration) {
+	GetDefaultTokenCache().Set(token, user, ttl)
+}
+
+func GetCache(token string) *User {
+	return GetDefaultTokenCache().Get(token)
+}
+
+func DeleteCache(token string) {
+	GetDefaultTokenCache().Delete(token)
+}
+
+func CheckCacheTimeout() {
+	GetDefaultTokenCache().CheckTimeout()
+}
+
+// The keys are the raw tokens. Use SessionManager to list the sessions by user without exposing the tokens.
+func GetAllTokenExpiredTime() map[string]time.Time {
+	return GetDefaultTokenCache().GetAllTokenExpiredTime()
+}
@@ -0,0 +1,121 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryTokenCacheExpiry(t *testing.T) {
+	memoryTokenCache := CreateMemoryTokenCache(0)
+	defer memoryTokenCache.Stop()
+
+	user := &User{Name: "u"}
+	memoryTokenCache.Set("valid", user, time.Hour)
+	memoryTokenCache.Set("expired", user, -time.Second)
+
+	if memoryTokenCache.Get("valid") != user {
+		t.Errorf("Valid token should return the user")
+	}
+	if memoryTokenCache.Get("expired") != nil {
+		t.Errorf("Expired token should not return the user")
+	}
+	if memoryTokenCache.Get("unknown") != nil {
+		t.Errorf("Unknown token should not return the user")
+	}
+
+	statistics := memoryTokenCache.GetStatistics()
+	if statistics.Hit != 1 || statistics.Miss != 2 || statistics.Eviction != 1 {
+		t.Errorf("Unexpected statistics %+v", statistics)
+	}
+	if _, ok := memoryTokenCache.GetAllTokenExpiredTime()["expired"]; ok {
+		t.Errorf("Expired token should be evicted on read")
+	}
+
+	if memoryTokenCache.Extend("valid", 2*time.Hour) == false || memoryTokenCache.GetAllTokenExpiredTime()["valid"].Before(time.Now().Add(time.Hour)) {
+		t.Errorf("Cached token should be extended")
+	}
+	if memoryTokenCache.Extend("unknown", time.Hour) || memoryTokenCache.Peek("unknown") != nil {
+		t.Errorf("Unknown token should not be added by the extension")
+	}
+	if memoryTokenCache.Peek("valid") != user || memoryTokenCache.GetStatistics() != statistics {
+		t.Errorf("Peek should not be counted in the statistics")
+	}
+}
+
+func TestMemoryTokenCacheSweeper(t *testing.T) {
+	memoryTokenCache := CreateMemoryTokenCache(10 * time.Millisecond)
+	defer memoryTokenCache.Stop()
+
+	memoryTokenCache.Set("token", &User{Name: "u"}, 5*time.Millisecond)
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if len(memoryTokenCache.GetAllTokenExpiredTime()) == 0 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if len(memoryTokenCache.GetAllTokenExpiredTime()) != 0 {
+		t.Errorf("Sweeper should remove the expired token")
+	}
+	if memoryTokenCache.GetStatistics().Eviction != 1 {
+		t.Errorf("Sweeper eviction should be counted")
+	}
+
+	// Stop is idempotent
+	memoryTokenCache.Stop()
+}
+
+func TestMemoryTokenCacheConcurrency(t *testing.T) {
+	memoryTokenCache := CreateMemoryTokenCache(time.Millisecond)
+	defer memoryTokenCache.Stop()
+
+	waitGroup := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+			for j := 0; j < 500; j++ {
+				token := strconv.Itoa(i) + "-" + strconv.Itoa(j)
+				memoryTokenCache.Set(token, &User{Name: token}, time.Millisecond)
+				memoryTokenCache.Get(token)
+				memoryTokenCache.GetAllTokenExpiredTime()
+				memoryTokenCache.CheckTimeout()
+			}
+		}(i)
+	}
+	waitGroup.Wait()
+}
+
+func TestDefaultTokenCache(t *testing.T) {
+	memoryTokenCache := CreateMemoryTokenCache(0)
+	previousTokenCache := SetDefaultTokenCache(memoryTokenCache)
+	defer SetDefaultTokenCache(previousTokenCache)
+
+	user := &User{Name: "u"}
+	SetCache("token", user, time.Hour)
+	if GetCache("token") != user {
+		t.Errorf("Package function should use the default token cache")
+	}
+	DeleteCache("token")
+	if GetCache("token") != nil {
+		t.Errorf("Deleted token should not return the user")
+	}
+}
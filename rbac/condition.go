@@ -0,0 +1,625 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"errors"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RequestContext carries the attributes of a request which the conditions of permissions are evaluated against
+type RequestContext struct {
+	RemoteAddress string    // IP or IP:port
+	Time          time.Time // Zero time means now
+	AttributeMap  map[string]string
+}
+
+type conditionEnvironment struct {
+	user           *User
+	requestContext *RequestContext
+	component      string
+	method         string
+	path           string
+}
+
+type conditionValue struct {
+	text      string
+	list      []conditionValue
+	isList    bool
+	isBoolean bool
+	boolean   bool
+}
+
+type conditionNode interface {
+	evaluate(environment *conditionEnvironment) (conditionValue, error)
+}
+
+// Condition is a small expression language evaluated against the request. For example:
+//
+//	remote.ip in ["10.0.0.0/8", "192.168.1.0/24"] && time.clock >= "09:00" && time.clock < "18:00"
+//	user.meta.team == attribute.owner
+//
+// Operators: || && ! == != < <= > >= in, and parentheses.
+// Operands: "string", number, [list], and the variables:
+//   - remote.ip
+//   - time.hour, time.minute, time.weekday (0 is Sunday), time.clock (HH:MM) in UTC unless SetConditionLocation is called
+//   - user.name, user.meta.<key> from MetaDataMap
+//   - request.component, request.method, request.path
+//   - attribute.<key> from RequestContext.AttributeMap
+//
+// A missing variable is an error so the condition fails closed instead of comparing empty strings.
+// == != and in compare the strings exactly, so "01" isn't equal to "1".
+// < <= > >= compare numerically when both sides are decimals such as 9, -1 or 0.5, otherwise lexicographically.
+// Other number forms such as 1e0, Inf or NaN are compared as strings.
+// in checks the membership of a list, and for an IP also whether it is in a CIDR of the list or string.
+func ValidateCondition(condition string) error {
+	_, err := compileCondition(condition)
+	return err
+}
+
+// The cache is cleared when full so conditions from arbitrary input can't grow it without limit
+const maximumCompiledConditionCount = 1024
+
+var compiledConditionMap = make(map[string]conditionNode)
+var compiledConditionMutex sync.RWMutex
+
+var conditionLocation = time.UTC
+var conditionLocationMutex sync.RWMutex
+
+// SetConditionLocation sets the location time.hour, time.minute, time.weekday and time.clock are evaluated in.
+// The default is UTC so the result doesn't depend on the server time zone.
+func SetConditionLocation(location *time.Location) error {
+	if location == nil {
+		log.Error("Location couldn't be empty")
+		return errors.New("Location couldn't be empty")
+	}
+	conditionLocationMutex.Lock()
+	conditionLocation = location
+	conditionLocationMutex.Unlock()
+	return nil
+}
+
+func getConditionLocation() *time.Location {
+	conditionLocationMutex.RLock()
+	defer conditionLocationMutex.RUnlock()
+	return conditionLocation
+}
+
+func compileCondition(condition string) (conditionNode, error) {
+	compiledConditionMutex.RLock()
+	node, ok := compiledConditionMap[condition]
+	compiledConditionMutex.RUnlock()
+	if ok {
+		return node, nil
+	}
+
+	tokenSlice, err := tokenizeCondition(condition)
+	if err != nil {
+		return nil, err
+	}
+	parser := &conditionParser{tokenSlice, 0}
+	node, err = parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.position != len(parser.tokenSlice) {
+		return nil, errors.New("Unexpected token " + parser.tokenSlice[parser.position].text + " in condition " + condition)
+	}
+
+	compiledConditionMutex.Lock()
+	if len(compiledConditionMap) >= maximumCompiledConditionCount {
+		compiledConditionMap = make(map[string]conditionNode)
+	}
+	compiledConditionMap[condition] = node
+	compiledConditionMutex.Unlock()
+
+	return node, nil
+}
+
+func evaluateCondition(condition string, environment *conditionEnvironment) (bool, error) {
+	node, err := compileCondition(condition)
+	if err != nil {
+		return false, err
+	}
+	value, err := node.evaluate(environment)
+	if err != nil {
+		return false, err
+	}
+	if value.isBoolean == false {
+		return false, errors.New("Condition " + condition + " is not a boolean expression")
+	}
+	return value.boolean, nil
+}
+
+const (
+	conditionTokenString = iota
+	conditionTokenNumber
+	conditionTokenIdentifier
+	conditionTokenOperator
+)
+
+type conditionToken struct {
+	kind int
+	text string
+}
+
+func tokenizeCondition(condition string) ([]conditionToken, error) {
+	tokenSlice := make([]conditionToken, 0)
+	i := 0
+	for i < len(condition) {
+		character := condition[i]
+		switch {
+		case character == ' ' || character == '\t' || character == '\n' || character == '\r':
+			i++
+		case character == '"':
+			end := i + 1
+			for end < len(condition) && condition[end] != '"' {
+				if condition[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(condition) {
+				return nil, errors.New("Unterminated string in condition " + condition)
+			}
+			text, err := strconv.Unquote(condition[i : end+1])
+			if err != nil {
+				return nil, errors.New("Invalid string in condition " + condition)
+			}
+			tokenSlice = append(tokenSlice, conditionToken{conditionTokenString, text})
+			i = end + 1
+		case (character >= '0' && character <= '9') || (character == '-' && i+1 < len(condition) && condition[i+1] >= '0' && condition[i+1] <= '9'):
+			end := i + 1
+			for end < len(condition) && ((condition[end] >= '0' && condition[end] <= '9') || condition[end] == '.') {
+				end++
+			}
+			if _, err := strconv.ParseFloat(condition[i:end], 64); err != nil {
+				return nil, errors.New("Invalid number " + condition[i:end] + " in condition " + condition)
+			}
+			tokenSlice = append(tokenSlice, conditionToken{conditionTokenNumber, condition[i:end]})
+			i = end
+		case isConditionIdentifierCharacter(character) && !(character >= '0' && character <= '9'):
+			end := i + 1
+			for end < len(condition) && (isConditionIdentifierCharacter(condition[end]) || condition[end] == '.' || condition[end] == '-') {
+				end++
+			}
+			text := condition[i:end]
+			if text == "in" {
+				tokenSlice = append(tokenSlice, conditionToken{conditionTokenOperator, text})
+			} else {
+				tokenSlice = append(tokenSlice, conditionToken{conditionTokenIdentifier, text})
+			}
+			i = end
+		default:
+			matched := false
+			for _, operator := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ","} {
+				if strings.HasPrefix(condition[i:], operator) {
+					tokenSlice = append(tokenSlice, conditionToken{conditionTokenOperator, operator})
+					i += len(operator)
+					matched = true
+					break
+				}
+			}
+			if matched == false {
+				return nil, errors.New("Unexpected character " + string(character) + " in condition " + condition)
+			}
+		}
+	}
+	return tokenSlice, nil
+}
+
+func isConditionIdentifierCharacter(character byte) bool {
+	return (character >= 'a' && character <= 'z') || (character >= 'A' && character <= 'Z') || (character >= '0' && character <= '9') || character == '_'
+}
+
+type conditionParser struct {
+	tokenSlice []conditionToken
+	position   int
+}
+
+func (parser *conditionParser) peekOperator(operator string) bool {
+	return parser.position < len(parser.tokenSlice) &&
+		parser.tokenSlice[parser.position].kind == conditionTokenOperator &&
+		parser.tokenSlice[parser.position].text == operator
+}
+
+func (parser *conditionParser) expectOperator(operator string) error {
+	if parser.peekOperator(operator) == false {
+		return errors.New("Expect " + operator + " in condition")
+	}
+	parser.position++
+	return nil
+}
+
+func (parser *conditionParser) parseOr() (conditionNode, error) {
+	left, err := parser.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for parser.peekOperator("||") {
+		parser.position++
+		right, err := parser.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalConditionNode{"||", left, right}
+	}
+	return left, nil
+}
+
+func (parser *conditionParser) parseAnd() (conditionNode, error) {
+	left, err := parser.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for parser.peekOperator("&&") {
+		parser.position++
+		right, err := parser.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalConditionNode{"&&", left, right}
+	}
+	return left, nil
+}
+
+func (parser *conditionParser) parseNot() (conditionNode, error) {
+	if parser.peekOperator("!") {
+		parser.position++
+		operand, err := parser.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notConditionNode{operand}, nil
+	}
+	return parser.parseComparison()
+}
+
+func (parser *conditionParser) parseComparison() (conditionNode, error) {
+	if parser.peekOperator("(") {
+		parser.position++
+		node, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := parser.expectOperator(")"); err != nil {
+			return nil, err
+		}
+		return node, nil
+	}
+
+	left, err := parser.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	for _, operator := range []string{"==", "!=", "<=", ">=", "<", ">", "in"} {
+		if parser.peekOperator(operator) {
+			parser.position++
+			right, err := parser.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			if isListConditionNode(left) || (operator != "in" && isListConditionNode(right)) {
+				return nil, errors.New("List could only be the right operand of in")
+			}
+			return &comparisonConditionNode{operator, left, right}, nil
+		}
+	}
+	return left, nil
+}
+
+func (parser *conditionParser) parseOperand() (conditionNode, error) {
+	if parser.position >= len(parser.tokenSlice) {
+		return nil, errors.New("Unexpected end of condition")
+	}
+	token := parser.tokenSlice[parser.position]
+	switch token.kind {
+	case conditionTokenString, conditionTokenNumber:
+		parser.position++
+		return &literalConditionNode{conditionValue{text: token.text}}, nil
+	case conditionTokenIdentifier:
+		parser.position++
+		if token.text == "true" || token.text == "false" {
+			return &literalConditionNode{conditionValue{isBoolean: true, boolean: token.text == "true"}}, nil
+		}
+		if err := validateConditionVariable(token.text); err != nil {
+			return nil, err
+		}
+		return &variableConditionNode{token.text}, nil
+	default:
+		if token.text == "[" {
+			parser.position++
+			list := make([]conditionValue, 0)
+			for parser.peekOperator("]") == false {
+				if len(list) > 0 {
+					if err := parser.expectOperator(","); err != nil {
+						return nil, err
+					}
+				}
+				if parser.position >= len(parser.tokenSlice) {
+					return nil, errors.New("Unterminated list in condition")
+				}
+				element := parser.tokenSlice[parser.position]
+				if element.kind != conditionTokenString && element.kind != conditionTokenNumber {
+					return nil, errors.New("List in condition could only contain strings and numbers")
+				}
+				list = append(list, conditionValue{text: element.text})
+				parser.position++
+			}
+			parser.position++
+			return &literalConditionNode{conditionValue{list: list, isList: true}}, nil
+		}
+		return nil, errors.New("Unexpected token " + token.text + " in condition")
+	}
+}
+
+func isListConditionNode(node conditionNode) bool {
+	literalNode, ok := node.(*literalConditionNode)
+	return ok && literalNode.value.isList
+}
+
+func validateConditionVariable(name string) error {
+	switch name {
+	case "remote.ip", "time.hour", "time.minute", "time.weekday", "time.clock",
+		"user.name", "request.component", "request.method", "request.path":
+		return nil
+	}
+	if (strings.HasPrefix(name, "user.meta.") && len(name) > len("user.meta.")) ||
+		(strings.HasPrefix(name, "attribute.") && len(name) > len("attribute.")) {
+		return nil
+	}
+	return errors.New("Unknown variable " + name + " in condition")
+}
+
+type literalConditionNode struct {
+	value conditionValue
+}
+
+func (node *literalConditionNode) evaluate(environment *conditionEnvironment) (conditionValue, error) {
+	return node.value, nil
+}
+
+type variableConditionNode struct {
+	name string
+}
+
+func (node *variableConditionNode) evaluate(environment *conditionEnvironment) (conditionValue, error) {
+	requestContext := environment.requestContext
+	if requestContext == nil {
+		requestContext = &RequestContext{}
+	}
+	now := requestContext.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+	now = now.In(getConditionLocation())
+
+	switch node.name {
+	case "remote.ip":
+		if requestContext.RemoteAddress == "" {
+			return conditionValue{}, errors.New("Remote address is not provided")
+		}
+		host, _, err := net.SplitHostPort(requestContext.RemoteAddress)
+		if err != nil {
+			host = requestContext.RemoteAddress
+		}
+		return conditionValue{text: host}, nil
+	case "time.hour":
+		return conditionValue{text: strconv.Itoa(now.Hour())}, nil
+	case "time.minute":
+		return conditionValue{text: strconv.Itoa(now.Minute())}, nil
+	case "time.weekday":
+		return conditionValue{text: strconv.Itoa(int(now.Weekday()))}, nil
+	case "time.clock":
+		return conditionValue{text: now.Format("15:04")}, nil
+	case "request.component":
+		return conditionValue{text: environment.component}, nil
+	case "request.method":
+		return conditionValue{text: environment.method}, nil
+	case "request.path":
+		return conditionValue{text: environment.path}, nil
+	case "user.name":
+		if environment.user == nil {
+			return conditionValue{}, errors.New("User is not provided")
+		}
+		return conditionValue{text: environment.user.Name}, nil
+	}
+
+	if strings.HasPrefix(node.name, "user.meta.") {
+		key := strings.TrimPrefix(node.name, "user.meta.")
+		if environment.user != nil && environment.user.MetaDataMap != nil {
+			if value, ok := environment.user.MetaDataMap[key]; ok {
+				return conditionValue{text: value}, nil
+			}
+		}
+		return conditionValue{}, errors.New("User meta data " + key + " is not provided")
+	}
+	if strings.HasPrefix(node.name, "attribute.") {
+		key := strings.TrimPrefix(node.name, "attribute.")
+		if requestContext.AttributeMap != nil {
+			if value, ok := requestContext.AttributeMap[key]; ok {
+				return conditionValue{text: value}, nil
+			}
+		}
+		return conditionValue{}, errors.New("Request attribute " + key + " is not provided")
+	}
+	return conditionValue{}, errors.New("Unknown variable " + node.name + " in condition")
+}
+
+type notConditionNode struct {
+	operand conditionNode
+}
+
+func (node *notConditionNode) evaluate(environment *conditionEnvironment) (conditionValue, error) {
+	value, err := node.operand.evaluate(environment)
+	if err != nil {
+		return conditionValue{}, err
+	}
+	if value.isBoolean == false {
+		return conditionValue{}, errors.New("Operand of ! is not a boolean")
+	}
+	return conditionValue{isBoolean: true, boolean: !value.boolean}, nil
+}
+
+type logicalConditionNode struct {
+	operator string
+	left     conditionNode
+	right    conditionNode
+}
+
+func (node *logicalConditionNode) evaluate(environment *conditionEnvironment) (conditionValue, error) {
+	left, err := node.left.evaluate(environment)
+	if err != nil {
+		return conditionValue{}, err
+	}
+	if left.isBoolean == false {
+		return conditionValue{}, errors.New("Operand of " + node.operator + " is not a boolean")
+	}
+	// Short circuit
+	if node.operator == "&&" && left.boolean == false {
+		return left, nil
+	}
+	if node.operator == "||" && left.boolean {
+		return left, nil
+	}
+
+	right, err := node.right.evaluate(environment)
+	if err != nil {
+		return conditionValue{}, err
+	}
+	if right.isBoolean == false {
+		return conditionValue{}, errors.New("Operand of " + node.operator + " is not a boolean")
+	}
+	return right, nil
+}
+
+type comparisonConditionNode struct {
+	operator string
+	left     conditionNode
+	right    conditionNode
+}
+
+func (node *comparisonConditionNode) evaluate(environment *conditionEnvironment) (conditionValue, error) {
+	left, err := node.left.evaluate(environment)
+	if err != nil {
+		return conditionValue{}, err
+	}
+	right, err := node.right.evaluate(environment)
+	if err != nil {
+		return conditionValue{}, err
+	}
+	if left.isList || left.isBoolean || right.isBoolean {
+		return conditionValue{}, errors.New("Invalid operand for " + node.operator)
+	}
+
+	result := false
+	if node.operator == "in" {
+		if right.isList {
+			for _, element := range right.list {
+				if left.text == element.text || containIP(element.text, left.text) {
+					result = true
+					break
+				}
+			}
+		} else {
+			result = containIP(right.text, left.text)
+		}
+		return conditionValue{isBoolean: true, boolean: result}, nil
+	}
+
+	if right.isList {
+		return conditionValue{}, errors.New("Invalid operand for " + node.operator)
+	}
+	if node.operator == "==" || node.operator == "!=" {
+		result = (left.text == right.text) == (node.operator == "==")
+		return conditionValue{isBoolean: true, boolean: result}, nil
+	}
+
+	comparison := compareConditionValue(left.text, right.text)
+	switch node.operator {
+	case "<":
+		result = comparison < 0
+	case "<=":
+		result = comparison <= 0
+	case ">":
+		result = comparison > 0
+	case ">=":
+		result = comparison >= 0
+	}
+	return conditionValue{isBoolean: true, boolean: result}, nil
+}
+
+// Order the values numerically if both are decimals, otherwise lexicographically
+func compareConditionValue(left string, right string) int {
+	leftNumber, leftOK := parseConditionDecimal(left)
+	rightNumber, rightOK := parseConditionDecimal(right)
+	if leftOK && rightOK {
+		if leftNumber < rightNumber {
+			return -1
+		} else if leftNumber > rightNumber {
+			return 1
+		} else {
+			return 0
+		}
+	}
+	return strings.Compare(left, right)
+}
+
+// Only an optional minus, digits and an optional fraction are accepted
+func parseConditionDecimal(text string) (float64, bool) {
+	splitSlice := strings.SplitN(strings.TrimPrefix(text, "-"), ".", 2)
+	for _, digitText := range splitSlice {
+		if isConditionDigit(digitText) == false {
+			return 0, false
+		}
+	}
+	number, err := strconv.ParseFloat(text, 64)
+	if err != nil || math.IsInf(number, 0) || math.IsNaN(number) {
+		return 0, false
+	}
+	return number, true
+}
+
+func isConditionDigit(text string) bool {
+	if text == "" {
+		return false
+	}
+	for _, character := range text {
+		if character < '0' || character > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Check whether the IP is in the CIDR or is the same IP
+func containIP(cidr string, ip string) bool {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return false
+	}
+	if _, ipNet, err := net.ParseCIDR(cidr); err == nil {
+		return ipNet.Contains(parsedIP)
+	}
+	if parsedCIDRIP := net.ParseIP(cidr); parsedCIDRIP != nil {
+		return parsedCIDRIP.Equal(parsedIP)
+	}
+	return false
+}
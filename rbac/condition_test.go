@@ -0,0 +1,198 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func createConditionTestEnvironment() *conditionEnvironment {
+	user := &User{Name: "alice", MetaDataMap: map[string]string{"team": "team-a", "level": "10"}}
+	requestContext := &RequestContext{
+		RemoteAddress: "10.1.2.3:52100",
+		// Wednesday
+		Time:         time.Date(2016, 1, 6, 14, 30, 0, 0, time.UTC),
+		AttributeMap: map[string]string{"owner": "team-a", "namespace": "production"},
+	}
+	return &conditionEnvironment{user, requestContext, "cloudone", "POST", "/api/v1/namespaces/production"}
+}
+
+func TestConditionOperator(t *testing.T) {
+	environment := createConditionTestEnvironment()
+
+	checkSlice := []struct {
+		condition string
+		expected  bool
+	}{
+		{`user.meta.team == attribute.owner`, true},
+		{`user.meta.team == "team-b"`, false},
+		{`user.name != "bob"`, true},
+		{`user.name != "alice"`, false},
+		{`time.hour < 18`, true},
+		{`time.hour < 14`, false},
+		{`time.hour <= 14`, true},
+		{`time.hour > 14`, false},
+		{`time.hour >= 9`, true},
+		{`time.clock >= "09:00" && time.clock < "18:00"`, true},
+		{`user.meta.level > 9`, true},
+		{`user.meta.level > "9"`, true},
+		{`time.weekday in [1, 2, 3, 4, 5]`, true},
+		{`remote.ip in ["10.0.0.0/8", "192.168.0.0/16"]`, true},
+		{`remote.ip in "172.16.0.0/12"`, false},
+		{`remote.ip in ["10.1.2.3"]`, true},
+		{`request.method in ["GET", "HEAD"]`, false},
+		{`request.path == "/api/v1/namespaces/production"`, true},
+		{`request.component == "cloudone"`, true},
+		{`!(attribute.namespace == "production")`, false},
+		{`time.hour < 9 || time.hour >= 14`, true},
+		{`time.hour < 9 || time.hour > 18`, false},
+		{`true && !false`, true},
+		{`(time.hour < 9 || user.name == "alice") && remote.ip in "10.0.0.0/8"`, true},
+		// Short circuit skips the missing variable
+		{`false && user.meta.missing == ""`, false},
+		// Equality is exact while the order of the decimals is numeric
+		{`"01" == "1"`, false},
+		{`"01" != "1"`, true},
+		{`"1" in ["01", "1.0"]`, false},
+		{`"010" > 9`, true},
+		{`-1.5 < 1`, true},
+		{`"1e0" == "1"`, false},
+		{`"1e0" >= "1"`, true},
+		{`"9" < "1e2"`, false},
+		{`"NaN" == "NaN"`, true},
+		{`"NaN" < 1`, false},
+		{`"NaN" > "Inf"`, true},
+	}
+	for _, check := range checkSlice {
+		result, err := evaluateCondition(check.condition, environment)
+		if err != nil {
+			t.Errorf("Condition %s error: %s", check.condition, err)
+		} else if result != check.expected {
+			t.Errorf("Condition %s should be %v", check.condition, check.expected)
+		}
+	}
+}
+
+func TestConditionError(t *testing.T) {
+	for _, condition := range []string{`unknown.variable == 1`, `time.hour ==`, `(true`, `"unterminated`, `time.hour $ 1`, `[1, 2] == 1`, `user.meta. == 1`} {
+		if err := ValidateCondition(condition); err == nil {
+			t.Errorf("Condition %s should be invalid", condition)
+		}
+	}
+
+	environment := createConditionTestEnvironment()
+	for _, condition := range []string{`user.meta.missing == ""`, `attribute.missing == ""`, `time.hour`, `!time.hour`} {
+		if _, err := evaluateCondition(condition, environment); err == nil {
+			t.Errorf("Condition %s should fail to evaluate", condition)
+		}
+	}
+	environment.requestContext.RemoteAddress = ""
+	if _, err := evaluateCondition(`remote.ip in "10.0.0.0/8"`, environment); err == nil {
+		t.Errorf("Missing remote address should fail to evaluate")
+	}
+}
+
+func TestConditionLocation(t *testing.T) {
+	environment := createConditionTestEnvironment()
+	// The same instant in another zone is still evaluated in UTC by default
+	environment.requestContext.Time = environment.requestContext.Time.In(time.FixedZone("UTC+9", 9*60*60))
+	if result, err := evaluateCondition(`time.clock == "14:30" && time.weekday == 3`, environment); err != nil || result == false {
+		t.Errorf("Time should be evaluated in UTC by default")
+	}
+
+	if err := SetConditionLocation(nil); err == nil {
+		t.Errorf("Empty location should be rejected")
+	}
+	if err := SetConditionLocation(time.FixedZone("UTC+10", 10*60*60)); err != nil {
+		t.Fatal(err)
+	}
+	defer SetConditionLocation(time.UTC)
+	if result, err := evaluateCondition(`time.clock == "00:30" && time.weekday == 4`, environment); err != nil || result == false {
+		t.Errorf("Time should be evaluated in the configured location")
+	}
+}
+
+func TestCompiledConditionBounded(t *testing.T) {
+	for i := 0; i < maximumCompiledConditionCount*2; i++ {
+		if err := ValidateCondition("time.hour == " + strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	compiledConditionMutex.RLock()
+	count := len(compiledConditionMap)
+	compiledConditionMutex.RUnlock()
+	if count > maximumCompiledConditionCount {
+		t.Errorf("Compiled condition cache should be bounded but has %d entries", count)
+	}
+}
+
+func TestHasPermissionWithContext(t *testing.T) {
+	deployPermission, _ := CreatePermission("cloudone", "POST", "/api/v1/namespaces/production")
+	if err := deployPermission.SetCondition(`remote.ip in "10.0.0.0/8" && time.clock >= "09:00" && time.clock < "18:00"`); err != nil {
+		t.Fatal(err)
+	}
+	ownerPermission, _ := CreatePermission("cloudone", "DELETE", "/api/v1/namespaces/{namespace}")
+	ownerPermission.SetCondition(`user.meta.team == attribute.owner`)
+	denyPermission, _ := CreateDenyPermission("cloudone", "*", "/api/v1/namespaces/production/secrets")
+	denyPermission.SetCondition(`user.meta.team != "security"`)
+	if err := denyPermission.SetCondition(`user.meta.team !! "security"`); err == nil {
+		t.Errorf("Invalid condition should be rejected")
+	}
+
+	user := &User{
+		Name:        "alice",
+		MetaDataMap: map[string]string{"team": "team-a"},
+		RoleSlice:   []*Role{&Role{Name: "deployer", PermissionSlice: []*Permission{deployPermission, ownerPermission, denyPermission}}},
+	}
+	office := &RequestContext{RemoteAddress: "10.1.2.3:52100", Time: time.Date(2016, 1, 6, 14, 30, 0, 0, time.UTC), AttributeMap: map[string]string{"owner": "team-a"}}
+	home := &RequestContext{RemoteAddress: "203.0.113.5:40000", Time: office.Time}
+	night := &RequestContext{RemoteAddress: office.RemoteAddress, Time: time.Date(2016, 1, 6, 23, 0, 0, 0, time.UTC)}
+
+	if user.HasPermissionWithContext(office, "cloudone", "POST", "/api/v1/namespaces/production/pods") == false {
+		t.Errorf("Deploy from office during business hours should be allowed")
+	}
+	if user.HasPermissionWithContext(home, "cloudone", "POST", "/api/v1/namespaces/production/pods") {
+		t.Errorf("Deploy from outside network should be denied")
+	}
+	if user.HasPermissionWithContext(night, "cloudone", "POST", "/api/v1/namespaces/production/pods") {
+		t.Errorf("Deploy outside business hours should be denied")
+	}
+	if user.HasPermission("cloudone", "POST", "/api/v1/namespaces/production/pods") {
+		t.Errorf("Conditional allow should not grant without the request context")
+	}
+	if user.HasChildPermissionWithContext(office, "cloudone", "POST", "/api/v1/namespaces") == false {
+		t.Errorf("Conditional child permission should be reachable when the condition holds")
+	}
+	if user.HasChildPermission("cloudone", "POST", "/api/v1/namespaces") {
+		t.Errorf("Conditional child permission should not be reachable without the request context")
+	}
+
+	if user.HasPermissionWithContext(office, "cloudone", "DELETE", "/api/v1/namespaces/team-a") == false {
+		t.Errorf("Owner team should be allowed")
+	}
+	if user.HasPermissionWithContext(home, "cloudone", "DELETE", "/api/v1/namespaces/team-a") {
+		t.Errorf("Missing owner attribute should fail closed")
+	}
+
+	if user.HasPermissionWithContext(office, "cloudone", "POST", "/api/v1/namespaces/production/secrets") {
+		t.Errorf("Conditional deny should apply when the condition holds")
+	}
+	user.MetaDataMap["team"] = "security"
+	if user.HasPermissionWithContext(office, "cloudone", "POST", "/api/v1/namespaces/production/secrets") == false {
+		t.Errorf("Conditional deny should not apply when the condition doesn't hold")
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import ()
+
+// Effect of a permission or resource. Empty effect is treated as allow so the policies stored before effect was introduced keep their meaning.
+//
+// Evaluation is deny-overrides and doesn't depend on the order of roles, permissions or resources:
+//  1. If any deny matches the target, the target is denied.
+//  2. Otherwise, if any allow matches the target, the target is allowed.
+//  3. Otherwise, the target is denied.
+//
+// For child permission, an allow on a descendant of the target only counts when no deny covers that descendant.
+type Effect string
+
+const (
+	EffectAllow Effect = "Allow"
+	EffectDeny  Effect = "Deny"
+)
+
+func (effect Effect) IsDeny() bool {
+	return effect == EffectDeny
+}
+
+// Without the request context, a conditional allow doesn't grant and a conditional deny applies
+func evaluatePermission(permissionSlice []*Permission, component string, method string, path string) bool {
+	return evaluatePermissionWithEnvironment(permissionSlice, &conditionEnvironment{nil, nil, component, method, path})
+}
+
+func evaluatePermissionWithEnvironment(permissionSlice []*Permission, environment *conditionEnvironment) bool {
+	allowed := false
+	for _, permission := range permissionSlice {
+		if permission.Match(environment.component, environment.method, environment.path) && permission.isEffective(environment) {
+			if permission.Effect.IsDeny() {
+				return false
+			}
+			allowed = true
+		}
+	}
+	return allowed
+}
+
+func evaluateChildPermission(permissionSlice []*Permission, component string, method string, path string) bool {
+	return evaluateChildPermissionWithEnvironment(permissionSlice, func(reachablePath string) []*Permission {
+		return permissionSlice
+	}, &conditionEnvironment{nil, nil, component, method, path})
+}
+
+// The deny candidates are looked up by the reachable path so the index could narrow them down
+func evaluateChildPermissionWithEnvironment(permissionSlice []*Permission, getDenyCandidateSlice func(reachablePath string) []*Permission, environment *conditionEnvironment) bool {
+	component := environment.component
+	method := environment.method
+	for _, permission := range permissionSlice {
+		if permission.Effect.IsDeny() || !permission.MatchChild(component, method, environment.path) || !permission.isEffective(environment) {
+			continue
+		}
+
+		// The node where the allow starts to apply under the target
+		reachablePath := permission.getReachablePath(environment.path)
+
+		denied := false
+		for _, denyPermission := range getDenyCandidateSlice(reachablePath) {
+			if denyPermission.Effect.IsDeny() && denyPermission.Match(component, method, reachablePath) && denyPermission.isEffective(environment) {
+				denied = true
+				break
+			}
+		}
+		if denied == false {
+			return true
+		}
+	}
+	return false
+}
+
+func evaluateResource(resourceSlice []*Resource, component string, path string) bool {
+	allowed := false
+	for _, resource := range resourceSlice {
+		if resource.Match(component, path) {
+			if resource.Effect.IsDeny() {
+				return false
+			}
+			allowed = true
+		}
+	}
+	return allowed
+}
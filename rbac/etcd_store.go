@@ -0,0 +1,196 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"github.com/cloudawan/cloudone_utility/database/etcd"
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Objects are stored under EtcdBasePath/rbac/<kind>/<escaped name>
+const etcdStoreDirectory = "/rbac"
+
+// Wait before watching again after the watch fails
+const etcdStoreWatchRetryInterval = 5 * time.Second
+
+type EtcdStore struct {
+	*backendStore
+	etcdClient *etcd.EtcdClient
+}
+
+func CreateEtcdStore(etcdClient *etcd.EtcdClient) *EtcdStore {
+	etcdStore := &EtcdStore{etcdClient: etcdClient}
+	etcdStore.backendStore = &backendStore{etcdStore}
+	return etcdStore
+}
+
+func (etcdStore *EtcdStore) getDirectory() string {
+	return etcdStore.etcdClient.EtcdBasePath + etcdStoreDirectory
+}
+
+func (etcdStore *EtcdStore) getKey(kind string, name string) string {
+	return etcdStore.getDirectory() + "/" + kind + "/" + url.QueryEscape(name)
+}
+
+// Parse the kind and the name from the key. Return false if the key isn't an object.
+func (etcdStore *EtcdStore) parseKey(key string) (string, string, bool) {
+	if strings.HasPrefix(key, etcdStore.getDirectory()+"/") == false {
+		return "", "", false
+	}
+	fieldSlice := strings.Split(strings.TrimPrefix(key, etcdStore.getDirectory()+"/"), "/")
+	if len(fieldSlice) != 2 {
+		return "", "", false
+	}
+	name, err := url.QueryUnescape(fieldSlice[1])
+	if err != nil {
+		return "", "", false
+	}
+	return fieldSlice[0], name, true
+}
+
+func isEtcdErrorCode(err error, code int) bool {
+	errorData, ok := err.(client.Error)
+	return ok && errorData.Code == code
+}
+
+func (etcdStore *EtcdStore) save(kind string, name string, byteSlice []byte) error {
+	keysAPI, err := etcdStore.etcdClient.GetKeysAPI()
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	_, err = keysAPI.Set(context.Background(), etcdStore.getKey(kind, name), string(byteSlice), nil)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	return nil
+}
+
+// Deleting the object not existing is not an error
+func (etcdStore *EtcdStore) delete(kind string, name string) error {
+	keysAPI, err := etcdStore.etcdClient.GetKeysAPI()
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	_, err = keysAPI.Delete(context.Background(), etcdStore.getKey(kind, name), nil)
+	if err != nil && isEtcdErrorCode(err, client.ErrorCodeKeyNotFound) == false {
+		log.Error(err)
+		return err
+	}
+	return nil
+}
+
+func (etcdStore *EtcdStore) get(kind string, name string) ([]byte, error) {
+	keysAPI, err := etcdStore.etcdClient.GetKeysAPI()
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	response, err := keysAPI.Get(context.Background(), etcdStore.getKey(kind, name), nil)
+	if err != nil {
+		if isEtcdErrorCode(err, client.ErrorCodeKeyNotFound) {
+			return nil, nil
+		}
+		log.Error(err)
+		return nil, err
+	}
+	return []byte(response.Node.Value), nil
+}
+
+func (etcdStore *EtcdStore) getAll(kind string) ([][]byte, error) {
+	keysAPI, err := etcdStore.etcdClient.GetKeysAPI()
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	byteSliceSlice := make([][]byte, 0)
+	response, err := keysAPI.Get(context.Background(), etcdStore.getDirectory()+"/"+kind, &client.GetOptions{Recursive: true, Sort: true})
+	if err != nil {
+		if isEtcdErrorCode(err, client.ErrorCodeKeyNotFound) {
+			return byteSliceSlice, nil
+		}
+		log.Error(err)
+		return nil, err
+	}
+
+	for _, node := range response.Node.Nodes {
+		if node.Dir == false {
+			byteSliceSlice = append(byteSliceSlice, []byte(node.Value))
+		}
+	}
+	return byteSliceSlice, nil
+}
+
+// Watch the changes with a goroutine. If the watch falls behind the etcd event history, a resync event is sent.
+func (etcdStore *EtcdStore) Watch(handler func(storeEvent *StoreEvent)) (func(), error) {
+	keysAPI, err := etcdStore.etcdClient.GetKeysAPI()
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		watcher := keysAPI.Watcher(etcdStore.getDirectory(), &client.WatcherOptions{Recursive: true})
+		for {
+			response, err := watcher.Next(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				if isEtcdErrorCode(err, client.ErrorCodeEventIndexCleared) {
+					// Restart from the current index since the missed changes are unknown
+					log.Error("Watch of %s falls behind, resync", etcdStore.getDirectory())
+					watcher = keysAPI.Watcher(etcdStore.getDirectory(), &client.WatcherOptions{Recursive: true})
+					handler(&StoreEvent{StoreEventTypeResync, "", ""})
+					continue
+				}
+				log.Error(err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(etcdStoreWatchRetryInterval):
+				}
+				continue
+			}
+
+			if response.Node == nil {
+				continue
+			}
+			kind, name, ok := etcdStore.parseKey(response.Node.Key)
+			if ok == false {
+				continue
+			}
+			eventType := StoreEventTypeSaved
+			switch response.Action {
+			case "delete", "expire", "compareAndDelete":
+				eventType = StoreEventTypeDeleted
+			}
+			handler(&StoreEvent{eventType, kind, name})
+		}
+	}()
+
+	return cancel, nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"errors"
+	"github.com/cloudawan/cloudone_utility/database/etcd"
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// In-memory keys API with the flat keys, the directory listing and the recursive watch only
+type fakeKeysAPI struct {
+	valueMap     map[string]string
+	responseChan chan *client.Response
+	mutex        sync.Mutex
+}
+
+func (fake *fakeKeysAPI) Get(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	if value, ok := fake.valueMap[key]; ok {
+		return &client.Response{Action: "get", Node: &client.Node{Key: key, Value: value}}, nil
+	}
+	node := &client.Node{Key: key, Dir: true}
+	keySlice := make([]string, 0)
+	for childKey := range fake.valueMap {
+		if strings.HasPrefix(childKey, key+"/") {
+			keySlice = append(keySlice, childKey)
+		}
+	}
+	if len(keySlice) == 0 {
+		return nil, client.Error{Code: client.ErrorCodeKeyNotFound, Message: "Key not found"}
+	}
+	sort.Strings(keySlice)
+	for _, childKey := range keySlice {
+		node.Nodes = append(node.Nodes, &client.Node{Key: childKey, Value: fake.valueMap[childKey]})
+	}
+	return &client.Response{Action: "get", Node: node}, nil
+}
+
+func (fake *fakeKeysAPI) Set(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+	fake.mutex.Lock()
+	fake.valueMap[key] = value
+	fake.mutex.Unlock()
+	response := &client.Response{Action: "set", Node: &client.Node{Key: key, Value: value}}
+	fake.responseChan <- response
+	return response, nil
+}
+
+func (fake *fakeKeysAPI) Delete(ctx context.Context, key string, opts *client.DeleteOptions) (*client.Response, error) {
+	fake.mutex.Lock()
+	_, ok := fake.valueMap[key]
+	delete(fake.valueMap, key)
+	fake.mutex.Unlock()
+	if ok == false {
+		return nil, client.Error{Code: client.ErrorCodeKeyNotFound, Message: "Key not found"}
+	}
+	response := &client.Response{Action: "delete", Node: &client.Node{Key: key}}
+	fake.responseChan <- response
+	return response, nil
+}
+
+func (fake *fakeKeysAPI) Create(ctx context.Context, key, value string) (*client.Response, error) {
+	return nil, errors.New("Not supported")
+}
+
+func (fake *fakeKeysAPI) CreateInOrder(ctx context.Context, dir, value string, opts *client.CreateInOrderOptions) (*client.Response, error) {
+	return nil, errors.New("Not supported")
+}
+
+func (fake *fakeKeysAPI) Update(ctx context.Context, key, value string) (*client.Response, error) {
+	return nil, errors.New("Not supported")
+}
+
+func (fake *fakeKeysAPI) Watcher(key string, opts *client.WatcherOptions) client.Watcher {
+	return fake
+}
+
+func (fake *fakeKeysAPI) Next(ctx context.Context) (*client.Response, error) {
+	select {
+	case response := <-fake.responseChan:
+		return response, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func createTestEtcdStore() (*EtcdStore, *fakeKeysAPI) {
+	fake := &fakeKeysAPI{valueMap: make(map[string]string), responseChan: make(chan *client.Response, 100)}
+	etcdClient := &etcd.EtcdClient{KeysAPI: fake, EtcdBasePath: "/cloudone"}
+	return CreateEtcdStore(etcdClient), fake
+}
+
+func TestEtcdStore(t *testing.T) {
+	etcdStore, fake := createTestEtcdStore()
+	saveTestStoreObject(t, etcdStore)
+	if _, ok := fake.valueMap["/cloudone/rbac/users/bob%2Fops"]; ok == false {
+		t.Errorf("User should be stored under the base path with the escaped name")
+	}
+	checkTestStoreObject(t, etcdStore)
+}
+
+func TestEtcdStoreWatch(t *testing.T) {
+	etcdStore, fake := createTestEtcdStore()
+	eventChan := make(chan *StoreEvent, 10)
+	stop, err := etcdStore.Watch(func(storeEvent *StoreEvent) {
+		eventChan <- storeEvent
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	etcdStore.SaveUser(createTestUser(t, "bob/ops", testPassword, nil, nil, "", nil, nil, false))
+	etcdStore.DeleteUser("bob/ops")
+	fake.responseChan <- &client.Response{Action: "set", Node: &client.Node{Key: "/cloudone/other/key"}}
+	etcdStore.SaveRole(&Role{Name: "viewer"})
+
+	expectedSlice := []StoreEvent{
+		{StoreEventTypeSaved, StoreKindUser, "bob/ops"},
+		{StoreEventTypeDeleted, StoreKindUser, "bob/ops"},
+		{StoreEventTypeSaved, StoreKindRole, "viewer"},
+	}
+	for _, expected := range expectedSlice {
+		select {
+		case storeEvent := <-eventChan:
+			if *storeEvent != expected {
+				t.Errorf("Expect %v but get %v", expected, *storeEvent)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expect %v but get nothing", expected)
+		}
+	}
+}
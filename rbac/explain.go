@@ -0,0 +1,123 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import ()
+
+const (
+	DecisionReasonAllowed         = "Allowed"
+	DecisionReasonDenied          = "Denied"
+	DecisionReasonNoMatch         = "NoMatch"
+	NearMissDifferenceMethod      = "Method"
+	NearMissDifferencePath        = "Path"
+	ResourceDecisionReasonAllowed = "Allowed"
+	ResourceDecisionReasonDenied  = "Denied"
+	ResourceDecisionReasonNoMatch = "NoMatch"
+)
+
+// Decision explains the result of HasPermission and HasResource for the same target
+type Decision struct {
+	Component       string
+	Method          string
+	Path            string
+	Allowed         bool
+	Reason          string
+	RoleName        string      // The role granting the permission or the role holding the deny which won
+	Permission      *Permission // The permission granting the target or the deny which won
+	ResourceAllowed bool
+	ResourceReason  string
+	Resource        *Resource // The resource granting the target or the deny which won
+	NearMissSlice   []*NearMiss
+}
+
+// NearMiss is an allow permission which would grant the target if only the method or the path were different
+type NearMiss struct {
+	RoleName   string
+	Permission *Permission
+	Difference string
+}
+
+// Explain why HasPermission and HasResource return the result for the target. The decision is consistent with them.
+func (user *User) Explain(component string, method string, path string) *Decision {
+	decision := &Decision{
+		Component:     component,
+		Method:        method,
+		Path:          path,
+		Reason:        DecisionReasonNoMatch,
+		NearMissSlice: make([]*NearMiss, 0),
+	}
+
+	for _, role := range user.GetEffectiveRoleSlice() {
+		for _, permission := range role.GetEffectivePermissionSlice() {
+			if permission.Match(component, method, path) && permission.isEffective(nil) {
+				if permission.Effect.IsDeny() {
+					if decision.Reason != DecisionReasonDenied {
+						decision.Allowed = false
+						decision.Reason = DecisionReasonDenied
+						decision.RoleName = role.Name
+						decision.Permission = permission
+					}
+				} else if decision.Reason == DecisionReasonNoMatch {
+					decision.Allowed = true
+					decision.Reason = DecisionReasonAllowed
+					decision.RoleName = role.Name
+					decision.Permission = permission
+				}
+			} else if permission.Effect.IsDeny() == false {
+				if difference := permission.getNearMissDifference(component, method, path); difference != "" {
+					decision.NearMissSlice = append(decision.NearMissSlice, &NearMiss{
+						role.Name,
+						permission,
+						difference,
+					})
+				}
+			}
+		}
+	}
+
+	decision.ResourceReason = ResourceDecisionReasonNoMatch
+	for _, resource := range user.GetEffectiveResourceSlice() {
+		if resource.Match(component, path) {
+			if resource.Effect.IsDeny() {
+				decision.ResourceAllowed = false
+				decision.ResourceReason = ResourceDecisionReasonDenied
+				decision.Resource = resource
+				break
+			} else if decision.ResourceReason == ResourceDecisionReasonNoMatch {
+				decision.ResourceAllowed = true
+				decision.ResourceReason = ResourceDecisionReasonAllowed
+				decision.Resource = resource
+			}
+		}
+	}
+
+	return decision
+}
+
+// Return which part differs if the permission would match the target with only the method or only the path changed, otherwise empty string
+func (permission *Permission) getNearMissDifference(component string, method string, path string) string {
+	if permission.Component != "*" && permission.Component != component {
+		return ""
+	}
+	methodMatched := permission.Method == "*" || permission.Method == method
+	pathMatched := permission.Match(component, permission.Method, path)
+	if methodMatched == false && pathMatched {
+		return NearMissDifferenceMethod
+	} else if methodMatched && pathMatched == false {
+		return NearMissDifferencePath
+	} else {
+		return ""
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestExplain(t *testing.T) {
+	user := createDenyTestUser(t)
+
+	decision := user.Explain("cloudone_gui", "GET", "/gui/inventory")
+	if decision.Allowed == false || decision.Reason != DecisionReasonAllowed || decision.RoleName != "operator" || decision.Permission.Path != "/gui" {
+		t.Errorf("Unexpected decision %+v", decision)
+	}
+
+	decision = user.Explain("cloudone_gui", "GET", "/gui/system/rbac/user")
+	if decision.Allowed || decision.Reason != DecisionReasonDenied || decision.RoleName != "restriction" || decision.Permission.Path != "/gui/system/rbac" {
+		t.Errorf("Unexpected decision %+v", decision)
+	}
+
+	decision = user.Explain("cloudone", "POST", "/api/v1/namespaces/default")
+	if decision.Allowed || decision.Reason != DecisionReasonNoMatch {
+		t.Errorf("Unexpected decision %+v", decision)
+	}
+	if len(decision.NearMissSlice) != 1 || decision.NearMissSlice[0].Difference != NearMissDifferenceMethod {
+		t.Errorf("Expect a near miss on method but get %+v", decision.NearMissSlice)
+	}
+
+	decision = user.Explain("cloudone", "GET", "/api/v1/nodes")
+	if len(decision.NearMissSlice) != 1 || decision.NearMissSlice[0].Difference != NearMissDifferencePath {
+		t.Errorf("Expect a near miss on path but get %+v", decision.NearMissSlice)
+	}
+
+	decision = user.Explain("cloudone", "GET", "/namespaces/kube-system")
+	if decision.ResourceAllowed || decision.ResourceReason != ResourceDecisionReasonDenied {
+		t.Errorf("Unexpected resource decision %+v", decision)
+	}
+
+	if _, err := json.Marshal(decision); err != nil {
+		t.Errorf("Decision should be serializable: %s", err)
+	}
+}
+
+func TestExplainConsistency(t *testing.T) {
+	user := createDenyTestUser(t)
+
+	for _, component := range []string{"cloudone_gui", "cloudone"} {
+		for _, method := range []string{"GET", "POST"} {
+			for _, path := range []string{"/gui", "/gui/system/rbac", "/api/v1/namespaces/x", "/namespaces/kube-system", "/namespaces/default"} {
+				decision := user.Explain(component, method, path)
+				if decision.Allowed != user.HasPermission(component, method, path) {
+					t.Errorf("Explain permission differs for %s %s %s", component, method, path)
+				}
+				if decision.ResourceAllowed != user.HasResource(component, path) {
+					t.Errorf("Explain resource differs for %s %s", component, path)
+				}
+			}
+		}
+	}
+}
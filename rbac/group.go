@@ -0,0 +1,97 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"errors"
+	"sync"
+)
+
+// Roles and resources of a group are granted to all the users referencing the group by name
+type Group struct {
+	Name          string
+	RoleSlice     []*Role
+	ResourceSlice []*Resource
+	Description   string
+}
+
+func CreateGroup(name string, roleSlice []*Role, resourceSlice []*Resource, description string) (*Group, error) {
+	if name == "" {
+		log.Error("Name couldn't be empty")
+		return nil, errors.New("Name couldn't be empty")
+	}
+
+	return &Group{
+		name,
+		roleSlice,
+		resourceSlice,
+		description,
+	}, nil
+}
+
+func (group *Group) HasPermission(component string, method string, path string) bool {
+	return evaluatePermission(group.getPermissionSlice(), component, method, path)
+}
+
+func (group *Group) HasResource(component string, path string) bool {
+	return evaluateResource(group.ResourceSlice, component, path)
+}
+
+func (group *Group) getPermissionSlice() []*Permission {
+	permissionSlice := make([]*Permission, 0)
+	for _, role := range group.RoleSlice {
+		permissionSlice = append(permissionSlice, role.GetEffectivePermissionSlice()...)
+	}
+	return permissionSlice
+}
+
+type GroupResolver struct {
+	groupMap map[string]*Group
+}
+
+func CreateGroupResolver(groupSlice []*Group) (*GroupResolver, error) {
+	groupResolver := &GroupResolver{make(map[string]*Group)}
+	for _, group := range groupSlice {
+		if _, ok := groupResolver.groupMap[group.Name]; ok {
+			log.Error("Duplicate group name %s", group.Name)
+			return nil, errors.New("Duplicate group name " + group.Name)
+		}
+		groupResolver.groupMap[group.Name] = group
+	}
+	return groupResolver, nil
+}
+
+func (groupResolver *GroupResolver) GetGroup(name string) *Group {
+	if groupResolver == nil {
+		return nil
+	}
+	return groupResolver.groupMap[name]
+}
+
+var groupResolver *GroupResolver
+var groupResolverMutex sync.RWMutex
+
+func GetGroupResolver() *GroupResolver {
+	groupResolverMutex.RLock()
+	defer groupResolverMutex.RUnlock()
+	return groupResolver
+}
+
+// Set the resolver used to resolve the groups referenced by name from users
+func SetGroupResolver(resolver *GroupResolver) {
+	groupResolverMutex.Lock()
+	defer groupResolverMutex.Unlock()
+	groupResolver = resolver
+}
@@ -0,0 +1,67 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"testing"
+)
+
+func TestGroup(t *testing.T) {
+	inventoryPermission, _ := CreatePermission("cloudone_gui", "GET", "/gui/inventory")
+	repositoryPermission, _ := CreatePermission("cloudone_gui", "GET", "/gui/repository")
+	denyPermission, _ := CreateDenyPermission("cloudone_gui", "*", "/gui/inventory/secret")
+	namespaceResource, _ := CreateResource("cloudone", "/namespaces/team-a")
+
+	teamA, _ := CreateGroup("team-a", []*Role{&Role{Name: "viewer", PermissionSlice: []*Permission{inventoryPermission}}}, []*Resource{namespaceResource}, "")
+	teamB, _ := CreateGroup("team-b", []*Role{&Role{Name: "builder", PermissionSlice: []*Permission{inventoryPermission, repositoryPermission}}}, nil, "")
+	groupResolver, err := CreateGroupResolver([]*Group{teamA, teamB})
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetGroupResolver(groupResolver)
+	defer SetGroupResolver(nil)
+
+	user := createTestUser(t, "u", testPassword, []*Role{&Role{Name: "restriction", PermissionSlice: []*Permission{denyPermission}}}, nil, "", nil, nil, false)
+	user.GroupNameSlice = []string{"team-a", "team-b", "missing"}
+
+	if user.HasPermission("cloudone_gui", "GET", "/gui/repository/image") == false {
+		t.Errorf("Group permission should be merged")
+	}
+	if user.HasPermission("cloudone_gui", "GET", "/gui/inventory/secret") {
+		t.Errorf("User deny should override group allow")
+	}
+	if user.HasResource("cloudone", "/namespaces/team-a/pods") == false {
+		t.Errorf("Group resource should be merged")
+	}
+
+	groupSlice := user.GetGroupSliceWithPermission("cloudone_gui", "GET", "/gui/inventory")
+	if len(groupSlice) != 2 || groupSlice[0].Name != "team-a" || groupSlice[1].Name != "team-b" {
+		t.Errorf("Both groups should contribute the inventory permission")
+	}
+	groupSlice = user.GetGroupSliceWithPermission("cloudone_gui", "GET", "/gui/repository")
+	if len(groupSlice) != 1 || groupSlice[0].Name != "team-b" {
+		t.Errorf("Only team-b should contribute the repository permission")
+	}
+
+	partialUser := user.CopyPartialUserDataForComponent("cloudone_gui")
+	SetGroupResolver(nil)
+	if partialUser.HasPermission("cloudone_gui", "GET", "/gui/repository") == false {
+		t.Errorf("Partial user should carry the group permissions")
+	}
+
+	if _, err := CreateGroupResolver([]*Group{teamA, teamA}); err == nil {
+		t.Errorf("Duplicate group should be rejected")
+	}
+}
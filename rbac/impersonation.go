@@ -0,0 +1,117 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Impersonation is granted with the permission on ImpersonationComponent with ImpersonationMethod to the path of the target user,
+// such as "/users/alice" for one user or "/users" for all the users.
+const (
+	ImpersonationComponent       = "rbac"
+	ImpersonationMethod          = "IMPERSONATE"
+	ImpersonationUserPath        = "/users"
+	ImpersonatorMetaDataKey      = "impersonator" // Reserved so the meta data couldn't pass for an impersonation. See GetImpersonatorName.
+	MaximumImpersonationDuration = time.Hour
+)
+
+var ErrImpersonationForbidden = errors.New("Impersonation is not granted")
+
+func GetImpersonationPath(userName string) string {
+	return ImpersonationUserPath + "/" + userName
+}
+
+// The user couldn't impersonate itself
+func (user *User) CanImpersonate(userName string) bool {
+	if user.Name == userName {
+		return false
+	}
+	return user.HasPermission(ImpersonationComponent, ImpersonationMethod, GetImpersonationPath(userName))
+}
+
+// Return the real user name if the user is impersonated. Empty otherwise.
+// It is only set by CreateImpersonationSession and the signed token, never by the meta data.
+func GetImpersonatorName(user *User) string {
+	if user == nil {
+		return ""
+	}
+	return user.impersonatorName
+}
+
+// The target is copied with the impersonator. The target itself isn't modified.
+func createImpersonatedUser(realUser *User, targetUser *User) *User {
+	impersonatedUser := *targetUser
+	impersonatedUser.impersonatorName = realUser.Name
+	return &impersonatedUser
+}
+
+// Create a session evaluated with the permissions of the target user on behalf of the real user.
+// The duration is limited by MaximumImpersonationDuration and the session neither slides nor refreshes.
+// Nested impersonation and impersonating a user who could impersonate others are rejected to avoid escalating the privilege.
+func (sessionManager *SessionManager) CreateImpersonationSession(realUser *User, targetUser *User, duration time.Duration, remoteAddress string, userAgent string) (string, *Session, error) {
+	if realUser == nil || targetUser == nil {
+		log.Error("User couldn't be nil")
+		return "", nil, errors.New("User couldn't be nil")
+	}
+	if duration <= 0 || duration > MaximumImpersonationDuration {
+		log.Error("Impersonation duration %v is out of range", duration)
+		return "", nil, errors.New("Impersonation duration must be positive and at most " + strconv.Itoa(int(MaximumImpersonationDuration/time.Minute)) + " minutes")
+	}
+	if GetImpersonatorName(realUser) != "" || GetImpersonatorName(targetUser) != "" {
+		log.Error("Nested impersonation of %s by %s is rejected", targetUser.Name, realUser.Name)
+		return "", nil, ErrImpersonationForbidden
+	}
+	if realUser.Disabled || realUser.CanImpersonate(targetUser.Name) == false {
+		log.Error("User %s isn't allowed to impersonate %s", realUser.Name, targetUser.Name)
+		return "", nil, ErrImpersonationForbidden
+	}
+	if targetUser.HasChildPermission(ImpersonationComponent, ImpersonationMethod, ImpersonationUserPath) {
+		log.Error("User %s could impersonate others so couldn't be impersonated", targetUser.Name)
+		return "", nil, ErrImpersonationForbidden
+	}
+
+	token, err := GenerateToken()
+	if err != nil {
+		log.Error(err)
+		return "", nil, err
+	}
+
+	impersonatedUser := createImpersonatedUser(realUser, targetUser)
+	session := sessionManager.recordSession(token, impersonatedUser, duration, remoteAddress, userAgent, "", sessionManager.now(), realUser.Name)
+	return token, session, nil
+}
+
+// Unexpired sessions impersonated by the user in the order of the creation
+func (sessionManager *SessionManager) GetImpersonationSessionSlice(impersonatorName string) []*Session {
+	sessionSlice := make([]*Session, 0)
+	if impersonatorName == "" {
+		return sessionSlice
+	}
+
+	sessionManager.mutex.Lock()
+	defer sessionManager.mutex.Unlock()
+	now := sessionManager.now()
+	for _, session := range sessionManager.sessionMap {
+		if session.ImpersonatorName == impersonatorName && now.After(session.ExpiredTime) == false {
+			copiedSession := *session
+			sessionSlice = append(sessionSlice, &copiedSession)
+		}
+	}
+	sortSessionSlice(sessionSlice)
+	return sessionSlice
+}
@@ -0,0 +1,240 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"github.com/cloudawan/cloudone_utility/audit"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func createImpersonationTestUser(t *testing.T, name string, path string) *User {
+	permission, err := CreatePermission(ImpersonationComponent, ImpersonationMethod, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	support := &Role{Name: "support", PermissionSlice: []*Permission{permission}}
+	return &User{Name: name, RoleSlice: []*Role{support}}
+}
+
+func TestImpersonationGrant(t *testing.T) {
+	support := createImpersonationTestUser(t, "support", ImpersonationUserPath)
+	limited := createImpersonationTestUser(t, "limited", GetImpersonationPath("u"))
+
+	checkSlice := []struct {
+		user     *User
+		target   string
+		expected bool
+	}{
+		{support, "u", true},
+		{support, "other", true},
+		{support, "support", false},
+		{limited, "u", true},
+		{limited, "other", false},
+		{createDenyTestUser(t), "support", false},
+	}
+	for _, check := range checkSlice {
+		if check.user.CanImpersonate(check.target) != check.expected {
+			t.Errorf("%s impersonating %s should be %v", check.user.Name, check.target, check.expected)
+		}
+	}
+}
+
+func TestImpersonationSession(t *testing.T) {
+	sessionManager, err := CreateSessionManager(CreateMemoryTokenCache(0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionManager.SlidingExpiry = true
+	now := time.Now()
+	sessionManager.now = func() time.Time {
+		return now
+	}
+
+	support := createImpersonationTestUser(t, "support", ImpersonationUserPath)
+	target := createDenyTestUser(t)
+	target.MetaDataMap = map[string]string{"email": "u@example.com"}
+
+	if _, _, err := sessionManager.CreateImpersonationSession(support, target, MaximumImpersonationDuration+time.Minute, "", ""); err == nil {
+		t.Errorf("Duration beyond the limit should be rejected")
+	}
+	if _, _, err := sessionManager.CreateImpersonationSession(target, support, time.Minute, "", ""); err != ErrImpersonationForbidden {
+		t.Errorf("User without the grant should be rejected but get %v", err)
+	}
+	other := createImpersonationTestUser(t, "other", GetImpersonationPath("u"))
+	if _, _, err := sessionManager.CreateImpersonationSession(support, other, time.Minute, "", ""); err != ErrImpersonationForbidden {
+		t.Errorf("User who could impersonate should not be impersonated but get %v", err)
+	}
+
+	token, session, err := sessionManager.CreateImpersonationSession(support, target, 10*time.Minute, "10.0.0.1:1234", "curl/7.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.UserName != "u" || session.ImpersonatorName != "support" {
+		t.Errorf("Session should carry both identities but get %s %s", session.UserName, session.ImpersonatorName)
+	}
+	if len(target.MetaDataMap) != 1 {
+		t.Errorf("Target user should not be modified")
+	}
+
+	user := sessionManager.GetUser(token)
+	if user == nil || user.Name != "u" || GetImpersonatorName(user) != "support" || user.MetaDataMap["email"] != "u@example.com" {
+		t.Fatalf("Impersonated user should be looked up with the impersonator")
+	}
+	if user.HasPermission("cloudone_gui", "GET", "/gui/inventory") == false || user.HasPermission("cloudone_gui", "GET", "/gui/system/rbac") {
+		t.Errorf("Impersonated user should be evaluated with the permissions of the target")
+	}
+	if user.CanImpersonate("other") {
+		t.Errorf("Impersonated user should not inherit the grant of the impersonator")
+	}
+	if _, _, err := sessionManager.CreateImpersonationSession(user, createDenyTestUser(t), time.Minute, "", ""); err != ErrImpersonationForbidden {
+		t.Errorf("Nested impersonation should be rejected but get %v", err)
+	}
+
+	now = now.Add(5 * time.Minute)
+	sessionManager.GetUser(token)
+	sessionSlice := sessionManager.GetImpersonationSessionSlice("support")
+	if len(sessionSlice) != 1 || sessionSlice[0].ExpiredTime.Equal(session.ExpiredTime) == false {
+		t.Errorf("Impersonation session should not slide")
+	}
+	if len(sessionManager.GetImpersonationSessionSlice("")) != 0 {
+		t.Errorf("Empty impersonator should match nothing")
+	}
+
+	amount, err := sessionManager.RevokeAllSession("support")
+	if err != nil || amount != 1 {
+		t.Errorf("Impersonation session should be revoked with the impersonator but get %d %v", amount, err)
+	}
+	if sessionManager.GetUser(token) != nil {
+		t.Errorf("Revoked impersonation token should be rejected")
+	}
+}
+
+func TestImpersonationAuditLog(t *testing.T) {
+	previousTokenCache := SetDefaultTokenCache(CreateMemoryTokenCache(0))
+	defer SetDefaultTokenCache(previousTokenCache)
+
+	sessionManager, err := CreateSessionManager(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	support := createImpersonationTestUser(t, "support", ImpersonationUserPath)
+	token, _, err := sessionManager.CreateImpersonationSession(support, createDenyTestUser(t), time.Minute, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auditLogSlice := make([]*audit.AuditLog, 0)
+	authorizationMiddleware := CreateAuthorizationMiddleware("cloudone_gui", CreateHeaderTokenSource("token"))
+	authorizationMiddleware.UserLookup = sessionManager.GetUser
+	authorizationMiddleware.AuditLogHandler = func(auditLog *audit.AuditLog) {
+		auditLogSlice = append(auditLogSlice, auditLog)
+	}
+	handler := authorizationMiddleware.Handler(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {}))
+
+	for _, path := range []string{"/gui/inventory", "/gui/system/rbac"} {
+		request := httptest.NewRequest("GET", path, nil)
+		request.Header.Set("token", token)
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+	}
+	if len(auditLogSlice) != 2 {
+		t.Fatalf("Audit log should be emitted for every request")
+	}
+	for _, auditLog := range auditLogSlice {
+		if auditLog.UserName != "u" || auditLog.RealUserName != "support" {
+			t.Errorf("Audit log should record the effective and the real user but get %s %s", auditLog.UserName, auditLog.RealUserName)
+		}
+	}
+	if auditLogSlice[0].Decision != AuthorizationDecisionAllowed || auditLogSlice[1].Decision != AuthorizationDecisionForbidden {
+		t.Errorf("Requests should be authorized as the target user")
+	}
+}
+
+func TestImpersonationSynchronizeTokenCache(t *testing.T) {
+	store := CreateMemoryStore()
+	previousRoleResolver, previousGroupResolver := GetRoleResolver(), GetGroupResolver()
+	defer SetRoleResolver(previousRoleResolver)
+	defer SetGroupResolver(previousGroupResolver)
+
+	support := createImpersonationTestUser(t, "support", ImpersonationUserPath)
+	target := createDenyTestUser(t)
+	for _, role := range append(support.RoleSlice, target.RoleSlice...) {
+		if err := store.SaveRole(role); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, user := range []*User{support, target} {
+		if err := store.SaveUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tokenCache := CreateMemoryTokenCache(0)
+	tokenCache.Set("impersonation-token", createImpersonatedUser(support, target), time.Hour)
+	stop, err := SynchronizeTokenCache(store, tokenCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	target.Description = "changed"
+	store.SaveUser(target)
+	if user := tokenCache.Get("impersonation-token"); user == nil || user.Description != "changed" || GetImpersonatorName(user) != "support" {
+		t.Errorf("Impersonated user should be refreshed with the impersonator kept")
+	}
+
+	support.Disabled = true
+	store.SaveUser(support)
+	if tokenCache.Get("impersonation-token") != nil {
+		t.Errorf("Impersonation should end once the impersonator is disabled")
+	}
+}
+
+func TestImpersonatorIsNotMetaData(t *testing.T) {
+	support := createImpersonationTestUser(t, "support", ImpersonationUserPath)
+	forgedUser := createDenyTestUser(t)
+	forgedUser.MetaDataMap = map[string]string{ImpersonatorMetaDataKey: "support", ServiceAccountMetaDataKey: "true", "email": "u@example.com"}
+	if GetImpersonatorName(forgedUser) != "" {
+		t.Errorf("Meta data should not pass for the impersonator")
+	}
+
+	policyDocument := CreatePolicyDocument(nil, nil, []*User{forgedUser})
+	if metaDataMap := policyDocument.UserSlice[0].MetaDataMap; len(metaDataMap) != 1 || metaDataMap["email"] == "" {
+		t.Errorf("Reserved meta data keys should not be exported but get %v", metaDataMap)
+	}
+	_, err := LoadPolicy([]byte(`
+users:
+  - name: bob
+    metaData:
+      impersonator: support
+      serviceAccount: "true"
+`))
+	if policyValidationError, ok := err.(*PolicyValidationError); ok == false || len(policyValidationError.ErrorSlice) != 2 || policyValidationError.ErrorSlice[0].Line != 4 {
+		t.Errorf("Reserved meta data keys should be rejected but get %v", err)
+	}
+
+	// The signed token carries the impersonator outside the meta data
+	signingKey, _ := CreateHS256SigningKey("key", []byte("0123456789abcdef0123456789abcdef"))
+	token, err := CreateTokenIssuer("cloudone", signingKey, time.Hour).Issue(createImpersonatedUser(support, createDenyTestUser(t)), "cloudone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenUser, err := CreateTokenVerifier("cloudone", 0, []*SigningKey{signingKey}).Verify(token, "cloudone")
+	if err != nil || GetImpersonatorName(tokenUser) != "support" {
+		t.Errorf("Signed token should carry the impersonator but get %v", err)
+	}
+}
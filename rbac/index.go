@@ -0,0 +1,213 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"strings"
+)
+
+// AuthorizationIndex is an immutable snapshot of a user's effective permissions and resources.
+// Permissions are keyed by component and method and then placed in a trie over the path segments so only the candidates along the target path are evaluated.
+// The candidates are still checked with the same matching as the user so the answers are identical to HasPermission, HasChildPermission and HasResource.
+type AuthorizationIndex struct {
+	permissionIndexMap map[string]map[string]*indexNode // Component -> method -> trie root
+	resourceIndexMap   map[string]*indexNode            // Component -> trie root
+}
+
+type indexNode struct {
+	childMap        map[string]*indexNode
+	permissionSlice []*Permission
+	resourceSlice   []*Resource
+}
+
+func createIndexNode() *indexNode {
+	return &indexNode{
+		make(map[string]*indexNode),
+		make([]*Permission, 0),
+		make([]*Resource, 0),
+	}
+}
+
+// Build the index from the user's effective roles and resources including inherited roles and groups at the moment
+// Role grants active at the moment are included, so rebuild the index once a grant starts or ends.
+func CreateAuthorizationIndex(user *User) *AuthorizationIndex {
+	authorizationIndex := &AuthorizationIndex{
+		make(map[string]map[string]*indexNode),
+		make(map[string]*indexNode),
+	}
+
+	for _, permission := range user.getPermissionSlice() {
+		component := permission.Component
+		method := permission.Method
+		if component == "*" {
+			// Component * applies regardless of the method
+			method = "*"
+		}
+		methodMap, ok := authorizationIndex.permissionIndexMap[component]
+		if ok == false {
+			methodMap = make(map[string]*indexNode)
+			authorizationIndex.permissionIndexMap[component] = methodMap
+		}
+		root, ok := methodMap[method]
+		if ok == false {
+			root = createIndexNode()
+			methodMap[method] = root
+		}
+		node := root.getOrCreateNode(getIndexSegmentSlice(permission.Component, permission.Path, permission.MatchMode))
+		node.permissionSlice = append(node.permissionSlice, permission)
+	}
+
+	for _, resource := range user.GetEffectiveResourceSlice() {
+		root, ok := authorizationIndex.resourceIndexMap[resource.Component]
+		if ok == false {
+			root = createIndexNode()
+			authorizationIndex.resourceIndexMap[resource.Component] = root
+		}
+		node := root.getOrCreateNode(getIndexSegmentSlice("", resource.Path, resource.MatchMode))
+		node.resourceSlice = append(node.resourceSlice, resource)
+	}
+
+	return authorizationIndex
+}
+
+// The literal leading segments of the path where the entry is placed. The entries which couldn't be placed by segment stay at the root.
+func getIndexSegmentSlice(component string, path string, matchMode MatchMode) []string {
+	if component == "*" || path == "*" || matchMode.IsPrefix() {
+		return nil
+	}
+	segmentSlice := make([]string, 0)
+	for _, segment := range splitPath(path) {
+		if strings.ContainsAny(segment, "*{}") {
+			break
+		}
+		segmentSlice = append(segmentSlice, segment)
+	}
+	return segmentSlice
+}
+
+func (node *indexNode) getOrCreateNode(segmentSlice []string) *indexNode {
+	current := node
+	for _, segment := range segmentSlice {
+		child, ok := current.childMap[segment]
+		if ok == false {
+			child = createIndexNode()
+			current.childMap[segment] = child
+		}
+		current = child
+	}
+	return current
+}
+
+// Nodes from the root along the path as far as the trie goes
+func (node *indexNode) getNodeSliceAlongPath(segmentSlice []string) []*indexNode {
+	nodeSlice := []*indexNode{node}
+	current := node
+	for _, segment := range segmentSlice {
+		child, ok := current.childMap[segment]
+		if ok == false {
+			break
+		}
+		nodeSlice = append(nodeSlice, child)
+		current = child
+	}
+	return nodeSlice
+}
+
+func (node *indexNode) collectSubtreePermission(permissionSlice []*Permission) []*Permission {
+	permissionSlice = append(permissionSlice, node.permissionSlice...)
+	for _, child := range node.childMap {
+		permissionSlice = child.collectSubtreePermission(permissionSlice)
+	}
+	return permissionSlice
+}
+
+func (authorizationIndex *AuthorizationIndex) getPermissionRootSlice(component string, method string) []*indexNode {
+	rootSlice := make([]*indexNode, 0)
+	if methodMap, ok := authorizationIndex.permissionIndexMap[component]; ok {
+		if root, ok := methodMap[method]; ok {
+			rootSlice = append(rootSlice, root)
+		}
+		if method != "*" {
+			if root, ok := methodMap["*"]; ok {
+				rootSlice = append(rootSlice, root)
+			}
+		}
+	}
+	if component != "*" {
+		if methodMap, ok := authorizationIndex.permissionIndexMap["*"]; ok {
+			if root, ok := methodMap["*"]; ok {
+				rootSlice = append(rootSlice, root)
+			}
+		}
+	}
+	return rootSlice
+}
+
+// Permissions which may match the target node
+func (authorizationIndex *AuthorizationIndex) getCandidatePermissionSlice(component string, method string, path string) []*Permission {
+	permissionSlice := make([]*Permission, 0)
+	segmentSlice := splitPath(path)
+	for _, root := range authorizationIndex.getPermissionRootSlice(component, method) {
+		for _, node := range root.getNodeSliceAlongPath(segmentSlice) {
+			permissionSlice = append(permissionSlice, node.permissionSlice...)
+		}
+	}
+	return permissionSlice
+}
+
+// Permissions which may match the target node or its descendants
+func (authorizationIndex *AuthorizationIndex) getCandidateChildPermissionSlice(component string, method string, path string) []*Permission {
+	permissionSlice := make([]*Permission, 0)
+	segmentSlice := splitPath(path)
+	for _, root := range authorizationIndex.getPermissionRootSlice(component, method) {
+		nodeSlice := root.getNodeSliceAlongPath(segmentSlice)
+		for i, node := range nodeSlice {
+			if i == len(segmentSlice) {
+				// The target node itself, so all the descendants are candidates
+				permissionSlice = node.collectSubtreePermission(permissionSlice)
+			} else {
+				permissionSlice = append(permissionSlice, node.permissionSlice...)
+			}
+		}
+	}
+	return permissionSlice
+}
+
+func (authorizationIndex *AuthorizationIndex) HasPermission(component string, method string, path string) bool {
+	return evaluatePermission(authorizationIndex.getCandidatePermissionSlice(component, method, path), component, method, path)
+}
+
+func (authorizationIndex *AuthorizationIndex) HasChildPermission(component string, method string, path string) bool {
+	return evaluateChildPermissionWithEnvironment(authorizationIndex.getCandidateChildPermissionSlice(component, method, path), func(reachablePath string) []*Permission {
+		return authorizationIndex.getCandidatePermissionSlice(component, method, reachablePath)
+	}, &conditionEnvironment{nil, nil, component, method, path})
+}
+
+func (authorizationIndex *AuthorizationIndex) HasResource(component string, path string) bool {
+	resourceSlice := make([]*Resource, 0)
+	segmentSlice := splitPath(path)
+	componentSlice := []string{component}
+	if component != "*" {
+		componentSlice = append(componentSlice, "*")
+	}
+	for _, indexComponent := range componentSlice {
+		if root, ok := authorizationIndex.resourceIndexMap[indexComponent]; ok {
+			for _, node := range root.getNodeSliceAlongPath(segmentSlice) {
+				resourceSlice = append(resourceSlice, node.resourceSlice...)
+			}
+		}
+	}
+	return evaluateResource(resourceSlice, component, path)
+}
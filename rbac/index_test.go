@@ -0,0 +1,166 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func createRandomPath(random *rand.Rand, segmentSlice []string, maxLength int) string {
+	length := random.Intn(maxLength + 1)
+	pathSegmentSlice := make([]string, 0)
+	for i := 0; i < length; i++ {
+		pathSegmentSlice = append(pathSegmentSlice, segmentSlice[random.Intn(len(segmentSlice))])
+	}
+	path := "/" + strings.Join(pathSegmentSlice, "/")
+	if random.Intn(5) == 0 {
+		path += "/"
+	}
+	return path
+}
+
+func createRandomUser(random *rand.Rand) *User {
+	componentSlice := []string{"c1", "c2", "*"}
+	methodSlice := []string{"GET", "POST", "*"}
+	patternSegmentSlice := []string{"a", "b", "ab", "{x}", "*", "**"}
+	matchModeSlice := []MatchMode{"", MatchModePrefix, MatchModeSegment, MatchModeSegment}
+	effectSlice := []Effect{"", EffectAllow, EffectDeny}
+
+	createPath := func() string {
+		if random.Intn(10) == 0 {
+			return "*"
+		}
+		return createRandomPath(random, patternSegmentSlice, 3)
+	}
+
+	roleSlice := make([]*Role, 0)
+	for i := 0; i < 1+random.Intn(3); i++ {
+		role := &Role{Name: "r" + strconv.Itoa(i)}
+		for j := 0; j < random.Intn(6); j++ {
+			role.PermissionSlice = append(role.PermissionSlice, &Permission{
+				Name:      "p",
+				Component: componentSlice[random.Intn(len(componentSlice))],
+				Method:    methodSlice[random.Intn(len(methodSlice))],
+				Path:      createPath(),
+				Effect:    effectSlice[random.Intn(len(effectSlice))],
+				MatchMode: matchModeSlice[random.Intn(len(matchModeSlice))],
+			})
+		}
+		roleSlice = append(roleSlice, role)
+	}
+
+	resourceSlice := make([]*Resource, 0)
+	for i := 0; i < random.Intn(5); i++ {
+		resourceSlice = append(resourceSlice, &Resource{
+			Name:      "r",
+			Component: componentSlice[random.Intn(len(componentSlice))],
+			Path:      createPath(),
+			Effect:    effectSlice[random.Intn(len(effectSlice))],
+			MatchMode: matchModeSlice[random.Intn(len(matchModeSlice))],
+		})
+	}
+
+	return &User{Name: "u", RoleSlice: roleSlice, ResourceSlice: resourceSlice}
+}
+
+func TestAuthorizationIndexAgreesWithUser(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	componentSlice := []string{"c1", "c2"}
+	methodSlice := []string{"GET", "POST"}
+	segmentSlice := []string{"a", "b", "ab", "c"}
+
+	for i := 0; i < 2000; i++ {
+		user := createRandomUser(random)
+		authorizationIndex := CreateAuthorizationIndex(user)
+
+		for j := 0; j < 30; j++ {
+			component := componentSlice[random.Intn(len(componentSlice))]
+			method := methodSlice[random.Intn(len(methodSlice))]
+			path := createRandomPath(random, segmentSlice, 4)
+
+			if user.HasPermission(component, method, path) != authorizationIndex.HasPermission(component, method, path) {
+				t.Fatalf("HasPermission differs for %s %s %s with user %s", component, method, path, describeUser(user))
+			}
+			if user.HasChildPermission(component, method, path) != authorizationIndex.HasChildPermission(component, method, path) {
+				t.Fatalf("HasChildPermission differs for %s %s %s with user %s", component, method, path, describeUser(user))
+			}
+			if user.HasResource(component, path) != authorizationIndex.HasResource(component, path) {
+				t.Fatalf("HasResource differs for %s %s with user %s", component, path, describeUser(user))
+			}
+		}
+	}
+}
+
+func describeUser(user *User) string {
+	description := ""
+	for _, role := range user.RoleSlice {
+		for _, permission := range role.PermissionSlice {
+			description += "\n  " + string(permission.Effect) + " " + permission.Component + " " + permission.Method + " " + permission.Path + " " + string(permission.MatchMode)
+		}
+	}
+	for _, resource := range user.ResourceSlice {
+		description += "\n  resource " + string(resource.Effect) + " " + resource.Component + " " + resource.Path + " " + string(resource.MatchMode)
+	}
+	return description
+}
+
+func createBenchmarkUser() *User {
+	permissionSlice := make([]*Permission, 0)
+	for i := 0; i < 500; i++ {
+		namespace := "namespace-" + strconv.Itoa(i)
+		for _, method := range []string{"GET", "POST", "DELETE"} {
+			permission, _ := CreatePermission("cloudone", method, "/api/v1/namespaces/"+namespace+"/pods")
+			permissionSlice = append(permissionSlice, permission)
+		}
+	}
+	denyPermission, _ := CreateDenyPermission("cloudone", "*", "/api/v1/namespaces/kube-system")
+	permissionSlice = append(permissionSlice, denyPermission)
+	return &User{Name: "u", RoleSlice: []*Role{&Role{Name: "generated", PermissionSlice: permissionSlice}}}
+}
+
+func BenchmarkUserHasPermission(b *testing.B) {
+	user := createBenchmarkUser()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		user.HasPermission("cloudone", "DELETE", "/api/v1/namespaces/namespace-499/pods/nginx")
+	}
+}
+
+func BenchmarkAuthorizationIndexHasPermission(b *testing.B) {
+	authorizationIndex := CreateAuthorizationIndex(createBenchmarkUser())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		authorizationIndex.HasPermission("cloudone", "DELETE", "/api/v1/namespaces/namespace-499/pods/nginx")
+	}
+}
+
+func BenchmarkUserHasChildPermission(b *testing.B) {
+	user := createBenchmarkUser()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		user.HasChildPermission("cloudone", "DELETE", "/api/v1/namespaces/namespace-499")
+	}
+}
+
+func BenchmarkAuthorizationIndexHasChildPermission(b *testing.B) {
+	authorizationIndex := CreateAuthorizationIndex(createBenchmarkUser())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		authorizationIndex.HasChildPermission("cloudone", "DELETE", "/api/v1/namespaces/namespace-499")
+	}
+}
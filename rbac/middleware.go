@@ -0,0 +1,207 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/cloudawan/cloudone_utility/audit"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	AuthorizationDecisionAllowed         = "Allowed"
+	AuthorizationDecisionUnauthenticated = "Unauthenticated"
+	AuthorizationDecisionForbidden       = "Forbidden"
+)
+
+type TokenSource interface {
+	GetToken(request *http.Request) string
+}
+
+type headerTokenSource struct {
+	headerName string
+}
+
+// Read the token from the header. A "Bearer " prefix is removed if present.
+func CreateHeaderTokenSource(headerName string) TokenSource {
+	return &headerTokenSource{headerName}
+}
+
+func (source *headerTokenSource) GetToken(request *http.Request) string {
+	token := request.Header.Get(source.headerName)
+	if strings.HasPrefix(token, "Bearer ") {
+		token = strings.TrimPrefix(token, "Bearer ")
+	}
+	return token
+}
+
+type queryTokenSource struct {
+	parameterName string
+}
+
+func CreateQueryTokenSource(parameterName string) TokenSource {
+	return &queryTokenSource{parameterName}
+}
+
+func (source *queryTokenSource) GetToken(request *http.Request) string {
+	return request.URL.Query().Get(source.parameterName)
+}
+
+type userContextKey struct{}
+
+// Get the authenticated user put into the request context by the authorization middleware
+func GetUserFromContext(ctx context.Context) *User {
+	user, _ := ctx.Value(userContextKey{}).(*User)
+	return user
+}
+
+func withUser(ctx context.Context, user *User) context.Context {
+	return context.WithValue(ctx, userContextKey{}, user)
+}
+
+// AuthorizationMiddleware authenticates the token, checks HasPermission for the request method and path and optionally HasResource.
+// Conditions of the permissions are evaluated with the remote address and the time of the request.
+type AuthorizationMiddleware struct {
+	Component   string
+	TokenSource TokenSource
+	// Look up the user of the token. Default is GetCache.
+	UserLookup func(token string) *User
+	// Optional. Return the resource path of the request and true to enforce HasResource.
+	ResourceExtractor func(request *http.Request) (string, bool)
+	// Optional. Called with the audit log of every decision.
+	AuditLogHandler func(auditLog *audit.AuditLog)
+}
+
+func CreateAuthorizationMiddleware(component string, tokenSource TokenSource) *AuthorizationMiddleware {
+	return &AuthorizationMiddleware{
+		Component:   component,
+		TokenSource: tokenSource,
+		UserLookup:  GetCache,
+	}
+}
+
+func (authorizationMiddleware *AuthorizationMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		token := authorizationMiddleware.TokenSource.GetToken(request)
+		requestPath := cleanRequestPath(request.URL.Path)
+		var user *User
+		if token != "" {
+			user = authorizationMiddleware.UserLookup(token)
+		}
+		if user == nil {
+			authorizationMiddleware.emitAuditLog(request, requestPath, token, nil, AuthorizationDecisionUnauthenticated)
+			writeJsonError(responseWriter, http.StatusUnauthorized, "Token is missing, invalid or expired")
+			return
+		}
+
+		requestContext := &RequestContext{
+			RemoteAddress: request.RemoteAddr,
+			Time:          time.Now(),
+		}
+		if user.HasPermissionWithContext(requestContext, authorizationMiddleware.Component, request.Method, requestPath) == false {
+			authorizationMiddleware.emitAuditLog(request, requestPath, token, user, AuthorizationDecisionForbidden)
+			writeJsonError(responseWriter, http.StatusForbidden, "No permission to "+request.Method+" "+requestPath)
+			return
+		}
+		if authorizationMiddleware.ResourceExtractor != nil {
+			if resourcePath, ok := authorizationMiddleware.ResourceExtractor(request); ok {
+				if user.HasResource(authorizationMiddleware.Component, resourcePath) == false {
+					authorizationMiddleware.emitAuditLog(request, requestPath, token, user, AuthorizationDecisionForbidden)
+					writeJsonError(responseWriter, http.StatusForbidden, "No access to resource "+resourcePath)
+					return
+				}
+			}
+		}
+
+		authorizationMiddleware.emitAuditLog(request, requestPath, token, user, AuthorizationDecisionAllowed)
+		next.ServeHTTP(responseWriter, request.WithContext(withUser(request.Context(), user)))
+	})
+}
+
+// Resolve the dot segments and the duplicated slashes so a path like /gui/inventory/../system/rbac is checked as /gui/system/rbac.
+// The trailing slash is kept.
+func cleanRequestPath(requestPath string) string {
+	cleanedPath := path.Clean("/" + requestPath)
+	if strings.HasSuffix(requestPath, "/") && cleanedPath != "/" {
+		cleanedPath += "/"
+	}
+	return cleanedPath
+}
+
+// The user is the effective one. The real user is recorded too during impersonation.
+func (authorizationMiddleware *AuthorizationMiddleware) emitAuditLog(request *http.Request, requestPath string, token string, user *User, decision string) {
+	if authorizationMiddleware.AuditLogHandler == nil {
+		return
+	}
+
+	userName := ""
+	if user != nil {
+		userName = user.Name
+	}
+
+	// The token must not be written into the audit log
+	requestHeader := maskToken(request.Header, token)
+	queryParameterMap := maskToken(request.URL.Query(), token)
+	requestURI := request.URL.RequestURI()
+	if token != "" {
+		requestURI = strings.Replace(requestURI, token, "******", -1)
+	}
+
+	// The request body is left for the handler to read
+	auditLog := audit.CreateAuditLog(
+		authorizationMiddleware.Component,
+		requestPath,
+		userName,
+		request.RemoteAddr,
+		queryParameterMap,
+		nil,
+		request.Method,
+		requestURI,
+		"",
+		requestHeader,
+	)
+	auditLog.Decision = decision
+	auditLog.RealUserName = GetImpersonatorName(user)
+
+	authorizationMiddleware.AuditLogHandler(auditLog)
+}
+
+func maskToken(valueMap map[string][]string, token string) map[string][]string {
+	maskedValueMap := make(map[string][]string)
+	for key, valueSlice := range valueMap {
+		maskedValueSlice := make([]string, 0, len(valueSlice))
+		for _, value := range valueSlice {
+			if token != "" && strings.Contains(value, token) {
+				value = "******"
+			}
+			maskedValueSlice = append(maskedValueSlice, value)
+		}
+		maskedValueMap[key] = maskedValueSlice
+	}
+	return maskedValueMap
+}
+
+func writeJsonError(responseWriter http.ResponseWriter, statusCode int, errorMessage string) {
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.WriteHeader(statusCode)
+	json.NewEncoder(responseWriter).Encode(map[string]string{
+		"Error":        http.StatusText(statusCode),
+		"ErrorMessage": errorMessage,
+	})
+}
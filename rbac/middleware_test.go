@@ -0,0 +1,137 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"encoding/json"
+	"github.com/cloudawan/cloudone_utility/audit"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthorizationMiddleware(t *testing.T) {
+	previousTokenCache := SetDefaultTokenCache(CreateMemoryTokenCache(0))
+	defer SetDefaultTokenCache(previousTokenCache)
+
+	user := createDenyTestUser(t)
+	SetCache("valid-token", user, time.Hour)
+
+	auditLogSlice := make([]*audit.AuditLog, 0)
+	authorizationMiddleware := CreateAuthorizationMiddleware("cloudone_gui", CreateHeaderTokenSource("token"))
+	authorizationMiddleware.ResourceExtractor = func(request *http.Request) (string, bool) {
+		namespace := request.URL.Query().Get("namespace")
+		return "/namespaces/" + namespace, namespace != ""
+	}
+	authorizationMiddleware.AuditLogHandler = func(auditLog *audit.AuditLog) {
+		auditLogSlice = append(auditLogSlice, auditLog)
+	}
+
+	handler := authorizationMiddleware.Handler(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		responseWriter.Write([]byte(GetUserFromContext(request.Context()).Name))
+	}))
+
+	checkSlice := []struct {
+		token      string
+		method     string
+		target     string
+		statusCode int
+		decision   string
+	}{
+		{"", "GET", "/gui/inventory", http.StatusUnauthorized, AuthorizationDecisionUnauthenticated},
+		{"unknown-token", "GET", "/gui/inventory", http.StatusUnauthorized, AuthorizationDecisionUnauthenticated},
+		{"valid-token", "GET", "/gui/inventory", http.StatusOK, AuthorizationDecisionAllowed},
+		{"Bearer valid-token", "GET", "/gui/inventory", http.StatusOK, AuthorizationDecisionAllowed},
+		{"valid-token", "GET", "/gui/system/rbac", http.StatusForbidden, AuthorizationDecisionForbidden},
+		{"valid-token", "GET", "/gui/inventory/../system/rbac", http.StatusForbidden, AuthorizationDecisionForbidden},
+		{"valid-token", "GET", "/gui//system/./rbac", http.StatusForbidden, AuthorizationDecisionForbidden},
+		{"valid-token", "GET", "/gui/inventory?namespace=default", http.StatusOK, AuthorizationDecisionAllowed},
+		{"valid-token", "GET", "/gui/inventory?namespace=kube-system", http.StatusOK, AuthorizationDecisionAllowed},
+	}
+	for i, check := range checkSlice {
+		request := httptest.NewRequest(check.method, check.target, nil)
+		if check.token != "" {
+			request.Header.Set("token", check.token)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != check.statusCode {
+			t.Errorf("%s %s with token %q should be %d but get %d", check.method, check.target, check.token, check.statusCode, recorder.Code)
+		}
+		if recorder.Code == http.StatusOK {
+			if recorder.Body.String() != "u" {
+				t.Errorf("User should be put into the request context")
+			}
+		} else {
+			jsonMap := make(map[string]string)
+			if err := json.Unmarshal(recorder.Body.Bytes(), &jsonMap); err != nil || jsonMap["Error"] == "" {
+				t.Errorf("Rejection should have a JSON body but get %s", recorder.Body.String())
+			}
+		}
+		if len(auditLogSlice) != i+1 || auditLogSlice[i].Decision != check.decision {
+			t.Fatalf("Audit log with decision %s should be emitted for %s", check.decision, check.target)
+		}
+		if strings.Contains(auditLogSlice[i].Path, "/.") || strings.Contains(auditLogSlice[i].Path, "//") {
+			t.Errorf("Cleaned path should be recorded in the audit log but get %s", auditLogSlice[i].Path)
+		}
+		for _, value := range auditLogSlice[i].RequestHeader["Token"] {
+			if strings.Contains(value, "valid-token") {
+				t.Errorf("Token should be masked in the audit log")
+			}
+		}
+	}
+}
+
+func TestAuthorizationMiddlewareResource(t *testing.T) {
+	user := createDenyTestUser(t)
+	authorizationMiddleware := CreateAuthorizationMiddleware("cloudone", CreateQueryTokenSource("token"))
+	authorizationMiddleware.UserLookup = func(token string) *User {
+		if token == "t" {
+			return user
+		}
+		return nil
+	}
+	authorizationMiddleware.ResourceExtractor = func(request *http.Request) (string, bool) {
+		splitSlice := strings.Split(request.URL.Path, "/")
+		// /api/v1/namespaces/<namespace>
+		if len(splitSlice) > 4 {
+			return "/namespaces/" + splitSlice[4], true
+		}
+		return "", false
+	}
+	auditLogSlice := make([]*audit.AuditLog, 0)
+	authorizationMiddleware.AuditLogHandler = func(auditLog *audit.AuditLog) {
+		auditLogSlice = append(auditLogSlice, auditLog)
+	}
+	handler := authorizationMiddleware.Handler(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/v1/namespaces/default?token=t", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Allowed resource should pass but get %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/v1/namespaces/kube-system?token=t", nil))
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Denied resource should be forbidden but get %d", recorder.Code)
+	}
+	if strings.Contains(auditLogSlice[1].RequestURI, "token=t") || auditLogSlice[1].QueryParameterMap["token"][0] != "******" {
+		t.Errorf("Token in the query should be masked in the audit log")
+	}
+}
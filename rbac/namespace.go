@@ -0,0 +1,165 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Namespaces are resources under this path such as /namespaces/team-a
+const NamespaceResourcePath = "/namespaces"
+
+// Role binding for all the namespaces
+const AllNamespace = "*"
+
+// Roles of the binding are granted only within the namespace while the roles of the user are granted in every namespace the user has resource for.
+// The binding also grants the namespace resource but only to the namespace checks. HasResource doesn't count it.
+type RoleBinding struct {
+	Namespace string
+	RoleSlice []*Role
+}
+
+func CreateRoleBinding(namespace string, roleSlice []*Role) (*RoleBinding, error) {
+	if err := validateNamespace(namespace); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	return &RoleBinding{
+		namespace,
+		roleSlice,
+	}, nil
+}
+
+func validateNamespace(namespace string) error {
+	if namespace == "" {
+		return errors.New("Namespace couldn't be empty")
+	}
+	if namespace != AllNamespace && (strings.ContainsAny(namespace, "/{}*") || namespace == "." || namespace == "..") {
+		return errors.New("Invalid namespace " + namespace)
+	}
+	return nil
+}
+
+func GetNamespaceResourcePath(namespace string) string {
+	return NamespaceResourcePath + "/" + namespace
+}
+
+func (roleBinding *RoleBinding) matchNamespace(namespace string) bool {
+	return roleBinding.Namespace == AllNamespace || roleBinding.Namespace == namespace
+}
+
+func (roleBinding *RoleBinding) getResource() *Resource {
+	path := GetNamespaceResourcePath(roleBinding.Namespace)
+	name, _ := GetResourceName("*", path)
+	return &Resource{
+		name,
+		"*",
+		path,
+		EffectAllow,
+		MatchModeSegment,
+	}
+}
+
+// Whether the user could access the namespace through the resources or the role bindings. Deny resource overrides the role bindings.
+func (user *User) HasNamespace(component string, namespace string) bool {
+	resourceSlice := user.GetEffectiveResourceSlice()
+	for _, roleBinding := range user.RoleBindingSlice {
+		resourceSlice = append(resourceSlice, roleBinding.getResource())
+	}
+	return evaluateResource(resourceSlice, component, GetNamespaceResourcePath(namespace))
+}
+
+// The path naming a namespace such as /api/v1/namespaces/team-b/pods must name the checked one.
+// Otherwise the roles bound to one namespace would be granted on the objects of another.
+func matchNamespacePath(namespace string, path string) bool {
+	segmentSlice := splitPath(path)
+	for i := 0; i+1 < len(segmentSlice); i++ {
+		if "/"+segmentSlice[i] == NamespaceResourcePath && segmentSlice[i+1] != namespace {
+			return false
+		}
+	}
+	return true
+}
+
+// Permissions of the user's roles, the groups' roles and the roles bound to the namespace
+func (user *User) getNamespacePermissionSlice(namespace string) []*Permission {
+	permissionSlice := user.getPermissionSlice()
+	for _, roleBinding := range user.RoleBindingSlice {
+		if roleBinding.matchNamespace(namespace) {
+			for _, role := range roleBinding.RoleSlice {
+				permissionSlice = append(permissionSlice, role.GetEffectivePermissionSlice()...)
+			}
+		}
+	}
+	return permissionSlice
+}
+
+// Check the permission for the request within the namespace. The user must have the namespace resource as well.
+// The path is rejected if it names another namespace.
+func (user *User) HasPermissionInNamespace(namespace string, component string, method string, path string) bool {
+	if matchNamespacePath(namespace, path) == false || user.HasNamespace(component, namespace) == false {
+		return false
+	}
+	return evaluatePermission(user.getNamespacePermissionSlice(namespace), component, method, path)
+}
+
+func (user *User) HasChildPermissionInNamespace(namespace string, component string, method string, path string) bool {
+	if matchNamespacePath(namespace, path) == false || user.HasNamespace(component, namespace) == false {
+		return false
+	}
+	return evaluateChildPermission(user.getNamespacePermissionSlice(namespace), component, method, path)
+}
+
+// List the namespaces in which the user could perform the method on some path of the component, in the order of the candidates.
+// If the candidates are nil, the namespaces named by the role bindings and the resources are the candidates.
+// Namespace granted by wildcard is only listed if the candidates are given.
+func (user *User) GetNamespaceSlice(component string, method string, candidateNamespaceSlice []string) []string {
+	if candidateNamespaceSlice == nil {
+		candidateNamespaceSlice = user.getNamedNamespaceSlice()
+	}
+
+	namespaceSlice := make([]string, 0)
+	for _, namespace := range candidateNamespaceSlice {
+		if user.HasChildPermissionInNamespace(namespace, component, method, "/") {
+			namespaceSlice = append(namespaceSlice, namespace)
+		}
+	}
+	return namespaceSlice
+}
+
+func (user *User) getNamedNamespaceSlice() []string {
+	namespaceMap := make(map[string]bool)
+	for _, roleBinding := range user.RoleBindingSlice {
+		if roleBinding.Namespace != AllNamespace {
+			namespaceMap[roleBinding.Namespace] = true
+		}
+	}
+	for _, resource := range user.GetEffectiveResourceSlice() {
+		segmentSlice := splitPath(resource.Path)
+		if resource.Effect.IsDeny() == false && len(segmentSlice) >= 2 && "/"+segmentSlice[0] == NamespaceResourcePath && validateNamespace(segmentSlice[1]) == nil && segmentSlice[1] != AllNamespace {
+			namespaceMap[segmentSlice[1]] = true
+		}
+	}
+
+	namespaceSlice := make([]string, 0, len(namespaceMap))
+	for namespace := range namespaceMap {
+		namespaceSlice = append(namespaceSlice, namespace)
+	}
+	sort.Strings(namespaceSlice)
+	return namespaceSlice
+}
@@ -0,0 +1,190 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func createNamespaceTestUser(t *testing.T) *User {
+	adminPermission, _ := CreatePermission("cloudone", "*", "/api/v1/**")
+	viewerPermission, _ := CreatePermission("cloudone", "GET", "/api/v1/**")
+	admin := &Role{Name: "admin", PermissionSlice: []*Permission{adminPermission}}
+	viewer := &Role{Name: "viewer", PermissionSlice: []*Permission{viewerPermission}}
+
+	teamA, err := CreateRoleBinding("team-a", []*Role{admin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	teamB, _ := CreateRoleBinding("team-b", []*Role{viewer})
+	// Denied namespace is not accessible even with the binding
+	teamC, _ := CreateRoleBinding("team-c", []*Role{admin})
+	denyResource, _ := CreateDenyResource("*", "/namespaces/team-c")
+
+	user := createTestUser(t, "alice", testPassword, nil, []*Resource{denyResource}, "", nil, nil, false)
+	user.RoleBindingSlice = []*RoleBinding{teamA, teamB, teamC}
+	return user
+}
+
+func TestRoleBinding(t *testing.T) {
+	user := createNamespaceTestUser(t)
+
+	checkSlice := []struct {
+		namespace string
+		method    string
+		expected  bool
+	}{
+		{"team-a", "GET", true},
+		{"team-a", "DELETE", true},
+		{"team-b", "GET", true},
+		{"team-b", "DELETE", false},
+		{"team-c", "GET", false},
+		{"team-d", "GET", false},
+	}
+	for _, check := range checkSlice {
+		if result := user.HasPermissionInNamespace(check.namespace, "cloudone", check.method, "/api/v1/replicationcontrollers"); result != check.expected {
+			t.Errorf("%s %s expects %v but get %v", check.method, check.namespace, check.expected, result)
+		}
+	}
+
+	if user.HasPermission("cloudone", "GET", "/api/v1/replicationcontrollers") {
+		t.Errorf("Bound roles should not be granted outside the namespace")
+	}
+	if user.HasNamespace("cloudone", "team-a") == false || user.HasNamespace("cloudone", "team-d") {
+		t.Errorf("Binding should grant only its namespace")
+	}
+	if user.HasResource("cloudone", "/namespaces/team-a") || len(user.GetEffectiveResourceSlice()) != 1 {
+		t.Errorf("Binding should not grant the namespace resource outside the namespace checks")
+	}
+
+	// The roles bound to team-a are not granted on the objects of team-b
+	if user.HasPermissionInNamespace("team-a", "cloudone", "DELETE", "/api/v1/namespaces/team-b/pods") ||
+		user.HasChildPermissionInNamespace("team-a", "cloudone", "DELETE", "/api/v1/namespaces/team-b") {
+		t.Errorf("Path of another namespace should be rejected")
+	}
+	if user.HasPermissionInNamespace("team-a", "cloudone", "DELETE", "/api/v1/namespaces/team-a/pods") == false {
+		t.Errorf("Path of the namespace should be granted")
+	}
+
+	if _, err := CreateRoleBinding("team/a", nil); err == nil {
+		t.Errorf("Namespace with slash should be rejected")
+	}
+}
+
+func TestGlobalRoleInNamespace(t *testing.T) {
+	viewerPermission, _ := CreatePermission("cloudone", "GET", "/api/v1/**")
+	viewer := &Role{Name: "viewer", PermissionSlice: []*Permission{viewerPermission}}
+	resource, _ := CreateResource("cloudone", "/namespaces/default")
+	user := createTestUser(t, "bob", testPassword, []*Role{viewer}, []*Resource{resource}, "", nil, nil, false)
+
+	if user.HasPermissionInNamespace("default", "cloudone", "GET", "/api/v1/pods") == false {
+		t.Errorf("Global role should be granted in the namespace of the resource")
+	}
+	if user.HasPermissionInNamespace("other", "cloudone", "GET", "/api/v1/pods") {
+		t.Errorf("Global role should not be granted in the namespace without resource")
+	}
+}
+
+func TestGetNamespaceSlice(t *testing.T) {
+	user := createNamespaceTestUser(t)
+
+	if namespaceSlice := user.GetNamespaceSlice("cloudone", "DELETE", nil); reflect.DeepEqual(namespaceSlice, []string{"team-a"}) == false {
+		t.Errorf("Expect [team-a] but get %v", namespaceSlice)
+	}
+	if namespaceSlice := user.GetNamespaceSlice("cloudone", "GET", nil); reflect.DeepEqual(namespaceSlice, []string{"team-a", "team-b"}) == false {
+		t.Errorf("Expect [team-a team-b] but get %v", namespaceSlice)
+	}
+	if namespaceSlice := user.GetNamespaceSlice("cloudone_gui", "GET", nil); len(namespaceSlice) != 0 {
+		t.Errorf("Expect no namespace but get %v", namespaceSlice)
+	}
+
+	// Wildcard binding needs the candidates
+	viewerPermission, _ := CreatePermission("cloudone", "GET", "/**")
+	allNamespace, _ := CreateRoleBinding(AllNamespace, []*Role{{Name: "viewer", PermissionSlice: []*Permission{viewerPermission}}})
+	user.RoleBindingSlice = append(user.RoleBindingSlice, allNamespace)
+	if namespaceSlice := user.GetNamespaceSlice("cloudone", "GET", []string{"default", "team-c", "team-a"}); reflect.DeepEqual(namespaceSlice, []string{"default", "team-a"}) == false {
+		t.Errorf("Expect [default team-a] but get %v", namespaceSlice)
+	}
+}
+
+func TestRoleBindingCopyAndToken(t *testing.T) {
+	user := createNamespaceTestUser(t)
+
+	partialUser := user.CopyPartialUserDataForComponent("cloudone")
+	if partialUser.HasPermissionInNamespace("team-a", "cloudone", "DELETE", "/api/v1/pods") == false ||
+		partialUser.HasPermissionInNamespace("team-c", "cloudone", "GET", "/api/v1/pods") {
+		t.Errorf("Partial user should keep the role bindings")
+	}
+	if len(user.CopyPartialUserDataForComponent("cloudone_gui").RoleBindingSlice) != 0 {
+		t.Errorf("Role bindings without permission for the component should be dropped")
+	}
+
+	signingKey, _ := CreateHS256SigningKey("key", []byte("0123456789abcdef0123456789abcdef"))
+	tokenIssuer := CreateTokenIssuer("cloudone", signingKey, time.Hour)
+	token, err := tokenIssuer.Issue(partialUser, "cloudone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenUser, err := CreateTokenVerifier("cloudone", 0, []*SigningKey{signingKey}).Verify(token, "cloudone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokenUser.HasPermissionInNamespace("team-b", "cloudone", "GET", "/api/v1/pods") == false ||
+		tokenUser.HasPermissionInNamespace("team-b", "cloudone", "DELETE", "/api/v1/pods") {
+		t.Errorf("Signed token should carry the role bindings")
+	}
+}
+
+func TestPolicyRoleBinding(t *testing.T) {
+	data := []byte(`
+roles:
+  - name: admin
+    permissions:
+      - component: cloudone
+        method: "*"
+        path: /api/v1/**
+users:
+  - name: alice
+    roleBindings:
+      - namespace: team-a
+        roles: [admin]
+`)
+	policy, err := LoadPolicy(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := policy.UserSlice[0]
+	if user.HasPermissionInNamespace("team-a", "cloudone", "POST", "/api/v1/pods") == false {
+		t.Errorf("Role binding should be built from the policy")
+	}
+
+	policyDocument := CreatePolicyDocument(nil, nil, policy.UserSlice)
+	if len(policyDocument.RoleSlice) != 1 || policyDocument.UserSlice[0].RoleBindingSlice[0].Namespace != "team-a" {
+		t.Errorf("Role binding should be exported")
+	}
+
+	_, err = LoadPolicy([]byte(`
+users:
+  - name: alice
+    roleBindings:
+      - namespace: team/a
+        roles: [unknown]
+`))
+	if policyValidationError, ok := err.(*PolicyValidationError); ok == false || len(policyValidationError.ErrorSlice) != 2 {
+		t.Errorf("Invalid namespace and unknown role should be reported but get %v", err)
+	}
+}
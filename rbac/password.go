@@ -0,0 +1,289 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/sha3"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The encoded password is self-describing so the hasher used to create it could be identified from the encoded password itself.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	// Identify whether the encoded password is created by this kind of hasher
+	Identify(encodedPassword string) bool
+	Verify(encodedPassword string, password string) bool
+	// Whether the encoded password is created with the parameters different from this hasher
+	NeedsRehash(encodedPassword string) bool
+}
+
+const (
+	argon2idPrefix           = "$argon2id$"
+	argon2idDefaultTime      = 1
+	argon2idDefaultMemory    = 64 * 1024
+	argon2idDefaultThreads   = 4
+	argon2idDefaultKeyLength = 32
+	argon2idSaltLength       = 16
+	// Upper bounds of the parameters read from the encoded password so a corrupted one couldn't exhaust the memory or the CPU
+	argon2idMaximumTime      = 32
+	argon2idMaximumMemory    = 1024 * 1024 // 1 GiB in KiB
+	argon2idMaximumKeyLength = 1024
+)
+
+// Encoded format: $argon2id$v=19$m=65536,t=1,p=4$<salt>$<key>
+type Argon2idPasswordHasher struct {
+	Time      uint32
+	Memory    uint32 // KiB
+	Threads   uint8
+	KeyLength uint32
+}
+
+func CreateArgon2idPasswordHasher(time uint32, memory uint32, threads uint8) *Argon2idPasswordHasher {
+	return &Argon2idPasswordHasher{
+		time,
+		memory,
+		threads,
+		argon2idDefaultKeyLength,
+	}
+}
+
+func (argon2idPasswordHasher *Argon2idPasswordHasher) Hash(password string) (string, error) {
+	salt := make([]byte, argon2idSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		log.Error(err)
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, argon2idPasswordHasher.Time, argon2idPasswordHasher.Memory, argon2idPasswordHasher.Threads, argon2idPasswordHasher.KeyLength)
+
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix,
+		argon2.Version,
+		argon2idPasswordHasher.Memory,
+		argon2idPasswordHasher.Time,
+		argon2idPasswordHasher.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (argon2idPasswordHasher *Argon2idPasswordHasher) Identify(encodedPassword string) bool {
+	return strings.HasPrefix(encodedPassword, argon2idPrefix)
+}
+
+type argon2idParameter struct {
+	version int
+	time    uint32
+	memory  uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func parseArgon2idEncodedPassword(encodedPassword string) (*argon2idParameter, error) {
+	// "", "argon2id", "v=19", "m=65536,t=1,p=4", salt, key
+	splitSlice := strings.Split(encodedPassword, "$")
+	if len(splitSlice) != 6 || splitSlice[1] != "argon2id" {
+		return nil, errors.New("Invalid argon2id encoded password format")
+	}
+
+	parameter := &argon2idParameter{}
+	if _, err := fmt.Sscanf(splitSlice[2], "v=%d", &parameter.version); err != nil {
+		return nil, err
+	}
+	if parameter.version != argon2.Version {
+		return nil, errors.New("Unsupported argon2id version")
+	}
+	if _, err := fmt.Sscanf(splitSlice[3], "m=%d,t=%d,p=%d", &parameter.memory, &parameter.time, &parameter.threads); err != nil {
+		return nil, err
+	}
+	// Threads is at most 255 by its type
+	if parameter.time < 1 || parameter.time > argon2idMaximumTime {
+		return nil, errors.New("Invalid argon2id time " + strconv.Itoa(int(parameter.time)))
+	}
+	if parameter.threads < 1 {
+		return nil, errors.New("Invalid argon2id threads " + strconv.Itoa(int(parameter.threads)))
+	}
+	if parameter.memory < 8*uint32(parameter.threads) || parameter.memory > argon2idMaximumMemory {
+		return nil, errors.New("Invalid argon2id memory " + strconv.Itoa(int(parameter.memory)))
+	}
+
+	var err error
+	parameter.salt, err = base64.RawStdEncoding.DecodeString(splitSlice[4])
+	if err != nil {
+		return nil, err
+	}
+	parameter.key, err = base64.RawStdEncoding.DecodeString(splitSlice[5])
+	if err != nil {
+		return nil, err
+	}
+	if len(parameter.key) == 0 || len(parameter.key) > argon2idMaximumKeyLength {
+		return nil, errors.New("Invalid argon2id key length")
+	}
+
+	return parameter, nil
+}
+
+func (argon2idPasswordHasher *Argon2idPasswordHasher) Verify(encodedPassword string, password string) bool {
+	parameter, err := parseArgon2idEncodedPassword(encodedPassword)
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+
+	key := argon2.IDKey([]byte(password), parameter.salt, parameter.time, parameter.memory, parameter.threads, uint32(len(parameter.key)))
+
+	return subtle.ConstantTimeCompare(key, parameter.key) == 1
+}
+
+func (argon2idPasswordHasher *Argon2idPasswordHasher) NeedsRehash(encodedPassword string) bool {
+	parameter, err := parseArgon2idEncodedPassword(encodedPassword)
+	if err != nil {
+		return true
+	}
+
+	return parameter.time != argon2idPasswordHasher.Time ||
+		parameter.memory != argon2idPasswordHasher.Memory ||
+		parameter.threads != argon2idPasswordHasher.Threads ||
+		uint32(len(parameter.key)) != argon2idPasswordHasher.KeyLength
+}
+
+// Encoded format is the modular crypt format produced by bcrypt such as $2a$10$<salt and hash>
+type BcryptPasswordHasher struct {
+	Cost int
+}
+
+func CreateBcryptPasswordHasher(cost int) *BcryptPasswordHasher {
+	return &BcryptPasswordHasher{
+		cost,
+	}
+}
+
+func (bcryptPasswordHasher *BcryptPasswordHasher) Hash(password string) (string, error) {
+	byteSlice, err := bcrypt.GenerateFromPassword([]byte(password), bcryptPasswordHasher.Cost)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	return string(byteSlice), nil
+}
+
+func (bcryptPasswordHasher *BcryptPasswordHasher) Identify(encodedPassword string) bool {
+	return strings.HasPrefix(encodedPassword, "$2a$") ||
+		strings.HasPrefix(encodedPassword, "$2b$") ||
+		strings.HasPrefix(encodedPassword, "$2y$")
+}
+
+func (bcryptPasswordHasher *BcryptPasswordHasher) Verify(encodedPassword string, password string) bool {
+	// CompareHashAndPassword compares in constant time
+	return bcrypt.CompareHashAndPassword([]byte(encodedPassword), []byte(password)) == nil
+}
+
+func (bcryptPasswordHasher *BcryptPasswordHasher) NeedsRehash(encodedPassword string) bool {
+	cost, err := bcrypt.Cost([]byte(encodedPassword))
+	if err != nil {
+		return true
+	}
+	return cost != bcryptPasswordHasher.Cost
+}
+
+// Unsalted SHA3-512 hex digest used before the versioned format. It is kept only to verify and migrate the stored users.
+type LegacySha3PasswordHasher struct {
+}
+
+func (legacySha3PasswordHasher *LegacySha3PasswordHasher) Hash(password string) (string, error) {
+	fixedSlice := sha3.Sum512([]byte(password))
+	return hex.EncodeToString(fixedSlice[:]), nil
+}
+
+func (legacySha3PasswordHasher *LegacySha3PasswordHasher) Identify(encodedPassword string) bool {
+	if len(encodedPassword) != hex.EncodedLen(sha3.New512().Size()) {
+		return false
+	}
+	_, err := hex.DecodeString(encodedPassword)
+	return err == nil
+}
+
+func (legacySha3PasswordHasher *LegacySha3PasswordHasher) Verify(encodedPassword string, password string) bool {
+	expected, _ := legacySha3PasswordHasher.Hash(password)
+	return subtle.ConstantTimeCompare([]byte(strings.ToLower(encodedPassword)), []byte(expected)) == 1
+}
+
+func (legacySha3PasswordHasher *LegacySha3PasswordHasher) NeedsRehash(encodedPassword string) bool {
+	return true
+}
+
+// Hashers used to verify the encoded password which is not created by the current password hasher
+var verificationPasswordHasherSlice = []PasswordHasher{
+	CreateArgon2idPasswordHasher(argon2idDefaultTime, argon2idDefaultMemory, argon2idDefaultThreads),
+	CreateBcryptPasswordHasher(bcrypt.DefaultCost),
+	&LegacySha3PasswordHasher{},
+}
+
+var passwordHasher PasswordHasher = verificationPasswordHasherSlice[0]
+var passwordHasherMutex sync.RWMutex
+
+func GetPasswordHasher() PasswordHasher {
+	passwordHasherMutex.RLock()
+	defer passwordHasherMutex.RUnlock()
+	return passwordHasher
+}
+
+// Set the hasher used to encode the new passwords. The encoded passwords created by the other hashers are still verifiable but reported as needing rehash.
+func SetPasswordHasher(hasher PasswordHasher) {
+	passwordHasherMutex.Lock()
+	defer passwordHasherMutex.Unlock()
+	passwordHasher = hasher
+}
+
+func EncodePassword(password string) (string, error) {
+	return GetPasswordHasher().Hash(password)
+}
+
+// Return whether the password matches and whether the encoded password should be replaced by the one from the current password hasher
+func VerifyPassword(encodedPassword string, password string) (bool, bool) {
+	currentPasswordHasher := GetPasswordHasher()
+	if currentPasswordHasher.Identify(encodedPassword) {
+		if currentPasswordHasher.Verify(encodedPassword, password) {
+			return true, currentPasswordHasher.NeedsRehash(encodedPassword)
+		} else {
+			return false, false
+		}
+	}
+
+	for _, verificationPasswordHasher := range verificationPasswordHasherSlice {
+		if verificationPasswordHasher.Identify(encodedPassword) {
+			if verificationPasswordHasher.Verify(encodedPassword, password) {
+				// Created by a different hasher
+				return true, true
+			} else {
+				return false, false
+			}
+		}
+	}
+
+	log.Error("Unknown encoded password format")
+	return false, false
+}
@@ -0,0 +1,187 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	PasswordViolationTooShort       = "TooShort"
+	PasswordViolationNoUpperCase    = "NoUpperCase"
+	PasswordViolationNoLowerCase    = "NoLowerCase"
+	PasswordViolationNoDigit        = "NoDigit"
+	PasswordViolationNoSymbol       = "NoSymbol"
+	PasswordViolationContainUser    = "ContainUserName"
+	PasswordViolationCommonPassword = "CommonPassword"
+	PasswordViolationReused         = "Reused"
+)
+
+type PasswordViolation struct {
+	Code    string
+	Message string // Human readable message for the GUI
+}
+
+type PasswordPolicyError struct {
+	ViolationSlice []*PasswordViolation
+}
+
+func (passwordPolicyError *PasswordPolicyError) Error() string {
+	messageSlice := make([]string, 0)
+	for _, violation := range passwordPolicyError.ViolationSlice {
+		messageSlice = append(messageSlice, violation.Message)
+	}
+	return strings.Join(messageSlice, "; ")
+}
+
+type PasswordPolicy struct {
+	MinimumLength        int
+	RequireUpperCase     bool
+	RequireLowerCase     bool
+	RequireDigit         bool
+	RequireSymbol        bool
+	RejectUserName       bool
+	RejectCommonPassword bool
+	MaximumAge           time.Duration // 0 means the password never expires
+	HistoryCount         int           // Number of the previous encoded passwords kept and rejected for reuse
+}
+
+func CreateDefaultPasswordPolicy() *PasswordPolicy {
+	return &PasswordPolicy{
+		MinimumLength:        8,
+		RejectUserName:       true,
+		RejectCommonPassword: true,
+		HistoryCount:         5,
+	}
+}
+
+// The password is checked in a case insensitive way
+var commonPasswordMap = map[string]bool{}
+
+func init() {
+	for _, commonPassword := range []string{
+		"123456", "1234567", "12345678", "123456789", "1234567890", "0123456789",
+		"111111", "11111111", "000000", "00000000", "123123", "123321", "654321",
+		"666666", "121212", "112233", "159753", "987654321", "1q2w3e4r", "1qaz2wsx",
+		"qwerty", "qwerty123", "qwertyuiop", "asdfgh", "asdfghjkl", "zxcvbnm", "qazwsx",
+		"password", "password1", "password12", "password123", "passw0rd", "p@ssw0rd", "p@ssword",
+		"abc123", "abcd1234", "abcdefg", "abcdefgh", "a1b2c3d4", "aa123456", "iloveyou",
+		"admin", "admin123", "administrator", "root", "toor", "changeme", "default",
+		"letmein", "welcome", "welcome1", "welcome123", "login", "secret", "guest",
+		"master", "monkey", "dragon", "football", "baseball", "sunshine", "princess",
+		"shadow", "superman", "batman", "trustno1", "starwars", "whatever", "freedom",
+		"michael", "jennifer", "hello123", "test1234", "testtest", "cloudone",
+	} {
+		commonPasswordMap[commonPassword] = true
+	}
+}
+
+// Violations of the password without the history. The user name is used only if RejectUserName is set.
+func (passwordPolicy *PasswordPolicy) Validate(name string, password string) []*PasswordViolation {
+	violationSlice := make([]*PasswordViolation, 0)
+
+	if len([]rune(password)) < passwordPolicy.MinimumLength {
+		violationSlice = append(violationSlice, &PasswordViolation{PasswordViolationTooShort,
+			fmt.Sprintf("Password must be at least %d characters long", passwordPolicy.MinimumLength)})
+	}
+
+	hasUpperCase, hasLowerCase, hasDigit, hasSymbol := false, false, false, false
+	for _, character := range password {
+		switch {
+		case unicode.IsUpper(character):
+			hasUpperCase = true
+		case unicode.IsLower(character):
+			hasLowerCase = true
+		case unicode.IsDigit(character):
+			hasDigit = true
+		case unicode.IsLetter(character) == false:
+			hasSymbol = true
+		}
+	}
+	if passwordPolicy.RequireUpperCase && hasUpperCase == false {
+		violationSlice = append(violationSlice, &PasswordViolation{PasswordViolationNoUpperCase, "Password must contain an upper case letter"})
+	}
+	if passwordPolicy.RequireLowerCase && hasLowerCase == false {
+		violationSlice = append(violationSlice, &PasswordViolation{PasswordViolationNoLowerCase, "Password must contain a lower case letter"})
+	}
+	if passwordPolicy.RequireDigit && hasDigit == false {
+		violationSlice = append(violationSlice, &PasswordViolation{PasswordViolationNoDigit, "Password must contain a digit"})
+	}
+	if passwordPolicy.RequireSymbol && hasSymbol == false {
+		violationSlice = append(violationSlice, &PasswordViolation{PasswordViolationNoSymbol, "Password must contain a symbol"})
+	}
+
+	lowerCasePassword := strings.ToLower(password)
+	if passwordPolicy.RejectUserName && name != "" && strings.Contains(lowerCasePassword, strings.ToLower(name)) {
+		violationSlice = append(violationSlice, &PasswordViolation{PasswordViolationContainUser, "Password must not contain the user name"})
+	}
+	if passwordPolicy.RejectCommonPassword && commonPasswordMap[lowerCasePassword] {
+		violationSlice = append(violationSlice, &PasswordViolation{PasswordViolationCommonPassword, "Password is too common"})
+	}
+
+	return violationSlice
+}
+
+// Violations of the new password of the user including the reuse of the current and the previous passwords
+func (passwordPolicy *PasswordPolicy) ValidateForUser(user *User, password string) []*PasswordViolation {
+	violationSlice := passwordPolicy.Validate(user.Name, password)
+
+	if passwordPolicy.HistoryCount > 0 {
+		encodedPasswordSlice := append([]string{user.EncodedPassword}, user.PasswordHistorySlice...)
+		for _, encodedPassword := range encodedPasswordSlice {
+			if matched, _ := VerifyPassword(encodedPassword, password); matched {
+				violationSlice = append(violationSlice, &PasswordViolation{PasswordViolationReused,
+					fmt.Sprintf("Password must not be one of the last %d passwords", passwordPolicy.HistoryCount)})
+				break
+			}
+		}
+	}
+
+	return violationSlice
+}
+
+// The password of the user without the changed time is never expired since the age is unknown
+func (passwordPolicy *PasswordPolicy) IsPasswordExpired(user *User, now time.Time) bool {
+	if passwordPolicy.MaximumAge <= 0 || user.PasswordChangedTime == nil {
+		return false
+	}
+	return now.After(user.PasswordChangedTime.Add(passwordPolicy.MaximumAge))
+}
+
+func createPasswordPolicyError(violationSlice []*PasswordViolation) error {
+	if len(violationSlice) == 0 {
+		return nil
+	}
+	return &PasswordPolicyError{violationSlice}
+}
+
+var passwordPolicy = CreateDefaultPasswordPolicy()
+var passwordPolicyMutex sync.RWMutex
+
+func GetPasswordPolicy() *PasswordPolicy {
+	passwordPolicyMutex.RLock()
+	defer passwordPolicyMutex.RUnlock()
+	return passwordPolicy
+}
+
+func SetPasswordPolicy(newPasswordPolicy *PasswordPolicy) {
+	passwordPolicyMutex.Lock()
+	defer passwordPolicyMutex.Unlock()
+	passwordPolicy = newPasswordPolicy
+}
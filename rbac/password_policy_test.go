@@ -0,0 +1,150 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"testing"
+	"time"
+)
+
+func getViolationCodeSlice(violationSlice []*PasswordViolation) []string {
+	codeSlice := make([]string, 0)
+	for _, violation := range violationSlice {
+		codeSlice = append(codeSlice, violation.Code)
+	}
+	return codeSlice
+}
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	passwordPolicy := &PasswordPolicy{
+		MinimumLength:        8,
+		RequireUpperCase:     true,
+		RequireLowerCase:     true,
+		RequireDigit:         true,
+		RequireSymbol:        true,
+		RejectUserName:       true,
+		RejectCommonPassword: true,
+	}
+
+	checkSlice := []struct {
+		password string
+		expected []string
+	}{
+		{"Str0ng!Pass", []string{}},
+		{"", []string{PasswordViolationTooShort, PasswordViolationNoUpperCase, PasswordViolationNoLowerCase, PasswordViolationNoDigit, PasswordViolationNoSymbol}},
+		{"S0rt!a", []string{PasswordViolationTooShort}},
+		{"alllower1!", []string{PasswordViolationNoUpperCase}},
+		{"ALLUPPER1!", []string{PasswordViolationNoLowerCase}},
+		{"NoDigits!!", []string{PasswordViolationNoDigit}},
+		{"NoSymbol11", []string{PasswordViolationNoSymbol}},
+		{"My-Alice-1", []string{PasswordViolationContainUser}},
+		{"P@ssw0rd", []string{PasswordViolationCommonPassword}},
+	}
+	for _, check := range checkSlice {
+		codeSlice := getViolationCodeSlice(passwordPolicy.Validate("alice", check.password))
+		if len(codeSlice) != len(check.expected) {
+			t.Errorf("Password %q expects %v but get %v", check.password, check.expected, codeSlice)
+			continue
+		}
+		for i := range codeSlice {
+			if codeSlice[i] != check.expected[i] {
+				t.Errorf("Password %q expects %v but get %v", check.password, check.expected, codeSlice)
+				break
+			}
+		}
+	}
+
+	err := createPasswordPolicyError(passwordPolicy.Validate("alice", "short"))
+	if err == nil || err.Error() == "" {
+		t.Errorf("Violations should have a human readable message")
+	}
+}
+
+func TestCreateUserPasswordPolicy(t *testing.T) {
+	if _, err := CreateUser("alice", "", nil, nil, "", nil, nil, false); err == nil {
+		t.Errorf("Empty password should be rejected by the default policy")
+	} else if _, ok := err.(*PasswordPolicyError); ok == false {
+		t.Errorf("Error should be a password policy error but get %v", err)
+	}
+
+	user, err := CreateUser("alice", "correct horse battery", nil, nil, "", nil, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.CheckPassword("correct horse battery") == false || user.PasswordChangedTime == nil {
+		t.Errorf("User should be created with the password and the changed time")
+	}
+}
+
+func TestChangePasswordHistory(t *testing.T) {
+	previousPasswordPolicy := GetPasswordPolicy()
+	defer SetPasswordPolicy(previousPasswordPolicy)
+	SetPasswordPolicy(&PasswordPolicy{MinimumLength: 4, HistoryCount: 3})
+	SetPasswordHasher(CreateBcryptPasswordHasher(4))
+	defer SetPasswordHasher(verificationPasswordHasherSlice[0])
+
+	user := createTestUser(t, "alice", "first", nil, nil, "", nil, nil, false)
+	for _, password := range []string{"second", "third"} {
+		if err := user.ChangePassword(password); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The last three passwords are rejected
+	for _, password := range []string{"first", "second", "third"} {
+		err := user.ChangePassword(password)
+		if passwordPolicyError, ok := err.(*PasswordPolicyError); ok == false || passwordPolicyError.ViolationSlice[0].Code != PasswordViolationReused {
+			t.Errorf("Password %s should be rejected for reuse but get %v", password, err)
+		}
+	}
+
+	if err := user.ChangePassword("fourth"); err != nil {
+		t.Fatal(err)
+	}
+	if len(user.PasswordHistorySlice) != 2 {
+		t.Errorf("History should keep the previous two passwords but get %d", len(user.PasswordHistorySlice))
+	}
+	// The oldest password falls out of the history
+	if err := user.ChangePassword("first"); err != nil {
+		t.Errorf("Password out of the history should be accepted but get %v", err)
+	}
+}
+
+func TestPasswordExpired(t *testing.T) {
+	passwordPolicy := &PasswordPolicy{MaximumAge: 24 * time.Hour}
+	changedTime := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	user := &User{Name: "alice", PasswordChangedTime: &changedTime}
+
+	if passwordPolicy.IsPasswordExpired(user, changedTime.Add(23*time.Hour)) {
+		t.Errorf("Password should not be expired within the maximum age")
+	}
+	if passwordPolicy.IsPasswordExpired(user, changedTime.Add(25*time.Hour)) == false {
+		t.Errorf("Password should be expired after the maximum age")
+	}
+	if passwordPolicy.IsPasswordExpired(&User{Name: "legacy"}, changedTime.Add(25*time.Hour)) {
+		t.Errorf("Password without the changed time should not be expired")
+	}
+
+	previousPasswordPolicy := GetPasswordPolicy()
+	defer SetPasswordPolicy(previousPasswordPolicy)
+	SetPasswordPolicy(passwordPolicy)
+	alice := createTestUser(t, "alice", testPassword, nil, nil, "", nil, nil, false)
+	oldChangedTime := changedTime.Add(-48 * time.Hour)
+	alice.PasswordChangedTime = &oldChangedTime
+	authenticator, _, _ := createTestAuthenticator(alice)
+	if _, _, err := authenticator.Authenticate("alice", testPassword, ""); err != ErrPasswordExpired {
+		t.Errorf("Expired password should be reported but get %v", err)
+	}
+}
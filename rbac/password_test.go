@@ -0,0 +1,102 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestArgon2idPasswordHasher(t *testing.T) {
+	user := createTestUser(t, "u", testPassword, nil, nil, "", nil, nil, false)
+	other := createTestUser(t, "o", testPassword, nil, nil, "", nil, nil, false)
+
+	if !strings.HasPrefix(user.EncodedPassword, "$argon2id$v=19$m=65536,t=1,p=4$") {
+		t.Errorf("Unexpected encoded password %s", user.EncodedPassword)
+	}
+	if user.EncodedPassword == other.EncodedPassword {
+		t.Errorf("The same password should be salted differently")
+	}
+	if matched, rehash := user.CheckPasswordWithRehash(testPassword); !matched || rehash {
+		t.Errorf("Expect matched without rehash but get %v %v", matched, rehash)
+	}
+	if user.CheckPassword("wrong") {
+		t.Errorf("Wrong password should not match")
+	}
+
+	stronger := CreateArgon2idPasswordHasher(2, 64*1024, 4)
+	if !stronger.NeedsRehash(user.EncodedPassword) {
+		t.Errorf("Different parameters should need rehash")
+	}
+}
+
+func TestBcryptPasswordHasher(t *testing.T) {
+	bcryptPasswordHasher := CreateBcryptPasswordHasher(4)
+	encodedPassword, err := bcryptPasswordHasher.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Verifiable with the default argon2id hasher but reported as needing rehash
+	matched, rehash := VerifyPassword(encodedPassword, "secret")
+	if !matched || !rehash {
+		t.Errorf("Expect matched with rehash but get %v %v", matched, rehash)
+	}
+	if matched, _ := VerifyPassword(encodedPassword, "wrong"); matched {
+		t.Errorf("Wrong password should not match")
+	}
+}
+
+func TestLegacyPasswordMigration(t *testing.T) {
+	// SHA3-512 of "secret" as stored before the versioned format
+	legacyEncodedPassword, _ := (&LegacySha3PasswordHasher{}).Hash("secret")
+	user := &User{Name: "u", EncodedPassword: legacyEncodedPassword}
+
+	matched, rehash := user.CheckPasswordWithRehash("secret")
+	if !matched || !rehash {
+		t.Fatalf("Legacy password should match and need rehash but get %v %v", matched, rehash)
+	}
+	if err := user.SetPassword("secret"); err != nil {
+		t.Fatal(err)
+	}
+	if user.PasswordChangedTime == nil {
+		t.Errorf("Password changed time should be set")
+	}
+	if matched, rehash := user.CheckPasswordWithRehash("secret"); !matched || rehash {
+		t.Errorf("Migrated password should match without rehash but get %v %v", matched, rehash)
+	}
+	if user.CheckPassword("wrong") {
+		t.Errorf("Wrong password should not match")
+	}
+}
+
+func TestUnknownEncodedPassword(t *testing.T) {
+	for _, encodedPassword := range []string{
+		"",
+		"******",
+		"$argon2id$v=19$broken",
+		"$unknown$x",
+		// Out of range parameters are rejected before deriving the key
+		"$argon2id$v=19$m=65536,t=0,p=4$c2FsdHNhbHRzYWx0c2FsdA$a2V5",
+		"$argon2id$v=19$m=65536,t=1,p=0$c2FsdHNhbHRzYWx0c2FsdA$a2V5",
+		"$argon2id$v=19$m=65536,t=1,p=256$c2FsdHNhbHRzYWx0c2FsdA$a2V5",
+		"$argon2id$v=19$m=4294967295,t=1,p=4$c2FsdHNhbHRzYWx0c2FsdA$a2V5",
+		"$argon2id$v=19$m=65536,t=4294967295,p=4$c2FsdHNhbHRzYWx0c2FsdA$a2V5",
+	} {
+		if matched, _ := VerifyPassword(encodedPassword, ""); matched {
+			t.Errorf("Encoded password %q should not match", encodedPassword)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"errors"
+	"strings"
+)
+
+// MatchMode decides how the path of a permission or resource is compared with the target path.
+// Empty match mode of a Permission or Resource is treated as prefix so the permissions stored before match mode was introduced evaluate identically.
+// The policy document differs since it is new: an omitted matchMode there means segment. See PolicyDocument.
+//
+// In prefix mode, the path is a plain string prefix so /gui/inv also covers /gui/inventory.
+//
+// In segment mode, the path is compared segment by segment separated by /, and the path could be a pattern:
+//   - {name} or * matches exactly one segment
+//   - ** matches zero or more segments
+//
+// For example, /api/v1/namespaces/{namespace}/pods/* or /gui/**/detail.
+// Both modes are hierarchical so the path also covers all of its descendants.
+type MatchMode string
+
+const (
+	MatchModePrefix  MatchMode = "Prefix"
+	MatchModeSegment MatchMode = "Segment"
+)
+
+// Used in the reachable path for a segment which any value could be, so only the wildcard matches it
+const anySegmentPlaceholder = "{*}"
+
+func (matchMode MatchMode) IsPrefix() bool {
+	return matchMode == "" || matchMode == MatchModePrefix
+}
+
+func ValidatePathPattern(pattern string) error {
+	for _, segment := range splitPath(pattern) {
+		if strings.Contains(segment, "**") && segment != "**" {
+			return errors.New("** must be a whole segment in path " + pattern)
+		}
+		if strings.ContainsAny(segment, "{}") {
+			if !strings.HasPrefix(segment, "{") || !strings.HasSuffix(segment, "}") || len(segment) < 3 || strings.ContainsAny(segment[1:len(segment)-1], "{}") {
+				return errors.New("Invalid path parameter " + segment + " in path " + pattern)
+			}
+		}
+	}
+	return nil
+}
+
+func splitPath(path string) []string {
+	segmentSlice := make([]string, 0)
+	for _, segment := range strings.Split(path, "/") {
+		if segment != "" {
+			segmentSlice = append(segmentSlice, segment)
+		}
+	}
+	return segmentSlice
+}
+
+func matchSegment(patternSegment string, segment string) bool {
+	if patternSegment == "*" {
+		return true
+	} else if strings.HasPrefix(patternSegment, "{") && strings.HasSuffix(patternSegment, "}") {
+		return true
+	} else {
+		return patternSegment == segment
+	}
+}
+
+// Check whether the path is the pattern node or the descendant of the pattern node
+func matchPath(matchMode MatchMode, pattern string, path string) bool {
+	if matchMode.IsPrefix() {
+		return strings.HasPrefix(path, pattern)
+	} else {
+		return matchSegmentSlice(splitPath(pattern), splitPath(path))
+	}
+}
+
+// State of the matching identified by the remaining lengths of the pattern and the path since both only shrink from the front
+type segmentMatchState struct {
+	patternLength int
+	length        int
+}
+
+// The failed states are skipped so several ** don't take exponential time
+func matchSegmentSlice(patternSegmentSlice []string, segmentSlice []string) bool {
+	return matchSegmentSliceWithFailedState(patternSegmentSlice, segmentSlice, make(map[segmentMatchState]bool))
+}
+
+func matchSegmentSliceWithFailedState(patternSegmentSlice []string, segmentSlice []string, failedStateMap map[segmentMatchState]bool) bool {
+	if len(patternSegmentSlice) == 0 {
+		// Hierarchy
+		return true
+	}
+	state := segmentMatchState{len(patternSegmentSlice), len(segmentSlice)}
+	if failedStateMap[state] {
+		return false
+	}
+	matched := false
+	if patternSegmentSlice[0] == "**" {
+		matched = matchSegmentSliceWithFailedState(patternSegmentSlice[1:], segmentSlice, failedStateMap) ||
+			(len(segmentSlice) > 0 && matchSegmentSliceWithFailedState(patternSegmentSlice, segmentSlice[1:], failedStateMap))
+	} else if len(segmentSlice) > 0 {
+		matched = matchSegment(patternSegmentSlice[0], segmentSlice[0]) && matchSegmentSliceWithFailedState(patternSegmentSlice[1:], segmentSlice[1:], failedStateMap)
+	}
+	if matched == false {
+		failedStateMap[state] = true
+	}
+	return matched
+}
+
+// Check whether the path is the pattern node or the ancestor of some node matched by the pattern
+func matchChildPath(matchMode MatchMode, pattern string, path string) bool {
+	_, ok := getReachablePath(matchMode, pattern, path)
+	return ok
+}
+
+// The shallowest node under the path that the pattern applies to. It is used to check whether the node is covered by other permissions.
+func getReachablePath(matchMode MatchMode, pattern string, path string) (string, bool) {
+	if matchMode.IsPrefix() {
+		return pattern, strings.HasPrefix(pattern, path)
+	} else {
+		if pattern == "*" {
+			return path, true
+		}
+		reachableSegmentSlice, ok := getReachableSegmentSlice(splitPath(pattern), splitPath(path))
+		if ok == false {
+			return "", false
+		}
+		return "/" + strings.Join(reachableSegmentSlice, "/"), true
+	}
+}
+
+// Same as matchSegmentSlice, the failed states are skipped
+func getReachableSegmentSlice(patternSegmentSlice []string, segmentSlice []string) ([]string, bool) {
+	return getReachableSegmentSliceWithFailedState(patternSegmentSlice, segmentSlice, make(map[segmentMatchState]bool))
+}
+
+func getReachableSegmentSliceWithFailedState(patternSegmentSlice []string, segmentSlice []string, failedStateMap map[segmentMatchState]bool) ([]string, bool) {
+	state := segmentMatchState{len(patternSegmentSlice), len(segmentSlice)}
+	if failedStateMap[state] {
+		return nil, false
+	}
+	reachableSegmentSlice, ok := getReachableSegmentSliceOnce(patternSegmentSlice, segmentSlice, failedStateMap)
+	if ok == false {
+		failedStateMap[state] = true
+	}
+	return reachableSegmentSlice, ok
+}
+
+func getReachableSegmentSliceOnce(patternSegmentSlice []string, segmentSlice []string, failedStateMap map[segmentMatchState]bool) ([]string, bool) {
+	if len(segmentSlice) == 0 {
+		// Fill the rest of the pattern with the shortest node matched
+		reachableSegmentSlice := make([]string, 0)
+		for _, patternSegment := range patternSegmentSlice {
+			if patternSegment == "**" {
+				continue
+			} else if matchSegment(patternSegment, "") {
+				reachableSegmentSlice = append(reachableSegmentSlice, anySegmentPlaceholder)
+			} else {
+				reachableSegmentSlice = append(reachableSegmentSlice, patternSegment)
+			}
+		}
+		return reachableSegmentSlice, true
+	}
+	if len(patternSegmentSlice) == 0 {
+		// The pattern is the ancestor of the path, which is not the child permission
+		return nil, false
+	}
+	if patternSegmentSlice[0] == "**" {
+		if reachableSegmentSlice, ok := getReachableSegmentSliceWithFailedState(patternSegmentSlice[1:], segmentSlice, failedStateMap); ok {
+			return reachableSegmentSlice, true
+		}
+		if reachableSegmentSlice, ok := getReachableSegmentSliceWithFailedState(patternSegmentSlice, segmentSlice[1:], failedStateMap); ok {
+			return append([]string{segmentSlice[0]}, reachableSegmentSlice...), true
+		}
+		return nil, false
+	}
+	if matchSegment(patternSegmentSlice[0], segmentSlice[0]) {
+		if reachableSegmentSlice, ok := getReachableSegmentSliceWithFailedState(patternSegmentSlice[1:], segmentSlice[1:], failedStateMap); ok {
+			return append([]string{segmentSlice[0]}, reachableSegmentSlice...), true
+		}
+	}
+	return nil, false
+}
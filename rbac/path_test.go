@@ -0,0 +1,155 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchPath(t *testing.T) {
+	checkSlice := []struct {
+		matchMode MatchMode
+		pattern   string
+		path      string
+		expected  bool
+	}{
+		// Legacy stored policies without match mode
+		{"", "/gui/inv", "/gui/inventory", true},
+		{MatchModePrefix, "/gui/inv", "/gui/invoices", true},
+		{MatchModeSegment, "/gui/inv", "/gui/inventory", false},
+		{MatchModeSegment, "/gui/inv", "/gui/inv", true},
+		{MatchModeSegment, "/gui/inv", "/gui/inv/", true},
+		{MatchModeSegment, "/gui/inv", "/gui/inv/service", true},
+		{MatchModeSegment, "/api/v1/namespaces/{namespace}/pods/*", "/api/v1/namespaces/default/pods/nginx", true},
+		{MatchModeSegment, "/api/v1/namespaces/{namespace}/pods/*", "/api/v1/namespaces/default/pods/nginx/log", true},
+		{MatchModeSegment, "/api/v1/namespaces/{namespace}/pods/*", "/api/v1/namespaces/default/pods", false},
+		{MatchModeSegment, "/api/v1/namespaces/{namespace}/pods/*", "/api/v1/namespaces/default/services/nginx", false},
+		{MatchModeSegment, "/gui/**/detail", "/gui/detail", true},
+		{MatchModeSegment, "/gui/**/detail", "/gui/a/b/detail", true},
+		{MatchModeSegment, "/gui/**/detail", "/gui/a/b/details", false},
+		{MatchModeSegment, "/gui/**", "/gui", true},
+		{MatchModeSegment, "/", "/anything", true},
+	}
+	for _, check := range checkSlice {
+		if matchPath(check.matchMode, check.pattern, check.path) != check.expected {
+			t.Errorf("matchPath %q %s %s should be %v", check.matchMode, check.pattern, check.path, check.expected)
+		}
+	}
+}
+
+func TestMatchChildPath(t *testing.T) {
+	checkSlice := []struct {
+		matchMode MatchMode
+		pattern   string
+		path      string
+		expected  bool
+		reachable string
+	}{
+		{"", "/gui/inventory/service", "/gui/inv", true, "/gui/inventory/service"},
+		{MatchModeSegment, "/gui/inventory/service", "/gui/inv", false, ""},
+		{MatchModeSegment, "/gui/inventory/service", "/gui/inventory", true, "/gui/inventory/service"},
+		{MatchModeSegment, "/gui/inventory", "/gui/inventory/service", false, ""},
+		{MatchModeSegment, "/api/v1/namespaces/{namespace}/pods", "/api/v1/namespaces", true, "/api/v1/namespaces/{*}/pods"},
+		{MatchModeSegment, "/api/v1/namespaces/{namespace}/pods", "/api/v1/namespaces/default", true, "/api/v1/namespaces/default/pods"},
+		{MatchModeSegment, "/api/v1/namespaces/{namespace}/pods", "/api/v1/namespaces/default/services", false, ""},
+		{MatchModeSegment, "/gui/**/detail", "/gui/a/b", true, "/gui/a/b/detail"},
+		{MatchModeSegment, "/gui/**/detail", "/gui", true, "/gui/detail"},
+		{MatchModeSegment, "*", "/gui", true, "/gui"},
+	}
+	for _, check := range checkSlice {
+		reachable, ok := getReachablePath(check.matchMode, check.pattern, check.path)
+		if ok != check.expected || reachable != check.reachable {
+			t.Errorf("getReachablePath %q %s %s should be %v %s but get %v %s", check.matchMode, check.pattern, check.path, check.expected, check.reachable, ok, reachable)
+		}
+	}
+}
+
+func TestValidatePathPattern(t *testing.T) {
+	for _, pattern := range []string{"/gui", "/api/{namespace}/*", "/gui/**/detail", "*"} {
+		if err := ValidatePathPattern(pattern); err != nil {
+			t.Errorf("Pattern %s should be valid: %s", pattern, err)
+		}
+	}
+	for _, pattern := range []string{"/gui/a**", "/api/{namespace", "/api/{}", "/api/x{y}"} {
+		if err := ValidatePathPattern(pattern); err == nil {
+			t.Errorf("Pattern %s should be invalid", pattern)
+		}
+	}
+}
+
+func TestMatchPathWithManyDoubleWildcard(t *testing.T) {
+	pattern := strings.Repeat("/**", 30) + "/x"
+	path := strings.Repeat("/a", 30) + "/b"
+	done := make(chan bool)
+	go func() {
+		matchPath(MatchModeSegment, pattern, path)
+		matchChildPath(MatchModeSegment, pattern, path)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Pattern with many ** should be matched in polynomial time")
+	}
+	if matchPath(MatchModeSegment, pattern, path+"/x") == false || matchPath(MatchModeSegment, pattern, path) {
+		t.Errorf("Pattern with many ** should still match correctly")
+	}
+}
+
+func TestCreatePermissionWithMatchMode(t *testing.T) {
+	if _, err := CreatePermission("cloudone", "GET", "/api/a**"); err == nil {
+		t.Errorf("Invalid pattern should be rejected in segment mode")
+	}
+	permission, err := CreatePermissionWithMatchMode("cloudone", "GET", "/api/a**", EffectAllow, MatchModePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if permission.HasPermission("cloudone", "GET", "/api/a**b") == false {
+		t.Errorf("Legacy prefix path should be accepted in prefix mode")
+	}
+	if _, err := CreateResourceWithMatchMode("cloudone", "/ns{", EffectAllow, MatchModePrefix); err != nil {
+		t.Errorf("Legacy prefix resource should be accepted in prefix mode: %s", err)
+	}
+}
+
+func TestSegmentPermissionWithDeny(t *testing.T) {
+	allowPermission, _ := CreatePermission("cloudone", "GET", "/api/v1/namespaces/{namespace}/pods")
+	denyPermission, _ := CreateDenyPermission("cloudone", "*", "/api/v1/namespaces/kube-system")
+	user := &User{Name: "u", RoleSlice: []*Role{&Role{Name: "r", PermissionSlice: []*Permission{allowPermission, denyPermission}}}}
+
+	if user.HasPermission("cloudone", "GET", "/api/v1/namespaces/default/pods/nginx") == false {
+		t.Errorf("Pattern should grant the pod in default namespace")
+	}
+	if user.HasPermission("cloudone", "GET", "/api/v1/namespaces/kube-system/pods/dns") {
+		t.Errorf("Deny should override the pattern")
+	}
+	if user.HasChildPermission("cloudone", "GET", "/api/v1/namespaces") == false {
+		t.Errorf("Namespaces should be reachable because the deny only covers one namespace")
+	}
+	if user.HasChildPermission("cloudone", "GET", "/api/v1/namespaces/kube-system") {
+		t.Errorf("Denied namespace should not be reachable")
+	}
+
+	legacyPermission := &Permission{Name: "p", Component: "cloudone_gui", Method: "GET", Path: "/gui/inv"}
+	segmentPermission, _ := CreatePermission("cloudone_gui", "GET", "/gui/inv")
+	if legacyPermission.HasPermission("cloudone_gui", "GET", "/gui/inventory") == false {
+		t.Errorf("Legacy permission should keep the prefix behavior")
+	}
+	if segmentPermission.HasPermission("cloudone_gui", "GET", "/gui/inventory") {
+		t.Errorf("Segment permission should respect the segment boundary")
+	}
+}
@@ -17,7 +17,6 @@ package rbac
 import (
 	"encoding/hex"
 	"errors"
-	"strings"
 )
 
 type Permission struct {
@@ -25,20 +24,48 @@ type Permission struct {
 	Component string
 	Method    string
 	Path      string // Path is hierarchy
+	Effect    Effect
+	MatchMode MatchMode
+	Condition string // Optional. See ValidateCondition for the syntax.
 }
 
 func CreatePermission(component string, method string, path string) (*Permission, error) {
-	name, err := GetPermissionName(component, method, path)
+	return CreatePermissionWithEffect(component, method, path, EffectAllow)
+}
+
+func CreateDenyPermission(component string, method string, path string) (*Permission, error) {
+	return CreatePermissionWithEffect(component, method, path, EffectDeny)
+}
+
+// The permission is created in segment match mode. It is a breaking change from the string prefix of the earlier versions:
+// /gui/inv no longer covers /gui/inventory, and the path with a segment containing ** or braces but not being a pattern is rejected.
+// Use CreatePermissionWithMatchMode with MatchModePrefix to keep the legacy behavior.
+func CreatePermissionWithEffect(component string, method string, path string, effect Effect) (*Permission, error) {
+	return CreatePermissionWithMatchMode(component, method, path, effect, MatchModeSegment)
+}
+
+// The path is validated as a pattern only in segment match mode
+func CreatePermissionWithMatchMode(component string, method string, path string, effect Effect, matchMode MatchMode) (*Permission, error) {
+	name, err := getPermissionNameWithEffect(component, method, path, effect)
 	if err != nil {
 		log.Error(err)
 		return nil, err
 	}
+	if matchMode.IsPrefix() == false {
+		if err := ValidatePathPattern(path); err != nil {
+			log.Error(err)
+			return nil, err
+		}
+	}
 
 	return &Permission{
 		name,
 		component,
 		method,
 		path,
+		effect,
+		matchMode,
+		"",
 	}, nil
 }
 
@@ -59,7 +86,71 @@ func GetPermissionName(component string, method string, path string) (string, er
 	return hex.EncodeToString([]byte(component + " " + method + " " + path)), nil
 }
 
+func getPermissionNameWithEffect(component string, method string, path string, effect Effect) (string, error) {
+	name, err := GetPermissionName(component, method, path)
+	if err != nil {
+		return "", err
+	}
+	if effect.IsDeny() {
+		// Keep the allow and deny on the same node distinguishable
+		name = hex.EncodeToString([]byte(string(EffectDeny)+" ")) + name
+	}
+	return name, nil
+}
+
+// The shallowest node at or under the target path where the permission applies. The permission must match child of the target.
+// The name doesn't tell the match mode and the condition so every field is compared
+func (permission *Permission) equal(other *Permission) bool {
+	return permission.Component == other.Component && permission.Method == other.Method && permission.Path == other.Path &&
+		permission.Effect == other.Effect && permission.MatchMode == other.MatchMode && permission.Condition == other.Condition
+}
+
+func (permission *Permission) getReachablePath(path string) string {
+	if permission.Component == "*" || permission.Path == "*" {
+		return path
+	}
+	reachablePath, ok := getReachablePath(permission.MatchMode, permission.Path, path)
+	if ok == false {
+		return path
+	}
+	return reachablePath
+}
+
+// Check whether the permission grants the target. Deny permission and conditional permission never grant without the request context.
 func (permission *Permission) HasPermission(component string, method string, path string) bool {
+	return permission.Effect.IsDeny() == false && permission.Condition == "" && permission.Match(component, method, path)
+}
+
+func (permission *Permission) SetCondition(condition string) error {
+	if condition != "" {
+		if err := ValidateCondition(condition); err != nil {
+			log.Error(err)
+			return err
+		}
+	}
+	permission.Condition = condition
+	return nil
+}
+
+// Check whether the condition holds. Without the request context or when the condition fails to evaluate, it fails closed:
+// a conditional allow doesn't apply and a conditional deny applies.
+func (permission *Permission) isEffective(environment *conditionEnvironment) bool {
+	if permission.Condition == "" {
+		return true
+	}
+	if environment == nil || environment.requestContext == nil {
+		return permission.Effect.IsDeny()
+	}
+	result, err := evaluateCondition(permission.Condition, environment)
+	if err != nil {
+		log.Error(err)
+		return permission.Effect.IsDeny()
+	}
+	return result
+}
+
+// Check whether the permission applies to the target regardless of the effect
+func (permission *Permission) Match(component string, method string, path string) bool {
 	// * means all
 	if permission.Component == "*" {
 		return true
@@ -71,7 +162,7 @@ func (permission *Permission) HasPermission(component string, method string, pat
 				return true
 			} else {
 				// Prefix for hierarchy authorization
-				return strings.HasPrefix(path, permission.Path)
+				return matchPath(permission.MatchMode, permission.Path, path)
 			}
 		} else if permission.Method == method {
 			// * means all
@@ -79,7 +170,7 @@ func (permission *Permission) HasPermission(component string, method string, pat
 				return true
 			} else {
 				// Prefix for hierarchy authorization
-				return strings.HasPrefix(path, permission.Path)
+				return matchPath(permission.MatchMode, permission.Path, path)
 			}
 		} else {
 			// Different method won't apply path hierarchy authorization
@@ -92,6 +183,11 @@ func (permission *Permission) HasPermission(component string, method string, pat
 
 // Check whether user has the target permission node or child permission node of the target permission node along the tree
 func (permission *Permission) HasChildPermission(component string, method string, path string) bool {
+	return permission.Effect.IsDeny() == false && permission.Condition == "" && permission.MatchChild(component, method, path)
+}
+
+// Check whether the permission applies to the target node or child node of the target node regardless of the effect
+func (permission *Permission) MatchChild(component string, method string, path string) bool {
 	// * means all
 	if permission.Component == "*" {
 		return true
@@ -99,10 +195,10 @@ func (permission *Permission) HasChildPermission(component string, method string
 		// * means all
 		if permission.Method == "*" {
 			// Prefix for hierarchy authorization. Unlike HasPermission, here it check whether target permission is the same or the child of the permissions owned
-			return strings.HasPrefix(permission.Path, path)
+			return matchChildPath(permission.MatchMode, permission.Path, path)
 		} else if permission.Method == method {
 			// Prefix for hierarchy authorization. Unlike HasPermission, here it check whether target permission is the same or the child of the permissions owned
-			return strings.HasPrefix(permission.Path, path)
+			return matchChildPath(permission.MatchMode, permission.Path, path)
 		} else {
 			// Different method won't apply path hierarchy authorization
 			return false
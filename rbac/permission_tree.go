@@ -0,0 +1,72 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import ()
+
+const (
+	// HasPermission is true for the node
+	PermissionTreeNodeStateFull = "Full"
+	// Only HasChildPermission is true for the node so the user could pass it to reach the permitted descendants
+	PermissionTreeNodeStateDescendant = "Descendant"
+	// Neither is true. The node is only kept if some descendant is visible.
+	PermissionTreeNodeStateHidden = "Hidden"
+)
+
+// Node of the declared tree such as a menu. State is set in the tree returned by CreatePermissionTree.
+type PermissionTreeNode struct {
+	Name       string
+	Method     string
+	Path       string
+	State      string
+	ChildSlice []*PermissionTreeNode
+}
+
+// Evaluate every node of the declared tree for the user and return the pruned copy.
+// The state of each node is the same as HasPermission and HasChildPermission of the user for the node's method and path.
+func CreatePermissionTree(user *User, component string, declaredNodeSlice []*PermissionTreeNode) []*PermissionTreeNode {
+	return CreateAuthorizationIndex(user).CreatePermissionTree(component, declaredNodeSlice)
+}
+
+// Reuse the index to evaluate several trees for the same user
+func (authorizationIndex *AuthorizationIndex) CreatePermissionTree(component string, declaredNodeSlice []*PermissionTreeNode) []*PermissionTreeNode {
+	nodeSlice := make([]*PermissionTreeNode, 0)
+	for _, declaredNode := range declaredNodeSlice {
+		if node := authorizationIndex.createPermissionTreeNode(component, declaredNode); node != nil {
+			nodeSlice = append(nodeSlice, node)
+		}
+	}
+	return nodeSlice
+}
+
+// Return nil if the node and all its descendants are hidden
+func (authorizationIndex *AuthorizationIndex) createPermissionTreeNode(component string, declaredNode *PermissionTreeNode) *PermissionTreeNode {
+	node := &PermissionTreeNode{
+		declaredNode.Name,
+		declaredNode.Method,
+		declaredNode.Path,
+		PermissionTreeNodeStateHidden,
+		authorizationIndex.CreatePermissionTree(component, declaredNode.ChildSlice),
+	}
+
+	if authorizationIndex.HasPermission(component, declaredNode.Method, declaredNode.Path) {
+		node.State = PermissionTreeNodeStateFull
+	} else if authorizationIndex.HasChildPermission(component, declaredNode.Method, declaredNode.Path) {
+		node.State = PermissionTreeNodeStateDescendant
+	} else if len(node.ChildSlice) == 0 {
+		return nil
+	}
+	return node
+}
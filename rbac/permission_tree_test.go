@@ -0,0 +1,113 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func createTestMenu() []*PermissionTreeNode {
+	return []*PermissionTreeNode{
+		{Name: "root", Method: "GET", Path: "/", ChildSlice: []*PermissionTreeNode{
+			{Name: "gui", Method: "GET", Path: "/gui", ChildSlice: []*PermissionTreeNode{
+				{Name: "inventory", Method: "GET", Path: "/gui/inventory"},
+				{Name: "system", Method: "GET", Path: "/gui/system", ChildSlice: []*PermissionTreeNode{
+					{Name: "rbac", Method: "GET", Path: "/gui/system/rbac", ChildSlice: []*PermissionTreeNode{
+						{Name: "user", Method: "GET", Path: "/gui/system/rbac/user"},
+					}},
+					{Name: "notification", Method: "POST", Path: "/gui/system/notification"},
+				}},
+			}},
+			{Name: "other", Method: "GET", Path: "/other"},
+		}},
+	}
+}
+
+func checkPermissionTreeConsistency(t *testing.T, user *User, component string, declaredNodeSlice []*PermissionTreeNode, nodeSlice []*PermissionTreeNode) {
+	nodeMap := make(map[string]*PermissionTreeNode)
+	for _, node := range nodeSlice {
+		nodeMap[node.Name] = node
+	}
+	for _, declaredNode := range declaredNodeSlice {
+		expected := PermissionTreeNodeStateHidden
+		if user.HasPermission(component, declaredNode.Method, declaredNode.Path) {
+			expected = PermissionTreeNodeStateFull
+		} else if user.HasChildPermission(component, declaredNode.Method, declaredNode.Path) {
+			expected = PermissionTreeNodeStateDescendant
+		}
+
+		node, ok := nodeMap[declaredNode.Name]
+		if ok == false {
+			if expected != PermissionTreeNodeStateHidden {
+				t.Errorf("Node %s should not be pruned", declaredNode.Name)
+			}
+			continue
+		}
+		if node.State != expected {
+			t.Errorf("Node %s expects %s but get %s", declaredNode.Name, expected, node.State)
+		}
+		checkPermissionTreeConsistency(t, user, component, declaredNode.ChildSlice, node.ChildSlice)
+	}
+}
+
+func TestPermissionTree(t *testing.T) {
+	user := createDenyTestUser(t)
+	menu := createTestMenu()
+	tree := CreatePermissionTree(user, "cloudone_gui", menu)
+
+	checkPermissionTreeConsistency(t, user, "cloudone_gui", menu, tree)
+
+	root := tree[0]
+	if root.State != PermissionTreeNodeStateDescendant || len(root.ChildSlice) != 1 {
+		t.Fatalf("Root should only be passed to reach gui")
+	}
+	system := root.ChildSlice[0].ChildSlice[1]
+	if system.State != PermissionTreeNodeStateFull || len(system.ChildSlice) != 1 || system.ChildSlice[0].Name != "notification" {
+		t.Errorf("Denied rbac should be pruned from system")
+	}
+	if menu[0].State != "" {
+		t.Errorf("Declared tree should not be modified")
+	}
+
+	byteSlice, err := json.Marshal(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodedTree := make([]*PermissionTreeNode, 0)
+	if err := json.Unmarshal(byteSlice, &decodedTree); err != nil || decodedTree[0].ChildSlice[0].State != PermissionTreeNodeStateFull {
+		t.Errorf("Tree should be serializable to JSON")
+	}
+}
+
+func TestPermissionTreeHiddenAncestor(t *testing.T) {
+	user := createDenyTestUser(t)
+	// Menu groups aren't necessarily along the path
+	menu := []*PermissionTreeNode{
+		{Name: "admin", Method: "GET", Path: "/admin", ChildSlice: []*PermissionTreeNode{
+			{Name: "inventory", Method: "GET", Path: "/gui/inventory"},
+			{Name: "rbac", Method: "GET", Path: "/gui/system/rbac"},
+		}},
+	}
+	tree := CreatePermissionTree(user, "cloudone_gui", menu)
+
+	checkPermissionTreeConsistency(t, user, "cloudone_gui", menu, tree)
+	if len(tree) != 1 || tree[0].State != PermissionTreeNodeStateHidden || len(tree[0].ChildSlice) != 1 {
+		t.Errorf("Hidden node should be kept for its visible descendant")
+	}
+	if len(CreatePermissionTree(user, "cloudone", menu)) != 0 {
+		t.Errorf("All nodes should be pruned for the component without permission")
+	}
+}
@@ -0,0 +1,1128 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PolicyDocument is the declarative form of roles, groups and users in YAML or JSON. For example:
+//
+//	roles:
+//	  - name: viewer
+//	    permissions:
+//	      - {component: cloudone_gui, method: GET, path: /gui}
+//	  - name: operator
+//	    parents: [viewer]
+//	    permissions:
+//	      - {component: cloudone_gui, method: "*", path: /gui/system/rbac, effect: Deny}
+//	groups:
+//	  - name: team-a
+//	    roles: [operator]
+//	    resources:
+//	      - {component: cloudone, path: /namespaces/team-a}
+//	users:
+//	  - name: alice
+//	    encodedPassword: $argon2id$v=19$...
+//	    groups: [team-a]
+//	rateLimits:
+//	  - {component: cloudone, method: "*", key: user, limit: 100, period: 1m}
+//
+// The match mode of a permission or resource defaults to Segment when omitted, as CreatePermission and CreateResource do.
+// It differs from the empty MatchMode of a Permission or Resource, which is Prefix for the permissions stored before,
+// so CreatePolicyDocument writes Prefix explicitly. Effect defaults to Allow.
+type PolicyDocument struct {
+	RoleSlice  []*PolicyRole  `yaml:"roles,omitempty" json:"roles,omitempty"`
+	GroupSlice []*PolicyGroup `yaml:"groups,omitempty" json:"groups,omitempty"`
+	UserSlice  []*PolicyUser  `yaml:"users,omitempty" json:"users,omitempty"`
+	// Rate limits of the requests by the identities. See RateLimit.
+	RateLimitSlice []*PolicyRateLimit `yaml:"rateLimits,omitempty" json:"rateLimits,omitempty"`
+	position       policyPosition
+}
+
+type PolicyRole struct {
+	Name                string              `yaml:"name" json:"name"`
+	Description         string              `yaml:"description,omitempty" json:"description,omitempty"`
+	ParentRoleNameSlice []string            `yaml:"parents,omitempty" json:"parents,omitempty"`
+	PermissionSlice     []*PolicyPermission `yaml:"permissions,omitempty" json:"permissions,omitempty"`
+	RequireSecondFactor bool                `yaml:"requireSecondFactor,omitempty" json:"requireSecondFactor,omitempty"`
+	position            policyPosition
+}
+
+type PolicyPermission struct {
+	Component string `yaml:"component" json:"component"`
+	Method    string `yaml:"method" json:"method"`
+	Path      string `yaml:"path" json:"path"`
+	Effect    string `yaml:"effect,omitempty" json:"effect,omitempty"`
+	MatchMode string `yaml:"matchMode,omitempty" json:"matchMode,omitempty"`
+	Condition string `yaml:"condition,omitempty" json:"condition,omitempty"`
+	position  policyPosition
+}
+
+type PolicyResource struct {
+	Component string `yaml:"component" json:"component"`
+	Path      string `yaml:"path" json:"path"`
+	Effect    string `yaml:"effect,omitempty" json:"effect,omitempty"`
+	MatchMode string `yaml:"matchMode,omitempty" json:"matchMode,omitempty"`
+	position  policyPosition
+}
+
+type PolicyGroup struct {
+	Name          string            `yaml:"name" json:"name"`
+	Description   string            `yaml:"description,omitempty" json:"description,omitempty"`
+	RoleNameSlice []string          `yaml:"roles,omitempty" json:"roles,omitempty"`
+	ResourceSlice []*PolicyResource `yaml:"resources,omitempty" json:"resources,omitempty"`
+	position      policyPosition
+}
+
+type PolicyUser struct {
+	Name            string            `yaml:"name" json:"name"`
+	EncodedPassword string            `yaml:"encodedPassword,omitempty" json:"encodedPassword,omitempty"`
+	Description     string            `yaml:"description,omitempty" json:"description,omitempty"`
+	RoleNameSlice   []string          `yaml:"roles,omitempty" json:"roles,omitempty"`
+	GroupNameSlice  []string          `yaml:"groups,omitempty" json:"groups,omitempty"`
+	ResourceSlice   []*PolicyResource `yaml:"resources,omitempty" json:"resources,omitempty"`
+	// Roles granted only within the namespace
+	RoleBindingSlice []*PolicyRoleBinding `yaml:"roleBindings,omitempty" json:"roleBindings,omitempty"`
+	MetaDataMap      map[string]string    `yaml:"metaData,omitempty" json:"metaData,omitempty"`
+	ExpiredTime      string               `yaml:"expiredTime,omitempty" json:"expiredTime,omitempty"` // RFC 3339
+	Disabled         bool                 `yaml:"disabled,omitempty" json:"disabled,omitempty"`
+	// Kept for the password policy when the user is persisted
+	PasswordChangedTime  string        `yaml:"passwordChangedTime,omitempty" json:"passwordChangedTime,omitempty"` // RFC 3339
+	PasswordHistorySlice []string      `yaml:"passwordHistory,omitempty" json:"passwordHistory,omitempty"`
+	SecondFactor         *SecondFactor `yaml:"secondFactor,omitempty" json:"secondFactor,omitempty"` // Only by Store. CreatePolicyDocument leaves it out.
+	// Roles granted within a time window
+	RoleGrantSlice []*PolicyRoleGrant `yaml:"roleGrants,omitempty" json:"roleGrants,omitempty"`
+	position       policyPosition
+}
+
+type PolicyRoleBinding struct {
+	Namespace     string   `yaml:"namespace" json:"namespace"`
+	RoleNameSlice []string `yaml:"roles,omitempty" json:"roles,omitempty"`
+	position      policyPosition
+}
+
+type PolicyRateLimit struct {
+	Component string `yaml:"component" json:"component"`
+	Method    string `yaml:"method" json:"method"`
+	KeyKind   string `yaml:"key" json:"key"`
+	RoleName  string `yaml:"role,omitempty" json:"role,omitempty"`
+	Limit     int    `yaml:"limit" json:"limit"`
+	Period    string `yaml:"period" json:"period"` // Such as 1s or 1m
+	Burst     int    `yaml:"burst,omitempty" json:"burst,omitempty"`
+	position  policyPosition
+}
+
+type PolicyRoleGrant struct {
+	RoleName     string `yaml:"role" json:"role"`
+	StartTime    string `yaml:"startTime,omitempty" json:"startTime,omitempty"` // RFC 3339
+	EndTime      string `yaml:"endTime,omitempty" json:"endTime,omitempty"`     // RFC 3339
+	Reason       string `yaml:"reason,omitempty" json:"reason,omitempty"`
+	ApproverName string `yaml:"approver,omitempty" json:"approver,omitempty"`
+	position     policyPosition
+}
+
+// Policy is the in-memory objects built from a policy document
+type Policy struct {
+	RoleSlice      []*Role
+	GroupSlice     []*Group
+	UserSlice      []*User
+	RateLimitSlice []*RateLimit // Only from the policy document. Store doesn't keep the rate limits.
+}
+
+// Line of the item and its fields in the source document. Zero if the document is not parsed from the source.
+type policyPosition struct {
+	line         int
+	fieldLineMap map[string]int
+}
+
+func (position *policyPosition) getLine(field string) int {
+	if line, ok := position.fieldLineMap[field]; ok {
+		return line
+	}
+	return position.line
+}
+
+// Record the lines and reject the unknown fields
+func (position *policyPosition) record(node *yaml.Node, knownFieldSlice ...string) error {
+	position.line = node.Line
+	position.fieldLineMap = make(map[string]int)
+	if node.Kind != yaml.MappingNode {
+		return &PolicyError{node.Line, "Expect a mapping"}
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i]
+		known := false
+		for _, knownField := range knownFieldSlice {
+			if key.Value == knownField {
+				known = true
+				break
+			}
+		}
+		if known == false {
+			return &PolicyError{key.Line, "Unknown field " + key.Value}
+		}
+		position.fieldLineMap[key.Value] = key.Line
+	}
+	return nil
+}
+
+func (policyDocument *PolicyDocument) UnmarshalYAML(node *yaml.Node) error {
+	if err := policyDocument.position.record(node, "roles", "groups", "users", "rateLimits"); err != nil {
+		return err
+	}
+	type plain PolicyDocument
+	return node.Decode((*plain)(policyDocument))
+}
+
+func (policyRole *PolicyRole) UnmarshalYAML(node *yaml.Node) error {
+	if err := policyRole.position.record(node, "name", "description", "parents", "permissions", "requireSecondFactor"); err != nil {
+		return err
+	}
+	type plain PolicyRole
+	return node.Decode((*plain)(policyRole))
+}
+
+func (policyPermission *PolicyPermission) UnmarshalYAML(node *yaml.Node) error {
+	if err := policyPermission.position.record(node, "component", "method", "path", "effect", "matchMode", "condition"); err != nil {
+		return err
+	}
+	type plain PolicyPermission
+	return node.Decode((*plain)(policyPermission))
+}
+
+func (policyResource *PolicyResource) UnmarshalYAML(node *yaml.Node) error {
+	if err := policyResource.position.record(node, "component", "path", "effect", "matchMode"); err != nil {
+		return err
+	}
+	type plain PolicyResource
+	return node.Decode((*plain)(policyResource))
+}
+
+func (policyGroup *PolicyGroup) UnmarshalYAML(node *yaml.Node) error {
+	if err := policyGroup.position.record(node, "name", "description", "roles", "resources"); err != nil {
+		return err
+	}
+	type plain PolicyGroup
+	return node.Decode((*plain)(policyGroup))
+}
+
+func (policyUser *PolicyUser) UnmarshalYAML(node *yaml.Node) error {
+	if err := policyUser.position.record(node, "name", "encodedPassword", "description", "roles", "groups", "resources", "roleBindings", "metaData", "expiredTime", "disabled", "passwordChangedTime", "passwordHistory", "secondFactor", "roleGrants"); err != nil {
+		return err
+	}
+	type plain PolicyUser
+	return node.Decode((*plain)(policyUser))
+}
+
+func (policyRoleBinding *PolicyRoleBinding) UnmarshalYAML(node *yaml.Node) error {
+	if err := policyRoleBinding.position.record(node, "namespace", "roles"); err != nil {
+		return err
+	}
+	type plain PolicyRoleBinding
+	return node.Decode((*plain)(policyRoleBinding))
+}
+
+func (policyRateLimit *PolicyRateLimit) UnmarshalYAML(node *yaml.Node) error {
+	if err := policyRateLimit.position.record(node, "component", "method", "key", "role", "limit", "period", "burst"); err != nil {
+		return err
+	}
+	type plain PolicyRateLimit
+	return node.Decode((*plain)(policyRateLimit))
+}
+
+func (policyRoleGrant *PolicyRoleGrant) UnmarshalYAML(node *yaml.Node) error {
+	if err := policyRoleGrant.position.record(node, "role", "startTime", "endTime", "reason", "approver"); err != nil {
+		return err
+	}
+	type plain PolicyRoleGrant
+	return node.Decode((*plain)(policyRoleGrant))
+}
+
+type PolicyError struct {
+	Line    int
+	Message string
+}
+
+func (policyError *PolicyError) Error() string {
+	if policyError.Line > 0 {
+		return fmt.Sprintf("line %d: %s", policyError.Line, policyError.Message)
+	}
+	return policyError.Message
+}
+
+// PolicyValidationError holds all the problems found in a policy document
+type PolicyValidationError struct {
+	ErrorSlice []*PolicyError
+}
+
+func (policyValidationError *PolicyValidationError) Error() string {
+	messageSlice := make([]string, 0)
+	for _, policyError := range policyValidationError.ErrorSlice {
+		messageSlice = append(messageSlice, policyError.Error())
+	}
+	return strings.Join(messageSlice, "\n")
+}
+
+// Parse the policy document in YAML or JSON, which is a subset of YAML, and validate it
+func ParsePolicyDocument(data []byte) (*PolicyDocument, error) {
+	policyDocument := &PolicyDocument{}
+	if err := yaml.Unmarshal(data, policyDocument); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if err := policyDocument.Validate(); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return policyDocument, nil
+}
+
+// Parse, validate and build the in-memory objects
+func LoadPolicy(data []byte) (*Policy, error) {
+	policyDocument, err := ParsePolicyDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	return policyDocument.Build()
+}
+
+var validMethodMap = map[string]bool{
+	"*":       true,
+	"GET":     true,
+	"HEAD":    true,
+	"POST":    true,
+	"PUT":     true,
+	"PATCH":   true,
+	"DELETE":  true,
+	"OPTIONS": true,
+	// Not an HTTP method. See CanImpersonate.
+	ImpersonationMethod: true,
+}
+
+func (policyDocument *PolicyDocument) Validate() error {
+	errorSlice := make([]*PolicyError, 0)
+	addError := func(line int, message string) {
+		errorSlice = append(errorSlice, &PolicyError{line, message})
+	}
+
+	roleMap := make(map[string]*PolicyRole)
+	for _, policyRole := range policyDocument.RoleSlice {
+		if policyRole.Name == "" {
+			addError(policyRole.position.getLine("name"), "Role name couldn't be empty")
+		} else if _, ok := roleMap[policyRole.Name]; ok {
+			addError(policyRole.position.getLine("name"), "Duplicate role name "+policyRole.Name)
+		} else {
+			roleMap[policyRole.Name] = policyRole
+		}
+	}
+	groupMap := make(map[string]*PolicyGroup)
+	for _, policyGroup := range policyDocument.GroupSlice {
+		if policyGroup.Name == "" {
+			addError(policyGroup.position.getLine("name"), "Group name couldn't be empty")
+		} else if _, ok := groupMap[policyGroup.Name]; ok {
+			addError(policyGroup.position.getLine("name"), "Duplicate group name "+policyGroup.Name)
+		} else {
+			groupMap[policyGroup.Name] = policyGroup
+		}
+	}
+	userNameMap := make(map[string]bool)
+	for _, policyUser := range policyDocument.UserSlice {
+		if policyUser.Name == "" {
+			addError(policyUser.position.getLine("name"), "User name couldn't be empty")
+		} else if userNameMap[policyUser.Name] {
+			addError(policyUser.position.getLine("name"), "Duplicate user name "+policyUser.Name)
+		} else if err := validateUserName(policyUser.Name); err != nil {
+			addError(policyUser.position.getLine("name"), err.Error())
+		} else {
+			userNameMap[policyUser.Name] = true
+		}
+	}
+
+	for _, policyRole := range policyDocument.RoleSlice {
+		for _, parentRoleName := range policyRole.ParentRoleNameSlice {
+			if _, ok := roleMap[parentRoleName]; ok == false {
+				addError(policyRole.position.getLine("parents"), "Role "+policyRole.Name+" references unknown parent role "+parentRoleName)
+			}
+		}
+		for _, policyPermission := range policyRole.PermissionSlice {
+			errorSlice = append(errorSlice, policyPermission.validate()...)
+		}
+	}
+	for _, policyGroup := range policyDocument.GroupSlice {
+		for _, roleName := range policyGroup.RoleNameSlice {
+			if _, ok := roleMap[roleName]; ok == false {
+				addError(policyGroup.position.getLine("roles"), "Group "+policyGroup.Name+" references unknown role "+roleName)
+			}
+		}
+		for _, policyResource := range policyGroup.ResourceSlice {
+			errorSlice = append(errorSlice, policyResource.validate()...)
+		}
+	}
+	for _, policyUser := range policyDocument.UserSlice {
+		for _, roleName := range policyUser.RoleNameSlice {
+			if _, ok := roleMap[roleName]; ok == false {
+				addError(policyUser.position.getLine("roles"), "User "+policyUser.Name+" references unknown role "+roleName)
+			}
+		}
+		for _, groupName := range policyUser.GroupNameSlice {
+			if _, ok := groupMap[groupName]; ok == false {
+				addError(policyUser.position.getLine("groups"), "User "+policyUser.Name+" references unknown group "+groupName)
+			}
+		}
+		for _, policyResource := range policyUser.ResourceSlice {
+			errorSlice = append(errorSlice, policyResource.validate()...)
+		}
+		for _, key := range reservedMetaDataKeySlice {
+			if _, ok := policyUser.MetaDataMap[key]; ok {
+				addError(policyUser.position.getLine("metaData"), "Meta data key "+key+" of user "+policyUser.Name+" is reserved")
+			}
+		}
+		for _, policyRoleBinding := range policyUser.RoleBindingSlice {
+			if err := validateNamespace(policyRoleBinding.Namespace); err != nil {
+				addError(policyRoleBinding.position.getLine("namespace"), err.Error())
+			}
+			for _, roleName := range policyRoleBinding.RoleNameSlice {
+				if _, ok := roleMap[roleName]; ok == false {
+					addError(policyRoleBinding.position.getLine("roles"), "User "+policyUser.Name+" binds unknown role "+roleName)
+				}
+			}
+		}
+		for _, policyRoleGrant := range policyUser.RoleGrantSlice {
+			errorSlice = append(errorSlice, policyRoleGrant.validate(policyUser.Name, roleMap)...)
+		}
+		if policyUser.ExpiredTime != "" {
+			if _, err := time.Parse(time.RFC3339, policyUser.ExpiredTime); err != nil {
+				addError(policyUser.position.getLine("expiredTime"), "Invalid expired time "+policyUser.ExpiredTime+", expect RFC 3339")
+			}
+		}
+		if policyUser.PasswordChangedTime != "" {
+			if _, err := time.Parse(time.RFC3339, policyUser.PasswordChangedTime); err != nil {
+				addError(policyUser.position.getLine("passwordChangedTime"), "Invalid password changed time "+policyUser.PasswordChangedTime+", expect RFC 3339")
+			}
+		}
+	}
+
+	rateLimitNameMap := make(map[string]bool)
+	for _, policyRateLimit := range policyDocument.RateLimitSlice {
+		rateLimit, field, err := policyRateLimit.build()
+		if err != nil {
+			addError(policyRateLimit.position.getLine(field), err.Error())
+			continue
+		}
+		if rateLimit.RoleName != "" {
+			if _, ok := roleMap[rateLimit.RoleName]; ok == false {
+				addError(policyRateLimit.position.getLine("role"), "Rate limit references unknown role "+rateLimit.RoleName)
+			}
+		}
+		if rateLimitNameMap[rateLimit.GetName()] {
+			addError(policyRateLimit.position.line, "Duplicate rate limit "+rateLimit.GetName())
+		}
+		rateLimitNameMap[rateLimit.GetName()] = true
+	}
+
+	// Cycles are only checked when all the references are known
+	if len(errorSlice) == 0 {
+		roleResolver := &RoleResolver{make(map[string]*Role)}
+		roleSlice := make([]*Role, 0)
+		for _, policyRole := range policyDocument.RoleSlice {
+			role := &Role{Name: policyRole.Name, ParentRoleNameSlice: policyRole.ParentRoleNameSlice}
+			roleResolver.roleMap[role.Name] = role
+			roleSlice = append(roleSlice, role)
+		}
+		for i, role := range roleSlice {
+			if _, err := roleResolver.GetEffectivePermissionSlice(role); err != nil {
+				addError(policyDocument.RoleSlice[i].position.getLine("parents"), err.Error())
+				break
+			}
+		}
+	}
+
+	if len(errorSlice) > 0 {
+		return &PolicyValidationError{errorSlice}
+	}
+	return nil
+}
+
+func (policyPermission *PolicyPermission) validate() []*PolicyError {
+	errorSlice := make([]*PolicyError, 0)
+	position := &policyPermission.position
+	if policyPermission.Component == "" {
+		errorSlice = append(errorSlice, &PolicyError{position.getLine("component"), "Component couldn't be empty"})
+	}
+	if validMethodMap[policyPermission.Method] == false {
+		errorSlice = append(errorSlice, &PolicyError{position.getLine("method"), "Invalid method " + policyPermission.Method})
+	}
+	if policyPermission.Path == "" {
+		errorSlice = append(errorSlice, &PolicyError{position.getLine("path"), "Path couldn't be empty"})
+	} else if policyPermission.MatchMode != string(MatchModePrefix) {
+		if err := ValidatePathPattern(policyPermission.Path); err != nil {
+			errorSlice = append(errorSlice, &PolicyError{position.getLine("path"), err.Error()})
+		}
+	}
+	errorSlice = append(errorSlice, validatePolicyEffectAndMatchMode(policyPermission.Effect, policyPermission.MatchMode, position)...)
+	if policyPermission.Condition != "" {
+		if err := ValidateCondition(policyPermission.Condition); err != nil {
+			errorSlice = append(errorSlice, &PolicyError{position.getLine("condition"), err.Error()})
+		}
+	}
+	return errorSlice
+}
+
+func (policyRoleGrant *PolicyRoleGrant) validate(userName string, roleMap map[string]*PolicyRole) []*PolicyError {
+	errorSlice := make([]*PolicyError, 0)
+	position := &policyRoleGrant.position
+	if _, ok := roleMap[policyRoleGrant.RoleName]; ok == false {
+		errorSlice = append(errorSlice, &PolicyError{position.getLine("role"), "User " + userName + " is granted unknown role " + policyRoleGrant.RoleName})
+	}
+	startTime, startErr := parsePolicyOptionalTime(policyRoleGrant.StartTime)
+	if startErr != nil {
+		errorSlice = append(errorSlice, &PolicyError{position.getLine("startTime"), "Invalid start time " + policyRoleGrant.StartTime + ", expect RFC 3339"})
+	}
+	endTime, endErr := parsePolicyOptionalTime(policyRoleGrant.EndTime)
+	if endErr != nil {
+		errorSlice = append(errorSlice, &PolicyError{position.getLine("endTime"), "Invalid end time " + policyRoleGrant.EndTime + ", expect RFC 3339"})
+	}
+	if startErr == nil && endErr == nil {
+		if err := validateRoleGrantWindow(startTime, endTime); err != nil {
+			errorSlice = append(errorSlice, &PolicyError{position.getLine("endTime"), err.Error()})
+		}
+	}
+	return errorSlice
+}
+
+// Return the invalid field on error
+func (policyRateLimit *PolicyRateLimit) build() (*RateLimit, string, error) {
+	period, err := time.ParseDuration(policyRateLimit.Period)
+	if err != nil {
+		return nil, "period", errors.New("Invalid period " + policyRateLimit.Period + ", expect a duration such as 1m")
+	}
+	rateLimit := &RateLimit{
+		policyRateLimit.Component,
+		policyRateLimit.Method,
+		policyRateLimit.KeyKind,
+		policyRateLimit.RoleName,
+		policyRateLimit.Limit,
+		period,
+		policyRateLimit.Burst,
+	}
+	if field, err := rateLimit.validateField(); err != nil {
+		return nil, field, err
+	}
+	return rateLimit, "", nil
+}
+
+// Nil if the value is empty
+func parsePolicyOptionalTime(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	parsedTime, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, err
+	}
+	return &parsedTime, nil
+}
+
+func formatPolicyOptionalTime(value *time.Time) string {
+	if value == nil {
+		return ""
+	}
+	return value.Format(time.RFC3339)
+}
+
+func (policyResource *PolicyResource) validate() []*PolicyError {
+	errorSlice := make([]*PolicyError, 0)
+	position := &policyResource.position
+	if policyResource.Component == "" {
+		errorSlice = append(errorSlice, &PolicyError{position.getLine("component"), "Component couldn't be empty"})
+	}
+	if policyResource.Path == "" {
+		errorSlice = append(errorSlice, &PolicyError{position.getLine("path"), "Path couldn't be empty"})
+	} else if policyResource.MatchMode != string(MatchModePrefix) {
+		if err := ValidatePathPattern(policyResource.Path); err != nil {
+			errorSlice = append(errorSlice, &PolicyError{position.getLine("path"), err.Error()})
+		}
+	}
+	errorSlice = append(errorSlice, validatePolicyEffectAndMatchMode(policyResource.Effect, policyResource.MatchMode, position)...)
+	return errorSlice
+}
+
+func validatePolicyEffectAndMatchMode(effect string, matchMode string, position *policyPosition) []*PolicyError {
+	errorSlice := make([]*PolicyError, 0)
+	if effect != "" && effect != string(EffectAllow) && effect != string(EffectDeny) {
+		errorSlice = append(errorSlice, &PolicyError{position.getLine("effect"), "Invalid effect " + effect + ", expect Allow or Deny"})
+	}
+	if matchMode != "" && matchMode != string(MatchModePrefix) && matchMode != string(MatchModeSegment) {
+		errorSlice = append(errorSlice, &PolicyError{position.getLine("matchMode"), "Invalid match mode " + matchMode + ", expect Prefix or Segment"})
+	}
+	return errorSlice
+}
+
+func (policyPermission *PolicyPermission) build() *Permission {
+	effect := Effect(policyPermission.Effect)
+	if effect == "" {
+		effect = EffectAllow
+	}
+	matchMode := MatchMode(policyPermission.MatchMode)
+	if matchMode == "" {
+		matchMode = MatchModeSegment
+	}
+	name, _ := getPermissionNameWithEffect(policyPermission.Component, policyPermission.Method, policyPermission.Path, effect)
+	return &Permission{
+		name,
+		policyPermission.Component,
+		policyPermission.Method,
+		policyPermission.Path,
+		effect,
+		matchMode,
+		policyPermission.Condition,
+	}
+}
+
+func (policyResource *PolicyResource) build() *Resource {
+	effect := Effect(policyResource.Effect)
+	if effect == "" {
+		effect = EffectAllow
+	}
+	matchMode := MatchMode(policyResource.MatchMode)
+	if matchMode == "" {
+		matchMode = MatchModeSegment
+	}
+	name, _ := getResourceNameWithEffect(policyResource.Component, policyResource.Path, effect)
+	return &Resource{
+		name,
+		policyResource.Component,
+		policyResource.Path,
+		effect,
+		matchMode,
+	}
+}
+
+func buildPolicyResourceSlice(policyResourceSlice []*PolicyResource) []*Resource {
+	resourceSlice := make([]*Resource, 0)
+	for _, policyResource := range policyResourceSlice {
+		resourceSlice = append(resourceSlice, policyResource.build())
+	}
+	return resourceSlice
+}
+
+// Build the in-memory objects. The document is validated first.
+func (policyDocument *PolicyDocument) Build() (*Policy, error) {
+	if err := policyDocument.Validate(); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	policy := &Policy{make([]*Role, 0), make([]*Group, 0), make([]*User, 0), make([]*RateLimit, 0)}
+	roleMap := make(map[string]*Role)
+	for _, policyRole := range policyDocument.RoleSlice {
+		role := &Role{
+			Name:                policyRole.Name,
+			PermissionSlice:     make([]*Permission, 0),
+			Description:         policyRole.Description,
+			ParentRoleNameSlice: policyRole.ParentRoleNameSlice,
+			RequireSecondFactor: policyRole.RequireSecondFactor,
+		}
+		for _, policyPermission := range policyRole.PermissionSlice {
+			role.PermissionSlice = append(role.PermissionSlice, policyPermission.build())
+		}
+		roleMap[role.Name] = role
+		policy.RoleSlice = append(policy.RoleSlice, role)
+	}
+
+	for _, policyGroup := range policyDocument.GroupSlice {
+		group := &Group{
+			policyGroup.Name,
+			make([]*Role, 0),
+			buildPolicyResourceSlice(policyGroup.ResourceSlice),
+			policyGroup.Description,
+		}
+		for _, roleName := range policyGroup.RoleNameSlice {
+			group.RoleSlice = append(group.RoleSlice, roleMap[roleName])
+		}
+		policy.GroupSlice = append(policy.GroupSlice, group)
+	}
+
+	for _, policyUser := range policyDocument.UserSlice {
+		user := &User{
+			Name:                 policyUser.Name,
+			EncodedPassword:      policyUser.EncodedPassword,
+			RoleSlice:            make([]*Role, 0),
+			ResourceSlice:        buildPolicyResourceSlice(policyUser.ResourceSlice),
+			Description:          policyUser.Description,
+			MetaDataMap:          policyUser.MetaDataMap,
+			Disabled:             policyUser.Disabled,
+			GroupNameSlice:       policyUser.GroupNameSlice,
+			PasswordHistorySlice: policyUser.PasswordHistorySlice,
+			SecondFactor:         policyUser.SecondFactor,
+		}
+		for _, roleName := range policyUser.RoleNameSlice {
+			user.RoleSlice = append(user.RoleSlice, roleMap[roleName])
+		}
+		for _, policyRoleBinding := range policyUser.RoleBindingSlice {
+			roleBinding := &RoleBinding{policyRoleBinding.Namespace, make([]*Role, 0)}
+			for _, roleName := range policyRoleBinding.RoleNameSlice {
+				roleBinding.RoleSlice = append(roleBinding.RoleSlice, roleMap[roleName])
+			}
+			user.RoleBindingSlice = append(user.RoleBindingSlice, roleBinding)
+		}
+		for _, policyRoleGrant := range policyUser.RoleGrantSlice {
+			startTime, _ := parsePolicyOptionalTime(policyRoleGrant.StartTime)
+			endTime, _ := parsePolicyOptionalTime(policyRoleGrant.EndTime)
+			user.RoleGrantSlice = append(user.RoleGrantSlice, &RoleGrant{
+				roleMap[policyRoleGrant.RoleName],
+				startTime,
+				endTime,
+				policyRoleGrant.Reason,
+				policyRoleGrant.ApproverName,
+			})
+		}
+		if policyUser.ExpiredTime != "" {
+			expiredTime, _ := time.Parse(time.RFC3339, policyUser.ExpiredTime)
+			user.ExpiredTime = &expiredTime
+		}
+		if policyUser.PasswordChangedTime != "" {
+			passwordChangedTime, _ := time.Parse(time.RFC3339, policyUser.PasswordChangedTime)
+			user.PasswordChangedTime = &passwordChangedTime
+		}
+		policy.UserSlice = append(policy.UserSlice, user)
+	}
+
+	for _, policyRateLimit := range policyDocument.RateLimitSlice {
+		rateLimit, _, _ := policyRateLimit.build()
+		policy.RateLimitSlice = append(policy.RateLimitSlice, rateLimit)
+	}
+
+	return policy, nil
+}
+
+// Resolvers for the role inheritance and the group membership of the policy
+func (policy *Policy) CreateResolver() (*RoleResolver, *GroupResolver, error) {
+	roleResolver, err := CreateRoleResolver(policy.RoleSlice)
+	if err != nil {
+		return nil, nil, err
+	}
+	groupResolver, err := CreateGroupResolver(policy.GroupSlice)
+	if err != nil {
+		return nil, nil, err
+	}
+	return roleResolver, groupResolver, nil
+}
+
+func createPolicyPermission(permission *Permission) *PolicyPermission {
+	policyPermission := &PolicyPermission{
+		Component: permission.Component,
+		Method:    permission.Method,
+		Path:      permission.Path,
+		Condition: permission.Condition,
+	}
+	if permission.Effect.IsDeny() {
+		policyPermission.Effect = string(EffectDeny)
+	}
+	// Omitted match mode means Segment in the document so the legacy one must be explicit
+	if permission.MatchMode.IsPrefix() {
+		policyPermission.MatchMode = string(MatchModePrefix)
+	}
+	return policyPermission
+}
+
+func createPolicyResourceSlice(resourceSlice []*Resource) []*PolicyResource {
+	policyResourceSlice := make([]*PolicyResource, 0)
+	for _, resource := range resourceSlice {
+		policyResource := &PolicyResource{
+			Component: resource.Component,
+			Path:      resource.Path,
+		}
+		if resource.Effect.IsDeny() {
+			policyResource.Effect = string(EffectDeny)
+		}
+		if resource.MatchMode.IsPrefix() {
+			policyResource.MatchMode = string(MatchModePrefix)
+		}
+		policyResourceSlice = append(policyResourceSlice, policyResource)
+	}
+	return policyResourceSlice
+}
+
+// Meta data keys set by the package. They are rejected by the validation and left out of the export so the meta data couldn't pass for them.
+var reservedMetaDataKeySlice = []string{ImpersonatorMetaDataKey, ServiceAccountMetaDataKey, APIKeyMetaDataKey}
+
+// Nil if the meta data is nil
+func createPolicyMetaDataMap(metaDataMap map[string]string) map[string]string {
+	if metaDataMap == nil {
+		return nil
+	}
+	policyMetaDataMap := make(map[string]string)
+	for key, value := range metaDataMap {
+		if containsString(reservedMetaDataKeySlice, key) == false {
+			policyMetaDataMap[key] = value
+		}
+	}
+	return policyMetaDataMap
+}
+
+// Export the in-memory objects. The roles referenced by the groups and users but missing in the role slice are exported as well.
+// The second factor secrets are left out so the document is safe to review and keep in version control. Store keeps them.
+func CreatePolicyDocument(roleSlice []*Role, groupSlice []*Group, userSlice []*User) *PolicyDocument {
+	return createPolicyDocument(roleSlice, groupSlice, userSlice, false)
+}
+
+// The second factor is only included for the persistence
+func createPolicyDocument(roleSlice []*Role, groupSlice []*Group, userSlice []*User, includeSecondFactor bool) *PolicyDocument {
+	policyDocument := &PolicyDocument{
+		RoleSlice:  make([]*PolicyRole, 0),
+		GroupSlice: make([]*PolicyGroup, 0),
+		UserSlice:  make([]*PolicyUser, 0),
+	}
+
+	roleNameMap := make(map[string]bool)
+	addRole := func(role *Role) {
+		if roleNameMap[role.Name] {
+			return
+		}
+		roleNameMap[role.Name] = true
+		policyRole := &PolicyRole{
+			Name:                role.Name,
+			Description:         role.Description,
+			ParentRoleNameSlice: role.ParentRoleNameSlice,
+			PermissionSlice:     make([]*PolicyPermission, 0),
+			RequireSecondFactor: role.RequireSecondFactor,
+		}
+		for _, permission := range role.PermissionSlice {
+			policyRole.PermissionSlice = append(policyRole.PermissionSlice, createPolicyPermission(permission))
+		}
+		policyDocument.RoleSlice = append(policyDocument.RoleSlice, policyRole)
+	}
+	getRoleNameSlice := func(roleSlice []*Role) []string {
+		roleNameSlice := make([]string, 0)
+		for _, role := range roleSlice {
+			addRole(role)
+			roleNameSlice = append(roleNameSlice, role.Name)
+		}
+		return roleNameSlice
+	}
+
+	for _, role := range roleSlice {
+		addRole(role)
+	}
+	for _, group := range groupSlice {
+		policyDocument.GroupSlice = append(policyDocument.GroupSlice, &PolicyGroup{
+			Name:          group.Name,
+			Description:   group.Description,
+			RoleNameSlice: getRoleNameSlice(group.RoleSlice),
+			ResourceSlice: createPolicyResourceSlice(group.ResourceSlice),
+		})
+	}
+	for _, user := range userSlice {
+		policyUser := &PolicyUser{
+			Name:                 user.Name,
+			EncodedPassword:      user.EncodedPassword,
+			Description:          user.Description,
+			RoleNameSlice:        getRoleNameSlice(user.RoleSlice),
+			GroupNameSlice:       user.GroupNameSlice,
+			ResourceSlice:        createPolicyResourceSlice(user.ResourceSlice),
+			MetaDataMap:          createPolicyMetaDataMap(user.MetaDataMap),
+			Disabled:             user.Disabled,
+			PasswordHistorySlice: user.PasswordHistorySlice,
+		}
+		if includeSecondFactor {
+			policyUser.SecondFactor = user.SecondFactor
+		}
+		for _, roleBinding := range user.RoleBindingSlice {
+			policyUser.RoleBindingSlice = append(policyUser.RoleBindingSlice, &PolicyRoleBinding{
+				Namespace:     roleBinding.Namespace,
+				RoleNameSlice: getRoleNameSlice(roleBinding.RoleSlice),
+			})
+		}
+		for _, roleGrant := range user.RoleGrantSlice {
+			addRole(roleGrant.Role)
+			policyUser.RoleGrantSlice = append(policyUser.RoleGrantSlice, &PolicyRoleGrant{
+				RoleName:     roleGrant.Role.Name,
+				StartTime:    formatPolicyOptionalTime(roleGrant.StartTime),
+				EndTime:      formatPolicyOptionalTime(roleGrant.EndTime),
+				Reason:       roleGrant.Reason,
+				ApproverName: roleGrant.ApproverName,
+			})
+		}
+		if user.ExpiredTime != nil {
+			policyUser.ExpiredTime = user.ExpiredTime.Format(time.RFC3339)
+		}
+		if user.PasswordChangedTime != nil {
+			policyUser.PasswordChangedTime = user.PasswordChangedTime.Format(time.RFC3339)
+		}
+		policyDocument.UserSlice = append(policyDocument.UserSlice, policyUser)
+	}
+
+	return policyDocument
+}
+
+func (policyDocument *PolicyDocument) MarshalToYAML() ([]byte, error) {
+	return yaml.Marshal(policyDocument)
+}
+
+func (policyDocument *PolicyDocument) MarshalToJSON() ([]byte, error) {
+	return json.MarshalIndent(policyDocument, "", "  ")
+}
+
+const (
+	PolicyChangeTypeAdded   = "Added"
+	PolicyChangeTypeRemoved = "Removed"
+	PolicyChangeTypeChanged = "Changed"
+)
+
+// PolicyChange is a single difference between two policy versions.
+// Subject is such as role/viewer or user/alice. Grant is the granted item such as "permission Allow cloudone_gui GET /gui" or the changed attribute.
+type PolicyChange struct {
+	Type    string
+	Subject string
+	Grant   string
+	Before  string
+	After   string
+}
+
+func (policyChange *PolicyChange) String() string {
+	if policyChange.Type == PolicyChangeTypeChanged {
+		return fmt.Sprintf("%s %s %s: %q -> %q", policyChange.Type, policyChange.Subject, policyChange.Grant, policyChange.Before, policyChange.After)
+	}
+	if policyChange.Grant == "" {
+		return policyChange.Type + " " + policyChange.Subject
+	}
+	return policyChange.Type + " " + policyChange.Subject + " " + policyChange.Grant
+}
+
+func (policyPermission *PolicyPermission) getGrant() string {
+	effect := policyPermission.Effect
+	if effect == "" {
+		effect = string(EffectAllow)
+	}
+	matchMode := policyPermission.MatchMode
+	if matchMode == "" {
+		matchMode = string(MatchModeSegment)
+	}
+	grant := "permission " + effect + " " + policyPermission.Component + " " + policyPermission.Method + " " + policyPermission.Path + " " + matchMode
+	if policyPermission.Condition != "" {
+		grant += " if " + policyPermission.Condition
+	}
+	return grant
+}
+
+func (policyResource *PolicyResource) getGrant() string {
+	effect := policyResource.Effect
+	if effect == "" {
+		effect = string(EffectAllow)
+	}
+	matchMode := policyResource.MatchMode
+	if matchMode == "" {
+		matchMode = string(MatchModeSegment)
+	}
+	return "resource " + effect + " " + policyResource.Component + " " + policyResource.Path + " " + matchMode
+}
+
+// Such as "role deployer from 2024-01-01T00:00:00Z until 2024-01-02T00:00:00Z approved by alice for INC-42"
+func (policyRoleGrant *PolicyRoleGrant) getGrant() string {
+	grant := "role " + policyRoleGrant.RoleName
+	if policyRoleGrant.StartTime != "" {
+		grant += " from " + policyRoleGrant.StartTime
+	}
+	if policyRoleGrant.EndTime != "" {
+		grant += " until " + policyRoleGrant.EndTime
+	}
+	if policyRoleGrant.ApproverName != "" {
+		grant += " approved by " + policyRoleGrant.ApproverName
+	}
+	if policyRoleGrant.Reason != "" {
+		grant += " for " + policyRoleGrant.Reason
+	}
+	return grant
+}
+
+type policySubject struct {
+	grantSlice     []string
+	attributeMap   map[string]string
+	hiddenValueMap map[string]bool // Attributes whose values are not shown in the diff
+}
+
+func getPolicySubjectMap(policyDocument *PolicyDocument) map[string]*policySubject {
+	subjectMap := make(map[string]*policySubject)
+	if policyDocument == nil {
+		return subjectMap
+	}
+
+	for _, policyRole := range policyDocument.RoleSlice {
+		subject := &policySubject{
+			make([]string, 0),
+			map[string]string{
+				"description":         policyRole.Description,
+				"requireSecondFactor": fmt.Sprint(policyRole.RequireSecondFactor),
+			},
+			nil,
+		}
+		for _, parentRoleName := range policyRole.ParentRoleNameSlice {
+			subject.grantSlice = append(subject.grantSlice, "parent "+parentRoleName)
+		}
+		for _, policyPermission := range policyRole.PermissionSlice {
+			subject.grantSlice = append(subject.grantSlice, policyPermission.getGrant())
+		}
+		subjectMap["role/"+policyRole.Name] = subject
+	}
+	for _, policyGroup := range policyDocument.GroupSlice {
+		subject := &policySubject{make([]string, 0), map[string]string{"description": policyGroup.Description}, nil}
+		for _, roleName := range policyGroup.RoleNameSlice {
+			subject.grantSlice = append(subject.grantSlice, "role "+roleName)
+		}
+		for _, policyResource := range policyGroup.ResourceSlice {
+			subject.grantSlice = append(subject.grantSlice, policyResource.getGrant())
+		}
+		subjectMap["group/"+policyGroup.Name] = subject
+	}
+	for _, policyUser := range policyDocument.UserSlice {
+		subject := &policySubject{
+			make([]string, 0),
+			map[string]string{
+				"description":         policyUser.Description,
+				"encodedPassword":     policyUser.EncodedPassword,
+				"expiredTime":         policyUser.ExpiredTime,
+				"disabled":            fmt.Sprint(policyUser.Disabled),
+				"passwordChangedTime": policyUser.PasswordChangedTime,
+				"passwordHistory":     strings.Join(policyUser.PasswordHistorySlice, ","),
+				"secondFactor":        fmt.Sprint(policyUser.SecondFactor),
+			},
+			map[string]bool{"encodedPassword": true, "passwordHistory": true, "secondFactor": true},
+		}
+		for key, value := range policyUser.MetaDataMap {
+			subject.attributeMap["metaData."+key] = value
+		}
+		for _, roleName := range policyUser.RoleNameSlice {
+			subject.grantSlice = append(subject.grantSlice, "role "+roleName)
+		}
+		for _, groupName := range policyUser.GroupNameSlice {
+			subject.grantSlice = append(subject.grantSlice, "group "+groupName)
+		}
+		for _, policyResource := range policyUser.ResourceSlice {
+			subject.grantSlice = append(subject.grantSlice, policyResource.getGrant())
+		}
+		for _, policyRoleBinding := range policyUser.RoleBindingSlice {
+			for _, roleName := range policyRoleBinding.RoleNameSlice {
+				subject.grantSlice = append(subject.grantSlice, "role "+roleName+" in namespace "+policyRoleBinding.Namespace)
+			}
+		}
+		for _, policyRoleGrant := range policyUser.RoleGrantSlice {
+			subject.grantSlice = append(subject.grantSlice, policyRoleGrant.getGrant())
+		}
+		subjectMap["user/"+policyUser.Name] = subject
+	}
+	for _, policyRateLimit := range policyDocument.RateLimitSlice {
+		name := policyRateLimit.Component + " " + policyRateLimit.Method + " " + policyRateLimit.KeyKind
+		if policyRateLimit.RoleName != "" {
+			name += " " + policyRateLimit.RoleName
+		}
+		subjectMap["rateLimit/"+name] = &policySubject{
+			make([]string, 0),
+			map[string]string{
+				"limit":  fmt.Sprint(policyRateLimit.Limit),
+				"period": policyRateLimit.Period,
+				"burst":  fmt.Sprint(policyRateLimit.Burst),
+			},
+			nil,
+		}
+	}
+	return subjectMap
+}
+
+func getSortedKeySlice(valueMap map[string]bool) []string {
+	keySlice := make([]string, 0, len(valueMap))
+	for key := range valueMap {
+		keySlice = append(keySlice, key)
+	}
+	sort.Strings(keySlice)
+	return keySlice
+}
+
+// Report the added, removed and changed grants and attributes from the old to the new policy in a deterministic order
+func DiffPolicyDocument(oldPolicyDocument *PolicyDocument, newPolicyDocument *PolicyDocument) []*PolicyChange {
+	oldSubjectMap := getPolicySubjectMap(oldPolicyDocument)
+	newSubjectMap := getPolicySubjectMap(newPolicyDocument)
+
+	subjectNameMap := make(map[string]bool)
+	for subjectName := range oldSubjectMap {
+		subjectNameMap[subjectName] = true
+	}
+	for subjectName := range newSubjectMap {
+		subjectNameMap[subjectName] = true
+	}
+
+	policyChangeSlice := make([]*PolicyChange, 0)
+	for _, subjectName := range getSortedKeySlice(subjectNameMap) {
+		oldSubject, oldOk := oldSubjectMap[subjectName]
+		newSubject, newOk := newSubjectMap[subjectName]
+		if oldOk == false {
+			policyChangeSlice = append(policyChangeSlice, &PolicyChange{Type: PolicyChangeTypeAdded, Subject: subjectName})
+			oldSubject = &policySubject{make([]string, 0), make(map[string]string), nil}
+		}
+		if newOk == false {
+			policyChangeSlice = append(policyChangeSlice, &PolicyChange{Type: PolicyChangeTypeRemoved, Subject: subjectName})
+			newSubject = &policySubject{make([]string, 0), make(map[string]string), nil}
+		}
+
+		oldGrantMap := make(map[string]bool)
+		for _, grant := range oldSubject.grantSlice {
+			oldGrantMap[grant] = true
+		}
+		newGrantMap := make(map[string]bool)
+		for _, grant := range newSubject.grantSlice {
+			newGrantMap[grant] = true
+		}
+		for _, grant := range getSortedKeySlice(oldGrantMap) {
+			if newGrantMap[grant] == false {
+				policyChangeSlice = append(policyChangeSlice, &PolicyChange{Type: PolicyChangeTypeRemoved, Subject: subjectName, Grant: grant})
+			}
+		}
+		for _, grant := range getSortedKeySlice(newGrantMap) {
+			if oldGrantMap[grant] == false {
+				policyChangeSlice = append(policyChangeSlice, &PolicyChange{Type: PolicyChangeTypeAdded, Subject: subjectName, Grant: grant})
+			}
+		}
+
+		// Attributes only matter when the subject exists in both
+		if oldOk && newOk {
+			attributeNameMap := make(map[string]bool)
+			for attributeName := range oldSubject.attributeMap {
+				attributeNameMap[attributeName] = true
+			}
+			for attributeName := range newSubject.attributeMap {
+				attributeNameMap[attributeName] = true
+			}
+			for _, attributeName := range getSortedKeySlice(attributeNameMap) {
+				before := oldSubject.attributeMap[attributeName]
+				after := newSubject.attributeMap[attributeName]
+				if before != after {
+					if newSubject.hiddenValueMap[attributeName] {
+						before = "******"
+						after = "******"
+					}
+					policyChangeSlice = append(policyChangeSlice, &PolicyChange{PolicyChangeTypeChanged, subjectName, attributeName, before, after})
+				}
+			}
+		}
+	}
+	return policyChangeSlice
+}
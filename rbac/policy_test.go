@@ -0,0 +1,216 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"strings"
+	"testing"
+)
+
+const testPolicyYAML = `roles:
+  - name: viewer
+    permissions:
+      - {component: cloudone_gui, method: GET, path: /gui}
+  - name: operator
+    parents: [viewer]
+    permissions:
+      - component: cloudone_gui
+        method: "*"
+        path: /gui/system/rbac
+        effect: Deny
+      - {component: cloudone_gui, method: POST, path: /gui/inv, matchMode: Prefix}
+groups:
+  - name: team-a
+    roles: [operator]
+    resources:
+      - {component: cloudone, path: "/namespaces/{namespace}"}
+users:
+  - name: alice
+    encodedPassword: "$2a$04$abc"
+    groups: [team-a]
+    metaData: {team: team-a}
+    expiredTime: "2030-01-02T03:04:05Z"
+`
+
+func TestLoadPolicy(t *testing.T) {
+	policy, err := LoadPolicy([]byte(testPolicyYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roleResolver, groupResolver, err := policy.CreateResolver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetRoleResolver(roleResolver)
+	SetGroupResolver(groupResolver)
+	defer SetRoleResolver(nil)
+	defer SetGroupResolver(nil)
+
+	alice := policy.UserSlice[0]
+	if alice.HasPermission("cloudone_gui", "GET", "/gui/inventory") == false {
+		t.Errorf("Inherited permission through group should be granted")
+	}
+	if alice.HasPermission("cloudone_gui", "GET", "/gui/system/rbac") {
+		t.Errorf("Deny should be loaded")
+	}
+	if alice.HasPermission("cloudone_gui", "POST", "/gui/inventory") == false {
+		t.Errorf("Prefix match mode should be loaded")
+	}
+	if alice.HasResource("cloudone", "/namespaces/team-a") == false {
+		t.Errorf("Group resource should be loaded")
+	}
+	if alice.ExpiredTime == nil || alice.ExpiredTime.Year() != 2030 {
+		t.Errorf("Expired time should be loaded")
+	}
+
+	// JSON is accepted as well
+	policyDocument, err := ParsePolicyDocument([]byte(`{"roles": [{"name": "viewer", "permissions": [{"component": "c", "method": "GET", "path": "/"}]}]}`))
+	if err != nil || len(policyDocument.RoleSlice) != 1 {
+		t.Errorf("JSON policy should be parsed: %v", err)
+	}
+}
+
+func TestPolicyValidation(t *testing.T) {
+	invalidPolicyYAML := `roles:
+  - name: viewer
+    permissions:
+      - component: ""
+        method: FETCH
+        path: /gui/{bad
+  - name: viewer
+    parents: [missing]
+users:
+  - name: bob
+    roles: [unknown]
+    groups: [nobody]
+    expiredTime: tomorrow
+`
+	_, err := ParsePolicyDocument([]byte(invalidPolicyYAML))
+	policyValidationError, ok := err.(*PolicyValidationError)
+	if ok == false {
+		t.Fatalf("Expect validation error but get %v", err)
+	}
+
+	expectedSlice := []struct {
+		line    int
+		message string
+	}{
+		{7, "Duplicate role name viewer"},
+		{4, "Component couldn't be empty"},
+		{5, "Invalid method FETCH"},
+		{6, "Invalid path parameter"},
+		{8, "unknown parent role missing"},
+		{11, "unknown role unknown"},
+		{12, "unknown group nobody"},
+		{13, "Invalid expired time"},
+	}
+	if len(policyValidationError.ErrorSlice) != len(expectedSlice) {
+		t.Fatalf("Expect %d errors but get:\n%s", len(expectedSlice), err)
+	}
+	for i, expected := range expectedSlice {
+		policyError := policyValidationError.ErrorSlice[i]
+		if policyError.Line != expected.line || !strings.Contains(policyError.Message, expected.message) {
+			t.Errorf("Expect line %d %s but get %s", expected.line, expected.message, policyError)
+		}
+	}
+
+	_, err = ParsePolicyDocument([]byte("roles:\n  - name: a\n    permision: []\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 3") || !strings.Contains(err.Error(), "Unknown field permision") {
+		t.Errorf("Unknown field should be reported with line but get %v", err)
+	}
+
+	_, err = ParsePolicyDocument([]byte("roles:\n  - name: a\n    parents: [b]\n  - name: b\n    parents: [a]\n"))
+	if err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("Cycle should be reported but get %v", err)
+	}
+
+	_, err = ParsePolicyDocument([]byte(`roles:
+  - name: a
+    permissions:
+      - component: c
+        method: GET
+        path: /
+        effect: Maybe
+        matchMode: Regex
+users:
+  - name: bob
+    resources:
+      - component: c
+        path: /
+        matchMode: Regex
+`))
+	policyValidationError, ok = err.(*PolicyValidationError)
+	if ok == false || len(policyValidationError.ErrorSlice) != 3 {
+		t.Fatalf("Invalid effect and match modes should be reported but get %v", err)
+	}
+	for i, line := range []int{7, 8, 14} {
+		if policyValidationError.ErrorSlice[i].Line != line {
+			t.Errorf("Expect line %d but get %s", line, policyValidationError.ErrorSlice[i])
+		}
+	}
+}
+
+func TestExportAndDiffPolicy(t *testing.T) {
+	policy, err := LoadPolicy([]byte(testPolicyYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyPermission := &Permission{Name: "p", Component: "cloudone", Method: "GET", Path: "/api/v1/nodes"}
+	policy.RoleSlice[0].PermissionSlice = append(policy.RoleSlice[0].PermissionSlice, legacyPermission)
+
+	exportedPolicyDocument := CreatePolicyDocument(policy.RoleSlice, policy.GroupSlice, policy.UserSlice)
+	for _, marshal := range []func() ([]byte, error){exportedPolicyDocument.MarshalToYAML, exportedPolicyDocument.MarshalToJSON} {
+		data, err := marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reloadedPolicyDocument, err := ParsePolicyDocument(data)
+		if err != nil {
+			t.Fatalf("Exported policy should be loadable: %s\n%s", err, data)
+		}
+		if policyChangeSlice := DiffPolicyDocument(exportedPolicyDocument, reloadedPolicyDocument); len(policyChangeSlice) != 0 {
+			t.Errorf("Round trip should have no difference but get %v", policyChangeSlice)
+		}
+		if reloadedPolicyDocument.RoleSlice[0].PermissionSlice[1].MatchMode != string(MatchModePrefix) {
+			t.Errorf("Legacy match mode should be exported explicitly")
+		}
+	}
+
+	oldPolicyDocument, _ := ParsePolicyDocument([]byte(testPolicyYAML))
+	newPolicyYAML := strings.Replace(testPolicyYAML, "method: GET, path: /gui}", "method: GET, path: /gui/inventory}", 1)
+	newPolicyYAML = strings.Replace(newPolicyYAML, "metaData: {team: team-a}", "metaData: {team: team-b}", 1)
+	newPolicyYAML = strings.Replace(newPolicyYAML, `"$2a$04$abc"`, `"$2a$04$def"`, 1)
+	newPolicyYAML += "  - name: bob\n    roles: [viewer]\n"
+	newPolicyDocument, err := ParsePolicyDocument([]byte(newPolicyYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changeStringSlice := make([]string, 0)
+	for _, policyChange := range DiffPolicyDocument(oldPolicyDocument, newPolicyDocument) {
+		changeStringSlice = append(changeStringSlice, policyChange.String())
+	}
+	expectedSlice := []string{
+		`Removed role/viewer permission Allow cloudone_gui GET /gui Segment`,
+		`Added role/viewer permission Allow cloudone_gui GET /gui/inventory Segment`,
+		`Changed user/alice encodedPassword: "******" -> "******"`,
+		`Changed user/alice metaData.team: "team-a" -> "team-b"`,
+		`Added user/bob`,
+		`Added user/bob role viewer`,
+	}
+	if strings.Join(changeStringSlice, "\n") != strings.Join(expectedSlice, "\n") {
+		t.Errorf("Unexpected diff:\n%s", strings.Join(changeStringSlice, "\n"))
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"strings"
+	"sync"
+)
+
+// Profile used for the components without their own profile
+const DefaultProjectionComponent = "*"
+
+// Deny permissions of the hidden roles are kept under this role
+const RedactedRoleName = "redacted"
+
+// ProjectionProfile selects what of the user is exposed to a component by CopyPartialUserDataForComponent.
+// The zero value exposes everything relevant to the component.
+// Hiding a role or a resource never widens the access, so the deny permissions and the deny resources are always kept.
+type ProjectionProfile struct {
+	MetaDataKeySlice  []string // Exposed metadata keys. Nil exposes all the keys. The impersonator isn't metadata and is always kept for the audit log.
+	RoleNameSlice     []string // Exposed roles. Nil exposes all the roles. Deny permissions of the hidden roles are merged into RedactedRoleName.
+	ResourcePathSlice []string // Allow resources on or under the paths are exposed. Nil exposes all the resources.
+	HideDescription   bool     // Hide the descriptions of the user and the roles
+}
+
+var projectionProfileMap = make(map[string]*ProjectionProfile)
+var projectionProfileMutex sync.RWMutex
+
+// The profile of the component, or the one of DefaultProjectionComponent. Nil if neither is set.
+func GetProjectionProfile(component string) *ProjectionProfile {
+	projectionProfileMutex.RLock()
+	defer projectionProfileMutex.RUnlock()
+	if projectionProfile, ok := projectionProfileMap[component]; ok {
+		return projectionProfile
+	}
+	return projectionProfileMap[DefaultProjectionComponent]
+}
+
+// Nil removes the profile of the component
+func SetProjectionProfile(component string, projectionProfile *ProjectionProfile) {
+	projectionProfileMutex.Lock()
+	defer projectionProfileMutex.Unlock()
+	if projectionProfile == nil {
+		delete(projectionProfileMap, component)
+	} else {
+		projectionProfileMap[component] = projectionProfile
+	}
+}
+
+func containsString(valueSlice []string, value string) bool {
+	for _, candidate := range valueSlice {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Always a new map. Nil if the source is nil.
+func (projectionProfile *ProjectionProfile) projectMetaDataMap(metaDataMap map[string]string) map[string]string {
+	if metaDataMap == nil {
+		return nil
+	}
+	newMetaDataMap := make(map[string]string)
+	for key, value := range metaDataMap {
+		if projectionProfile.MetaDataKeySlice == nil || containsString(projectionProfile.MetaDataKeySlice, key) {
+			newMetaDataMap[key] = value
+		}
+	}
+	return newMetaDataMap
+}
+
+func (projectionProfile *ProjectionProfile) exposeResource(resource *Resource) bool {
+	if projectionProfile.ResourcePathSlice == nil || resource.Effect.IsDeny() {
+		return true
+	}
+	for _, path := range projectionProfile.ResourcePathSlice {
+		if path == "/" || resource.Path == path || strings.HasPrefix(resource.Path, path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Copy the roles with the permissions for the component. The hidden roles are merged into one role with only their deny permissions and their second factor requirement.
+func (projectionProfile *ProjectionProfile) projectRoleSlice(roleSlice []*Role, component string) []*Role {
+	newRoleSlice := make([]*Role, 0)
+	redactedRole := &Role{Name: RedactedRoleName, PermissionSlice: make([]*Permission, 0)}
+	for _, role := range roleSlice {
+		newRole := copyRoleForComponent(role, component, projectionProfile.HideDescription)
+		if newRole == nil {
+			continue
+		}
+		if projectionProfile.RoleNameSlice == nil || containsString(projectionProfile.RoleNameSlice, role.Name) {
+			newRoleSlice = append(newRoleSlice, newRole)
+			continue
+		}
+		for _, permission := range newRole.PermissionSlice {
+			if permission.Effect.IsDeny() {
+				redactedRole.PermissionSlice = append(redactedRole.PermissionSlice, permission)
+			}
+		}
+		redactedRole.RequireSecondFactor = redactedRole.RequireSecondFactor || newRole.RequireSecondFactor
+	}
+	// Kept for the second factor requirement of the hidden roles even without any deny
+	if len(redactedRole.PermissionSlice) > 0 || redactedRole.RequireSecondFactor {
+		newRoleSlice = append(newRoleSlice, redactedRole)
+	}
+	return newRoleSlice
+}
@@ -0,0 +1,168 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"testing"
+	"time"
+)
+
+func createProjectionTestUser(t *testing.T) *User {
+	user := createDenyTestUser(t)
+	user.Description = "Customer"
+	user.RoleSlice[0].Description = "Operator of the customer"
+	user.MetaDataMap = map[string]string{"email": "u@example.com", "apiSecret": "s3cr3t"}
+	user.impersonatorName = "support"
+	endTime := time.Now().Add(time.Hour)
+	roleGrant, err := CreateRoleGrant(user.RoleSlice[1], nil, &endTime, "INC-42", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.RoleGrantSlice = []*RoleGrant{roleGrant}
+	roleBinding, _ := CreateRoleBinding("team-a", []*Role{user.RoleSlice[0]})
+	user.RoleBindingSlice = []*RoleBinding{roleBinding}
+	secretResource, _ := CreateDenyResource("*", "/namespaces/secret")
+	user.ResourceSlice = append(user.ResourceSlice, secretResource)
+	return user
+}
+
+// The policy document covers the fields of the user, the roles and the grants
+func getProjectionTestSnapshot(t *testing.T, user *User) string {
+	data, err := CreatePolicyDocument(nil, nil, []*User{user}).MarshalToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestProjectionProfile(t *testing.T) {
+	user := createProjectionTestUser(t)
+	projectionProfile := &ProjectionProfile{
+		MetaDataKeySlice:  []string{"email"},
+		RoleNameSlice:     []string{"operator"},
+		ResourcePathSlice: []string{"/namespaces/default"},
+		HideDescription:   true,
+	}
+	partialUser := user.CopyPartialUserDataWithProfile("cloudone_gui", projectionProfile)
+
+	if len(partialUser.MetaDataMap) != 1 || partialUser.MetaDataMap["email"] == "" || GetImpersonatorName(partialUser) != "support" {
+		t.Errorf("Only the selected metadata and the impersonator should be exposed but get %v", partialUser.MetaDataMap)
+	}
+	if partialUser.Description != "" || partialUser.RoleSlice[0].Description != "" {
+		t.Errorf("Descriptions should be hidden")
+	}
+	if len(partialUser.RoleSlice) != 2 || partialUser.RoleSlice[0].Name != "operator" || partialUser.RoleSlice[1].Name != RedactedRoleName {
+		t.Fatalf("Hidden role should be replaced by the redacted role")
+	}
+	if partialUser.HasPermission("cloudone_gui", "GET", "/gui/system/rbac") || partialUser.HasPermission("cloudone_gui", "GET", "/gui/inventory") == false {
+		t.Errorf("Hidden deny role should still deny")
+	}
+	if len(partialUser.RoleGrantSlice) != 1 || partialUser.RoleGrantSlice[0].Role.Name != RedactedRoleName || partialUser.RoleGrantSlice[0].EndTime == nil {
+		t.Errorf("Hidden granted role should be redacted with the window kept")
+	}
+	if len(partialUser.ResourceSlice) != 1 || partialUser.ResourceSlice[0].Path != "/namespaces/secret" {
+		t.Errorf("Only the deny resource should be left since no allow resource is selected but get %d", len(partialUser.ResourceSlice))
+	}
+	if len(partialUser.RoleBindingSlice) != 0 || partialUser.HasNamespace("cloudone", "team-a") {
+		t.Errorf("Role binding of the hidden namespace should be hidden")
+	}
+
+	namespaceProfile := &ProjectionProfile{ResourcePathSlice: []string{"/namespaces/team-a"}}
+	partialUser = user.CopyPartialUserDataWithProfile("cloudone_gui", namespaceProfile)
+	if len(partialUser.RoleBindingSlice) != 1 || partialUser.HasNamespace("cloudone", "team-a") == false {
+		t.Errorf("Role binding of the selected namespace should be exposed")
+	}
+
+	// The operator has no deny but requires the second factor
+	user.RoleSlice[0].RequireSecondFactor = true
+	partialUser = user.CopyPartialUserDataWithProfile("cloudone_gui", &ProjectionProfile{RoleNameSlice: []string{"restriction"}})
+	if partialUser.RequiresSecondFactor() == false {
+		t.Errorf("Second factor requirement of the hidden role should be kept")
+	}
+	user.RoleSlice[0].RequireSecondFactor = false
+
+	legacyUser := user.CopyPartialUserDataWithProfile("cloudone_gui", nil)
+	if len(legacyUser.MetaDataMap) != 2 || legacyUser.Description != "Customer" || len(legacyUser.RoleSlice) != 2 || legacyUser.RoleSlice[1].Name != "restriction" {
+		t.Errorf("Nil profile should expose everything relevant to the component")
+	}
+}
+
+func TestProjectionProfileByComponent(t *testing.T) {
+	defer SetProjectionProfile(DefaultProjectionComponent, nil)
+	defer SetProjectionProfile("cloudone", nil)
+	user := createProjectionTestUser(t)
+
+	SetProjectionProfile(DefaultProjectionComponent, &ProjectionProfile{MetaDataKeySlice: []string{}})
+	SetProjectionProfile("cloudone", &ProjectionProfile{MetaDataKeySlice: []string{"apiSecret"}})
+	if partialUser := user.CopyPartialUserDataForComponent("cloudone_gui"); len(partialUser.MetaDataMap) != 0 {
+		t.Errorf("Default profile should apply to the component without profile but get %v", partialUser.MetaDataMap)
+	}
+	if partialUser := user.CopyPartialUserDataForComponent("cloudone"); partialUser.MetaDataMap["apiSecret"] != "s3cr3t" {
+		t.Errorf("Profile of the component should apply")
+	}
+
+	SetProjectionProfile(DefaultProjectionComponent, nil)
+	if GetProjectionProfile("cloudone_gui") != nil || len(user.CopyPartialUserDataForComponent("cloudone_gui").MetaDataMap) != 2 {
+		t.Errorf("Removed default profile should not apply")
+	}
+}
+
+func TestProjectionDoesNotMutateSource(t *testing.T) {
+	user := createProjectionTestUser(t)
+	snapshot := getProjectionTestSnapshot(t, user)
+
+	for _, projectionProfile := range []*ProjectionProfile{
+		nil,
+		{MetaDataKeySlice: []string{}, RoleNameSlice: []string{}, ResourcePathSlice: []string{}, HideDescription: true},
+	} {
+		partialUser := user.CopyPartialUserDataWithProfile("cloudone_gui", projectionProfile)
+		if getProjectionTestSnapshot(t, user) != snapshot {
+			t.Fatalf("Copy should not mutate the source user")
+		}
+
+		// Every part of the copy is modified and the source must not notice
+		for key := range partialUser.MetaDataMap {
+			partialUser.MetaDataMap[key] = "changed"
+		}
+		partialUser.MetaDataMap["added"] = "added"
+		roleSlice := partialUser.RoleSlice
+		for _, roleBinding := range partialUser.RoleBindingSlice {
+			roleBinding.Namespace = "changed"
+			roleSlice = append(roleSlice, roleBinding.RoleSlice...)
+		}
+		for _, role := range roleSlice {
+			role.Name = "changed"
+			role.Description = "changed"
+			for _, permission := range role.PermissionSlice {
+				permission.Path = "/changed"
+				permission.Effect = EffectAllow
+			}
+		}
+		for _, resource := range partialUser.ResourceSlice {
+			resource.Path = "/changed"
+		}
+		for _, roleGrant := range partialUser.RoleGrantSlice {
+			*roleGrant.EndTime = time.Time{}
+			roleGrant.Role.PermissionSlice[0].Path = "/changed"
+		}
+
+		if getProjectionTestSnapshot(t, user) != snapshot {
+			t.Errorf("Modifying the copy should not mutate the source user")
+		}
+		if user.HasPermission("cloudone_gui", "GET", "/gui/system/rbac") || user.HasResource("cloudone", "/namespaces/kube-system") {
+			t.Errorf("Source user should evaluate the same after the copy is modified")
+		}
+	}
+}
@@ -0,0 +1,355 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The identity the requests are counted by
+const (
+	RateLimitKeyUser  = "user"
+	RateLimitKeyToken = "token"
+	RateLimitKeyRole  = "role" // All the users of the role share the bucket
+)
+
+// Idle buckets refilled to full are removed from the memory backend in this interval
+const memoryRateLimitPruneInterval = time.Minute
+
+// RateLimit allows Limit requests per Period with bursts up to Burst for each identity of the key kind
+type RateLimit struct {
+	Component string // * for all the components
+	Method    string // * for all the methods
+	KeyKind   string
+	RoleName  string // Only for RateLimitKeyRole. Empty applies to each role of the user.
+	Limit     int
+	Period    time.Duration
+	Burst     int // Capacity of the bucket. Limit if 0.
+}
+
+func CreateRateLimit(component string, method string, keyKind string, roleName string, limit int, period time.Duration, burst int) (*RateLimit, error) {
+	rateLimit := &RateLimit{
+		component,
+		method,
+		keyKind,
+		roleName,
+		limit,
+		period,
+		burst,
+	}
+	if err := rateLimit.validate(); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return rateLimit, nil
+}
+
+func (rateLimit *RateLimit) validate() error {
+	_, err := rateLimit.validateField()
+	return err
+}
+
+// Return the invalid field named as in the policy document so the error points to its line
+func (rateLimit *RateLimit) validateField() (string, error) {
+	if rateLimit.Component == "" {
+		return "component", errors.New("Component couldn't be empty")
+	}
+	if validMethodMap[rateLimit.Method] == false {
+		return "method", errors.New("Invalid method " + rateLimit.Method)
+	}
+	if rateLimit.KeyKind != RateLimitKeyUser && rateLimit.KeyKind != RateLimitKeyToken && rateLimit.KeyKind != RateLimitKeyRole {
+		return "key", errors.New("Invalid rate limit key " + rateLimit.KeyKind)
+	}
+	if rateLimit.RoleName != "" && rateLimit.KeyKind != RateLimitKeyRole {
+		return "role", errors.New("Role is only for the rate limit key " + RateLimitKeyRole)
+	}
+	if rateLimit.Limit <= 0 {
+		return "limit", errors.New("Limit must be positive")
+	}
+	if rateLimit.Period <= 0 {
+		return "period", errors.New("Period must be positive")
+	}
+	if rateLimit.Burst < 0 {
+		return "burst", errors.New("Burst couldn't be negative")
+	}
+	return "", nil
+}
+
+// Such as "cloudone * role operator"
+func (rateLimit *RateLimit) GetName() string {
+	name := rateLimit.Component + " " + rateLimit.Method + " " + rateLimit.KeyKind
+	if rateLimit.RoleName != "" {
+		name += " " + rateLimit.RoleName
+	}
+	return name
+}
+
+func (rateLimit *RateLimit) match(component string, method string) bool {
+	return (rateLimit.Component == "*" || rateLimit.Component == component) && (rateLimit.Method == "*" || rateLimit.Method == method)
+}
+
+// Tokens per second
+func (rateLimit *RateLimit) getRate() float64 {
+	return float64(rateLimit.Limit) / rateLimit.Period.Seconds()
+}
+
+func (rateLimit *RateLimit) getBurst() int {
+	if rateLimit.Burst > 0 {
+		return rateLimit.Burst
+	}
+	return rateLimit.Limit
+}
+
+// Bucket keys of the request. The token is digested so the backend never holds it.
+func (rateLimit *RateLimit) getKeySlice(user *User, token string) []string {
+	prefix := rateLimit.GetName() + "|"
+	keySlice := make([]string, 0)
+	switch rateLimit.KeyKind {
+	case RateLimitKeyUser:
+		if user != nil {
+			keySlice = append(keySlice, prefix+user.Name)
+		}
+	case RateLimitKeyToken:
+		if token != "" {
+			keySlice = append(keySlice, prefix+GetSessionID(token))
+		}
+	case RateLimitKeyRole:
+		if user == nil {
+			break
+		}
+		roleNameMap := make(map[string]bool)
+		for _, role := range user.GetEffectiveRoleSlice() {
+			if roleNameMap[role.Name] || (rateLimit.RoleName != "" && rateLimit.RoleName != role.Name) {
+				continue
+			}
+			roleNameMap[role.Name] = true
+			keySlice = append(keySlice, prefix+role.Name)
+		}
+	}
+	return keySlice
+}
+
+// RateLimitBackend keeps the token buckets. Implement it on a shared store so the instances behind a load balancer share the limits.
+type RateLimitBackend interface {
+	// Take one token from the bucket refilled at the rate per second up to the burst. A new bucket starts full.
+	// Return false and the wait until a token is available if the bucket is empty.
+	Take(key string, rate float64, burst int) (bool, time.Duration, error)
+	// Put back one token taken by Take, up to the burst. Used when another bucket of the same request rejects it.
+	Refund(key string, rate float64, burst int) error
+}
+
+type tokenBucket struct {
+	tokenAmount float64
+	updatedTime time.Time
+	rate        float64
+	burst       int
+}
+
+func (bucket *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(bucket.updatedTime).Seconds()
+	if elapsed > 0 {
+		bucket.tokenAmount = math.Min(float64(bucket.burst), bucket.tokenAmount+elapsed*bucket.rate)
+		bucket.updatedTime = now
+	}
+}
+
+// MemoryRateLimitBackend keeps the buckets in the process
+type MemoryRateLimitBackend struct {
+	bucketMap     map[string]*tokenBucket
+	lastPruneTime time.Time
+	mutex         sync.Mutex
+	now           func() time.Time
+}
+
+func CreateMemoryRateLimitBackend() *MemoryRateLimitBackend {
+	return &MemoryRateLimitBackend{
+		bucketMap:     make(map[string]*tokenBucket),
+		lastPruneTime: time.Now(),
+		now:           time.Now,
+	}
+}
+
+func (memoryRateLimitBackend *MemoryRateLimitBackend) Take(key string, rate float64, burst int) (bool, time.Duration, error) {
+	memoryRateLimitBackend.mutex.Lock()
+	defer memoryRateLimitBackend.mutex.Unlock()
+
+	now := memoryRateLimitBackend.now()
+	if now.Sub(memoryRateLimitBackend.lastPruneTime) >= memoryRateLimitPruneInterval {
+		memoryRateLimitBackend.prune(now)
+	}
+
+	bucket, ok := memoryRateLimitBackend.bucketMap[key]
+	if ok == false {
+		bucket = &tokenBucket{float64(burst), now, rate, burst}
+		memoryRateLimitBackend.bucketMap[key] = bucket
+	}
+	// The limit could be changed by the policy
+	bucket.rate = rate
+	bucket.burst = burst
+	bucket.refill(now)
+
+	if bucket.tokenAmount >= 1 {
+		bucket.tokenAmount--
+		return true, 0, nil
+	}
+	wait := time.Duration((1 - bucket.tokenAmount) / rate * float64(time.Second))
+	return false, wait, nil
+}
+
+func (memoryRateLimitBackend *MemoryRateLimitBackend) Refund(key string, rate float64, burst int) error {
+	memoryRateLimitBackend.mutex.Lock()
+	defer memoryRateLimitBackend.mutex.Unlock()
+
+	bucket, ok := memoryRateLimitBackend.bucketMap[key]
+	if ok == false {
+		// Pruned so it is full already
+		return nil
+	}
+	bucket.refill(memoryRateLimitBackend.now())
+	bucket.tokenAmount = math.Min(float64(burst), bucket.tokenAmount+1)
+	return nil
+}
+
+// A full bucket is the same as a new one so it is removed
+func (memoryRateLimitBackend *MemoryRateLimitBackend) prune(now time.Time) {
+	for key, bucket := range memoryRateLimitBackend.bucketMap {
+		bucket.refill(now)
+		if bucket.tokenAmount >= float64(bucket.burst) {
+			delete(memoryRateLimitBackend.bucketMap, key)
+		}
+	}
+	memoryRateLimitBackend.lastPruneTime = now
+}
+
+// RateLimiter applies the rate limits to the requests of the rbac identities
+type RateLimiter struct {
+	rateLimitSlice []*RateLimit
+	backend        RateLimitBackend
+}
+
+// The backend is a new MemoryRateLimitBackend if nil
+func CreateRateLimiter(rateLimitSlice []*RateLimit, backend RateLimitBackend) (*RateLimiter, error) {
+	for _, rateLimit := range rateLimitSlice {
+		if err := rateLimit.validate(); err != nil {
+			log.Error(err)
+			return nil, err
+		}
+	}
+	if backend == nil {
+		backend = CreateMemoryRateLimitBackend()
+	}
+
+	return &RateLimiter{
+		rateLimitSlice,
+		backend,
+	}, nil
+}
+
+type takenRateLimitBucket struct {
+	key       string
+	rateLimit *RateLimit
+}
+
+// Take a token from every bucket the request falls into. Return false and the longest wait if any bucket is empty.
+// A rejected request is charged to no bucket. The tokens taken before the rejection are refunded, so a request rejected by one limit doesn't drain the others.
+func (rateLimiter *RateLimiter) Allow(component string, method string, user *User, token string) (bool, time.Duration, error) {
+	allowed := true
+	retryAfter := time.Duration(0)
+	takenSlice := make([]takenRateLimitBucket, 0)
+	for _, rateLimit := range rateLimiter.rateLimitSlice {
+		if rateLimit.match(component, method) == false {
+			continue
+		}
+		for _, key := range rateLimit.getKeySlice(user, token) {
+			ok, wait, err := rateLimiter.backend.Take(key, rateLimit.getRate(), rateLimit.getBurst())
+			if err != nil {
+				log.Error(err)
+				rateLimiter.refund(takenSlice)
+				return false, 0, err
+			}
+			if ok {
+				takenSlice = append(takenSlice, takenRateLimitBucket{key, rateLimit})
+			} else {
+				allowed = false
+				if wait > retryAfter {
+					retryAfter = wait
+				}
+			}
+		}
+	}
+	if allowed == false {
+		rateLimiter.refund(takenSlice)
+	}
+	return allowed, retryAfter, nil
+}
+
+func (rateLimiter *RateLimiter) refund(takenSlice []takenRateLimitBucket) {
+	for _, taken := range takenSlice {
+		if err := rateLimiter.backend.Refund(taken.key, taken.rateLimit.getRate(), taken.rateLimit.getBurst()); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// RateLimitMiddleware rejects the requests over the rate limits with 429 Too Many Requests and Retry-After in seconds.
+// Requests without a valid token aren't limited and are left for AuthorizationMiddleware to reject.
+// The requests are allowed if the backend fails so an outage of a shared backend doesn't take the API down.
+type RateLimitMiddleware struct {
+	Component   string
+	TokenSource TokenSource
+	// Look up the user of the token. Default is GetCache. The user put into the request context by AuthorizationMiddleware is used first.
+	UserLookup  func(token string) *User
+	RateLimiter *RateLimiter
+}
+
+func CreateRateLimitMiddleware(component string, tokenSource TokenSource, rateLimiter *RateLimiter) *RateLimitMiddleware {
+	return &RateLimitMiddleware{
+		Component:   component,
+		TokenSource: tokenSource,
+		UserLookup:  GetCache,
+		RateLimiter: rateLimiter,
+	}
+}
+
+func (rateLimitMiddleware *RateLimitMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		token := rateLimitMiddleware.TokenSource.GetToken(request)
+		user := GetUserFromContext(request.Context())
+		if user == nil && token != "" {
+			user = rateLimitMiddleware.UserLookup(token)
+		}
+		if user == nil {
+			next.ServeHTTP(responseWriter, request)
+			return
+		}
+
+		allowed, retryAfter, err := rateLimitMiddleware.RateLimiter.Allow(rateLimitMiddleware.Component, request.Method, user, token)
+		if err == nil && allowed == false {
+			seconds := int(math.Ceil(retryAfter.Seconds()))
+			if seconds < 1 {
+				seconds = 1
+			}
+			responseWriter.Header().Set("Retry-After", strconv.Itoa(seconds))
+			writeJsonError(responseWriter, http.StatusTooManyRequests, "Rate limit exceeded, retry after "+strconv.Itoa(seconds)+" seconds")
+			return
+		}
+		next.ServeHTTP(responseWriter, request)
+	})
+}
@@ -0,0 +1,249 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type failingRateLimitBackend struct{}
+
+func (backend *failingRateLimitBackend) Take(key string, rate float64, burst int) (bool, time.Duration, error) {
+	return false, 0, errors.New("Backend is down")
+}
+
+func (backend *failingRateLimitBackend) Refund(key string, rate float64, burst int) error {
+	return errors.New("Backend is down")
+}
+
+func TestMemoryRateLimitBackend(t *testing.T) {
+	backend := CreateMemoryRateLimitBackend()
+	now := time.Now()
+	backend.now = func() time.Time {
+		return now
+	}
+
+	for i := 0; i < 3; i++ {
+		if ok, _, _ := backend.Take("k", 1, 3); ok == false {
+			t.Fatalf("Burst should be allowed")
+		}
+	}
+	ok, wait, err := backend.Take("k", 1, 3)
+	if err != nil || ok || wait != time.Second {
+		t.Fatalf("Empty bucket should be rejected with the wait but get %v %v %v", ok, wait, err)
+	}
+	if ok, _, _ := backend.Take("other", 1, 3); ok == false {
+		t.Errorf("Buckets should be independent")
+	}
+
+	now = now.Add(1500 * time.Millisecond)
+	if ok, _, _ := backend.Take("k", 1, 3); ok == false {
+		t.Errorf("Bucket should be refilled by the rate")
+	}
+	if ok, wait, _ := backend.Take("k", 1, 3); ok || wait != 500*time.Millisecond {
+		t.Errorf("Partial token should be counted for the wait but get %v", wait)
+	}
+
+	backend.Refund("k", 1, 3)
+	if ok, _, _ := backend.Take("k", 1, 3); ok == false {
+		t.Errorf("Refunded token should be taken again")
+	}
+
+	now = now.Add(memoryRateLimitPruneInterval)
+	backend.Take("new", 1, 3)
+	if len(backend.bucketMap) != 1 {
+		t.Errorf("Full buckets should be pruned but get %d", len(backend.bucketMap))
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	userLimit, err := CreateRateLimit("cloudone", "*", RateLimitKeyUser, "", 2, time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleteLimit, _ := CreateRateLimit("*", "DELETE", RateLimitKeyToken, "", 1, time.Minute, 0)
+	roleLimit, _ := CreateRateLimit("cloudone", "POST", RateLimitKeyRole, "operator", 3, time.Minute, 0)
+	rateLimiter, err := CreateRateLimiter([]*RateLimit{userLimit, deleteLimit, roleLimit}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := createDenyTestUser(t)
+	bob := createDenyTestUser(t)
+	bob.Name = "bob"
+
+	checkSlice := []struct {
+		component string
+		method    string
+		user      *User
+		token     string
+		expected  bool
+	}{
+		{"cloudone", "GET", alice, "a1", true},
+		{"cloudone", "DELETE", alice, "a2", true},
+		{"cloudone", "GET", alice, "a1", false},    // User limit of alice
+		{"cloudone_gui", "GET", alice, "a1", true}, // Other component
+		{"cloudone_gui", "DELETE", alice, "a1", true},
+		{"cloudone_gui", "DELETE", alice, "a1", false}, // Token limit of a1
+		{"cloudone_gui", "DELETE", alice, "a3", true},
+		{"cloudone", "POST", bob, "b1", true},
+		{"cloudone", "POST", bob, "b1", true},
+		{"cloudone", "POST", bob, "b1", false}, // User limit of bob
+		{"cloudone", "POST", alice, "a1", false},
+	}
+	for i, check := range checkSlice {
+		allowed, retryAfter, err := rateLimiter.Allow(check.component, check.method, check.user, check.token)
+		if err != nil || allowed != check.expected {
+			t.Errorf("Check %d %s %s expects %v but get %v %v", i, check.component, check.method, check.expected, allowed, err)
+		}
+		if allowed == false && retryAfter <= 0 {
+			t.Errorf("Check %d should have the retry after", i)
+		}
+	}
+
+	// Role bucket is shared by all the operators. Bob took 2 of 3 and the rejected requests took none.
+	carol := createDenyTestUser(t)
+	carol.Name = "carol"
+	if allowed, _, _ := rateLimiter.Allow("cloudone", "POST", carol, "c1"); allowed == false {
+		t.Errorf("Role limit should have the token left")
+	}
+	if allowed, _, _ := rateLimiter.Allow("cloudone", "POST", carol, "c2"); allowed {
+		t.Errorf("Role limit should be shared by the users of the role")
+	}
+
+	if _, err := CreateRateLimit("cloudone", "GET", RateLimitKeyUser, "operator", 1, time.Minute, 0); err == nil {
+		t.Errorf("Role should be rejected for the user key")
+	}
+	if _, err := CreateRateLimit("cloudone", "GET", "address", "", 1, time.Minute, 0); err == nil {
+		t.Errorf("Unknown key should be rejected")
+	}
+}
+
+func TestRateLimiterRejectionIsNotCharged(t *testing.T) {
+	userLimit, _ := CreateRateLimit("cloudone", "*", RateLimitKeyUser, "", 2, time.Minute, 0)
+	tokenLimit, _ := CreateRateLimit("cloudone", "DELETE", RateLimitKeyToken, "", 1, time.Minute, 0)
+	rateLimiter, _ := CreateRateLimiter([]*RateLimit{userLimit, tokenLimit}, nil)
+	user := createDenyTestUser(t)
+
+	if allowed, _, _ := rateLimiter.Allow("cloudone", "DELETE", user, "t1"); allowed == false {
+		t.Fatalf("First request should be allowed")
+	}
+	// Rejected by the token limit so the user limit keeps its token
+	for i := 0; i < 3; i++ {
+		if allowed, _, _ := rateLimiter.Allow("cloudone", "DELETE", user, "t1"); allowed {
+			t.Fatalf("Token limit should reject the request")
+		}
+	}
+	if allowed, _, _ := rateLimiter.Allow("cloudone", "GET", user, "t2"); allowed == false {
+		t.Errorf("Rejected requests should not drain the user limit")
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	previousTokenCache := SetDefaultTokenCache(CreateMemoryTokenCache(0))
+	defer SetDefaultTokenCache(previousTokenCache)
+	SetCache("valid-token", createDenyTestUser(t), time.Hour)
+
+	rateLimit, _ := CreateRateLimit("cloudone_gui", "*", RateLimitKeyUser, "", 1, time.Minute, 0)
+	rateLimiter, _ := CreateRateLimiter([]*RateLimit{rateLimit}, nil)
+	rateLimitMiddleware := CreateRateLimitMiddleware("cloudone_gui", CreateHeaderTokenSource("token"), rateLimiter)
+	handler := rateLimitMiddleware.Handler(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {}))
+
+	checkSlice := []struct {
+		token      string
+		statusCode int
+	}{
+		{"valid-token", http.StatusOK},
+		{"valid-token", http.StatusTooManyRequests},
+		{"", http.StatusOK},
+		{"unknown-token", http.StatusOK},
+	}
+	for _, check := range checkSlice {
+		request := httptest.NewRequest("GET", "/gui/inventory", nil)
+		if check.token != "" {
+			request.Header.Set("token", check.token)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != check.statusCode {
+			t.Errorf("Token %q should be %d but get %d", check.token, check.statusCode, recorder.Code)
+		}
+		if recorder.Code == http.StatusTooManyRequests && recorder.Header().Get("Retry-After") != "60" {
+			t.Errorf("Retry-After should be in seconds but get %q", recorder.Header().Get("Retry-After"))
+		}
+	}
+
+	// The requests pass when the shared backend is down
+	rateLimitMiddleware.RateLimiter, _ = CreateRateLimiter([]*RateLimit{rateLimit}, &failingRateLimitBackend{})
+	request := httptest.NewRequest("GET", "/gui/inventory", nil)
+	request.Header.Set("token", "valid-token")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Backend failure should not reject the request but get %d", recorder.Code)
+	}
+}
+
+func TestPolicyRateLimit(t *testing.T) {
+	policy, err := LoadPolicy([]byte(`
+roles:
+  - name: operator
+rateLimits:
+  - {component: cloudone, method: "*", key: user, limit: 100, period: 1m}
+  - {component: cloudone, method: POST, key: role, role: operator, limit: 10, period: 1s, burst: 20}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policy.RateLimitSlice) != 2 || policy.RateLimitSlice[0].Period != time.Minute || policy.RateLimitSlice[1].getBurst() != 20 {
+		t.Errorf("Rate limits should be built from the policy")
+	}
+	if _, err := CreateRateLimiter(policy.RateLimitSlice, nil); err != nil {
+		t.Errorf("Rate limiter should be created from the policy but get %v", err)
+	}
+
+	_, err = LoadPolicy([]byte(`
+rateLimits:
+  - {component: cloudone, method: GET, key: user, limit: 1, period: soon}
+  - {component: cloudone, method: GET, key: role, role: unknown, limit: 1, period: 1s}
+  - {component: cloudone, method: GET, key: user, limit: 0, period: 1s}
+`))
+	policyValidationError, ok := err.(*PolicyValidationError)
+	if ok == false || len(policyValidationError.ErrorSlice) != 3 {
+		t.Fatalf("Invalid period, unknown role and invalid limit should be reported but get %v", err)
+	}
+
+	_, err = LoadPolicy([]byte(`
+rateLimits:
+  - component: cloudone
+    method: FETCH
+    key: user
+    limit: 1
+    period: 1s
+  - component: cloudone
+    method: GET
+    key: user
+    limit: 1
+    period: 0s
+`))
+	policyValidationError, ok = err.(*PolicyValidationError)
+	if ok == false || len(policyValidationError.ErrorSlice) != 2 || policyValidationError.ErrorSlice[0].Line != 4 || policyValidationError.ErrorSlice[1].Line != 12 {
+		t.Errorf("Errors should point to the line of the invalid field but get %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrRefreshTokenInvalid = errors.New("Refresh token is invalid")
+	ErrRefreshTokenExpired = errors.New("Refresh token is expired")
+	// The refresh token is used twice so it may be stolen. The whole token family is revoked.
+	ErrRefreshTokenReused = errors.New("Refresh token is reused")
+)
+
+type TokenPair struct {
+	AccessToken             string
+	AccessTokenExpiredTime  time.Time
+	RefreshToken            string
+	RefreshTokenExpiredTime time.Time
+}
+
+// Refresh tokens are kept in memory only so they are lost on restart
+type refreshRecord struct {
+	familyID          string
+	familyCreatedTime time.Time
+	user              *User
+	accessTokenTTL    time.Duration
+	expiredTime       time.Time
+	used              bool
+}
+
+// Create a session with a refresh token. The refresh token is single use and rotated by Refresh.
+// All the access and refresh tokens derived from it form a family limited by MaximumLifetime.
+func (sessionManager *SessionManager) CreateSessionWithRefreshToken(user *User, accessTokenTTL time.Duration, remoteAddress string, userAgent string) (*TokenPair, *Session, error) {
+	familyID, err := generateRandomHex(16)
+	if err != nil {
+		log.Error(err)
+		return nil, nil, err
+	}
+	return sessionManager.createTokenPair(user, accessTokenTTL, remoteAddress, userAgent, familyID, sessionManager.now())
+}
+
+func (sessionManager *SessionManager) createTokenPair(user *User, accessTokenTTL time.Duration, remoteAddress string, userAgent string, familyID string, familyCreatedTime time.Time) (*TokenPair, *Session, error) {
+	accessToken, err := GenerateToken()
+	if err != nil {
+		log.Error(err)
+		return nil, nil, err
+	}
+	refreshToken, err := GenerateToken()
+	if err != nil {
+		log.Error(err)
+		return nil, nil, err
+	}
+
+	session := sessionManager.cacheSession(accessToken, user, accessTokenTTL, remoteAddress, userAgent, familyID, familyCreatedTime, "")
+	record := &refreshRecord{
+		familyID,
+		familyCreatedTime,
+		user,
+		accessTokenTTL,
+		sessionManager.limitLifetime(sessionManager.now().Add(sessionManager.RefreshTokenTTL), familyCreatedTime),
+		false,
+	}
+
+	// The family could be revoked by a concurrent reuse after the refresh token is checked, so it is checked again under the same lock as the insertion
+	sessionManager.mutex.Lock()
+	if _, ok := sessionManager.revokedFamilyMap[familyID]; ok {
+		sessionManager.mutex.Unlock()
+		sessionManager.getTokenCache().Delete(accessToken)
+		return nil, nil, ErrRefreshTokenReused
+	}
+	sessionManager.sessionMap[session.ID] = session
+	sessionManager.tokenMap[session.ID] = accessToken
+	sessionManager.refreshMap[GetSessionID(refreshToken)] = record
+	sessionManager.mutex.Unlock()
+
+	copiedSession := *session
+	return &TokenPair{
+		accessToken,
+		session.ExpiredTime,
+		refreshToken,
+		record.expiredTime,
+	}, &copiedSession, nil
+}
+
+// Exchange the refresh token for a new token pair. Reusing a refresh token revokes the whole family.
+func (sessionManager *SessionManager) Refresh(refreshToken string, remoteAddress string, userAgent string) (*TokenPair, *Session, error) {
+	now := sessionManager.now()
+
+	sessionManager.mutex.Lock()
+	record, ok := sessionManager.refreshMap[GetSessionID(refreshToken)]
+	if ok == false {
+		sessionManager.mutex.Unlock()
+		return nil, nil, ErrRefreshTokenInvalid
+	}
+	if _, ok := sessionManager.revokedFamilyMap[record.familyID]; ok {
+		sessionManager.mutex.Unlock()
+		return nil, nil, ErrRefreshTokenReused
+	}
+	used := record.used
+	record.used = true
+	sessionManager.mutex.Unlock()
+
+	if used {
+		log.Error("Refresh token of the family %s of user %s is reused, revoke the family", record.familyID, record.user.Name)
+		if err := sessionManager.RevokeFamily(record.familyID); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, ErrRefreshTokenReused
+	}
+	if now.After(record.expiredTime) {
+		return nil, nil, ErrRefreshTokenExpired
+	}
+
+	user := record.user
+	if sessionManager.UserFinder != nil {
+		foundUser, err := sessionManager.UserFinder(user.Name)
+		if err != nil {
+			log.Error(err)
+			return nil, nil, err
+		}
+		if foundUser == nil {
+			return nil, nil, ErrRefreshTokenInvalid
+		}
+		if foundUser.Disabled {
+			return nil, nil, ErrDisabled
+		}
+		if foundUser.ExpiredTime != nil && now.After(*foundUser.ExpiredTime) {
+			return nil, nil, ErrExpired
+		}
+		user = foundUser
+	}
+
+	return sessionManager.createTokenPair(user, record.accessTokenTTL, remoteAddress, userAgent, record.familyID, record.familyCreatedTime)
+}
+
+// Revoke all the access tokens and the refresh tokens of the family.
+// The family is kept as revoked until a refresh token of it would expire, so a refresh in progress couldn't add to it.
+func (sessionManager *SessionManager) RevokeFamily(familyID string) error {
+	idSlice := make([]string, 0)
+
+	sessionManager.mutex.Lock()
+	sessionManager.revokedFamilyMap[familyID] = sessionManager.now().Add(sessionManager.RefreshTokenTTL)
+	for id, record := range sessionManager.refreshMap {
+		if record.familyID == familyID {
+			delete(sessionManager.refreshMap, id)
+		}
+	}
+	for id, session := range sessionManager.sessionMap {
+		if session.FamilyID == familyID {
+			idSlice = append(idSlice, id)
+		}
+	}
+	sessionManager.mutex.Unlock()
+
+	for _, id := range idSlice {
+		if _, err := sessionManager.RevokeSession(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove the expired refresh tokens and revoked families. The used ones are kept until they expire for the reuse detection.
+func (sessionManager *SessionManager) PruneRefreshToken() {
+	now := sessionManager.now()
+
+	sessionManager.mutex.Lock()
+	defer sessionManager.mutex.Unlock()
+	for id, record := range sessionManager.refreshMap {
+		if now.After(record.expiredTime) {
+			delete(sessionManager.refreshMap, id)
+		}
+	}
+	for familyID, expiredTime := range sessionManager.revokedFamilyMap {
+		if now.After(expiredTime) {
+			delete(sessionManager.revokedFamilyMap, familyID)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"testing"
+	"time"
+)
+
+func createTestSessionManager(t *testing.T) (*SessionManager, *time.Time) {
+	sessionManager, err := CreateSessionManager(CreateMemoryTokenCache(0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	sessionManager.now = func() time.Time {
+		return now
+	}
+	return sessionManager, &now
+}
+
+func TestSlidingExpiry(t *testing.T) {
+	sessionManager, now := createTestSessionManager(t)
+	sessionManager.SlidingExpiry = true
+	sessionManager.MaximumLifetime = 2 * time.Hour
+	createdTime := *now
+
+	token, _, _ := sessionManager.CreateSession(&User{Name: "alice"}, time.Hour, "", "")
+	*now = now.Add(50 * time.Minute)
+	sessionManager.GetUser(token)
+	if expiredTime := sessionManager.GetSessionSlice("alice")[0].ExpiredTime; expiredTime.Equal(now.Add(time.Hour)) == false {
+		t.Errorf("Expiry should be extended on use but get %v", expiredTime)
+	}
+
+	*now = now.Add(50 * time.Minute)
+	sessionManager.GetUser(token)
+	if expiredTime := sessionManager.GetSessionSlice("alice")[0].ExpiredTime; expiredTime.Equal(createdTime.Add(2*time.Hour)) == false {
+		t.Errorf("Expiry should be limited by the maximum lifetime but get %v", expiredTime)
+	}
+	// Token cache counts the TTL from the real time
+	expiredTime := sessionManager.getTokenCache().GetAllTokenExpiredTime()[token]
+	expectedExpiredTime := time.Now().Add(createdTime.Add(2 * time.Hour).Sub(*now))
+	if expiredTime.Sub(expectedExpiredTime) > time.Second || expiredTime.Sub(expectedExpiredTime) < -time.Second {
+		t.Errorf("Token cache expiry should be extended to the maximum lifetime but get %v", expiredTime)
+	}
+
+	sessionManager.SlidingExpiry = false
+	otherToken, _, _ := sessionManager.CreateSession(&User{Name: "bob"}, time.Hour, "", "")
+	*now = now.Add(30 * time.Minute)
+	sessionManager.GetUser(otherToken)
+	if sessionManager.GetSessionSlice("bob")[0].ExpiredTime.Equal(now.Add(30*time.Minute)) == false {
+		t.Errorf("Expiry should be fixed without sliding")
+	}
+}
+
+// Evict the token right after the lookup like a concurrent revocation or synchronization
+type evictingTokenCache struct {
+	*MemoryTokenCache
+}
+
+func (evictingTokenCache *evictingTokenCache) Get(token string) *User {
+	user := evictingTokenCache.MemoryTokenCache.Get(token)
+	evictingTokenCache.MemoryTokenCache.Delete(token)
+	return user
+}
+
+func TestSlidingExpiryDoesNotResurrectToken(t *testing.T) {
+	sessionManager, now := createTestSessionManager(t)
+	tokenCache := &evictingTokenCache{CreateMemoryTokenCache(0)}
+	sessionManager.tokenCache = tokenCache
+	sessionManager.SlidingExpiry = true
+
+	token, session, _ := sessionManager.CreateSession(&User{Name: "alice"}, time.Hour, "", "")
+	*now = now.Add(30 * time.Minute)
+	sessionManager.GetUser(token)
+	if tokenCache.Peek(token) != nil {
+		t.Errorf("Evicted token should not be put back by the sliding expiry")
+	}
+	if sessionSlice := sessionManager.GetSessionSlice("alice"); len(sessionSlice) != 1 || sessionSlice[0].ExpiredTime.Equal(session.ExpiredTime) == false {
+		t.Errorf("Session should not be extended without the cached token")
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	sessionManager, now := createTestSessionManager(t)
+	sessionManager.RefreshTokenTTL = 24 * time.Hour
+	alice := &User{Name: "alice"}
+
+	tokenPair, _, err := sessionManager.CreateSessionWithRefreshToken(alice, time.Hour, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	*now = now.Add(10 * time.Minute)
+	refreshedTokenPair, session, err := sessionManager.Refresh(tokenPair.RefreshToken, "10.0.0.1:1234", "curl/7.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshedTokenPair.RefreshToken == tokenPair.RefreshToken || refreshedTokenPair.AccessToken == tokenPair.AccessToken {
+		t.Errorf("Tokens should be rotated")
+	}
+	if session.RemoteAddress != "10.0.0.1:1234" || sessionManager.GetUser(refreshedTokenPair.AccessToken) != alice {
+		t.Errorf("New access token should be issued for the user")
+	}
+
+	// Reuse of the rotated refresh token revokes the family
+	if _, _, err := sessionManager.Refresh(tokenPair.RefreshToken, "", ""); err != ErrRefreshTokenReused {
+		t.Fatalf("Reuse should be detected but get %v", err)
+	}
+	if sessionManager.GetUser(tokenPair.AccessToken) != nil || sessionManager.GetUser(refreshedTokenPair.AccessToken) != nil {
+		t.Errorf("Access tokens of the family should be revoked")
+	}
+	if _, _, err := sessionManager.Refresh(refreshedTokenPair.RefreshToken, "", ""); err != ErrRefreshTokenInvalid {
+		t.Errorf("Refresh tokens of the family should be revoked but get %v", err)
+	}
+}
+
+func TestRefreshTokenLifetime(t *testing.T) {
+	sessionManager, now := createTestSessionManager(t)
+	sessionManager.RefreshTokenTTL = time.Hour
+	sessionManager.MaximumLifetime = 90 * time.Minute
+	alice := &User{Name: "alice"}
+	deleted := false
+	sessionManager.UserFinder = func(name string) (*User, error) {
+		if deleted {
+			return nil, nil
+		}
+		return alice, nil
+	}
+
+	tokenPair, _, _ := sessionManager.CreateSessionWithRefreshToken(alice, time.Hour, "", "")
+	*now = now.Add(50 * time.Minute)
+	tokenPair, _, err := sessionManager.Refresh(tokenPair.RefreshToken, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokenPair.AccessTokenExpiredTime.Equal(now.Add(40*time.Minute)) == false || tokenPair.RefreshTokenExpiredTime.Equal(now.Add(40*time.Minute)) == false {
+		t.Errorf("Refreshed tokens should be limited by the maximum lifetime of the family")
+	}
+
+	*now = now.Add(41 * time.Minute)
+	if _, _, err := sessionManager.Refresh(tokenPair.RefreshToken, "", ""); err != ErrRefreshTokenExpired {
+		t.Errorf("Refresh beyond the maximum lifetime should fail but get %v", err)
+	}
+
+	*now = now.Add(-41 * time.Minute)
+	tokenPair, _, _ = sessionManager.CreateSessionWithRefreshToken(alice, time.Hour, "", "")
+	deleted = true
+	if _, _, err := sessionManager.Refresh(tokenPair.RefreshToken, "", ""); err != ErrRefreshTokenInvalid {
+		t.Errorf("Deleted user should not refresh but get %v", err)
+	}
+
+	deleted = false
+	tokenPair, _, _ = sessionManager.CreateSessionWithRefreshToken(alice, time.Hour, "", "")
+	sessionManager.RevokeAllSession("alice")
+	if _, _, err := sessionManager.Refresh(tokenPair.RefreshToken, "", ""); err != ErrRefreshTokenInvalid {
+		t.Errorf("Refresh token should be revoked with all the sessions but get %v", err)
+	}
+}
+
+func TestConcurrentRefreshTokenReuse(t *testing.T) {
+	sessionManager, _ := createTestSessionManager(t)
+	sessionManager.RefreshTokenTTL = 24 * time.Hour
+	alice := &User{Name: "alice"}
+	// Hold the first refresh after the refresh token is marked used and before the new pair is recorded
+	checkedChannel := make(chan bool)
+	releaseChannel := make(chan bool)
+	sessionManager.UserFinder = func(name string) (*User, error) {
+		checkedChannel <- true
+		<-releaseChannel
+		return alice, nil
+	}
+
+	tokenPair, _, err := sessionManager.CreateSessionWithRefreshToken(alice, time.Hour, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errorChannel := make(chan error)
+	var refreshedTokenPair *TokenPair
+	go func() {
+		var err error
+		refreshedTokenPair, _, err = sessionManager.Refresh(tokenPair.RefreshToken, "", "")
+		errorChannel <- err
+	}()
+	<-checkedChannel
+
+	if _, _, err := sessionManager.Refresh(tokenPair.RefreshToken, "", ""); err != ErrRefreshTokenReused {
+		t.Fatalf("Reuse should be detected but get %v", err)
+	}
+	close(releaseChannel)
+	if err := <-errorChannel; err != ErrRefreshTokenReused {
+		t.Fatalf("Refresh of the revoked family should fail but get %v", err)
+	}
+	if refreshedTokenPair != nil {
+		t.Errorf("No token pair should be issued for the revoked family")
+	}
+	if len(sessionManager.GetSessionSlice("alice")) != 0 {
+		t.Errorf("No session should remain for the revoked family")
+	}
+	if len(sessionManager.refreshMap) != 0 {
+		t.Errorf("No refresh token should remain for the revoked family")
+	}
+}
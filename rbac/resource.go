@@ -17,25 +17,50 @@ package rbac
 import (
 	"encoding/hex"
 	"errors"
-	"strings"
 )
 
 type Resource struct {
 	Name      string
 	Component string
 	Path      string // Path is hierarchy
+	Effect    Effect
+	MatchMode MatchMode
 }
 
 func CreateResource(component string, path string) (*Resource, error) {
-	name, err := GetResourceName(component, path)
+	return CreateResourceWithEffect(component, path, EffectAllow)
+}
+
+func CreateDenyResource(component string, path string) (*Resource, error) {
+	return CreateResourceWithEffect(component, path, EffectDeny)
+}
+
+// The resource is created in segment match mode, which is a breaking change from the string prefix of the earlier versions.
+// See CreatePermissionWithEffect. Use CreateResourceWithMatchMode with MatchModePrefix to keep the legacy behavior.
+func CreateResourceWithEffect(component string, path string, effect Effect) (*Resource, error) {
+	return CreateResourceWithMatchMode(component, path, effect, MatchModeSegment)
+}
+
+// The path is validated as a pattern only in segment match mode
+func CreateResourceWithMatchMode(component string, path string, effect Effect, matchMode MatchMode) (*Resource, error) {
+	name, err := getResourceNameWithEffect(component, path, effect)
 	if err != nil {
 		log.Error(err)
 		return nil, err
 	}
+	if matchMode.IsPrefix() == false {
+		if err := ValidatePathPattern(path); err != nil {
+			log.Error(err)
+			return nil, err
+		}
+	}
+
 	return &Resource{
 		name,
 		component,
 		path,
+		effect,
+		matchMode,
 	}, nil
 }
 
@@ -52,14 +77,37 @@ func GetResourceName(component string, path string) (string, error) {
 	return hex.EncodeToString([]byte(component + " " + path)), nil
 }
 
+func getResourceNameWithEffect(component string, path string, effect Effect) (string, error) {
+	name, err := GetResourceName(component, path)
+	if err != nil {
+		return "", err
+	}
+	if effect.IsDeny() {
+		// Keep the allow and deny on the same node distinguishable
+		name = hex.EncodeToString([]byte(string(EffectDeny)+" ")) + name
+	}
+	return name, nil
+}
+
+// Check whether the resource grants the target. Deny resource never grants.
+// The name doesn't tell the match mode so every field is compared
+func (resource *Resource) equal(other *Resource) bool {
+	return resource.Component == other.Component && resource.Path == other.Path && resource.Effect == other.Effect && resource.MatchMode == other.MatchMode
+}
+
 func (resource *Resource) HasResource(component string, path string) bool {
+	return resource.Effect.IsDeny() == false && resource.Match(component, path)
+}
+
+// Check whether the resource applies to the target regardless of the effect
+func (resource *Resource) Match(component string, path string) bool {
 	// * means all
 	if resource.Component == "*" {
 		// * means all
 		if resource.Path == "*" {
 			return true
 			// Prefix for hierarchy authorization
-		} else if strings.HasPrefix(path, resource.Path) {
+		} else if matchPath(resource.MatchMode, resource.Path, path) {
 			return true
 		} else {
 			return false
@@ -69,7 +117,7 @@ func (resource *Resource) HasResource(component string, path string) bool {
 		if resource.Path == "*" {
 			return true
 			// Prefix for hierarchy authorization
-		} else if strings.HasPrefix(path, resource.Path) {
+		} else if matchPath(resource.MatchMode, resource.Path, path) {
 			return true
 		} else {
 			return false
@@ -14,31 +14,132 @@
 
 package rbac
 
-import ()
+import (
+	"errors"
+	"strings"
+	"sync"
+)
 
 type Role struct {
-	Name            string
-	PermissionSlice []*Permission
-	Description     string
+	Name                string
+	PermissionSlice     []*Permission
+	Description         string
+	ParentRoleNameSlice []string // Inherit all permissions of the parent roles. A role with only parents is a composite role.
+	RequireSecondFactor bool     // The users with the role must pass the second factor to get a token
 }
 
+// Deny permission in the role or the parent roles overrides the allow permission. See Effect for the evaluation order.
 func (role *Role) HasPermission(component string, method string, path string) bool {
-	for _, permission := range role.PermissionSlice {
-		if permission.HasPermission(component, method, path) {
-			return true
+	return evaluatePermission(role.GetEffectivePermissionSlice(), component, method, path)
+}
+
+// Check whether user has the target permission node or child permission node of the target permission node along the tree
+func (role *Role) HasChildPermission(component string, method string, path string) bool {
+	return evaluateChildPermission(role.GetEffectivePermissionSlice(), component, method, path)
+}
+
+// Permissions of the role and all its ancestors resolved with the role resolver set by SetRoleResolver.
+// If the inheritance couldn't be resolved, it fails closed with only the deny permissions of the role itself so the role grants nothing.
+func (role *Role) GetEffectivePermissionSlice() []*Permission {
+	if len(role.ParentRoleNameSlice) == 0 {
+		return role.PermissionSlice
+	}
+
+	permissionSlice, err := GetRoleResolver().GetEffectivePermissionSlice(role)
+	if err != nil {
+		log.Error(err)
+		denyPermissionSlice := make([]*Permission, 0)
+		for _, permission := range role.PermissionSlice {
+			if permission.Effect.IsDeny() {
+				denyPermissionSlice = append(denyPermissionSlice, permission)
+			}
 		}
+		return denyPermissionSlice
 	}
+	return permissionSlice
+}
 
-	return false
+type RoleResolver struct {
+	roleMap map[string]*Role
 }
 
-// Check whether user has the target permission node or child permission node of the target permission node along the tree
-func (role *Role) HasChildPermission(component string, method string, path string) bool {
-	for _, permission := range role.PermissionSlice {
-		if permission.HasChildPermission(component, method, path) {
-			return true
+// All the parent roles must be in the role slice and the inheritance must not have cycle
+func CreateRoleResolver(roleSlice []*Role) (*RoleResolver, error) {
+	roleResolver := &RoleResolver{make(map[string]*Role)}
+	for _, role := range roleSlice {
+		if _, ok := roleResolver.roleMap[role.Name]; ok {
+			log.Error("Duplicate role name %s", role.Name)
+			return nil, errors.New("Duplicate role name " + role.Name)
+		}
+		roleResolver.roleMap[role.Name] = role
+	}
+
+	for _, role := range roleSlice {
+		if _, err := roleResolver.GetEffectivePermissionSlice(role); err != nil {
+			log.Error(err)
+			return nil, err
+		}
+	}
+
+	return roleResolver, nil
+}
+
+func (roleResolver *RoleResolver) GetRole(name string) *Role {
+	if roleResolver == nil {
+		return nil
+	}
+	return roleResolver.roleMap[name]
+}
+
+// Flatten the inheritance graph. The permissions of the role come first and then the parents in order. A role reached more than once is included once.
+func (roleResolver *RoleResolver) GetEffectivePermissionSlice(role *Role) ([]*Permission, error) {
+	permissionSlice := make([]*Permission, 0)
+	err := roleResolver.collectPermission(role, make([]string, 0), make(map[string]bool), &permissionSlice)
+	if err != nil {
+		return nil, err
+	}
+	return permissionSlice, nil
+}
+
+func (roleResolver *RoleResolver) collectPermission(role *Role, pathSlice []string, visitedMap map[string]bool, permissionSlice *[]*Permission) error {
+	for _, name := range pathSlice {
+		if name == role.Name {
+			return errors.New("Role inheritance cycle " + strings.Join(append(pathSlice, role.Name), " -> "))
+		}
+	}
+	if visitedMap[role.Name] {
+		return nil
+	}
+
+	pathSlice = append(pathSlice, role.Name)
+	*permissionSlice = append(*permissionSlice, role.PermissionSlice...)
+
+	for _, parentRoleName := range role.ParentRoleNameSlice {
+		parentRole := roleResolver.GetRole(parentRoleName)
+		if parentRole == nil {
+			return errors.New("Role " + role.Name + " references unknown parent role " + parentRoleName)
+		}
+		if err := roleResolver.collectPermission(parentRole, pathSlice, visitedMap, permissionSlice); err != nil {
+			return err
 		}
 	}
 
-	return false
+	visitedMap[role.Name] = true
+	return nil
+}
+
+var roleResolver *RoleResolver
+var roleResolverMutex sync.RWMutex
+
+func GetRoleResolver() *RoleResolver {
+	roleResolverMutex.RLock()
+	defer roleResolverMutex.RUnlock()
+	return roleResolver
+}
+
+// Set the resolver used to resolve the parent roles referenced by name
+func SetRoleResolver(resolver *RoleResolver) {
+	roleResolverMutex.Lock()
+	defer roleResolverMutex.Unlock()
+	roleResolver = resolver
 }
@@ -0,0 +1,133 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// RoleGrant assigns the role to the user within the window, such as the elevation for an incident.
+// The role is ignored before the start time and from the end time on.
+type RoleGrant struct {
+	Role         *Role
+	StartTime    *time.Time // Optional. Effective from the creation if nil.
+	EndTime      *time.Time // Optional. Never ends if nil.
+	Reason       string
+	ApproverName string // The user who approved the elevation
+}
+
+// ExpiringRoleGrant is the grant found by GetExpiringRoleGrantSlice with its user
+type ExpiringRoleGrant struct {
+	UserName  string
+	RoleGrant *RoleGrant
+}
+
+func CreateRoleGrant(role *Role, startTime *time.Time, endTime *time.Time, reason string, approverName string) (*RoleGrant, error) {
+	if role == nil {
+		log.Error("Role couldn't be nil")
+		return nil, errors.New("Role couldn't be nil")
+	}
+	if err := validateRoleGrantWindow(startTime, endTime); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	return &RoleGrant{
+		role,
+		startTime,
+		endTime,
+		reason,
+		approverName,
+	}, nil
+}
+
+func validateRoleGrantWindow(startTime *time.Time, endTime *time.Time) error {
+	if startTime != nil && endTime != nil && endTime.After(*startTime) == false {
+		return errors.New("End time must be after the start time")
+	}
+	return nil
+}
+
+func (roleGrant *RoleGrant) IsActive(now time.Time) bool {
+	if roleGrant.StartTime != nil && now.Before(*roleGrant.StartTime) {
+		return false
+	}
+	if roleGrant.EndTime != nil && now.Before(*roleGrant.EndTime) == false {
+		return false
+	}
+	return true
+}
+
+// Whether the grant couldn't be active any more
+func (roleGrant *RoleGrant) IsExpired(now time.Time) bool {
+	return roleGrant.EndTime != nil && now.Before(*roleGrant.EndTime) == false
+}
+
+// Roles of the grants active at the moment
+func (user *User) getActiveRoleGrantRoleSlice(now time.Time) []*Role {
+	roleSlice := make([]*Role, 0)
+	for _, roleGrant := range user.RoleGrantSlice {
+		if roleGrant.IsActive(now) {
+			roleSlice = append(roleSlice, roleGrant.Role)
+		}
+	}
+	return roleSlice
+}
+
+// Active grants ending within the duration from now, the earliest end first
+func (user *User) GetExpiringRoleGrantSlice(now time.Time, duration time.Duration) []*RoleGrant {
+	deadline := now.Add(duration)
+	roleGrantSlice := make([]*RoleGrant, 0)
+	for _, roleGrant := range user.RoleGrantSlice {
+		if roleGrant.IsActive(now) && roleGrant.EndTime != nil && roleGrant.EndTime.After(deadline) == false {
+			roleGrantSlice = append(roleGrantSlice, roleGrant)
+		}
+	}
+	sort.SliceStable(roleGrantSlice, func(i int, j int) bool {
+		return roleGrantSlice[i].EndTime.Before(*roleGrantSlice[j].EndTime)
+	})
+	return roleGrantSlice
+}
+
+// Active grants of the users ending within the duration from now, the earliest end first, such as for the reminder before the elevation ends
+func GetExpiringRoleGrantSlice(userSlice []*User, now time.Time, duration time.Duration) []*ExpiringRoleGrant {
+	expiringRoleGrantSlice := make([]*ExpiringRoleGrant, 0)
+	for _, user := range userSlice {
+		for _, roleGrant := range user.GetExpiringRoleGrantSlice(now, duration) {
+			expiringRoleGrantSlice = append(expiringRoleGrantSlice, &ExpiringRoleGrant{user.Name, roleGrant})
+		}
+	}
+	sort.SliceStable(expiringRoleGrantSlice, func(i int, j int) bool {
+		return expiringRoleGrantSlice[i].RoleGrant.EndTime.Before(*expiringRoleGrantSlice[j].RoleGrant.EndTime)
+	})
+	return expiringRoleGrantSlice
+}
+
+// Remove the expired grants from the user and return the amount removed
+func (user *User) RemoveExpiredRoleGrant(now time.Time) int {
+	roleGrantSlice := make([]*RoleGrant, 0)
+	for _, roleGrant := range user.RoleGrantSlice {
+		if roleGrant.IsExpired(now) == false {
+			roleGrantSlice = append(roleGrantSlice, roleGrant)
+		}
+	}
+	amount := len(user.RoleGrantSlice) - len(roleGrantSlice)
+	if amount > 0 {
+		user.RoleGrantSlice = roleGrantSlice
+	}
+	return amount
+}
@@ -0,0 +1,192 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"testing"
+	"time"
+)
+
+func createRoleGrantTestUser(t *testing.T, now time.Time) *User {
+	writePermission, _ := CreatePermission("cloudone", "*", "/api/v1/**")
+	deployPermission, _ := CreatePermission("cloudone", "POST", "/api/v1/deploys")
+	auditPermission, _ := CreatePermission("cloudone", "GET", "/audits")
+	productionWriter := &Role{Name: "production-writer", PermissionSlice: []*Permission{writePermission}}
+	deployer := &Role{Name: "deployer", PermissionSlice: []*Permission{deployPermission}}
+	auditor := &Role{Name: "auditor", PermissionSlice: []*Permission{auditPermission}}
+
+	startTime := now.Add(-time.Hour)
+	endTime := now.Add(30 * time.Minute)
+	active, err := CreateRoleGrant(productionWriter, &startTime, &endTime, "INC-42", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiredEndTime := now.Add(-time.Minute)
+	expired, _ := CreateRoleGrant(deployer, nil, &expiredEndTime, "INC-41", "alice")
+	futureStartTime := now.Add(time.Hour)
+	future, _ := CreateRoleGrant(auditor, &futureStartTime, nil, "Quarterly audit", "alice")
+
+	user := createTestUser(t, "bob", testPassword, nil, nil, "", nil, nil, false)
+	user.RoleGrantSlice = []*RoleGrant{active, expired, future}
+	return user
+}
+
+func TestRoleGrant(t *testing.T) {
+	user := createRoleGrantTestUser(t, time.Now())
+
+	checkSlice := []struct {
+		method   string
+		path     string
+		expected bool
+	}{
+		{"DELETE", "/api/v1/namespaces", true},
+		{"GET", "/audits", false},
+		{"POST", "/api/v1/deploys", true},
+		{"GET", "/gui", false},
+	}
+	for _, check := range checkSlice {
+		if result := user.HasPermission("cloudone", check.method, check.path); result != check.expected {
+			t.Errorf("%s %s expects %v but get %v", check.method, check.path, check.expected, result)
+		}
+	}
+	if user.HasChildPermission("cloudone", "POST", "/api") == false {
+		t.Errorf("Active grant should be considered for the child permission")
+	}
+
+	// Only the active grant gives the production write
+	user.RoleGrantSlice[0].EndTime = &time.Time{}
+	if user.HasPermission("cloudone", "DELETE", "/api/v1/namespaces") || user.HasChildPermission("cloudone", "DELETE", "/api") {
+		t.Errorf("Ended grant should be ignored")
+	}
+	if user.HasPermission("cloudone", "POST", "/api/v1/deploys") {
+		t.Errorf("Expired grant should be ignored")
+	}
+	user.RoleGrantSlice[2].StartTime = &time.Time{}
+	if user.HasPermission("cloudone", "GET", "/audits") == false {
+		t.Errorf("Grant should be active once started")
+	}
+
+	startTime := time.Now()
+	if _, err := CreateRoleGrant(&Role{Name: "r"}, &startTime, &startTime, "", ""); err == nil {
+		t.Errorf("Empty window should be rejected")
+	}
+}
+
+func TestGetExpiringRoleGrantSlice(t *testing.T) {
+	now := time.Now()
+	bob := createRoleGrantTestUser(t, now)
+	carol := createRoleGrantTestUser(t, now)
+	carol.Name = "carol"
+	soonEndTime := now.Add(10 * time.Minute)
+	carol.RoleGrantSlice[0].EndTime = &soonEndTime
+
+	if len(bob.GetExpiringRoleGrantSlice(now, 10*time.Minute)) != 0 {
+		t.Errorf("Grant ending later should not be listed")
+	}
+	expiringRoleGrantSlice := GetExpiringRoleGrantSlice([]*User{bob, carol}, now, time.Hour)
+	if len(expiringRoleGrantSlice) != 2 || expiringRoleGrantSlice[0].UserName != "carol" || expiringRoleGrantSlice[1].UserName != "bob" {
+		t.Fatalf("Active grants should be listed with the earliest end first")
+	}
+	if roleGrant := expiringRoleGrantSlice[1].RoleGrant; roleGrant.Role.Name != "production-writer" || roleGrant.ApproverName != "alice" || roleGrant.Reason != "INC-42" {
+		t.Errorf("Grant should carry the approver and the reason")
+	}
+
+	if amount := bob.RemoveExpiredRoleGrant(now); amount != 1 || len(bob.RoleGrantSlice) != 2 {
+		t.Errorf("Only the expired grant should be removed but get %d", amount)
+	}
+}
+
+func TestRoleGrantCopyAndToken(t *testing.T) {
+	user := createRoleGrantTestUser(t, time.Now())
+
+	partialUser := user.CopyPartialUserDataForComponent("cloudone")
+	if len(partialUser.RoleSlice) != 0 || len(partialUser.RoleGrantSlice) != 2 {
+		t.Fatalf("Partial user should keep the unexpired grants with the window")
+	}
+	if partialUser.RoleGrantSlice[1].StartTime == nil || partialUser.HasPermission("cloudone", "GET", "/audits") {
+		t.Errorf("Partial user should keep the start time")
+	}
+	if partialUser.RoleGrantSlice[0] == user.RoleGrantSlice[0] {
+		t.Errorf("Grant should be copied")
+	}
+
+	signingKey, _ := CreateHS256SigningKey("key", []byte("0123456789abcdef0123456789abcdef"))
+	tokenIssuer := CreateTokenIssuer("cloudone", signingKey, time.Hour)
+	token, err := tokenIssuer.Issue(user, "cloudone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenUser, err := CreateTokenVerifier("cloudone", 0, []*SigningKey{signingKey}).Verify(token, "cloudone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokenUser.RoleGrantSlice) != 2 || tokenUser.RoleGrantSlice[0].EndTime == nil ||
+		tokenUser.HasPermission("cloudone", "DELETE", "/api/v1/namespaces") == false || tokenUser.HasPermission("cloudone", "GET", "/audits") {
+		t.Errorf("Signed token should carry the grants with the window")
+	}
+}
+
+func TestPolicyRoleGrant(t *testing.T) {
+	data := []byte(`
+roles:
+  - name: production-writer
+    permissions:
+      - component: cloudone
+        method: "*"
+        path: /api/v1/**
+users:
+  - name: bob
+    roleGrants:
+      - role: production-writer
+        startTime: "2015-01-01T00:00:00Z"
+        endTime: "2015-01-02T00:00:00Z"
+        reason: INC-42
+        approver: alice
+`)
+	policy, err := LoadPolicy(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roleGrant := policy.UserSlice[0].RoleGrantSlice[0]
+	if roleGrant.Role.Name != "production-writer" || roleGrant.ApproverName != "alice" || roleGrant.IsActive(time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC)) == false {
+		t.Errorf("Role grant should be built from the policy")
+	}
+	if policy.UserSlice[0].HasPermission("cloudone", "GET", "/api/v1/pods") {
+		t.Errorf("Ended grant from the policy should be ignored")
+	}
+
+	oldPolicyDocument := CreatePolicyDocument(nil, nil, policy.UserSlice)
+	if len(oldPolicyDocument.RoleSlice) != 1 || oldPolicyDocument.UserSlice[0].RoleGrantSlice[0].EndTime != "2015-01-02T00:00:00Z" {
+		t.Errorf("Role grant should be exported")
+	}
+	endTime := time.Date(2015, 1, 3, 0, 0, 0, 0, time.UTC)
+	roleGrant.EndTime = &endTime
+	policyChangeSlice := DiffPolicyDocument(oldPolicyDocument, CreatePolicyDocument(nil, nil, policy.UserSlice))
+	if len(policyChangeSlice) != 2 || policyChangeSlice[1].Grant != "role production-writer from 2015-01-01T00:00:00Z until 2015-01-03T00:00:00Z approved by alice for INC-42" {
+		t.Errorf("Extended grant should be reported but get %v", policyChangeSlice)
+	}
+
+	_, err = LoadPolicy([]byte(`
+users:
+  - name: bob
+    roleGrants:
+      - role: unknown
+        startTime: "2015-01-02T00:00:00Z"
+        endTime: "2015-01-01T00:00:00Z"
+`))
+	if policyValidationError, ok := err.(*PolicyValidationError); ok == false || len(policyValidationError.ErrorSlice) != 2 {
+		t.Errorf("Unknown role and reversed window should be reported but get %v", err)
+	}
+}
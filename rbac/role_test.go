@@ -0,0 +1,128 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"strings"
+	"testing"
+)
+
+func createInheritanceTestRoleSlice(t *testing.T) []*Role {
+	viewPermission, err := CreatePermission("cloudone_gui", "GET", "/gui")
+	if err != nil {
+		t.Fatal(err)
+	}
+	editPermission, err := CreatePermission("cloudone_gui", "POST", "/gui/inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rbacPermission, err := CreatePermission("cloudone_gui", "*", "/gui/system/rbac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	denyPermission, err := CreateDenyPermission("cloudone_gui", "POST", "/gui/inventory/secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []*Role{
+		&Role{Name: "viewer", PermissionSlice: []*Permission{viewPermission}},
+		&Role{Name: "operator", PermissionSlice: []*Permission{editPermission, denyPermission}, ParentRoleNameSlice: []string{"viewer"}},
+		&Role{Name: "security", PermissionSlice: []*Permission{rbacPermission}, ParentRoleNameSlice: []string{"viewer"}},
+		// Composite role
+		&Role{Name: "admin", ParentRoleNameSlice: []string{"operator", "security"}},
+	}
+}
+
+func TestRoleInheritance(t *testing.T) {
+	roleSlice := createInheritanceTestRoleSlice(t)
+	roleResolver, err := CreateRoleResolver(roleSlice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetRoleResolver(roleResolver)
+	defer SetRoleResolver(nil)
+
+	admin := roleResolver.GetRole("admin")
+	permissionSlice, err := roleResolver.GetEffectivePermissionSlice(admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// viewer is reached twice but included once
+	if len(permissionSlice) != 4 {
+		t.Errorf("Expect 4 effective permissions but get %d", len(permissionSlice))
+	}
+
+	user := &User{Name: "u", RoleSlice: []*Role{admin}}
+	if user.HasPermission("cloudone_gui", "GET", "/gui/dashboard") == false {
+		t.Errorf("Permission from grandparent should be inherited")
+	}
+	if user.HasPermission("cloudone_gui", "DELETE", "/gui/system/rbac/user") == false {
+		t.Errorf("Permission from parent should be inherited")
+	}
+	if user.HasPermission("cloudone_gui", "POST", "/gui/inventory/secret") {
+		t.Errorf("Deny from parent should be inherited")
+	}
+	if user.HasChildPermission("cloudone_gui", "DELETE", "/gui/system") == false {
+		t.Errorf("Child permission from parent should be inherited")
+	}
+
+	partialUser := user.CopyPartialUserDataForComponent("cloudone_gui")
+	SetRoleResolver(nil)
+	if partialUser.HasPermission("cloudone_gui", "DELETE", "/gui/system/rbac/user") == false {
+		t.Errorf("Partial user should carry the flattened permissions")
+	}
+	if partialUser.HasPermission("cloudone_gui", "POST", "/gui/inventory/secret") {
+		t.Errorf("Partial user should carry the flattened deny")
+	}
+}
+
+func TestRoleInheritanceCycle(t *testing.T) {
+	roleSlice := createInheritanceTestRoleSlice(t)
+	roleSlice[0].ParentRoleNameSlice = []string{"admin"}
+
+	_, err := CreateRoleResolver(roleSlice)
+	if err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("Cycle should be detected but get %v", err)
+	}
+}
+
+func TestRoleInheritanceUnknownParent(t *testing.T) {
+	roleSlice := createInheritanceTestRoleSlice(t)
+	roleSlice[1].ParentRoleNameSlice = []string{"missing"}
+
+	if _, err := CreateRoleResolver(roleSlice); err == nil {
+		t.Errorf("Unknown parent role should be rejected")
+	}
+	if _, err := CreateRoleResolver(append(roleSlice, &Role{Name: "viewer"})); err == nil {
+		t.Errorf("Duplicate role should be rejected")
+	}
+
+	// The resolver doesn't know the parent so the role fails closed
+	roleResolver, err := CreateRoleResolver(roleSlice[0:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetRoleResolver(roleResolver)
+	defer SetRoleResolver(nil)
+	operator := roleSlice[1]
+	if operator.HasPermission("cloudone_gui", "POST", "/gui/inventory") || operator.HasChildPermission("cloudone_gui", "POST", "/gui") {
+		t.Errorf("Unresolved role should not allow its own permissions")
+	}
+	permissionSlice := operator.GetEffectivePermissionSlice()
+	if len(permissionSlice) != 1 || permissionSlice[0].Effect.IsDeny() == false {
+		t.Errorf("Unresolved role should keep only its own deny")
+	}
+}
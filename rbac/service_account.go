@@ -0,0 +1,343 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API key is formatted as the prefix, the hex encoded service account name, the key id and the secret joined by underscores
+const APIKeyPrefix = "cok"
+
+// Name of the user verified by an API key is the service account name with this prefix so it couldn't be taken for a human user.
+// The names of the users couldn't start with it.
+const ServiceAccountUserNamePrefix = "serviceaccount:"
+
+const (
+	ServiceAccountMetaDataKey = "serviceAccount"
+	APIKeyMetaDataKey         = "apiKey"
+)
+
+var (
+	ErrAPIKeyMalformed = errors.New("API key is malformed")
+	ErrAPIKeyInvalid   = errors.New("API key is invalid")
+	ErrAPIKeyExpired   = errors.New("API key is expired")
+)
+
+type APIKey struct {
+	ID            string
+	Name          string
+	EncodedSecret string // Hex encoded SHA-256 of the secret. The secret is only returned when the key is created.
+	// Allow permissions and allow resources of the service account granted to the key. Nil means all of them.
+	// They are compared in full including the match mode and the condition. The deny permissions and the deny resources of the service account always apply.
+	PermissionSlice []*Permission
+	ResourceSlice   []*Resource
+	CreatedTime     time.Time
+	ExpiredTime     *time.Time
+	LastUsedTime    *time.Time
+}
+
+// Non-interactive account for pipelines. It authenticates with the API keys instead of a password.
+type ServiceAccount struct {
+	Name          string
+	RoleSlice     []*Role
+	ResourceSlice []*Resource
+	Description   string
+	Disabled      bool
+	APIKeySlice   []*APIKey
+	mutex         sync.Mutex
+}
+
+func CreateServiceAccount(name string, roleSlice []*Role, resourceSlice []*Resource, description string) (*ServiceAccount, error) {
+	if name == "" {
+		log.Error("Name couldn't be empty")
+		return nil, errors.New("Name couldn't be empty")
+	}
+
+	return &ServiceAccount{
+		Name:          name,
+		RoleSlice:     roleSlice,
+		ResourceSlice: resourceSlice,
+		Description:   description,
+		APIKeySlice:   make([]*APIKey, 0),
+	}, nil
+}
+
+func (serviceAccount *ServiceAccount) getPermissionSlice() []*Permission {
+	permissionSlice := make([]*Permission, 0)
+	for _, role := range serviceAccount.RoleSlice {
+		permissionSlice = append(permissionSlice, role.GetEffectivePermissionSlice()...)
+	}
+	return permissionSlice
+}
+
+// Create the key scoped to the given allow permissions and allow resources of the service account. They are copied into the key.
+// The returned API key contains the secret and is the only chance to get it.
+func (serviceAccount *ServiceAccount) CreateAPIKey(name string, permissionSlice []*Permission, resourceSlice []*Resource, expiredTime *time.Time) (string, *APIKey, error) {
+	var scopePermissionSlice []*Permission
+	if permissionSlice != nil {
+		scopePermissionSlice = make([]*Permission, 0)
+	}
+	for _, permission := range permissionSlice {
+		if permission.Effect.IsDeny() || containPermission(serviceAccount.getPermissionSlice(), permission) == false {
+			log.Error("Permission %s %s %s is not granted to service account %s", permission.Component, permission.Method, permission.Path, serviceAccount.Name)
+			return "", nil, errors.New("Permission " + permission.Component + " " + permission.Method + " " + permission.Path + " is not granted to service account " + serviceAccount.Name)
+		}
+		copiedPermission := *permission
+		scopePermissionSlice = append(scopePermissionSlice, &copiedPermission)
+	}
+
+	var scopeResourceSlice []*Resource
+	if resourceSlice != nil {
+		scopeResourceSlice = make([]*Resource, 0)
+	}
+	for _, resource := range resourceSlice {
+		if resource.Effect.IsDeny() || containResource(serviceAccount.ResourceSlice, resource) == false {
+			log.Error("Resource %s %s is not granted to service account %s", resource.Component, resource.Path, serviceAccount.Name)
+			return "", nil, errors.New("Resource " + resource.Component + " " + resource.Path + " is not granted to service account " + serviceAccount.Name)
+		}
+		copiedResource := *resource
+		scopeResourceSlice = append(scopeResourceSlice, &copiedResource)
+	}
+
+	id, err := generateRandomHex(8)
+	if err != nil {
+		log.Error(err)
+		return "", nil, err
+	}
+	secret, err := generateRandomHex(32)
+	if err != nil {
+		log.Error(err)
+		return "", nil, err
+	}
+
+	apiKey := &APIKey{
+		id,
+		name,
+		encodeAPIKeySecret(secret),
+		scopePermissionSlice,
+		scopeResourceSlice,
+		time.Now(),
+		expiredTime,
+		nil,
+	}
+
+	serviceAccount.mutex.Lock()
+	serviceAccount.APIKeySlice = append(serviceAccount.APIKeySlice, apiKey)
+	serviceAccount.mutex.Unlock()
+
+	return strings.Join([]string{APIKeyPrefix, hex.EncodeToString([]byte(serviceAccount.Name)), id, secret}, "_"), apiKey, nil
+}
+
+func (serviceAccount *ServiceAccount) GetAPIKey(id string) *APIKey {
+	serviceAccount.mutex.Lock()
+	defer serviceAccount.mutex.Unlock()
+	for _, apiKey := range serviceAccount.APIKeySlice {
+		if apiKey.ID == id {
+			return apiKey
+		}
+	}
+	return nil
+}
+
+// Return false if the key doesn't exist
+func (serviceAccount *ServiceAccount) RevokeAPIKey(id string) bool {
+	serviceAccount.mutex.Lock()
+	defer serviceAccount.mutex.Unlock()
+	for i, apiKey := range serviceAccount.APIKeySlice {
+		if apiKey.ID == id {
+			serviceAccount.APIKeySlice = append(serviceAccount.APIKeySlice[:i:i], serviceAccount.APIKeySlice[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Last used time is updated concurrently by the verification so it is read with the lock
+func (serviceAccount *ServiceAccount) GetAPIKeyLastUsedTime(id string) *time.Time {
+	serviceAccount.mutex.Lock()
+	defer serviceAccount.mutex.Unlock()
+	for _, apiKey := range serviceAccount.APIKeySlice {
+		if apiKey.ID == id {
+			return apiKey.LastUsedTime
+		}
+	}
+	return nil
+}
+
+func containPermission(permissionSlice []*Permission, permission *Permission) bool {
+	for _, containedPermission := range permissionSlice {
+		if containedPermission.equal(permission) {
+			return true
+		}
+	}
+	return false
+}
+
+func containResource(resourceSlice []*Resource, resource *Resource) bool {
+	for _, containedResource := range resourceSlice {
+		if containedResource.equal(resource) {
+			return true
+		}
+	}
+	return false
+}
+
+// The user has a single role with the permissions granted to the key so HasPermission and HasResource work as for the other users.
+// The permissions removed from the service account after the key is created are no longer granted.
+func (serviceAccount *ServiceAccount) createUser(apiKey *APIKey) *User {
+	role := &Role{Name: serviceAccount.Name + "/" + apiKey.Name, PermissionSlice: make([]*Permission, 0)}
+	for _, permission := range serviceAccount.getPermissionSlice() {
+		if permission.Effect.IsDeny() || apiKey.PermissionSlice == nil || containPermission(apiKey.PermissionSlice, permission) {
+			role.PermissionSlice = append(role.PermissionSlice, permission)
+		}
+	}
+
+	resourceSlice := make([]*Resource, 0)
+	for _, resource := range serviceAccount.ResourceSlice {
+		if resource.Effect.IsDeny() || apiKey.ResourceSlice == nil || containResource(apiKey.ResourceSlice, resource) {
+			resourceSlice = append(resourceSlice, resource)
+		}
+	}
+
+	return &User{
+		Name:            ServiceAccountUserNamePrefix + serviceAccount.Name,
+		EncodedPassword: "******",
+		RoleSlice:       []*Role{role},
+		ResourceSlice:   resourceSlice,
+		Description:     serviceAccount.Description,
+		MetaDataMap: map[string]string{
+			ServiceAccountMetaDataKey: "true",
+			APIKeyMetaDataKey:         apiKey.ID,
+		},
+		ExpiredTime: apiKey.ExpiredTime,
+	}
+}
+
+func encodeAPIKeySecret(secret string) string {
+	// The secret is random with 256 bits so a slow password hash isn't needed
+	digest := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(digest[:])
+}
+
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix+"_")
+}
+
+type ServiceAccountResolver struct {
+	serviceAccountMap map[string]*ServiceAccount
+	now               func() time.Time
+}
+
+func CreateServiceAccountResolver(serviceAccountSlice []*ServiceAccount) (*ServiceAccountResolver, error) {
+	serviceAccountResolver := &ServiceAccountResolver{make(map[string]*ServiceAccount), time.Now}
+	for _, serviceAccount := range serviceAccountSlice {
+		if _, ok := serviceAccountResolver.serviceAccountMap[serviceAccount.Name]; ok {
+			log.Error("Duplicate service account name %s", serviceAccount.Name)
+			return nil, errors.New("Duplicate service account name " + serviceAccount.Name)
+		}
+		serviceAccountResolver.serviceAccountMap[serviceAccount.Name] = serviceAccount
+	}
+	return serviceAccountResolver, nil
+}
+
+func (serviceAccountResolver *ServiceAccountResolver) GetServiceAccount(name string) *ServiceAccount {
+	if serviceAccountResolver == nil {
+		return nil
+	}
+	return serviceAccountResolver.serviceAccountMap[name]
+}
+
+// Verify the API key and update its last used time. The returned user is scoped to the key.
+func (serviceAccountResolver *ServiceAccountResolver) VerifyAPIKey(token string) (*User, error) {
+	fieldSlice := strings.Split(token, "_")
+	if len(fieldSlice) != 4 || fieldSlice[0] != APIKeyPrefix {
+		return nil, ErrAPIKeyMalformed
+	}
+	name, err := hex.DecodeString(fieldSlice[1])
+	if err != nil {
+		return nil, ErrAPIKeyMalformed
+	}
+
+	serviceAccount := serviceAccountResolver.GetServiceAccount(string(name))
+	if serviceAccount == nil {
+		return nil, ErrAPIKeyInvalid
+	}
+	apiKey := serviceAccount.GetAPIKey(fieldSlice[2])
+	if apiKey == nil {
+		return nil, ErrAPIKeyInvalid
+	}
+	if subtle.ConstantTimeCompare([]byte(encodeAPIKeySecret(fieldSlice[3])), []byte(apiKey.EncodedSecret)) != 1 {
+		return nil, ErrAPIKeyInvalid
+	}
+
+	if serviceAccount.Disabled {
+		return nil, ErrDisabled
+	}
+	now := serviceAccountResolver.now()
+	if apiKey.ExpiredTime != nil && now.After(*apiKey.ExpiredTime) {
+		return nil, ErrAPIKeyExpired
+	}
+
+	serviceAccount.mutex.Lock()
+	apiKey.LastUsedTime = &now
+	serviceAccount.mutex.Unlock()
+
+	return serviceAccount.createUser(apiKey), nil
+}
+
+var serviceAccountResolver *ServiceAccountResolver
+var serviceAccountResolverMutex sync.RWMutex
+
+func GetServiceAccountResolver() *ServiceAccountResolver {
+	serviceAccountResolverMutex.RLock()
+	defer serviceAccountResolverMutex.RUnlock()
+	return serviceAccountResolver
+}
+
+// Set the resolver used to verify the API keys by VerifyAPIKey
+func SetServiceAccountResolver(resolver *ServiceAccountResolver) {
+	serviceAccountResolverMutex.Lock()
+	defer serviceAccountResolverMutex.Unlock()
+	serviceAccountResolver = resolver
+}
+
+func VerifyAPIKey(token string) (*User, error) {
+	currentServiceAccountResolver := GetServiceAccountResolver()
+	if currentServiceAccountResolver == nil {
+		return nil, ErrAPIKeyInvalid
+	}
+	return currentServiceAccountResolver.VerifyAPIKey(token)
+}
+
+// User lookup for AuthorizationMiddleware accepting both the API keys and the tokens looked up by the fallback such as GetCache
+func CreateAPIKeyUserLookup(fallback func(token string) *User) func(token string) *User {
+	return func(token string) *User {
+		if IsAPIKey(token) {
+			user, err := VerifyAPIKey(token)
+			if err != nil {
+				return nil
+			}
+			return user
+		}
+		return fallback(token)
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func createTestServiceAccount(t *testing.T) *ServiceAccount {
+	deployPermission, _ := CreatePermission("cloudone", "POST", "/api/v1/deploys/**")
+	readPermission, _ := CreatePermission("cloudone", "GET", "/api/v1/**")
+	denyPermission, _ := CreateDenyPermission("cloudone", "*", "/api/v1/deploys/kube-system")
+	role := &Role{Name: "pipeline", PermissionSlice: []*Permission{deployPermission, readPermission, denyPermission}}
+	resource, _ := CreateResource("cloudone", "/namespaces/**")
+	serviceAccount, err := CreateServiceAccount("ci", []*Role{role}, []*Resource{resource}, "CI pipeline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serviceAccount
+}
+
+func TestAPIKey(t *testing.T) {
+	serviceAccount := createTestServiceAccount(t)
+	serviceAccountResolver, err := CreateServiceAccountResolver([]*ServiceAccount{serviceAccount})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readPermission, _ := CreatePermission("cloudone", "GET", "/api/v1/**")
+	readOnlyKey, readOnlyAPIKey, err := serviceAccount.CreateAPIKey("read only", []*Permission{readPermission}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(readOnlyAPIKey.EncodedSecret, strings.Split(readOnlyKey, "_")[3]) {
+		t.Errorf("Secret should not be stored")
+	}
+
+	user, err := serviceAccountResolver.VerifyAPIKey(readOnlyKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.HasPermission("cloudone", "GET", "/api/v1/namespaces") == false {
+		t.Errorf("Scoped permission should be granted")
+	}
+	if user.HasPermission("cloudone", "POST", "/api/v1/deploys/default") {
+		t.Errorf("Permission out of the scope should not be granted")
+	}
+	if user.HasResource("cloudone", "/namespaces/default") == false {
+		t.Errorf("Nil resource scope should grant all the resources")
+	}
+	if user.MetaDataMap[APIKeyMetaDataKey] != readOnlyAPIKey.ID {
+		t.Errorf("User should carry the key id")
+	}
+	if serviceAccount.GetAPIKeyLastUsedTime(readOnlyAPIKey.ID) == nil {
+		t.Errorf("Last used time should be updated")
+	}
+
+	fullKey, _, err := serviceAccount.CreateAPIKey("full", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, _ = serviceAccountResolver.VerifyAPIKey(fullKey)
+	if user.HasPermission("cloudone", "POST", "/api/v1/deploys/default") == false {
+		t.Errorf("Nil permission scope should grant all the permissions")
+	}
+	if user.HasPermission("cloudone", "POST", "/api/v1/deploys/kube-system") {
+		t.Errorf("Deny permission of the service account should always apply")
+	}
+
+	otherPermission, _ := CreatePermission("cloudone", "DELETE", "/api/v1/**")
+	if _, _, err := serviceAccount.CreateAPIKey("escalation", []*Permission{otherPermission}, nil, nil); err == nil {
+		t.Errorf("Permission not granted to the service account should be rejected")
+	}
+}
+
+func TestAPIKeyScopeComparesFullPermission(t *testing.T) {
+	// Both permissions have the same name
+	exactPermission, _ := CreatePermission("cloudone", "GET", "/api/v1/namespaces")
+	prefixPermission, _ := CreatePermission("cloudone", "GET", "/api/v1/namespaces")
+	prefixPermission.MatchMode = MatchModePrefix
+	conditionPermission, _ := CreatePermission("cloudone", "GET", "/api/v1/namespaces")
+	if err := conditionPermission.SetCondition(`remote.ip in ["10.0.0.0/8"]`); err != nil {
+		t.Fatal(err)
+	}
+	role := &Role{Name: "pipeline", PermissionSlice: []*Permission{exactPermission, prefixPermission}}
+	serviceAccount, _ := CreateServiceAccount("ci", []*Role{role}, nil, "")
+	serviceAccountResolver, _ := CreateServiceAccountResolver([]*ServiceAccount{serviceAccount})
+
+	key, _, err := serviceAccount.CreateAPIKey("exact", []*Permission{exactPermission}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, _ := serviceAccountResolver.VerifyAPIKey(key)
+	if user.HasPermission("cloudone", "GET", "/api/v1/namespaces") == false || user.HasPermission("cloudone", "GET", "/api/v1/namespaces-other") {
+		t.Errorf("Only the permission with the same match mode should be granted")
+	}
+	if _, _, err := serviceAccount.CreateAPIKey("condition", []*Permission{conditionPermission}, nil, nil); err == nil {
+		t.Errorf("Permission with another condition should be rejected")
+	}
+}
+
+func TestVerifyAPIKeyError(t *testing.T) {
+	serviceAccount := createTestServiceAccount(t)
+	serviceAccountResolver, _ := CreateServiceAccountResolver([]*ServiceAccount{serviceAccount})
+	past := time.Now().Add(-time.Hour)
+	key, apiKey, _ := serviceAccount.CreateAPIKey("expired", nil, nil, &past)
+	otherKey, _, _ := serviceAccount.CreateAPIKey("other", nil, nil, nil)
+
+	fieldSlice := strings.Split(otherKey, "_")
+	checkSlice := []struct {
+		token    string
+		expected error
+	}{
+		{"cok_abc", ErrAPIKeyMalformed},
+		{"cok_zz_id_secret", ErrAPIKeyMalformed},
+		{strings.Join([]string{fieldSlice[0], fieldSlice[1], fieldSlice[2], "wrong"}, "_"), ErrAPIKeyInvalid},
+		{strings.Join([]string{fieldSlice[0], "6e6f626f6479", fieldSlice[2], fieldSlice[3]}, "_"), ErrAPIKeyInvalid},
+		{key, ErrAPIKeyExpired},
+	}
+	for _, check := range checkSlice {
+		if _, err := serviceAccountResolver.VerifyAPIKey(check.token); err != check.expected {
+			t.Errorf("Token %s expects %v but get %v", check.token, check.expected, err)
+		}
+	}
+
+	serviceAccount.Disabled = true
+	if _, err := serviceAccountResolver.VerifyAPIKey(otherKey); err != ErrDisabled {
+		t.Errorf("Disabled service account expects %v but get %v", ErrDisabled, err)
+	}
+	serviceAccount.Disabled = false
+
+	if serviceAccount.RevokeAPIKey(apiKey.ID) == false {
+		t.Errorf("Key should be revoked")
+	}
+	if _, err := serviceAccountResolver.VerifyAPIKey(key); err != ErrAPIKeyInvalid {
+		t.Errorf("Revoked key expects %v but get %v", ErrAPIKeyInvalid, err)
+	}
+}
+
+func TestAPIKeyUserLookup(t *testing.T) {
+	serviceAccount := createTestServiceAccount(t)
+	serviceAccountResolver, _ := CreateServiceAccountResolver([]*ServiceAccount{serviceAccount})
+	previousServiceAccountResolver := GetServiceAccountResolver()
+	SetServiceAccountResolver(serviceAccountResolver)
+	defer SetServiceAccountResolver(previousServiceAccountResolver)
+
+	key, _, _ := serviceAccount.CreateAPIKey("lookup", nil, nil, nil)
+	fallbackUser := &User{Name: "alice"}
+	userLookup := CreateAPIKeyUserLookup(func(token string) *User {
+		if token == "session" {
+			return fallbackUser
+		}
+		return nil
+	})
+
+	if user := userLookup(key); user == nil || user.Name != ServiceAccountUserNamePrefix+"ci" {
+		t.Errorf("API key should be verified")
+	}
+	if userLookup("session") != fallbackUser {
+		t.Errorf("Other tokens should be looked up by the fallback")
+	}
+	if userLookup(key+"0") != nil {
+		t.Errorf("Invalid API key should not fall back")
+	}
+}
@@ -0,0 +1,344 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Session is the record of an issued token. The token itself isn't exposed.
+type Session struct {
+	ID               string // Hex encoded SHA-256 of the token
+	UserName         string
+	CreatedTime      time.Time
+	LastSeenTime     time.Time
+	ExpiredTime      time.Time
+	RemoteAddress    string
+	UserAgent        string
+	FamilyID         string // Sessions created by the same refresh token family. Empty without refresh token.
+	ImpersonatorName string // The real user of an impersonation session. Empty otherwise.
+	ttl              time.Duration
+	startTime        time.Time // The maximum lifetime is counted from it
+}
+
+// RevocationStore persists the revoked session ids until the sessions expire
+type RevocationStore interface {
+	SaveRevocation(id string, expiredTime time.Time) error
+	DeleteRevocation(id string) error
+	LoadRevocation() (map[string]time.Time, error)
+}
+
+// SessionManager issues the tokens into the token cache and keeps the session records.
+// Revoked sessions are kept in the revocation list until they expire so the tokens verified elsewhere, such as the signed tokens, could be rejected with IsRevoked.
+type SessionManager struct {
+	// Optional. Extend the expiry by the original TTL on every lookup, up to MaximumLifetime from the creation.
+	SlidingExpiry bool
+	// Absolute lifetime of the session and its refresh token family. 0 means unlimited.
+	MaximumLifetime time.Duration
+	// TTL of the refresh tokens. See CreateSessionWithRefreshToken.
+	RefreshTokenTTL time.Duration
+	// Optional. Reload the user on refresh so the disabled, expired or deleted users couldn't refresh.
+	UserFinder       UserFinder
+	tokenCache       TokenCache
+	revocationStore  RevocationStore
+	sessionMap       map[string]*Session
+	tokenMap         map[string]string // Session id to token
+	revocationMap    map[string]time.Time
+	refreshMap       map[string]*refreshRecord // Keyed by the digest of the refresh token
+	revokedFamilyMap map[string]time.Time      // Revoked refresh token families until the refresh tokens of them would expire
+	mutex            sync.Mutex
+	now              func() time.Time
+}
+
+func GetSessionID(token string) string {
+	digest := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(digest[:])
+}
+
+// The token cache is the default one if nil. The revocation store is optional, without it the revocation list is lost on restart.
+func CreateSessionManager(tokenCache TokenCache, revocationStore RevocationStore) (*SessionManager, error) {
+	sessionManager := &SessionManager{
+		tokenCache:       tokenCache,
+		revocationStore:  revocationStore,
+		sessionMap:       make(map[string]*Session),
+		tokenMap:         make(map[string]string),
+		revocationMap:    make(map[string]time.Time),
+		refreshMap:       make(map[string]*refreshRecord),
+		revokedFamilyMap: make(map[string]time.Time),
+		now:              time.Now,
+	}
+
+	if revocationStore != nil {
+		revocationMap, err := revocationStore.LoadRevocation()
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		sessionManager.revocationMap = revocationMap
+		sessionManager.PruneRevocation()
+	}
+
+	return sessionManager, nil
+}
+
+func (sessionManager *SessionManager) getTokenCache() TokenCache {
+	if sessionManager.tokenCache != nil {
+		return sessionManager.tokenCache
+	}
+	return GetDefaultTokenCache()
+}
+
+// Generate a token for the user, cache it and record the session
+func (sessionManager *SessionManager) CreateSession(user *User, ttl time.Duration, remoteAddress string, userAgent string) (string, *Session, error) {
+	token, err := GenerateToken()
+	if err != nil {
+		log.Error(err)
+		return "", nil, err
+	}
+	return token, sessionManager.RecordSession(token, user, ttl, remoteAddress, userAgent), nil
+}
+
+// Cache the token issued elsewhere and record the session
+func (sessionManager *SessionManager) RecordSession(token string, user *User, ttl time.Duration, remoteAddress string, userAgent string) *Session {
+	return sessionManager.recordSession(token, user, ttl, remoteAddress, userAgent, "", sessionManager.now(), "")
+}
+
+// The expiry is limited by the maximum lifetime counted from the family creation
+func (sessionManager *SessionManager) recordSession(token string, user *User, ttl time.Duration, remoteAddress string, userAgent string, familyID string, familyCreatedTime time.Time, impersonatorName string) *Session {
+	session := sessionManager.cacheSession(token, user, ttl, remoteAddress, userAgent, familyID, familyCreatedTime, impersonatorName)
+
+	sessionManager.mutex.Lock()
+	defer sessionManager.mutex.Unlock()
+	sessionManager.sessionMap[session.ID] = session
+	sessionManager.tokenMap[session.ID] = token
+
+	copiedSession := *session
+	return &copiedSession
+}
+
+// Cache the token and create the session without recording it
+func (sessionManager *SessionManager) cacheSession(token string, user *User, ttl time.Duration, remoteAddress string, userAgent string, familyID string, familyCreatedTime time.Time, impersonatorName string) *Session {
+	now := sessionManager.now()
+	session := &Session{
+		GetSessionID(token),
+		user.Name,
+		now,
+		now,
+		sessionManager.limitLifetime(now.Add(ttl), familyCreatedTime),
+		remoteAddress,
+		userAgent,
+		familyID,
+		impersonatorName,
+		ttl,
+		familyCreatedTime,
+	}
+	ttl = session.ExpiredTime.Sub(now)
+
+	sessionManager.getTokenCache().Set(token, user, ttl)
+	return session
+}
+
+// Look up the user of the token and update the last seen time. It could be used as the UserLookup of AuthorizationMiddleware.
+func (sessionManager *SessionManager) GetUser(token string) *User {
+	id := GetSessionID(token)
+	if sessionManager.IsRevoked(token) {
+		return nil
+	}
+
+	user := sessionManager.getTokenCache().Get(token)
+
+	sessionManager.mutex.Lock()
+	defer sessionManager.mutex.Unlock()
+	if session, ok := sessionManager.sessionMap[id]; ok {
+		if user == nil {
+			delete(sessionManager.sessionMap, id)
+			delete(sessionManager.tokenMap, id)
+		} else {
+			now := sessionManager.now()
+			session.LastSeenTime = now
+			// The impersonation sessions never slide beyond the duration granted.
+			// Only the cached token is extended so a token evicted or refreshed meanwhile isn't put back with the stale user.
+			if sessionManager.SlidingExpiry && session.ImpersonatorName == "" {
+				expiredTime := sessionManager.limitLifetime(now.Add(session.ttl), session.startTime)
+				if expiredTime.After(session.ExpiredTime) && sessionManager.getTokenCache().Extend(token, expiredTime.Sub(now)) {
+					session.ExpiredTime = expiredTime
+				}
+			}
+		}
+	}
+	return user
+}
+
+func (sessionManager *SessionManager) limitLifetime(expiredTime time.Time, createdTime time.Time) time.Time {
+	if sessionManager.MaximumLifetime > 0 && expiredTime.After(createdTime.Add(sessionManager.MaximumLifetime)) {
+		return createdTime.Add(sessionManager.MaximumLifetime)
+	}
+	return expiredTime
+}
+
+func (sessionManager *SessionManager) IsRevoked(token string) bool {
+	sessionManager.mutex.Lock()
+	defer sessionManager.mutex.Unlock()
+	_, ok := sessionManager.revocationMap[GetSessionID(token)]
+	return ok
+}
+
+// Sessions of the user in the order of the creation. The expired sessions are removed.
+func (sessionManager *SessionManager) GetSessionSlice(userName string) []*Session {
+	sessionManager.mutex.Lock()
+	defer sessionManager.mutex.Unlock()
+
+	now := sessionManager.now()
+	sessionSlice := make([]*Session, 0)
+	for id, session := range sessionManager.sessionMap {
+		if now.After(session.ExpiredTime) {
+			delete(sessionManager.sessionMap, id)
+			delete(sessionManager.tokenMap, id)
+			continue
+		}
+		if session.UserName == userName {
+			copiedSession := *session
+			sessionSlice = append(sessionSlice, &copiedSession)
+		}
+	}
+	sortSessionSlice(sessionSlice)
+	return sessionSlice
+}
+
+func sortSessionSlice(sessionSlice []*Session) {
+	sort.Slice(sessionSlice, func(i int, j int) bool {
+		if sessionSlice[i].CreatedTime.Equal(sessionSlice[j].CreatedTime) {
+			return sessionSlice[i].ID < sessionSlice[j].ID
+		}
+		return sessionSlice[i].CreatedTime.Before(sessionSlice[j].CreatedTime)
+	})
+}
+
+// Return false if the session doesn't exist
+func (sessionManager *SessionManager) RevokeSession(id string) (bool, error) {
+	sessionManager.mutex.Lock()
+	session, ok := sessionManager.sessionMap[id]
+	token := sessionManager.tokenMap[id]
+	delete(sessionManager.sessionMap, id)
+	delete(sessionManager.tokenMap, id)
+	sessionManager.mutex.Unlock()
+
+	if ok == false {
+		return false, nil
+	}
+
+	sessionManager.getTokenCache().Delete(token)
+	return true, sessionManager.addRevocation(id, session.ExpiredTime)
+}
+
+// Revoke the token whether it is recorded or not, such as a signed token, until the expired time
+func (sessionManager *SessionManager) RevokeToken(token string, expiredTime time.Time) error {
+	id := GetSessionID(token)
+
+	sessionManager.mutex.Lock()
+	delete(sessionManager.sessionMap, id)
+	delete(sessionManager.tokenMap, id)
+	sessionManager.mutex.Unlock()
+
+	sessionManager.getTokenCache().Delete(token)
+	return sessionManager.addRevocation(id, expiredTime)
+}
+
+// Revoke all the sessions and the refresh tokens of the user, such as after the password is changed or the user is disabled.
+// The impersonation sessions started by the user are revoked too. Return the amount of the revoked sessions.
+func (sessionManager *SessionManager) RevokeAllSession(userName string) (int, error) {
+	sessionManager.mutex.Lock()
+	for id, record := range sessionManager.refreshMap {
+		if record.user.Name == userName {
+			delete(sessionManager.refreshMap, id)
+		}
+	}
+	sessionManager.mutex.Unlock()
+
+	idSlice := make([]string, 0)
+	for _, session := range sessionManager.GetSessionSlice(userName) {
+		idSlice = append(idSlice, session.ID)
+	}
+	for _, session := range sessionManager.GetImpersonationSessionSlice(userName) {
+		idSlice = append(idSlice, session.ID)
+	}
+
+	amount := 0
+	for _, id := range idSlice {
+		revoked, err := sessionManager.RevokeSession(id)
+		if err != nil {
+			return amount, err
+		}
+		if revoked {
+			amount++
+		}
+	}
+	return amount, nil
+}
+
+func (sessionManager *SessionManager) addRevocation(id string, expiredTime time.Time) error {
+	sessionManager.mutex.Lock()
+	sessionManager.revocationMap[id] = expiredTime
+	sessionManager.mutex.Unlock()
+
+	if sessionManager.revocationStore != nil {
+		if err := sessionManager.revocationStore.SaveRevocation(id, expiredTime); err != nil {
+			log.Error(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove the sessions expired or no longer in the token cache, so the sessions never looked up or listed don't pile up. Call it periodically.
+func (sessionManager *SessionManager) PruneSession() {
+	now := sessionManager.now()
+
+	sessionManager.mutex.Lock()
+	defer sessionManager.mutex.Unlock()
+	for id, session := range sessionManager.sessionMap {
+		if now.After(session.ExpiredTime) || sessionManager.getTokenCache().Peek(sessionManager.tokenMap[id]) == nil {
+			delete(sessionManager.sessionMap, id)
+			delete(sessionManager.tokenMap, id)
+		}
+	}
+}
+
+// Remove the expired revocations since their tokens are rejected by the expiry anyway
+func (sessionManager *SessionManager) PruneRevocation() {
+	now := sessionManager.now()
+	expiredIDSlice := make([]string, 0)
+
+	sessionManager.mutex.Lock()
+	for id, expiredTime := range sessionManager.revocationMap {
+		if now.After(expiredTime) {
+			delete(sessionManager.revocationMap, id)
+			expiredIDSlice = append(expiredIDSlice, id)
+		}
+	}
+	sessionManager.mutex.Unlock()
+
+	if sessionManager.revocationStore != nil {
+		for _, id := range expiredIDSlice {
+			if err := sessionManager.revocationStore.DeleteRevocation(id); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSession(t *testing.T) {
+	sessionManager, err := CreateSessionManager(CreateMemoryTokenCache(0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	sessionManager.now = func() time.Time {
+		return now
+	}
+
+	alice := &User{Name: "alice"}
+	bob := &User{Name: "bob"}
+	aliceToken, aliceSession, err := sessionManager.CreateSession(alice, time.Hour, "10.0.0.1:1234", "curl/7.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aliceSession.ID == aliceToken || aliceSession.ID != GetSessionID(aliceToken) {
+		t.Errorf("Session id should be the digest of the token")
+	}
+	now = now.Add(time.Second)
+	otherAliceToken, _, _ := sessionManager.CreateSession(alice, time.Hour, "10.0.0.2:1234", "Mozilla/5.0")
+	bobToken, _, _ := sessionManager.CreateSession(bob, time.Hour, "10.0.0.3:1234", "Mozilla/5.0")
+
+	now = now.Add(time.Minute)
+	if sessionManager.GetUser(aliceToken) != alice {
+		t.Fatalf("Token should be looked up")
+	}
+	sessionSlice := sessionManager.GetSessionSlice("alice")
+	if len(sessionSlice) != 2 || sessionSlice[0].ID != aliceSession.ID || sessionSlice[0].UserAgent != "curl/7.0" {
+		t.Fatalf("Sessions of alice should be listed in the order of the creation")
+	}
+	if sessionSlice[0].LastSeenTime.Equal(now) == false || sessionSlice[1].LastSeenTime.Equal(now) {
+		t.Errorf("Last seen time should be updated by the lookup")
+	}
+
+	revoked, err := sessionManager.RevokeSession(aliceSession.ID)
+	if err != nil || revoked == false {
+		t.Fatalf("Session should be revoked but get %v", err)
+	}
+	if sessionManager.GetUser(aliceToken) != nil || sessionManager.IsRevoked(aliceToken) == false {
+		t.Errorf("Revoked token should be rejected")
+	}
+	if revoked, _ := sessionManager.RevokeSession(aliceSession.ID); revoked {
+		t.Errorf("Revoked session should not be revoked again")
+	}
+
+	amount, err := sessionManager.RevokeAllSession("alice")
+	if err != nil || amount != 1 {
+		t.Errorf("Remaining session of alice should be revoked but get %d %v", amount, err)
+	}
+	if sessionManager.GetUser(otherAliceToken) != nil || sessionManager.GetUser(bobToken) != bob {
+		t.Errorf("Only the sessions of alice should be revoked")
+	}
+
+	now = now.Add(2 * time.Hour)
+	if len(sessionManager.GetSessionSlice("bob")) != 0 {
+		t.Errorf("Expired session should be removed")
+	}
+	sessionManager.PruneRevocation()
+	if sessionManager.IsRevoked(aliceToken) {
+		t.Errorf("Expired revocation should be pruned")
+	}
+}
+
+func TestPruneSession(t *testing.T) {
+	tokenCache := CreateMemoryTokenCache(0)
+	sessionManager, err := CreateSessionManager(tokenCache, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	sessionManager.now = func() time.Time {
+		return now
+	}
+
+	sessionManager.CreateSession(&User{Name: "alice"}, time.Minute, "", "")
+	evictedToken, _, _ := sessionManager.CreateSession(&User{Name: "bob"}, time.Hour, "", "")
+	sessionManager.CreateSession(&User{Name: "carol"}, time.Hour, "", "")
+	tokenCache.Delete(evictedToken)
+
+	// The sessions are never looked up nor listed
+	now = now.Add(2 * time.Minute)
+	sessionManager.PruneSession()
+	if len(sessionManager.sessionMap) != 1 || len(sessionManager.tokenMap) != 1 {
+		t.Errorf("Expired and evicted sessions should be pruned but get %d", len(sessionManager.sessionMap))
+	}
+}
+
+func TestSessionRevocationPersisted(t *testing.T) {
+	store := CreateMemoryStore()
+	sessionManager, err := CreateSessionManager(CreateMemoryTokenCache(0), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, session, _ := sessionManager.CreateSession(&User{Name: "alice"}, time.Hour, "", "")
+	sessionManager.RevokeSession(session.ID)
+	signedToken := "header.payload.signature"
+	sessionManager.RevokeToken(signedToken, time.Now().Add(time.Hour))
+	sessionManager.RevokeToken("expired", time.Now().Add(-time.Hour))
+
+	// Restart
+	restartedSessionManager, err := CreateSessionManager(CreateMemoryTokenCache(0), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restartedSessionManager.IsRevoked(token) == false || restartedSessionManager.IsRevoked(signedToken) == false {
+		t.Errorf("Revocation list should survive the restart")
+	}
+	if revocationMap, _ := store.LoadRevocation(); len(revocationMap) != 2 {
+		t.Errorf("Expired revocation should be pruned from the store but get %d", len(revocationMap))
+	}
+}
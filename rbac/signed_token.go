@@ -0,0 +1,543 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SigningAlgorithmHS256 = "HS256"
+	SigningAlgorithmRS256 = "RS256"
+	SigningAlgorithmEdDSA = "EdDSA"
+)
+
+var (
+	ErrTokenMalformed        = errors.New("Token is malformed")
+	ErrTokenUnknownKey       = errors.New("Token is signed with an unknown key")
+	ErrTokenInvalidSignature = errors.New("Token signature is invalid")
+	ErrTokenExpired          = errors.New("Token is expired")
+	ErrTokenNotYetValid      = errors.New("Token is not yet valid")
+	ErrTokenInvalidClaim     = errors.New("Token issuer or audience is invalid")
+)
+
+// SigningKey is identified by the key ID carried in the token header so the keys could be rotated.
+// A key without the private part could only verify.
+type SigningKey struct {
+	KeyID      string
+	Algorithm  string
+	Secret     []byte // HS256
+	PrivateKey crypto.Signer
+	PublicKey  crypto.PublicKey
+}
+
+func CreateHS256SigningKey(keyID string, secret []byte) (*SigningKey, error) {
+	if len(secret) < sha256.Size {
+		log.Error("HS256 secret must be at least %d bytes", sha256.Size)
+		return nil, errors.New("HS256 secret is too short")
+	}
+	return &SigningKey{keyID, SigningAlgorithmHS256, secret, nil, nil}, nil
+}
+
+func CreateRS256SigningKey(keyID string, privateKey *rsa.PrivateKey) (*SigningKey, error) {
+	if privateKey == nil {
+		log.Error("RS256 private key couldn't be empty")
+		return nil, errors.New("RS256 private key couldn't be empty")
+	}
+	return &SigningKey{keyID, SigningAlgorithmRS256, nil, privateKey, &privateKey.PublicKey}, nil
+}
+
+func CreateRS256VerificationKey(keyID string, publicKey *rsa.PublicKey) (*SigningKey, error) {
+	if publicKey == nil {
+		log.Error("RS256 public key couldn't be empty")
+		return nil, errors.New("RS256 public key couldn't be empty")
+	}
+	return &SigningKey{keyID, SigningAlgorithmRS256, nil, nil, publicKey}, nil
+}
+
+func CreateEdDSASigningKey(keyID string, privateKey ed25519.PrivateKey) (*SigningKey, error) {
+	if len(privateKey) != ed25519.PrivateKeySize {
+		log.Error("EdDSA private key couldn't be empty and must be %d bytes", ed25519.PrivateKeySize)
+		return nil, errors.New("EdDSA private key couldn't be empty and must be " + strconv.Itoa(ed25519.PrivateKeySize) + " bytes")
+	}
+	return &SigningKey{keyID, SigningAlgorithmEdDSA, nil, privateKey, privateKey.Public()}, nil
+}
+
+func CreateEdDSAVerificationKey(keyID string, publicKey ed25519.PublicKey) (*SigningKey, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		log.Error("EdDSA public key couldn't be empty and must be %d bytes", ed25519.PublicKeySize)
+		return nil, errors.New("EdDSA public key couldn't be empty and must be " + strconv.Itoa(ed25519.PublicKeySize) + " bytes")
+	}
+	return &SigningKey{keyID, SigningAlgorithmEdDSA, nil, nil, publicKey}, nil
+}
+
+func (signingKey *SigningKey) sign(data []byte) ([]byte, error) {
+	switch signingKey.Algorithm {
+	case SigningAlgorithmHS256:
+		mac := hmac.New(sha256.New, signingKey.Secret)
+		mac.Write(data)
+		return mac.Sum(nil), nil
+	case SigningAlgorithmRS256:
+		privateKey, ok := signingKey.PrivateKey.(*rsa.PrivateKey)
+		if ok == false {
+			return nil, errors.New("RS256 key " + signingKey.KeyID + " has no private key")
+		}
+		digest := sha256.Sum256(data)
+		return rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, digest[:])
+	case SigningAlgorithmEdDSA:
+		privateKey, ok := signingKey.PrivateKey.(ed25519.PrivateKey)
+		if ok == false {
+			return nil, errors.New("EdDSA key " + signingKey.KeyID + " has no private key")
+		}
+		return ed25519.Sign(privateKey, data), nil
+	default:
+		return nil, errors.New("Unsupported signing algorithm " + signingKey.Algorithm)
+	}
+}
+
+func (signingKey *SigningKey) verify(data []byte, signature []byte) bool {
+	switch signingKey.Algorithm {
+	case SigningAlgorithmHS256:
+		mac := hmac.New(sha256.New, signingKey.Secret)
+		mac.Write(data)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case SigningAlgorithmRS256:
+		publicKey, ok := signingKey.PublicKey.(*rsa.PublicKey)
+		if ok == false {
+			return false
+		}
+		digest := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature) == nil
+	case SigningAlgorithmEdDSA:
+		publicKey, ok := signingKey.PublicKey.(ed25519.PublicKey)
+		if ok == false {
+			return false
+		}
+		return ed25519.Verify(publicKey, data, signature)
+	default:
+		return false
+	}
+}
+
+type tokenHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// TokenClaims is the JWT payload. The user is the component filtered data from CopyPartialUserDataForComponent in a compact form.
+type TokenClaims struct {
+	Issuer    string       `json:"iss"`
+	Subject   string       `json:"sub"`
+	Audience  string       `json:"aud"`
+	IssuedAt  int64        `json:"iat"`
+	NotBefore int64        `json:"nbf"`
+	ExpiresAt int64        `json:"exp"`
+	ID        string       `json:"jti"`
+	User      *compactUser `json:"usr"`
+}
+
+type compactUser struct {
+	RoleSlice        []*compactRole        `json:"r,omitempty"`
+	ResourceSlice    [][]string            `json:"s,omitempty"`
+	MetaDataMap      map[string]string     `json:"m,omitempty"`
+	Description      string                `json:"d,omitempty"`
+	RoleBindingSlice []*compactRoleBinding `json:"b,omitempty"`
+	RoleGrantSlice   []*compactRoleGrant   `json:"g,omitempty"`
+	ImpersonatorName string                `json:"imp,omitempty"`
+}
+
+type compactRoleBinding struct {
+	Namespace string         `json:"ns"`
+	RoleSlice []*compactRole `json:"r"`
+}
+
+// Times are in Unix seconds. Zero if not set. The reason and the approver aren't needed for the evaluation.
+type compactRoleGrant struct {
+	Role      *compactRole `json:"r"`
+	StartTime int64        `json:"nbf,omitempty"`
+	EndTime   int64        `json:"exp,omitempty"`
+}
+
+type compactRole struct {
+	Name                string     `json:"n"`
+	PermissionSlice     [][]string `json:"p"`
+	RequireSecondFactor bool       `json:"sf,omitempty"`
+}
+
+// Trailing empty fields are omitted
+func trimCompactField(fieldSlice []string) []string {
+	for len(fieldSlice) > 0 && fieldSlice[len(fieldSlice)-1] == "" {
+		fieldSlice = fieldSlice[:len(fieldSlice)-1]
+	}
+	return fieldSlice
+}
+
+func getCompactField(fieldSlice []string, index int) string {
+	if index < len(fieldSlice) {
+		return fieldSlice[index]
+	}
+	return ""
+}
+
+func createCompactUser(user *User) *compactUser {
+	compact := &compactUser{
+		make([]*compactRole, 0),
+		make([][]string, 0),
+		user.MetaDataMap,
+		user.Description,
+		nil,
+		nil,
+		user.impersonatorName,
+	}
+	for _, role := range user.RoleSlice {
+		compact.RoleSlice = append(compact.RoleSlice, createCompactRole(role))
+	}
+	for _, roleBinding := range user.RoleBindingSlice {
+		newCompactRoleBinding := &compactRoleBinding{roleBinding.Namespace, make([]*compactRole, 0)}
+		for _, role := range roleBinding.RoleSlice {
+			newCompactRoleBinding.RoleSlice = append(newCompactRoleBinding.RoleSlice, createCompactRole(role))
+		}
+		compact.RoleBindingSlice = append(compact.RoleBindingSlice, newCompactRoleBinding)
+	}
+	for _, roleGrant := range user.RoleGrantSlice {
+		newCompactRoleGrant := &compactRoleGrant{createCompactRole(roleGrant.Role), 0, 0}
+		if roleGrant.StartTime != nil {
+			newCompactRoleGrant.StartTime = roleGrant.StartTime.Unix()
+		}
+		if roleGrant.EndTime != nil {
+			newCompactRoleGrant.EndTime = roleGrant.EndTime.Unix()
+		}
+		compact.RoleGrantSlice = append(compact.RoleGrantSlice, newCompactRoleGrant)
+	}
+	for _, resource := range user.ResourceSlice {
+		compact.ResourceSlice = append(compact.ResourceSlice, trimCompactField([]string{
+			resource.Component,
+			resource.Path,
+			string(resource.Effect),
+			string(resource.MatchMode),
+		}))
+	}
+	return compact
+}
+
+func createCompactRole(role *Role) *compactRole {
+	newCompactRole := &compactRole{role.Name, make([][]string, 0), role.RequireSecondFactor}
+	for _, permission := range role.PermissionSlice {
+		newCompactRole.PermissionSlice = append(newCompactRole.PermissionSlice, trimCompactField([]string{
+			permission.Component,
+			permission.Method,
+			permission.Path,
+			string(permission.Effect),
+			string(permission.MatchMode),
+			permission.Condition,
+		}))
+	}
+	return newCompactRole
+}
+
+func (role *compactRole) createRole() (*Role, error) {
+	newRole := &Role{Name: role.Name, PermissionSlice: make([]*Permission, 0), RequireSecondFactor: role.RequireSecondFactor}
+	for _, fieldSlice := range role.PermissionSlice {
+		permission := &Permission{
+			"",
+			getCompactField(fieldSlice, 0),
+			getCompactField(fieldSlice, 1),
+			getCompactField(fieldSlice, 2),
+			Effect(getCompactField(fieldSlice, 3)),
+			MatchMode(getCompactField(fieldSlice, 4)),
+			getCompactField(fieldSlice, 5),
+		}
+		name, err := getPermissionNameWithEffect(permission.Component, permission.Method, permission.Path, permission.Effect)
+		if err != nil {
+			return nil, err
+		}
+		permission.Name = name
+		newRole.PermissionSlice = append(newRole.PermissionSlice, permission)
+	}
+	return newRole, nil
+}
+
+func (compact *compactUser) createUser(name string) (*User, error) {
+	user := &User{
+		Name:             name,
+		EncodedPassword:  "******",
+		RoleSlice:        make([]*Role, 0),
+		ResourceSlice:    make([]*Resource, 0),
+		Description:      compact.Description,
+		MetaDataMap:      compact.MetaDataMap,
+		impersonatorName: compact.ImpersonatorName,
+	}
+	for _, role := range compact.RoleSlice {
+		newRole, err := role.createRole()
+		if err != nil {
+			return nil, err
+		}
+		user.RoleSlice = append(user.RoleSlice, newRole)
+	}
+	for _, roleBinding := range compact.RoleBindingSlice {
+		if err := validateNamespace(roleBinding.Namespace); err != nil {
+			return nil, err
+		}
+		newRoleBinding := &RoleBinding{roleBinding.Namespace, make([]*Role, 0)}
+		for _, role := range roleBinding.RoleSlice {
+			newRole, err := role.createRole()
+			if err != nil {
+				return nil, err
+			}
+			newRoleBinding.RoleSlice = append(newRoleBinding.RoleSlice, newRole)
+		}
+		user.RoleBindingSlice = append(user.RoleBindingSlice, newRoleBinding)
+	}
+	for _, roleGrant := range compact.RoleGrantSlice {
+		if roleGrant.Role == nil {
+			return nil, errors.New("Role grant without role")
+		}
+		newRole, err := roleGrant.Role.createRole()
+		if err != nil {
+			return nil, err
+		}
+		newRoleGrant := &RoleGrant{Role: newRole}
+		if roleGrant.StartTime != 0 {
+			startTime := time.Unix(roleGrant.StartTime, 0)
+			newRoleGrant.StartTime = &startTime
+		}
+		if roleGrant.EndTime != 0 {
+			endTime := time.Unix(roleGrant.EndTime, 0)
+			newRoleGrant.EndTime = &endTime
+		}
+		user.RoleGrantSlice = append(user.RoleGrantSlice, newRoleGrant)
+	}
+	for _, fieldSlice := range compact.ResourceSlice {
+		resource := &Resource{
+			"",
+			getCompactField(fieldSlice, 0),
+			getCompactField(fieldSlice, 1),
+			Effect(getCompactField(fieldSlice, 2)),
+			MatchMode(getCompactField(fieldSlice, 3)),
+		}
+		name, err := getResourceNameWithEffect(resource.Component, resource.Path, resource.Effect)
+		if err != nil {
+			return nil, err
+		}
+		resource.Name = name
+		user.ResourceSlice = append(user.ResourceSlice, resource)
+	}
+	return user, nil
+}
+
+// TokenIssuer signs the tokens with the current signing key. Rotate by SetSigningKey while the verifiers still know the old key ID.
+type TokenIssuer struct {
+	issuer     string
+	ttl        time.Duration
+	signingKey *SigningKey
+	mutex      sync.RWMutex
+}
+
+func CreateTokenIssuer(issuer string, signingKey *SigningKey, ttl time.Duration) *TokenIssuer {
+	return &TokenIssuer{
+		issuer:     issuer,
+		ttl:        ttl,
+		signingKey: signingKey,
+	}
+}
+
+func (tokenIssuer *TokenIssuer) SetSigningKey(signingKey *SigningKey) {
+	tokenIssuer.mutex.Lock()
+	defer tokenIssuer.mutex.Unlock()
+	tokenIssuer.signingKey = signingKey
+}
+
+// Issue a token carrying the user's data filtered for the component, which is also the audience of the token
+func (tokenIssuer *TokenIssuer) Issue(user *User, component string) (string, error) {
+	tokenIssuer.mutex.RLock()
+	signingKey := tokenIssuer.signingKey
+	tokenIssuer.mutex.RUnlock()
+	if signingKey == nil {
+		log.Error("Signing key couldn't be empty")
+		return "", errors.New("Signing key couldn't be empty")
+	}
+
+	idByteSlice := make([]byte, 16)
+	if _, err := rand.Read(idByteSlice); err != nil {
+		log.Error(err)
+		return "", err
+	}
+
+	now := time.Now()
+	claims := &TokenClaims{
+		tokenIssuer.issuer,
+		user.Name,
+		component,
+		now.Unix(),
+		now.Unix(),
+		now.Add(tokenIssuer.ttl).Unix(),
+		hex.EncodeToString(idByteSlice),
+		createCompactUser(user.CopyPartialUserDataForComponent(component)),
+	}
+
+	token, err := signToken(signingKey, claims)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	return token, nil
+}
+
+func signToken(signingKey *SigningKey, claims *TokenClaims) (string, error) {
+	headerByteSlice, err := json.Marshal(&tokenHeader{signingKey.Algorithm, "JWT", signingKey.KeyID})
+	if err != nil {
+		return "", err
+	}
+	claimsByteSlice, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerByteSlice) + "." + base64.RawURLEncoding.EncodeToString(claimsByteSlice)
+	signature, err := signingKey.sign([]byte(signingInput))
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// TokenVerifier verifies the tokens with the public keys or secrets only, so no state is shared with the issuer
+type TokenVerifier struct {
+	issuer    string
+	clockSkew time.Duration
+	keyMap    map[string]*SigningKey
+	mutex     sync.RWMutex
+}
+
+func CreateTokenVerifier(issuer string, clockSkew time.Duration, keySlice []*SigningKey) *TokenVerifier {
+	tokenVerifier := &TokenVerifier{
+		issuer:    issuer,
+		clockSkew: clockSkew,
+		keyMap:    make(map[string]*SigningKey),
+	}
+	for _, key := range keySlice {
+		if key == nil {
+			log.Error("Verification key couldn't be empty")
+			continue
+		}
+		tokenVerifier.keyMap[key.KeyID] = key
+	}
+	return tokenVerifier
+}
+
+func (tokenVerifier *TokenVerifier) AddKey(key *SigningKey) {
+	if key == nil {
+		log.Error("Verification key couldn't be empty")
+		return
+	}
+	tokenVerifier.mutex.Lock()
+	defer tokenVerifier.mutex.Unlock()
+	tokenVerifier.keyMap[key.KeyID] = key
+}
+
+func (tokenVerifier *TokenVerifier) RemoveKey(keyID string) {
+	tokenVerifier.mutex.Lock()
+	defer tokenVerifier.mutex.Unlock()
+	delete(tokenVerifier.keyMap, keyID)
+}
+
+// Verify the signature and the claims. The audience must be the component.
+func (tokenVerifier *TokenVerifier) VerifyClaims(token string, component string) (*TokenClaims, error) {
+	partSlice := strings.Split(token, ".")
+	if len(partSlice) != 3 {
+		return nil, ErrTokenMalformed
+	}
+
+	headerByteSlice, err := base64.RawURLEncoding.DecodeString(partSlice[0])
+	if err != nil {
+		return nil, ErrTokenMalformed
+	}
+	header := &tokenHeader{}
+	if err := json.Unmarshal(headerByteSlice, header); err != nil {
+		return nil, ErrTokenMalformed
+	}
+
+	tokenVerifier.mutex.RLock()
+	key := tokenVerifier.keyMap[header.KeyID]
+	tokenVerifier.mutex.RUnlock()
+	if key == nil {
+		return nil, ErrTokenUnknownKey
+	}
+	// The algorithm is decided by the key instead of the header to prevent algorithm confusion
+	if header.Algorithm != key.Algorithm {
+		return nil, ErrTokenInvalidSignature
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(partSlice[2])
+	if err != nil {
+		return nil, ErrTokenMalformed
+	}
+	if key.verify([]byte(partSlice[0]+"."+partSlice[1]), signature) == false {
+		return nil, ErrTokenInvalidSignature
+	}
+
+	claimsByteSlice, err := base64.RawURLEncoding.DecodeString(partSlice[1])
+	if err != nil {
+		return nil, ErrTokenMalformed
+	}
+	claims := &TokenClaims{}
+	if err := json.Unmarshal(claimsByteSlice, claims); err != nil {
+		return nil, ErrTokenMalformed
+	}
+
+	if claims.Issuer != tokenVerifier.issuer || claims.Audience != component || claims.Subject == "" {
+		return nil, ErrTokenInvalidClaim
+	}
+	now := time.Now()
+	if now.After(time.Unix(claims.ExpiresAt, 0).Add(tokenVerifier.clockSkew)) {
+		return nil, ErrTokenExpired
+	}
+	if now.Before(time.Unix(claims.NotBefore, 0).Add(-tokenVerifier.clockSkew)) {
+		return nil, ErrTokenNotYetValid
+	}
+
+	return claims, nil
+}
+
+// Verify the token and return the user carried in it, which is ready for HasPermission checks of the component
+func (tokenVerifier *TokenVerifier) Verify(token string, component string) (*User, error) {
+	claims, err := tokenVerifier.VerifyClaims(token, component)
+	if err != nil {
+		return nil, err
+	}
+	if claims.User == nil {
+		return &User{Name: claims.Subject, EncodedPassword: "******"}, nil
+	}
+	user, err := claims.User.createUser(claims.Subject)
+	if err != nil {
+		log.Error(err)
+		return nil, ErrTokenMalformed
+	}
+	return user, nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedToken(t *testing.T) {
+	hs256SigningKey, err := CreateHS256SigningKey("hs-1", []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPrivateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519PrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs256SigningKey, err := CreateRS256SigningKey("rs-1", rsaPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eddsaSigningKey, err := CreateEdDSASigningKey("ed-1", ed25519PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := createDenyTestUser(t)
+	user.MetaDataMap = map[string]string{"team": "team-a"}
+	user.RoleSlice[1].RequireSecondFactor = true
+
+	for _, signingKey := range []*SigningKey{hs256SigningKey, rs256SigningKey, eddsaSigningKey} {
+		tokenIssuer := CreateTokenIssuer("cloudone", signingKey, time.Hour)
+		token, err := tokenIssuer.Issue(user, "cloudone_gui")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		verificationKey := signingKey
+		if signingKey.Algorithm == SigningAlgorithmRS256 {
+			verificationKey, _ = CreateRS256VerificationKey("rs-1", &rsaPrivateKey.PublicKey)
+		} else if signingKey.Algorithm == SigningAlgorithmEdDSA {
+			verificationKey, _ = CreateEdDSAVerificationKey("ed-1", ed25519PrivateKey.Public().(ed25519.PublicKey))
+		}
+		tokenVerifier := CreateTokenVerifier("cloudone", 0, []*SigningKey{verificationKey})
+
+		verifiedUser, err := tokenVerifier.Verify(token, "cloudone_gui")
+		if err != nil {
+			t.Fatalf("%s: %s", signingKey.Algorithm, err)
+		}
+		if verifiedUser.Name != "u" || verifiedUser.MetaDataMap["team"] != "team-a" {
+			t.Errorf("%s: unexpected user %+v", signingKey.Algorithm, verifiedUser)
+		}
+		for _, path := range []string{"/gui/inventory", "/gui/system/rbac"} {
+			if verifiedUser.HasPermission("cloudone_gui", "GET", path) != user.HasPermission("cloudone_gui", "GET", path) {
+				t.Errorf("%s: verified user should evaluate %s the same", signingKey.Algorithm, path)
+			}
+		}
+		// Filtered for the component
+		if len(verifiedUser.RoleSlice) != 2 || len(verifiedUser.RoleSlice[0].PermissionSlice) != 1 {
+			t.Errorf("%s: token should only carry the permissions of the component", signingKey.Algorithm)
+		}
+		if verifiedUser.RequiresSecondFactor() == false {
+			t.Errorf("%s: token should carry the second factor requirement of the roles", signingKey.Algorithm)
+		}
+
+		if _, err := tokenVerifier.Verify(token, "cloudone"); err != ErrTokenInvalidClaim {
+			t.Errorf("%s: other audience should be rejected but get %v", signingKey.Algorithm, err)
+		}
+		partSlice := strings.Split(token, ".")
+		tampered := partSlice[0] + "." + partSlice[1] + "x." + partSlice[2]
+		if _, err := tokenVerifier.Verify(tampered, "cloudone_gui"); err == nil {
+			t.Errorf("%s: tampered token should be rejected", signingKey.Algorithm)
+		}
+	}
+}
+
+func TestSigningKeyNil(t *testing.T) {
+	if _, err := CreateRS256SigningKey("rs-1", nil); err == nil {
+		t.Errorf("Nil RS256 private key should be rejected")
+	}
+	if _, err := CreateRS256VerificationKey("rs-1", nil); err == nil {
+		t.Errorf("Nil RS256 public key should be rejected")
+	}
+	if _, err := CreateEdDSASigningKey("ed-1", nil); err == nil {
+		t.Errorf("Nil EdDSA private key should be rejected")
+	}
+	if _, err := CreateEdDSAVerificationKey("ed-1", nil); err == nil {
+		t.Errorf("Nil EdDSA public key should be rejected")
+	}
+	if _, err := CreateTokenIssuer("cloudone", nil, time.Hour).Issue(&User{Name: "u"}, "cloudone"); err == nil {
+		t.Errorf("Issue without the signing key should fail")
+	}
+	if len(CreateTokenVerifier("cloudone", 0, []*SigningKey{nil}).keyMap) != 0 {
+		t.Errorf("Nil verification key should be skipped")
+	}
+}
+
+func TestSignedTokenKeyRotationAndExpiry(t *testing.T) {
+	oldKey, _ := CreateHS256SigningKey("old", []byte("0123456789abcdef0123456789abcdef"))
+	newKey, _ := CreateHS256SigningKey("new", []byte("fedcba9876543210fedcba9876543210"))
+	user := &User{Name: "u"}
+
+	tokenIssuer := CreateTokenIssuer("cloudone", oldKey, time.Hour)
+	oldToken, _ := tokenIssuer.Issue(user, "cloudone")
+	tokenIssuer.SetSigningKey(newKey)
+	newToken, _ := tokenIssuer.Issue(user, "cloudone")
+
+	tokenVerifier := CreateTokenVerifier("cloudone", 0, []*SigningKey{oldKey, newKey})
+	if _, err := tokenVerifier.Verify(oldToken, "cloudone"); err != nil {
+		t.Errorf("Token signed by the old key should be valid during rotation: %s", err)
+	}
+	if _, err := tokenVerifier.Verify(newToken, "cloudone"); err != nil {
+		t.Errorf("Token signed by the new key should be valid: %s", err)
+	}
+	tokenVerifier.RemoveKey("old")
+	if _, err := tokenVerifier.Verify(oldToken, "cloudone"); err != ErrTokenUnknownKey {
+		t.Errorf("Token signed by the removed key should be rejected but get %v", err)
+	}
+
+	expiredToken, _ := CreateTokenIssuer("cloudone", newKey, -2*time.Second).Issue(user, "cloudone")
+	if _, err := tokenVerifier.Verify(expiredToken, "cloudone"); err != ErrTokenExpired {
+		t.Errorf("Expired token should be rejected but get %v", err)
+	}
+	tolerantTokenVerifier := CreateTokenVerifier("cloudone", time.Minute, []*SigningKey{newKey})
+	if _, err := tolerantTokenVerifier.Verify(expiredToken, "cloudone"); err != nil {
+		t.Errorf("Clock skew should be tolerated: %s", err)
+	}
+
+	// HS256 key shouldn't be accepted as RS256 from the header
+	rsaPrivateKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	rs256SigningKey, _ := CreateRS256SigningKey("new", rsaPrivateKey)
+	rsaToken, _ := CreateTokenIssuer("cloudone", rs256SigningKey, time.Hour).Issue(user, "cloudone")
+	if _, err := tokenVerifier.Verify(rsaToken, "cloudone"); err != ErrTokenInvalidSignature {
+		t.Errorf("Algorithm mismatch should be rejected but get %v", err)
+	}
+}
@@ -0,0 +1,520 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	StoreKindRole  = "roles"
+	StoreKindGroup = "groups"
+	StoreKindUser  = "users"
+	// Revoked session ids. See SessionManager.
+	StoreKindRevocation = "revocations"
+)
+
+const (
+	StoreEventTypeSaved   = "Saved"
+	StoreEventTypeDeleted = "Deleted"
+	// Changes may be missed so everything should be reloaded. Kind and name are empty.
+	StoreEventTypeResync = "Resync"
+)
+
+type StoreEvent struct {
+	Type string
+	Kind string
+	Name string
+}
+
+// Store persists the users, roles and groups. They are stored in the policy document format so the users and the groups reference the roles by name.
+// Rate limits aren't stored so the policy loaded from the store has none. Keep them in the policy document and create the RateLimiter from LoadPolicy.
+type Store interface {
+	SaveRole(role *Role) error
+	// Fail if the role is still referenced by a role, a group or a user
+	DeleteRole(name string) error
+	SaveGroup(group *Group) error
+	DeleteGroup(name string) error
+	SaveUser(user *User) error
+	DeleteUser(name string) error
+	// Load and validate all the stored objects. It fails if any reference is broken such as a user referencing a deleted role.
+	LoadPolicy() (*Policy, error)
+	// Return nil without error if the user doesn't exist. Only the user and the groups and the roles it references are loaded.
+	GetUser(name string) (*User, error)
+	// Call the handler for every change until the returned stop function is called
+	Watch(handler func(storeEvent *StoreEvent)) (func(), error)
+	// Keep the revocation list of the session manager
+	RevocationStore
+}
+
+// Raw storage of the JSON documents used by the stores
+type storeBackend interface {
+	save(kind string, name string, byteSlice []byte) error
+	delete(kind string, name string) error
+	// Return nil without error if the object doesn't exist
+	get(kind string, name string) ([]byte, error)
+	getAll(kind string) ([][]byte, error)
+}
+
+// Implement the object methods of Store on top of a backend
+type backendStore struct {
+	backend storeBackend
+}
+
+func (store *backendStore) saveItem(kind string, name string, value interface{}) error {
+	byteSlice, err := json.Marshal(value)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	return store.backend.save(kind, name, byteSlice)
+}
+
+func (store *backendStore) SaveRole(role *Role) error {
+	return store.saveItem(StoreKindRole, role.Name, CreatePolicyDocument([]*Role{role}, nil, nil).RoleSlice[0])
+}
+
+func (store *backendStore) DeleteRole(name string) error {
+	referenceName, err := store.getRoleReference(name)
+	if err != nil {
+		return err
+	}
+	if referenceName != "" {
+		log.Error("Role %s is referenced by %s", name, referenceName)
+		return errors.New("Role " + name + " is referenced by " + referenceName)
+	}
+	return store.backend.delete(StoreKindRole, name)
+}
+
+// Return the kind and the name of the first object referencing the role or empty if there is none
+func (store *backendStore) getRoleReference(name string) (string, error) {
+	roleByteSliceSlice, err := store.backend.getAll(StoreKindRole)
+	if err != nil {
+		return "", err
+	}
+	for _, byteSlice := range roleByteSliceSlice {
+		policyRole := &PolicyRole{}
+		if err := json.Unmarshal(byteSlice, policyRole); err != nil {
+			log.Error(err)
+			return "", err
+		}
+		for _, parentRoleName := range policyRole.ParentRoleNameSlice {
+			if parentRoleName == name {
+				return "role " + policyRole.Name, nil
+			}
+		}
+	}
+
+	groupByteSliceSlice, err := store.backend.getAll(StoreKindGroup)
+	if err != nil {
+		return "", err
+	}
+	for _, byteSlice := range groupByteSliceSlice {
+		policyGroup := &PolicyGroup{}
+		if err := json.Unmarshal(byteSlice, policyGroup); err != nil {
+			log.Error(err)
+			return "", err
+		}
+		for _, roleName := range policyGroup.RoleNameSlice {
+			if roleName == name {
+				return "group " + policyGroup.Name, nil
+			}
+		}
+	}
+
+	userByteSliceSlice, err := store.backend.getAll(StoreKindUser)
+	if err != nil {
+		return "", err
+	}
+	for _, byteSlice := range userByteSliceSlice {
+		policyUser := &PolicyUser{}
+		if err := json.Unmarshal(byteSlice, policyUser); err != nil {
+			log.Error(err)
+			return "", err
+		}
+		for _, roleName := range policyUser.getRoleNameSlice() {
+			if roleName == name {
+				return "user " + policyUser.Name, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+func (store *backendStore) SaveGroup(group *Group) error {
+	return store.saveItem(StoreKindGroup, group.Name, CreatePolicyDocument(nil, []*Group{group}, nil).GroupSlice[0])
+}
+
+func (store *backendStore) DeleteGroup(name string) error {
+	return store.backend.delete(StoreKindGroup, name)
+}
+
+// The reserved name is rejected here since it would fail LoadPolicy
+func (store *backendStore) SaveUser(user *User) error {
+	if err := validateUserName(user.Name); err != nil {
+		log.Error(err)
+		return err
+	}
+	return store.saveItem(StoreKindUser, user.Name, createPolicyDocument(nil, nil, []*User{user}, true).UserSlice[0])
+}
+
+func (store *backendStore) DeleteUser(name string) error {
+	return store.backend.delete(StoreKindUser, name)
+}
+
+type storeRevocation struct {
+	ID          string    `json:"id"`
+	ExpiredTime time.Time `json:"expiredTime"`
+}
+
+func (store *backendStore) SaveRevocation(id string, expiredTime time.Time) error {
+	return store.saveItem(StoreKindRevocation, id, &storeRevocation{id, expiredTime})
+}
+
+func (store *backendStore) DeleteRevocation(id string) error {
+	return store.backend.delete(StoreKindRevocation, id)
+}
+
+func (store *backendStore) LoadRevocation() (map[string]time.Time, error) {
+	byteSliceSlice, err := store.backend.getAll(StoreKindRevocation)
+	if err != nil {
+		return nil, err
+	}
+
+	revocationMap := make(map[string]time.Time)
+	for _, byteSlice := range byteSliceSlice {
+		revocation := &storeRevocation{}
+		if err := json.Unmarshal(byteSlice, revocation); err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		revocationMap[revocation.ID] = revocation.ExpiredTime
+	}
+	return revocationMap, nil
+}
+
+func (store *backendStore) LoadPolicy() (*Policy, error) {
+	policyDocument := &PolicyDocument{}
+
+	roleByteSliceSlice, err := store.backend.getAll(StoreKindRole)
+	if err != nil {
+		return nil, err
+	}
+	for _, byteSlice := range roleByteSliceSlice {
+		policyRole := &PolicyRole{}
+		if err := json.Unmarshal(byteSlice, policyRole); err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		policyDocument.RoleSlice = append(policyDocument.RoleSlice, policyRole)
+	}
+
+	groupByteSliceSlice, err := store.backend.getAll(StoreKindGroup)
+	if err != nil {
+		return nil, err
+	}
+	for _, byteSlice := range groupByteSliceSlice {
+		policyGroup := &PolicyGroup{}
+		if err := json.Unmarshal(byteSlice, policyGroup); err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		policyDocument.GroupSlice = append(policyDocument.GroupSlice, policyGroup)
+	}
+
+	userByteSliceSlice, err := store.backend.getAll(StoreKindUser)
+	if err != nil {
+		return nil, err
+	}
+	for _, byteSlice := range userByteSliceSlice {
+		policyUser := &PolicyUser{}
+		if err := json.Unmarshal(byteSlice, policyUser); err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		policyDocument.UserSlice = append(policyDocument.UserSlice, policyUser)
+	}
+
+	return policyDocument.Build()
+}
+
+func (store *backendStore) GetUser(name string) (*User, error) {
+	byteSlice, err := store.backend.get(StoreKindUser, name)
+	if err != nil {
+		return nil, err
+	}
+	if byteSlice == nil {
+		return nil, nil
+	}
+	policyUser := &PolicyUser{}
+	if err := json.Unmarshal(byteSlice, policyUser); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	policyDocument := &PolicyDocument{UserSlice: []*PolicyUser{policyUser}}
+
+	// The missing groups and roles are left for the validation to report
+	roleNameSlice := policyUser.getRoleNameSlice()
+	for _, groupName := range policyUser.GroupNameSlice {
+		byteSlice, err := store.backend.get(StoreKindGroup, groupName)
+		if err != nil {
+			return nil, err
+		}
+		if byteSlice == nil {
+			continue
+		}
+		policyGroup := &PolicyGroup{}
+		if err := json.Unmarshal(byteSlice, policyGroup); err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		policyDocument.GroupSlice = append(policyDocument.GroupSlice, policyGroup)
+		roleNameSlice = append(roleNameSlice, policyGroup.RoleNameSlice...)
+	}
+
+	// Load the parent roles too
+	loadedRoleNameMap := make(map[string]bool)
+	for len(roleNameSlice) > 0 {
+		roleName := roleNameSlice[0]
+		roleNameSlice = roleNameSlice[1:]
+		if loadedRoleNameMap[roleName] {
+			continue
+		}
+		loadedRoleNameMap[roleName] = true
+
+		byteSlice, err := store.backend.get(StoreKindRole, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if byteSlice == nil {
+			continue
+		}
+		policyRole := &PolicyRole{}
+		if err := json.Unmarshal(byteSlice, policyRole); err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		policyDocument.RoleSlice = append(policyDocument.RoleSlice, policyRole)
+		roleNameSlice = append(roleNameSlice, policyRole.ParentRoleNameSlice...)
+	}
+
+	policy, err := policyDocument.Build()
+	if err != nil {
+		return nil, err
+	}
+	return policy.GetUser(name), nil
+}
+
+// Roles referenced by the user directly, by the role bindings and by the role grants
+func (policyUser *PolicyUser) getRoleNameSlice() []string {
+	roleNameSlice := make([]string, 0)
+	roleNameSlice = append(roleNameSlice, policyUser.RoleNameSlice...)
+	for _, policyRoleBinding := range policyUser.RoleBindingSlice {
+		roleNameSlice = append(roleNameSlice, policyRoleBinding.RoleNameSlice...)
+	}
+	for _, policyRoleGrant := range policyUser.RoleGrantSlice {
+		roleNameSlice = append(roleNameSlice, policyRoleGrant.RoleName)
+	}
+	return roleNameSlice
+}
+
+func (policy *Policy) GetUser(name string) *User {
+	for _, user := range policy.UserSlice {
+		if user.Name == name {
+			return user
+		}
+	}
+	return nil
+}
+
+// MemoryStore keeps the serialized objects in memory. It is used for tests and single process deployments.
+type MemoryStore struct {
+	*backendStore
+	itemMap      map[string]map[string][]byte
+	handlerMap   map[int]func(storeEvent *StoreEvent)
+	handlerIndex int
+	mutex        sync.Mutex
+}
+
+func CreateMemoryStore() *MemoryStore {
+	memoryStore := &MemoryStore{
+		itemMap: map[string]map[string][]byte{
+			StoreKindRole:       make(map[string][]byte),
+			StoreKindGroup:      make(map[string][]byte),
+			StoreKindUser:       make(map[string][]byte),
+			StoreKindRevocation: make(map[string][]byte),
+		},
+		handlerMap: make(map[int]func(storeEvent *StoreEvent)),
+	}
+	memoryStore.backendStore = &backendStore{memoryStore}
+	return memoryStore
+}
+
+func (memoryStore *MemoryStore) save(kind string, name string, byteSlice []byte) error {
+	memoryStore.mutex.Lock()
+	memoryStore.itemMap[kind][name] = byteSlice
+	memoryStore.mutex.Unlock()
+
+	memoryStore.notify(&StoreEvent{StoreEventTypeSaved, kind, name})
+	return nil
+}
+
+func (memoryStore *MemoryStore) delete(kind string, name string) error {
+	memoryStore.mutex.Lock()
+	_, ok := memoryStore.itemMap[kind][name]
+	delete(memoryStore.itemMap[kind], name)
+	memoryStore.mutex.Unlock()
+
+	if ok {
+		memoryStore.notify(&StoreEvent{StoreEventTypeDeleted, kind, name})
+	}
+	return nil
+}
+
+func (memoryStore *MemoryStore) get(kind string, name string) ([]byte, error) {
+	memoryStore.mutex.Lock()
+	defer memoryStore.mutex.Unlock()
+	return memoryStore.itemMap[kind][name], nil
+}
+
+// Sorted by name as etcd does
+func (memoryStore *MemoryStore) getAll(kind string) ([][]byte, error) {
+	memoryStore.mutex.Lock()
+	defer memoryStore.mutex.Unlock()
+
+	nameSlice := make([]string, 0)
+	for name := range memoryStore.itemMap[kind] {
+		nameSlice = append(nameSlice, name)
+	}
+	sort.Strings(nameSlice)
+
+	byteSliceSlice := make([][]byte, 0)
+	for _, name := range nameSlice {
+		byteSliceSlice = append(byteSliceSlice, memoryStore.itemMap[kind][name])
+	}
+	return byteSliceSlice, nil
+}
+
+// The handlers are called synchronously after the change
+func (memoryStore *MemoryStore) notify(storeEvent *StoreEvent) {
+	memoryStore.mutex.Lock()
+	handlerSlice := make([]func(storeEvent *StoreEvent), 0)
+	for index := 0; index < memoryStore.handlerIndex; index++ {
+		if handler, ok := memoryStore.handlerMap[index]; ok {
+			handlerSlice = append(handlerSlice, handler)
+		}
+	}
+	memoryStore.mutex.Unlock()
+
+	for _, handler := range handlerSlice {
+		handler(storeEvent)
+	}
+}
+
+func (memoryStore *MemoryStore) Watch(handler func(storeEvent *StoreEvent)) (func(), error) {
+	memoryStore.mutex.Lock()
+	defer memoryStore.mutex.Unlock()
+
+	index := memoryStore.handlerIndex
+	memoryStore.handlerMap[index] = handler
+	memoryStore.handlerIndex++
+
+	return func() {
+		memoryStore.mutex.Lock()
+		defer memoryStore.mutex.Unlock()
+		delete(memoryStore.handlerMap, index)
+	}, nil
+}
+
+// Keep the token cache consistent with the store. The cached users affected by a change are refreshed from the store,
+// or evicted if they are deleted, disabled, expired or the store couldn't be loaded.
+// The role resolver and the group resolver are replaced with the ones of the stored policy on every role or group change.
+// A user change only loads the store if the user has a cached token. Users of the API keys aren't stored and are left in the cache.
+func SynchronizeTokenCache(store Store, tokenCache TokenCache) (func(), error) {
+	return store.Watch(func(storeEvent *StoreEvent) {
+		if storeEvent.Kind == StoreKindRevocation {
+			return
+		}
+		refreshTokenCache(store, tokenCache, storeEvent)
+	})
+}
+
+func refreshTokenCache(store Store, tokenCache TokenCache, storeEvent *StoreEvent) {
+	expiredTimeMap := tokenCache.GetAllTokenExpiredTime()
+	affectedUserMap := make(map[string]*User)
+	for token := range expiredTimeMap {
+		if IsAPIKey(token) {
+			continue
+		}
+		// Peek doesn't count the maintenance in the cache statistics
+		cachedUser := tokenCache.Peek(token)
+		if cachedUser == nil {
+			continue
+		}
+		if storeEvent.Kind == StoreKindUser && cachedUser.Name != storeEvent.Name && GetImpersonatorName(cachedUser) != storeEvent.Name {
+			continue
+		}
+		affectedUserMap[token] = cachedUser
+	}
+	// The resolvers don't have the users so they are left unchanged by a user change
+	if storeEvent.Kind == StoreKindUser && len(affectedUserMap) == 0 {
+		return
+	}
+
+	policy, err := store.LoadPolicy()
+	if err != nil {
+		log.Error("Fail to load the policy for %s %s %s, evict the affected tokens: %s", storeEvent.Type, storeEvent.Kind, storeEvent.Name, err)
+		policy = nil
+	} else {
+		roleResolver, groupResolver, err := policy.CreateResolver()
+		if err != nil {
+			log.Error(err)
+			policy = nil
+		} else if storeEvent.Kind != StoreKindUser {
+			SetRoleResolver(roleResolver)
+			SetGroupResolver(groupResolver)
+		}
+	}
+
+	now := time.Now()
+	for token, cachedUser := range affectedUserMap {
+		expiredTime := expiredTimeMap[token]
+		impersonatorName := GetImpersonatorName(cachedUser)
+
+		var user *User
+		if policy != nil {
+			user = policy.GetUser(cachedUser.Name)
+		}
+		// The impersonation ends once the real user loses the grant
+		if user != nil && impersonatorName != "" {
+			realUser := policy.GetUser(impersonatorName)
+			if realUser == nil || realUser.Disabled || (realUser.ExpiredTime != nil && now.After(*realUser.ExpiredTime)) || realUser.CanImpersonate(user.Name) == false {
+				user = nil
+			} else {
+				user = createImpersonatedUser(realUser, user)
+			}
+		}
+		ttl := expiredTime.Sub(now)
+		if user == nil || user.Disabled || (user.ExpiredTime != nil && now.After(*user.ExpiredTime)) || ttl <= 0 {
+			tokenCache.Delete(token)
+		} else {
+			tokenCache.Set(token, user, ttl)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"testing"
+	"time"
+)
+
+func saveTestStoreObject(t *testing.T, store Store) {
+	permission, _ := CreatePermission("cloudone", "GET", "/api/v1/**")
+	viewer := &Role{Name: "viewer", PermissionSlice: []*Permission{permission}}
+	deployPermission, _ := CreatePermission("cloudone", "POST", "/api/v1/deploys")
+	deployer := &Role{Name: "deployer", PermissionSlice: []*Permission{deployPermission}, ParentRoleNameSlice: []string{"viewer"}}
+	group, _ := CreateGroup("operators", []*Role{deployer}, nil, "")
+	alice := createTestUser(t, "alice", testPassword, []*Role{viewer}, nil, "", nil, nil, false)
+	bob := createTestUser(t, "bob/ops", testPassword, nil, nil, "", nil, nil, false)
+	bob.GroupNameSlice = []string{"operators"}
+
+	for _, role := range []*Role{viewer, deployer} {
+		if err := store.SaveRole(role); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.SaveGroup(group); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []*User{alice, bob} {
+		if err := store.SaveUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkTestStoreObject(t *testing.T, store Store) {
+	policy, err := store.LoadPolicy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policy.RoleSlice) != 2 || len(policy.GroupSlice) != 1 || len(policy.UserSlice) != 2 {
+		t.Fatalf("Expect 2 roles, 1 group and 2 users but get %d, %d and %d", len(policy.RoleSlice), len(policy.GroupSlice), len(policy.UserSlice))
+	}
+
+	alice, err := store.GetUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.CheckPassword(testPassword) == false || alice.HasPermission("cloudone", "GET", "/api/v1/namespaces") == false || alice.PasswordChangedTime == nil {
+		t.Errorf("Stored user should keep the password, the roles and the password changed time")
+	}
+	if user, _ := store.GetUser("nobody"); user != nil {
+		t.Errorf("Unknown user should be nil")
+	}
+
+	roleResolver, groupResolver, err := policy.CreateResolver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	previousRoleResolver, previousGroupResolver := GetRoleResolver(), GetGroupResolver()
+	SetRoleResolver(roleResolver)
+	SetGroupResolver(groupResolver)
+	defer SetRoleResolver(previousRoleResolver)
+	defer SetGroupResolver(previousGroupResolver)
+	bob := policy.GetUser("bob/ops")
+	if bob.HasPermission("cloudone", "POST", "/api/v1/deploys") == false || bob.HasPermission("cloudone", "GET", "/api/v1/namespaces") == false {
+		t.Errorf("Stored group and role inheritance should be resolved")
+	}
+
+	if err := store.DeleteUser("bob/ops"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteUser("bob/ops"); err != nil {
+		t.Errorf("Deleting the user not existing should not fail but get %v", err)
+	}
+	if user, _ := store.GetUser("bob/ops"); user != nil {
+		t.Errorf("User should be deleted")
+	}
+
+	if err := store.DeleteRole("viewer"); err == nil {
+		t.Errorf("Referenced role should not be deleted")
+	}
+	if _, err := store.LoadPolicy(); err != nil {
+		t.Errorf("Rejected deletion should keep the policy loadable but get %v", err)
+	}
+	if err := store.DeleteUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteGroup("operators"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteRole("viewer"); err == nil {
+		t.Errorf("Parent role should not be deleted")
+	}
+	if err := store.DeleteRole("deployer"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteRole("viewer"); err != nil {
+		t.Errorf("Role no longer referenced should be deleted but get %v", err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := CreateMemoryStore()
+	saveTestStoreObject(t, store)
+	checkTestStoreObject(t, store)
+}
+
+func TestStoreGetUserLoadsReferencedObjectOnly(t *testing.T) {
+	store := CreateMemoryStore()
+	saveTestStoreObject(t, store)
+	// An unrelated broken object fails the whole policy but not the user
+	store.saveItem(StoreKindRole, "broken", &PolicyRole{Name: "broken", ParentRoleNameSlice: []string{"missing"}})
+	if _, err := store.LoadPolicy(); err == nil {
+		t.Errorf("Broken reference should fail the load")
+	}
+
+	alice, err := store.GetUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice == nil || alice.HasPermission("cloudone", "GET", "/api/v1/namespaces") == false {
+		t.Errorf("User should be loaded with its roles")
+	}
+
+	store.saveItem(StoreKindUser, "carol", &PolicyUser{Name: "carol", RoleNameSlice: []string{"missing"}})
+	if _, err := store.GetUser("carol"); err == nil {
+		t.Errorf("Broken reference of the user should fail")
+	}
+}
+
+func TestSynchronizeTokenCache(t *testing.T) {
+	store := CreateMemoryStore()
+	saveTestStoreObject(t, store)
+	previousRoleResolver, previousGroupResolver := GetRoleResolver(), GetGroupResolver()
+	defer SetRoleResolver(previousRoleResolver)
+	defer SetGroupResolver(previousGroupResolver)
+
+	tokenCache := CreateMemoryTokenCache(0)
+	alice, _ := store.GetUser("alice")
+	bob, _ := store.GetUser("bob/ops")
+	tokenCache.Set("alice-token", alice, time.Hour)
+	tokenCache.Set("bob-token", bob, time.Hour)
+	serviceAccountUser := &User{Name: ServiceAccountUserNamePrefix + "ci", MetaDataMap: map[string]string{ServiceAccountMetaDataKey: "true"}}
+	apiKeyToken := APIKeyPrefix + "_6369_id_secret"
+	tokenCache.Set(apiKeyToken, serviceAccountUser, time.Hour)
+	// The metadata of a stored user doesn't make it a service account
+	forgedUser, _ := store.GetUser("alice")
+	forgedUser.MetaDataMap = map[string]string{ServiceAccountMetaDataKey: "true"}
+	tokenCache.Set("forged-token", forgedUser, time.Hour)
+
+	stop, err := SynchronizeTokenCache(store, tokenCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changing the role refreshes all the users
+	permission, _ := CreatePermission("cloudone", "*", "/api/v1/**")
+	store.SaveRole(&Role{Name: "viewer", PermissionSlice: []*Permission{permission}})
+	if tokenCache.Get("alice-token").HasPermission("cloudone", "DELETE", "/api/v1/namespaces") == false {
+		t.Errorf("Cached user should be refreshed after the role change")
+	}
+	if tokenCache.Get("bob-token").HasPermission("cloudone", "DELETE", "/api/v1/namespaces") == false {
+		t.Errorf("Inherited role should be refreshed with the resolver")
+	}
+
+	statistics := tokenCache.GetStatistics()
+	alice.Disabled = true
+	store.SaveUser(alice)
+	if tokenCache.GetStatistics() != statistics {
+		t.Errorf("Synchronization should not be counted in the cache statistics")
+	}
+	if tokenCache.Get("alice-token") != nil || tokenCache.Get("forged-token") != nil {
+		t.Errorf("Disabled user should be evicted")
+	}
+	if tokenCache.Get("bob-token") == nil {
+		t.Errorf("Other users should not be evicted")
+	}
+
+	store.DeleteUser("bob/ops")
+	if tokenCache.Get("bob-token") != nil {
+		t.Errorf("Deleted user should be evicted")
+	}
+	if tokenCache.Get(apiKeyToken) != serviceAccountUser {
+		t.Errorf("Service account user should be left in the cache")
+	}
+
+	stop()
+	store.SaveUser(bob)
+	tokenCache.Set("bob-token", bob, time.Hour)
+	store.DeleteUser("bob/ops")
+	if tokenCache.Get("bob-token") == nil {
+		t.Errorf("Token cache should not be synchronized after stop")
+	}
+}
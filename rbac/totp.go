@@ -0,0 +1,261 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RFC 6238 with the parameters supported by the common authenticator apps
+const (
+	TOTPPeriod = 30 * time.Second
+	TOTPDigit  = 6
+	// Accepted time steps before and after the current one for the clock drift
+	TOTPDriftWindow = 1
+)
+
+const recoveryCodeAmount = 10
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Guard the check and update of the used time step and the recovery codes
+var secondFactorMutex sync.Mutex
+
+// Second factor of the user. The TOTP secret must be readable for the verification so the stored user should be protected.
+type SecondFactor struct {
+	TOTPSecret        string `yaml:"totpSecret,omitempty" json:"totpSecret,omitempty"`               // Base32 without padding. Empty until the enrollment is confirmed.
+	PendingTOTPSecret string `yaml:"pendingTotpSecret,omitempty" json:"pendingTotpSecret,omitempty"` // Waiting for the confirmation
+	LastUsedTimeStep  int64  `yaml:"lastUsedTimeStep,omitempty" json:"lastUsedTimeStep,omitempty"`   // Codes of this and earlier time steps are rejected as replay
+	// Hex encoded SHA-256 of the unused recovery codes
+	RecoveryCodeSlice []string `yaml:"recoveryCodes,omitempty" json:"recoveryCodes,omitempty"`
+}
+
+func GenerateTOTPSecret() (string, error) {
+	byteSlice := make([]byte, 20)
+	if _, err := rand.Read(byteSlice); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(byteSlice), nil
+}
+
+// URI for the QR code of the authenticator apps
+func GetTOTPURI(issuer string, accountName string, secret string) string {
+	valueMap := url.Values{}
+	valueMap.Set("secret", secret)
+	valueMap.Set("issuer", issuer)
+	valueMap.Set("algorithm", "SHA1")
+	valueMap.Set("digits", fmt.Sprint(TOTPDigit))
+	valueMap.Set("period", fmt.Sprint(int(TOTPPeriod/time.Second)))
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(accountName)
+	return "otpauth://totp/" + label + "?" + valueMap.Encode()
+}
+
+func getTOTPTimeStep(now time.Time) int64 {
+	return now.Unix() / int64(TOTPPeriod/time.Second)
+}
+
+func generateTOTPCode(secret string, timeStep int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(timeStep))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation of RFC 4226
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(1)
+	for i := 0; i < TOTPDigit; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTPDigit, value%modulus), nil
+}
+
+func GenerateTOTPCode(secret string, now time.Time) (string, error) {
+	return generateTOTPCode(secret, getTOTPTimeStep(now))
+}
+
+// Return the matched time step within the drift window
+func matchTOTPCode(secret string, code string, now time.Time) (int64, bool) {
+	currentTimeStep := getTOTPTimeStep(now)
+	for timeStep := currentTimeStep - TOTPDriftWindow; timeStep <= currentTimeStep+TOTPDriftWindow; timeStep++ {
+		expected, err := generateTOTPCode(secret, timeStep)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return timeStep, true
+		}
+	}
+	return 0, false
+}
+
+func encodeRecoveryCode(code string) string {
+	digest := sha256.Sum256([]byte(strings.ToLower(strings.Replace(code, "-", "", -1))))
+	return hex.EncodeToString(digest[:])
+}
+
+// Generate a pending secret and return the URI for the QR code. The second factor isn't required until ConfirmTOTPEnrollment.
+func (user *User) BeginTOTPEnrollment(issuer string) (string, error) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+
+	secondFactorMutex.Lock()
+	defer secondFactorMutex.Unlock()
+	if user.SecondFactor == nil {
+		user.SecondFactor = &SecondFactor{}
+	}
+	user.SecondFactor.PendingTOTPSecret = secret
+	return GetTOTPURI(issuer, user.Name, secret), nil
+}
+
+// Confirm the pending secret with a code from the app. The returned recovery codes are only shown once.
+func (user *User) ConfirmTOTPEnrollment(code string, now time.Time) ([]string, error) {
+	recoveryCodeSlice := make([]string, 0)
+	encodedRecoveryCodeSlice := make([]string, 0)
+	for i := 0; i < recoveryCodeAmount; i++ {
+		recoveryCode, err := generateRandomHex(8)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		recoveryCode = recoveryCode[:8] + "-" + recoveryCode[8:]
+		recoveryCodeSlice = append(recoveryCodeSlice, recoveryCode)
+		encodedRecoveryCodeSlice = append(encodedRecoveryCodeSlice, encodeRecoveryCode(recoveryCode))
+	}
+
+	secondFactorMutex.Lock()
+	defer secondFactorMutex.Unlock()
+	if user.SecondFactor == nil || user.SecondFactor.PendingTOTPSecret == "" {
+		return nil, errors.New("No pending TOTP enrollment")
+	}
+	timeStep, ok := matchTOTPCode(user.SecondFactor.PendingTOTPSecret, code, now)
+	if ok == false {
+		return nil, errors.New("TOTP code is incorrect")
+	}
+
+	user.SecondFactor = &SecondFactor{
+		TOTPSecret:        user.SecondFactor.PendingTOTPSecret,
+		LastUsedTimeStep:  timeStep,
+		RecoveryCodeSlice: encodedRecoveryCodeSlice,
+	}
+	return recoveryCodeSlice, nil
+}
+
+func (user *User) DisableTOTP() {
+	secondFactorMutex.Lock()
+	defer secondFactorMutex.Unlock()
+	user.SecondFactor = nil
+}
+
+func (user *User) HasSecondFactor() bool {
+	secondFactorMutex.Lock()
+	defer secondFactorMutex.Unlock()
+	return user.SecondFactor != nil && user.SecondFactor.TOTPSecret != ""
+}
+
+// The second factor is required if any effective or bound role or their parent roles requires it, or the user has enrolled
+func (user *User) RequiresSecondFactor() bool {
+	if user.HasSecondFactor() {
+		return true
+	}
+	roleSlice := user.GetEffectiveRoleSlice()
+	for _, roleBinding := range user.RoleBindingSlice {
+		roleSlice = append(roleSlice, roleBinding.RoleSlice...)
+	}
+	for _, role := range roleSlice {
+		if role.requiresSecondFactor() {
+			return true
+		}
+	}
+	return false
+}
+
+// Walk the parent roles with the role resolver set by SetRoleResolver. It fails closed and requires the second factor if a parent couldn't be resolved.
+func (role *Role) requiresSecondFactor() bool {
+	roleResolver := GetRoleResolver()
+	visitedMap := make(map[string]bool)
+	pendingRoleSlice := []*Role{role}
+	for len(pendingRoleSlice) > 0 {
+		currentRole := pendingRoleSlice[len(pendingRoleSlice)-1]
+		pendingRoleSlice = pendingRoleSlice[:len(pendingRoleSlice)-1]
+		if visitedMap[currentRole.Name] {
+			continue
+		}
+		visitedMap[currentRole.Name] = true
+		if currentRole.RequireSecondFactor {
+			return true
+		}
+		for _, parentRoleName := range currentRole.ParentRoleNameSlice {
+			parentRole := roleResolver.GetRole(parentRoleName)
+			if parentRole == nil {
+				log.Error("Role %s references unknown parent role %s", currentRole.Name, parentRoleName)
+				return true
+			}
+			pendingRoleSlice = append(pendingRoleSlice, parentRole)
+		}
+	}
+	return false
+}
+
+// Verify the TOTP code or consume a recovery code. A TOTP code of an already used time step is rejected as replay.
+// The user should be persisted after the verification succeeds since the used time step or the recovery codes are changed.
+func (user *User) VerifySecondFactor(code string, now time.Time) bool {
+	secondFactorMutex.Lock()
+	defer secondFactorMutex.Unlock()
+
+	secondFactor := user.SecondFactor
+	if secondFactor == nil || secondFactor.TOTPSecret == "" {
+		return false
+	}
+
+	if timeStep, ok := matchTOTPCode(secondFactor.TOTPSecret, code, now); ok {
+		if timeStep <= secondFactor.LastUsedTimeStep {
+			return false
+		}
+		secondFactor.LastUsedTimeStep = timeStep
+		return true
+	}
+
+	encodedRecoveryCode := encodeRecoveryCode(code)
+	for i, encoded := range secondFactor.RecoveryCodeSlice {
+		if subtle.ConstantTimeCompare([]byte(encoded), []byte(encodedRecoveryCode)) == 1 {
+			secondFactor.RecoveryCodeSlice = append(secondFactor.RecoveryCodeSlice[:i:i], secondFactor.RecoveryCodeSlice[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
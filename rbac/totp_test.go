@@ -0,0 +1,204 @@
+// Copyright 2015 CloudAwan LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// Test vectors of RFC 6238 truncated to 6 digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	checkSlice := []struct {
+		unix     int64
+		expected string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{20000000000, "353130"},
+	}
+	for _, check := range checkSlice {
+		code, err := GenerateTOTPCode(secret, time.Unix(check.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != check.expected {
+			t.Errorf("Time %d expects %s but get %s", check.unix, check.expected, code)
+		}
+	}
+}
+
+func enrollTestTOTP(t *testing.T, user *User, now time.Time) []string {
+	uri, err := user.BeginTOTPEnrollment("CloudOne")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedURL, err := url.Parse(uri)
+	if err != nil || parsedURL.Scheme != "otpauth" || parsedURL.Host != "totp" || parsedURL.Query().Get("secret") != user.SecondFactor.PendingTOTPSecret {
+		t.Fatalf("Unexpected URI %s", uri)
+	}
+	if user.HasSecondFactor() {
+		t.Errorf("Second factor should not be active before the confirmation")
+	}
+
+	if _, err := user.ConfirmTOTPEnrollment("000000", now); err == nil {
+		t.Errorf("Wrong code should not confirm")
+	}
+	code, _ := GenerateTOTPCode(user.SecondFactor.PendingTOTPSecret, now)
+	recoveryCodeSlice, err := user.ConfirmTOTPEnrollment(code, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return recoveryCodeSlice
+}
+
+func TestTOTPVerification(t *testing.T) {
+	user := &User{Name: "alice"}
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	recoveryCodeSlice := enrollTestTOTP(t, user, now)
+	secret := user.SecondFactor.TOTPSecret
+
+	// The code used for the confirmation is replay
+	code, _ := GenerateTOTPCode(secret, now)
+	if user.VerifySecondFactor(code, now) {
+		t.Errorf("Code of the used time step should be rejected")
+	}
+
+	later := now.Add(TOTPPeriod)
+	code, _ = GenerateTOTPCode(secret, later)
+	if user.VerifySecondFactor(code, later.Add(TOTPPeriod)) == false {
+		t.Errorf("Code within the drift window should be accepted")
+	}
+	if user.VerifySecondFactor(code, later.Add(TOTPPeriod)) {
+		t.Errorf("Code should not be accepted twice")
+	}
+	code, _ = GenerateTOTPCode(secret, later.Add(5*TOTPPeriod))
+	if user.VerifySecondFactor(code, later.Add(TOTPPeriod)) {
+		t.Errorf("Code beyond the drift window should be rejected")
+	}
+
+	for _, recoveryCode := range user.SecondFactor.RecoveryCodeSlice {
+		if strings.Contains(strings.Join(recoveryCodeSlice, ""), recoveryCode) {
+			t.Errorf("Recovery codes should be stored hashed")
+		}
+	}
+	if user.VerifySecondFactor(strings.ToUpper(recoveryCodeSlice[0]), now) == false {
+		t.Errorf("Recovery code should be accepted")
+	}
+	if user.VerifySecondFactor(recoveryCodeSlice[0], now) {
+		t.Errorf("Recovery code should be single use")
+	}
+	if len(user.SecondFactor.RecoveryCodeSlice) != len(recoveryCodeSlice)-1 {
+		t.Errorf("Used recovery code should be removed")
+	}
+}
+
+func TestAuthenticateWithSecondFactor(t *testing.T) {
+	admin := &Role{Name: "admin", RequireSecondFactor: true}
+	alice := createTestUser(t, "alice", testPassword, []*Role{admin}, nil, "", nil, nil, false)
+	bob := createTestUser(t, "bob", testPassword, []*Role{admin}, nil, "", nil, nil, false)
+	authenticator, tokenCache, now := createTestAuthenticator(alice, bob)
+	enrollTestTOTP(t, alice, now.Add(-time.Hour))
+	updatedUserSlice := make([]*User, 0)
+	authenticator.SecondFactorUpdateHandler = func(user *User) {
+		updatedUserSlice = append(updatedUserSlice, user)
+	}
+
+	if _, _, err := authenticator.Authenticate("alice", testPassword, ""); err != ErrSecondFactorRequired {
+		t.Errorf("Second factor should be required but get %v", err)
+	}
+	if len(tokenCache.GetAllTokenExpiredTime()) != 0 {
+		t.Errorf("Token should not be cached before the second factor")
+	}
+	if _, _, err := authenticator.AuthenticateWithSecondFactor("alice", testPassword, "000000", ""); err != ErrBadSecondFactor {
+		t.Errorf("Wrong code should be rejected but get %v", err)
+	}
+	code, _ := GenerateTOTPCode(alice.SecondFactor.TOTPSecret, *now)
+	token, _, err := authenticator.AuthenticateWithSecondFactor("alice", testPassword, code, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokenCache.Get(token) != alice || len(updatedUserSlice) != 1 {
+		t.Errorf("Token should be cached and the user updated after the second factor")
+	}
+
+	if _, _, err := authenticator.Authenticate("bob", testPassword, ""); err != ErrSecondFactorNotEnrolled {
+		t.Errorf("User not enrolled should be rejected but get %v", err)
+	}
+
+	// Wrong codes count as failed logins
+	for i := 0; i < 3; i++ {
+		authenticator.AuthenticateWithSecondFactor("alice", testPassword, "000000", "")
+	}
+	if _, _, err := authenticator.AuthenticateWithSecondFactor("alice", testPassword, code, ""); err != ErrLocked {
+		t.Errorf("User should be locked after wrong codes but get %v", err)
+	}
+}
+
+func TestRequiresSecondFactorInherited(t *testing.T) {
+	admin := &Role{Name: "admin", RequireSecondFactor: true}
+	operator := &Role{Name: "operator", ParentRoleNameSlice: []string{"admin"}}
+	viewer := &Role{Name: "viewer"}
+	roleResolver, err := CreateRoleResolver([]*Role{admin, operator, viewer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetRoleResolver(roleResolver)
+	defer SetRoleResolver(nil)
+
+	alice := createTestUser(t, "alice", testPassword, []*Role{operator}, nil, "", nil, nil, false)
+	if alice.RequiresSecondFactor() == false {
+		t.Errorf("Second factor required by the parent role should be inherited")
+	}
+	if alice.CopyPartialUserDataForComponent("cloudone").RequiresSecondFactor() == false {
+		t.Errorf("Partial user should carry the inherited requirement")
+	}
+	if createTestUser(t, "bob", testPassword, []*Role{viewer}, nil, "", nil, nil, false).RequiresSecondFactor() {
+		t.Errorf("Role without the requirement should not require the second factor")
+	}
+
+	// The parent couldn't be resolved so it fails closed
+	SetRoleResolver(nil)
+	if alice.RequiresSecondFactor() == false {
+		t.Errorf("Unresolved parent role should require the second factor")
+	}
+}
+
+func TestSecondFactorExport(t *testing.T) {
+	alice := createTestUser(t, "alice", testPassword, nil, nil, "", nil, nil, false)
+	now := time.Now()
+	enrollTestTOTP(t, alice, now)
+
+	data, err := CreatePolicyDocument(nil, nil, []*User{alice}).MarshalToYAML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), alice.SecondFactor.TOTPSecret) || strings.Contains(string(data), "secondFactor") {
+		t.Errorf("Exported policy document should not contain the second factor:\n%s", data)
+	}
+
+	store := CreateMemoryStore()
+	if err := store.SaveUser(alice); err != nil {
+		t.Fatal(err)
+	}
+	storedUser, err := store.GetUser("alice")
+	if err != nil || storedUser == nil || storedUser.SecondFactor == nil || storedUser.SecondFactor.TOTPSecret != alice.SecondFactor.TOTPSecret {
+		t.Errorf("Store should keep the second factor")
+	}
+}
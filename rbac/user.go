@@ -15,8 +15,8 @@
 package rbac
 
 import (
-	"encoding/hex"
-	"golang.org/x/crypto/sha3"
+	"errors"
+	"strings"
 	"time"
 )
 
@@ -29,96 +29,293 @@ type User struct {
 	MetaDataMap     map[string]string // Used to store user's data which doesn't need to check password
 	ExpiredTime     *time.Time
 	Disabled        bool
+	GroupNameSlice  []string // Roles and resources of the groups are merged into the user's own
+	// Used by the password policy for the maximum age and the reuse check
+	PasswordChangedTime  *time.Time
+	PasswordHistorySlice []string // Previous encoded passwords, the latest first
+	RoleBindingSlice     []*RoleBinding
+	SecondFactor         *SecondFactor
+	RoleGrantSlice       []*RoleGrant // Roles granted within a time window. See RoleGrant.
+	impersonatorName     string       // Real user of the impersonated copy. Never stored so it couldn't be edited. See GetImpersonatorName.
 }
 
-func CreateUser(name string, password string, roleSlice []*Role, resourceSlice []*Resource, description string, metaDataMap map[string]string, expiredTime *time.Time, disabled bool) *User {
+// The password is validated with the password policy set by SetPasswordPolicy.
+// The error is a *PasswordPolicyError if the password violates the policy.
+func CreateUser(name string, password string, roleSlice []*Role, resourceSlice []*Resource, description string, metaDataMap map[string]string, expiredTime *time.Time, disabled bool) (*User, error) {
+	if err := validateUserName(name); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if err := createPasswordPolicyError(GetPasswordPolicy().Validate(name, password)); err != nil {
+		return nil, err
+	}
+	encodedPassword, err := EncodePassword(password)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	passwordChangedTime := time.Now()
+
 	return &User{
 		name,
-		encodePassword(password),
+		encodedPassword,
 		roleSlice,
 		resourceSlice,
 		description,
 		metaDataMap,
 		expiredTime,
 		disabled,
-	}
+		nil,
+		&passwordChangedTime,
+		nil,
+		nil,
+		nil,
+		nil,
+		"",
+	}, nil
 }
 
-func encodePassword(password string) string {
-	fixedSlice := sha3.Sum512([]byte(password))
-	byteSlice := make([]byte, 64)
-	for i := 0; i < len(fixedSlice); i++ {
-		byteSlice[i] = fixedSlice[i]
+// The names with ServiceAccountUserNamePrefix are kept for the users of the API keys
+func validateUserName(name string) error {
+	if strings.HasPrefix(name, ServiceAccountUserNamePrefix) {
+		return errors.New("User name " + name + " is reserved for the service accounts")
 	}
-	return hex.EncodeToString(byteSlice)
+	return nil
 }
 
-func (user *User) CheckPassword(password string) bool {
-	return user.EncodedPassword == encodePassword(password)
+// Set the password without the password policy, such as by an administrator. The password changed time is updated.
+func (user *User) SetPassword(password string) error {
+	encodedPassword, err := EncodePassword(password)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	user.EncodedPassword = encodedPassword
+	passwordChangedTime := time.Now()
+	user.PasswordChangedTime = &passwordChangedTime
+	return nil
 }
 
-func (user *User) HasPermission(component string, method string, path string) bool {
-	for _, role := range user.RoleSlice {
-		if role.HasPermission(component, method, path) {
-			return true
+// Validate the new password with the password policy set by SetPasswordPolicy, then keep the current encoded password in the history.
+// The error is a *PasswordPolicyError if the password violates the policy.
+func (user *User) ChangePassword(password string) error {
+	currentPasswordPolicy := GetPasswordPolicy()
+	if err := createPasswordPolicyError(currentPasswordPolicy.ValidateForUser(user, password)); err != nil {
+		return err
+	}
+
+	previousEncodedPassword := user.EncodedPassword
+	if err := user.SetPassword(password); err != nil {
+		return err
+	}
+
+	if currentPasswordPolicy.HistoryCount > 0 && previousEncodedPassword != "" {
+		user.PasswordHistorySlice = append([]string{previousEncodedPassword}, user.PasswordHistorySlice...)
+		// The current password counts as one of the last passwords
+		if len(user.PasswordHistorySlice) > currentPasswordPolicy.HistoryCount-1 {
+			user.PasswordHistorySlice = user.PasswordHistorySlice[:currentPasswordPolicy.HistoryCount-1]
 		}
+	} else {
+		user.PasswordHistorySlice = nil
 	}
 
-	return false
+	return nil
+}
+
+func (user *User) CheckPassword(password string) bool {
+	matched, _ := user.CheckPasswordWithRehash(password)
+	return matched
+}
+
+// The second returned value reports the password is verified against a legacy SHA3 digest or outdated parameters.
+// The caller should then call SetPassword with the verified password and persist the user to migrate it.
+func (user *User) CheckPasswordWithRehash(password string) (bool, bool) {
+	return VerifyPassword(user.EncodedPassword, password)
+}
+
+// Deny permission in any role overrides the allow permission in all roles. See Effect for the evaluation order.
+func (user *User) HasPermission(component string, method string, path string) bool {
+	return evaluatePermission(user.getPermissionSlice(), component, method, path)
 }
 
 // Check whether user has the target permission node or child permission node of the target permission node along the tree.
 // This doesn't mean user has permission to access the parent permission node in the tree but just is able to bypass the parent permission node in order to go down to the target child permission node in the tree.
 func (user *User) HasChildPermission(component string, method string, path string) bool {
-	for _, role := range user.RoleSlice {
-		if role.HasChildPermission(component, method, path) {
-			return true
+	return evaluateChildPermission(user.getPermissionSlice(), component, method, path)
+}
+
+// Conditions of the permissions are evaluated against the request context and the user
+func (user *User) HasPermissionWithContext(requestContext *RequestContext, component string, method string, path string) bool {
+	return evaluatePermissionWithEnvironment(user.getPermissionSlice(), &conditionEnvironment{user, requestContext, component, method, path})
+}
+
+func (user *User) HasChildPermissionWithContext(requestContext *RequestContext, component string, method string, path string) bool {
+	permissionSlice := user.getPermissionSlice()
+	return evaluateChildPermissionWithEnvironment(permissionSlice, func(reachablePath string) []*Permission {
+		return permissionSlice
+	}, &conditionEnvironment{user, requestContext, component, method, path})
+}
+
+// Deny resource overrides the allow resource. See Effect for the evaluation order.
+func (user *User) HasResource(component string, path string) bool {
+	return evaluateResource(user.GetEffectiveResourceSlice(), component, path)
+}
+
+func (user *User) getPermissionSlice() []*Permission {
+	permissionSlice := make([]*Permission, 0)
+	for _, role := range user.GetEffectiveRoleSlice() {
+		permissionSlice = append(permissionSlice, role.GetEffectivePermissionSlice()...)
+	}
+	return permissionSlice
+}
+
+// Groups referenced by the user resolved with the group resolver set by SetGroupResolver. Unknown groups are skipped.
+func (user *User) GetGroupSlice() []*Group {
+	groupSlice := make([]*Group, 0)
+	currentGroupResolver := GetGroupResolver()
+	for _, groupName := range user.GroupNameSlice {
+		group := currentGroupResolver.GetGroup(groupName)
+		if group == nil {
+			log.Error("User %s references unknown group %s", user.Name, groupName)
+			continue
 		}
+		groupSlice = append(groupSlice, group)
 	}
+	return groupSlice
+}
 
-	return false
+// The user's own roles followed by the roles of the groups and the role grants active at the moment
+func (user *User) GetEffectiveRoleSlice() []*Role {
+	return append(user.getAssignedRoleSlice(), user.getActiveRoleGrantRoleSlice(time.Now())...)
 }
 
-func (user *User) HasResource(component string, path string) bool {
-	for _, resource := range user.ResourceSlice {
-		if resource.HasResource(component, path) {
-			return true
+// The user's own roles followed by the roles of the groups
+func (user *User) getAssignedRoleSlice() []*Role {
+	roleSlice := make([]*Role, 0)
+	roleSlice = append(roleSlice, user.RoleSlice...)
+	for _, group := range user.GetGroupSlice() {
+		roleSlice = append(roleSlice, group.RoleSlice...)
+	}
+	return roleSlice
+}
+
+// The user's own resources followed by the resources of the groups.
+// The namespaces of the role bindings are left out since they are granted only by the namespace checks such as HasNamespace.
+func (user *User) GetEffectiveResourceSlice() []*Resource {
+	resourceSlice := make([]*Resource, 0)
+	resourceSlice = append(resourceSlice, user.ResourceSlice...)
+	for _, group := range user.GetGroupSlice() {
+		resourceSlice = append(resourceSlice, group.ResourceSlice...)
+	}
+	return resourceSlice
+}
+
+// List the groups which grant the permission by themselves. It doesn't consider the denies from the user's own roles or the other groups.
+func (user *User) GetGroupSliceWithPermission(component string, method string, path string) []*Group {
+	groupSlice := make([]*Group, 0)
+	for _, group := range user.GetGroupSlice() {
+		if group.HasPermission(component, method, path) {
+			groupSlice = append(groupSlice, group)
 		}
 	}
-	return false
+	return groupSlice
 }
 
+// Copy the data relevant to the component with the projection profile set by SetProjectionProfile
 func (user *User) CopyPartialUserDataForComponent(component string) *User {
+	return user.CopyPartialUserDataWithProfile(component, GetProjectionProfile(component))
+}
+
+// The copy shares no map, slice or grant with the user so neither could modify the other.
+// The profile is optional, nil exposes everything relevant to the component.
+func (user *User) CopyPartialUserDataWithProfile(component string, projectionProfile *ProjectionProfile) *User {
+	if projectionProfile == nil {
+		projectionProfile = &ProjectionProfile{}
+	}
+
 	newUser := &User{}
 	newUser.Name = user.Name
 	newUser.EncodedPassword = "******"
 	newUser.RoleSlice = make([]*Role, 0)
 	newUser.ResourceSlice = make([]*Resource, 0)
-	newUser.Description = user.Description
-	newUser.MetaDataMap = user.MetaDataMap
+	if projectionProfile.HideDescription == false {
+		newUser.Description = user.Description
+	}
+	newUser.MetaDataMap = projectionProfile.projectMetaDataMap(user.MetaDataMap)
+	// Always kept for the audit log
+	newUser.impersonatorName = user.impersonatorName
 
-	for _, resource := range user.ResourceSlice {
-		if resource.Component == "*" || resource.Component == component {
-			newUser.ResourceSlice = append(newUser.ResourceSlice, resource)
+	// Group grants are merged so the copy doesn't need the group resolver
+	for _, resource := range user.GetEffectiveResourceSlice() {
+		if (resource.Component == "*" || resource.Component == component) && projectionProfile.exposeResource(resource) {
+			copiedResource := *resource
+			newUser.ResourceSlice = append(newUser.ResourceSlice, &copiedResource)
 		}
 	}
 
-	for _, role := range user.RoleSlice {
-		newRole := &Role{}
-		newRole.Name = role.Name
-		newRole.PermissionSlice = make([]*Permission, 0)
-		newRole.Description = role.Description
+	newUser.RoleSlice = projectionProfile.projectRoleSlice(user.getAssignedRoleSlice(), component)
 
-		for _, permission := range role.PermissionSlice {
-			if permission.Component == "*" || permission.Component == component {
-				newRole.PermissionSlice = append(newRole.PermissionSlice, permission)
-			}
+	// The window is kept so the copy stops granting the role on time
+	now := time.Now()
+	for _, roleGrant := range user.RoleGrantSlice {
+		if roleGrant.IsExpired(now) {
+			continue
 		}
+		for _, newRole := range projectionProfile.projectRoleSlice([]*Role{roleGrant.Role}, component) {
+			newUser.RoleGrantSlice = append(newUser.RoleGrantSlice, &RoleGrant{
+				newRole,
+				copyTime(roleGrant.StartTime),
+				copyTime(roleGrant.EndTime),
+				roleGrant.Reason,
+				roleGrant.ApproverName,
+			})
+		}
+	}
 
-		if len(newRole.PermissionSlice) > 0 {
-			newUser.RoleSlice = append(newUser.RoleSlice, newRole)
+	// The binding grants its namespace resource so it is hidden along with the resource
+	for _, roleBinding := range user.RoleBindingSlice {
+		if projectionProfile.exposeResource(roleBinding.getResource()) == false {
+			continue
+		}
+		newRoleBinding := &RoleBinding{roleBinding.Namespace, projectionProfile.projectRoleSlice(roleBinding.RoleSlice, component)}
+		if len(newRoleBinding.RoleSlice) > 0 {
+			newUser.RoleBindingSlice = append(newUser.RoleBindingSlice, newRoleBinding)
 		}
 	}
 
 	return newUser
 }
+
+func copyTime(value *time.Time) *time.Time {
+	if value == nil {
+		return nil
+	}
+	copiedTime := *value
+	return &copiedTime
+}
+
+// Return nil if the role has no permission for the component and doesn't require the second factor
+func copyRoleForComponent(role *Role, component string, hideDescription bool) *Role {
+	newRole := &Role{}
+	newRole.Name = role.Name
+	newRole.PermissionSlice = make([]*Permission, 0)
+	if hideDescription == false {
+		newRole.Description = role.Description
+	}
+	// Flattened along with the permissions
+	newRole.RequireSecondFactor = role.requiresSecondFactor()
+
+	// Inherited permissions are flattened so the copy doesn't need the role resolver.
+	// Deny permissions are kept along with the allow permissions so the copy evaluates the same for the component
+	for _, permission := range role.GetEffectivePermissionSlice() {
+		if permission.Component == "*" || permission.Component == component {
+			copiedPermission := *permission
+			newRole.PermissionSlice = append(newRole.PermissionSlice, &copiedPermission)
+		}
+	}
+
+	if len(newRole.PermissionSlice) == 0 && newRole.RequireSecondFactor == false {
+		return nil
+	}
+	return newRole
+}
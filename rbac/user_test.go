@@ -17,19 +17,136 @@ package rbac
 import (
 	"fmt"
 	"testing"
+	"time"
 )
 
+// Accepted by the default password policy for all the test user names
+const testPassword = "Tq7!xz-9Wk#m"
+
+func TestReservedUserName(t *testing.T) {
+	if _, err := CreateUser(ServiceAccountUserNamePrefix+"ci", testPassword, nil, nil, "", nil, nil, false); err == nil {
+		t.Errorf("Name of the service account users should be reserved")
+	}
+	if _, err := LoadPolicy([]byte("users:\n  - name: " + ServiceAccountUserNamePrefix + "ci\n")); err == nil {
+		t.Errorf("Policy should reject the reserved name")
+	}
+	if err := CreateMemoryStore().SaveUser(&User{Name: ServiceAccountUserNamePrefix + "ci"}); err == nil {
+		t.Errorf("Store should reject the reserved name")
+	}
+}
+
+func createTestUser(t *testing.T, name string, password string, roleSlice []*Role, resourceSlice []*Resource, description string, metaDataMap map[string]string, expiredTime *time.Time, disabled bool) *User {
+	user, err := CreateUser(name, password, roleSlice, resourceSlice, description, metaDataMap, expiredTime, disabled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
 func TestHasPermission(t *testing.T) {
 	permissionSlice := make([]*Permission, 0)
-	permission := &Permission{"P1", "cloudone_gui", "GET", "/gui/inventory/service"}
+	permission := &Permission{Name: "P1", Component: "cloudone_gui", Method: "GET", Path: "/gui/inventory/service"}
 	permissionSlice = append(permissionSlice, permission)
 	roleSlice := make([]*Role, 0)
-	role := &Role{"R1", permissionSlice, ""}
+	role := &Role{Name: "R1", PermissionSlice: permissionSlice}
 	roleSlice = append(roleSlice, role)
-	user := &User{"u", "p", roleSlice, nil, ""}
+	user := &User{Name: "u", EncodedPassword: "p", RoleSlice: roleSlice}
 
 	fmt.Println(user.HasPermission("cloudone_gui", "GET", "/gui/inventory/service"))
 	fmt.Println(user.HasPermission("cloudone_gui", "GET", "/gui/inventory"))
 	fmt.Println(user.HasChildPermission("cloudone_gui", "GET", "/gui/inventory/service"))
 	fmt.Println(user.HasChildPermission("cloudone_gui", "GET", "/gui/inventory"))
 }
+
+func createDenyTestUser(t *testing.T) *User {
+	allowPermission, err := CreatePermission("cloudone_gui", "*", "/gui")
+	if err != nil {
+		t.Fatal(err)
+	}
+	denyPermission, err := CreateDenyPermission("cloudone_gui", "*", "/gui/system/rbac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPermission, err := CreatePermission("cloudone", "GET", "/api/v1/namespaces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowResource, _ := CreateResource("*", "/namespaces")
+	denyResource, _ := CreateDenyResource("cloudone", "/namespaces/kube-system")
+
+	operator := &Role{Name: "operator", PermissionSlice: []*Permission{allowPermission, otherPermission}}
+	restriction := &Role{Name: "restriction", PermissionSlice: []*Permission{denyPermission}}
+	return &User{Name: "u", RoleSlice: []*Role{operator, restriction}, ResourceSlice: []*Resource{denyResource, allowResource}}
+}
+
+func TestDenyPermission(t *testing.T) {
+	user := createDenyTestUser(t)
+
+	checkSlice := []struct {
+		method   string
+		path     string
+		expected bool
+	}{
+		{"GET", "/gui/inventory", true},
+		{"POST", "/gui/system/notification", true},
+		{"GET", "/gui/system/rbac", false},
+		{"GET", "/gui/system/rbac/user", false},
+	}
+	for _, check := range checkSlice {
+		if user.HasPermission("cloudone_gui", check.method, check.path) != check.expected {
+			t.Errorf("HasPermission %s %s should be %v", check.method, check.path, check.expected)
+		}
+	}
+
+	// The deny is in another role but still overrides
+	if user.RoleSlice[0].HasPermission("cloudone_gui", "GET", "/gui/system/rbac") == false {
+		t.Errorf("Role without deny should allow")
+	}
+	if user.RoleSlice[1].HasPermission("cloudone_gui", "GET", "/gui/system/rbac") {
+		t.Errorf("Role with only deny should not allow")
+	}
+}
+
+func TestDenyChildPermission(t *testing.T) {
+	allowPermission, _ := CreatePermission("cloudone_gui", "GET", "/gui/system/rbac/user")
+	denyPermission, _ := CreateDenyPermission("cloudone_gui", "*", "/gui/system/rbac")
+	visiblePermission, _ := CreatePermission("cloudone_gui", "GET", "/gui/system/notification")
+	user := &User{Name: "u", RoleSlice: []*Role{&Role{Name: "r", PermissionSlice: []*Permission{allowPermission, denyPermission}}}}
+
+	if user.HasChildPermission("cloudone_gui", "GET", "/gui/system") {
+		t.Errorf("Allow shadowed by deny should not make parent reachable")
+	}
+
+	user.RoleSlice[0].PermissionSlice = append(user.RoleSlice[0].PermissionSlice, visiblePermission)
+	if user.HasChildPermission("cloudone_gui", "GET", "/gui/system") == false {
+		t.Errorf("Allow not covered by deny should make parent reachable")
+	}
+	if user.HasChildPermission("cloudone_gui", "GET", "/gui/system/rbac") {
+		t.Errorf("Denied node should not be reachable")
+	}
+}
+
+func TestDenyResource(t *testing.T) {
+	user := createDenyTestUser(t)
+
+	if user.HasResource("cloudone", "/namespaces/default") == false {
+		t.Errorf("Allowed resource should be accessible")
+	}
+	if user.HasResource("cloudone", "/namespaces/kube-system") {
+		t.Errorf("Denied resource should not be accessible")
+	}
+	if user.HasResource("cloudone_gui", "/namespaces/kube-system") == false {
+		t.Errorf("Deny on another component should not apply")
+	}
+}
+
+func TestCopyPartialUserDataForComponentKeepsDeny(t *testing.T) {
+	user := createDenyTestUser(t)
+	partialUser := user.CopyPartialUserDataForComponent("cloudone_gui")
+
+	for _, path := range []string{"/gui/inventory", "/gui/system/rbac", "/gui/system/rbac/user"} {
+		if partialUser.HasPermission("cloudone_gui", "GET", path) != user.HasPermission("cloudone_gui", "GET", path) {
+			t.Errorf("Partial user should evaluate %s the same as the original user", path)
+		}
+	}
+}